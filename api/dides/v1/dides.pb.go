@@ -0,0 +1,1478 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: dides/v1/dides.proto
+
+package didesv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type InstanceStatus int32
+
+const (
+	InstanceStatus_INSTANCE_STATUS_UNKNOWN InstanceStatus = 0
+	InstanceStatus_INSTANCE_STATUS_HEALTHY InstanceStatus = 1
+	InstanceStatus_INSTANCE_STATUS_FAILED  InstanceStatus = 2
+)
+
+// Enum value maps for InstanceStatus.
+var (
+	InstanceStatus_name = map[int32]string{
+		0: "INSTANCE_STATUS_UNKNOWN",
+		1: "INSTANCE_STATUS_HEALTHY",
+		2: "INSTANCE_STATUS_FAILED",
+	}
+	InstanceStatus_value = map[string]int32{
+		"INSTANCE_STATUS_UNKNOWN": 0,
+		"INSTANCE_STATUS_HEALTHY": 1,
+		"INSTANCE_STATUS_FAILED":  2,
+	}
+)
+
+func (x InstanceStatus) Enum() *InstanceStatus {
+	p := new(InstanceStatus)
+	*p = x
+	return p
+}
+
+func (x InstanceStatus) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (InstanceStatus) Descriptor() protoreflect.EnumDescriptor {
+	return file_dides_v1_dides_proto_enumTypes[0].Descriptor()
+}
+
+func (InstanceStatus) Type() protoreflect.EnumType {
+	return &file_dides_v1_dides_proto_enumTypes[0]
+}
+
+func (x InstanceStatus) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use InstanceStatus.Descriptor instead.
+func (InstanceStatus) EnumDescriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{0}
+}
+
+type DeploymentStatus int32
+
+const (
+	DeploymentStatus_DEPLOYMENT_STATUS_UNKNOWN   DeploymentStatus = 0
+	DeploymentStatus_DEPLOYMENT_STATUS_RUNNING   DeploymentStatus = 1
+	DeploymentStatus_DEPLOYMENT_STATUS_COMPLETED DeploymentStatus = 2
+	DeploymentStatus_DEPLOYMENT_STATUS_FAILED    DeploymentStatus = 3
+)
+
+// Enum value maps for DeploymentStatus.
+var (
+	DeploymentStatus_name = map[int32]string{
+		0: "DEPLOYMENT_STATUS_UNKNOWN",
+		1: "DEPLOYMENT_STATUS_RUNNING",
+		2: "DEPLOYMENT_STATUS_COMPLETED",
+		3: "DEPLOYMENT_STATUS_FAILED",
+	}
+	DeploymentStatus_value = map[string]int32{
+		"DEPLOYMENT_STATUS_UNKNOWN":   0,
+		"DEPLOYMENT_STATUS_RUNNING":   1,
+		"DEPLOYMENT_STATUS_COMPLETED": 2,
+		"DEPLOYMENT_STATUS_FAILED":    3,
+	}
+)
+
+func (x DeploymentStatus) Enum() *DeploymentStatus {
+	p := new(DeploymentStatus)
+	*p = x
+	return p
+}
+
+func (x DeploymentStatus) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (DeploymentStatus) Descriptor() protoreflect.EnumDescriptor {
+	return file_dides_v1_dides_proto_enumTypes[1].Descriptor()
+}
+
+func (DeploymentStatus) Type() protoreflect.EnumType {
+	return &file_dides_v1_dides_proto_enumTypes[1]
+}
+
+func (x DeploymentStatus) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use DeploymentStatus.Descriptor instead.
+func (DeploymentStatus) EnumDescriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{1}
+}
+
+type State struct {
+	state                protoimpl.MessageState `protogen:"open.v1"`
+	CodeVersion          string                 `protobuf:"bytes,1,opt,name=code_version,json=codeVersion,proto3" json:"code_version,omitempty"`
+	ConfigurationVersion string                 `protobuf:"bytes,2,opt,name=configuration_version,json=configurationVersion,proto3" json:"configuration_version,omitempty"`
+	unknownFields        protoimpl.UnknownFields
+	sizeCache            protoimpl.SizeCache
+}
+
+func (x *State) Reset() {
+	*x = State{}
+	mi := &file_dides_v1_dides_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *State) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*State) ProtoMessage() {}
+
+func (x *State) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use State.ProtoReflect.Descriptor instead.
+func (*State) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *State) GetCodeVersion() string {
+	if x != nil {
+		return x.CodeVersion
+	}
+	return ""
+}
+
+func (x *State) GetConfigurationVersion() string {
+	if x != nil {
+		return x.ConfigurationVersion
+	}
+	return ""
+}
+
+type Instance struct {
+	state           protoimpl.MessageState `protogen:"open.v1"`
+	Id              string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Ip              string                 `protobuf:"bytes,2,opt,name=ip,proto3" json:"ip,omitempty"`
+	Name            string                 `protobuf:"bytes,3,opt,name=name,proto3" json:"name,omitempty"`
+	Labels          map[string]string      `protobuf:"bytes,4,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	LastPing        *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=last_ping,json=lastPing,proto3" json:"last_ping,omitempty"`
+	Status          InstanceStatus         `protobuf:"varint,6,opt,name=status,proto3,enum=dides.v1.InstanceStatus" json:"status,omitempty"`
+	CurrentState    *State                 `protobuf:"bytes,7,opt,name=current_state,json=currentState,proto3" json:"current_state,omitempty"`
+	DesiredState    *State                 `protobuf:"bytes,8,opt,name=desired_state,json=desiredState,proto3" json:"desired_state,omitempty"`
+	DesiredRevision int64                  `protobuf:"varint,9,opt,name=desired_revision,json=desiredRevision,proto3" json:"desired_revision,omitempty"`
+	PreviousState   *State                 `protobuf:"bytes,10,opt,name=previous_state,json=previousState,proto3" json:"previous_state,omitempty"`
+	Cordoned        bool                   `protobuf:"varint,11,opt,name=cordoned,proto3" json:"cordoned,omitempty"`
+	Draining        bool                   `protobuf:"varint,12,opt,name=draining,proto3" json:"draining,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *Instance) Reset() {
+	*x = Instance{}
+	mi := &file_dides_v1_dides_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Instance) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Instance) ProtoMessage() {}
+
+func (x *Instance) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Instance.ProtoReflect.Descriptor instead.
+func (*Instance) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Instance) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Instance) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *Instance) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Instance) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *Instance) GetLastPing() *timestamppb.Timestamp {
+	if x != nil {
+		return x.LastPing
+	}
+	return nil
+}
+
+func (x *Instance) GetStatus() InstanceStatus {
+	if x != nil {
+		return x.Status
+	}
+	return InstanceStatus_INSTANCE_STATUS_UNKNOWN
+}
+
+func (x *Instance) GetCurrentState() *State {
+	if x != nil {
+		return x.CurrentState
+	}
+	return nil
+}
+
+func (x *Instance) GetDesiredState() *State {
+	if x != nil {
+		return x.DesiredState
+	}
+	return nil
+}
+
+func (x *Instance) GetDesiredRevision() int64 {
+	if x != nil {
+		return x.DesiredRevision
+	}
+	return 0
+}
+
+func (x *Instance) GetPreviousState() *State {
+	if x != nil {
+		return x.PreviousState
+	}
+	return nil
+}
+
+func (x *Instance) GetCordoned() bool {
+	if x != nil {
+		return x.Cordoned
+	}
+	return false
+}
+
+func (x *Instance) GetDraining() bool {
+	if x != nil {
+		return x.Draining
+	}
+	return false
+}
+
+type RegisterRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Ip     string                 `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	Name   string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Labels map[string]string      `protobuf:"bytes,3,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Join token allowing the registration
+	Token string `protobuf:"bytes,4,opt,name=token,proto3" json:"token,omitempty"`
+	// Optional PEM encoded certificate signing request for a mutual TLS client certificate
+	Csr           string `protobuf:"bytes,5,opt,name=csr,proto3" json:"csr,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterRequest) Reset() {
+	*x = RegisterRequest{}
+	mi := &file_dides_v1_dides_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterRequest) ProtoMessage() {}
+
+func (x *RegisterRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterRequest.ProtoReflect.Descriptor instead.
+func (*RegisterRequest) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RegisterRequest) GetIp() string {
+	if x != nil {
+		return x.Ip
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *RegisterRequest) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *RegisterRequest) GetCsr() string {
+	if x != nil {
+		return x.Csr
+	}
+	return ""
+}
+
+type RegisterResponse struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Instance *Instance              `protobuf:"bytes,1,opt,name=instance,proto3" json:"instance,omitempty"`
+	// Credential authenticating the instance, only returned once
+	Credential string `protobuf:"bytes,2,opt,name=credential,proto3" json:"credential,omitempty"`
+	// PEM encoded client certificate, when a CSR was sent
+	Certificate   string `protobuf:"bytes,3,opt,name=certificate,proto3" json:"certificate,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RegisterResponse) Reset() {
+	*x = RegisterResponse{}
+	mi := &file_dides_v1_dides_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RegisterResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RegisterResponse) ProtoMessage() {}
+
+func (x *RegisterResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RegisterResponse.ProtoReflect.Descriptor instead.
+func (*RegisterResponse) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *RegisterResponse) GetInstance() *Instance {
+	if x != nil {
+		return x.Instance
+	}
+	return nil
+}
+
+func (x *RegisterResponse) GetCredential() string {
+	if x != nil {
+		return x.Credential
+	}
+	return ""
+}
+
+func (x *RegisterResponse) GetCertificate() string {
+	if x != nil {
+		return x.Certificate
+	}
+	return ""
+}
+
+type ReportStateRequest struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	InstanceId   string                 `protobuf:"bytes,1,opt,name=instance_id,json=instanceId,proto3" json:"instance_id,omitempty"`
+	Status       *InstanceStatus        `protobuf:"varint,2,opt,name=status,proto3,enum=dides.v1.InstanceStatus,oneof" json:"status,omitempty"`
+	CurrentState *State                 `protobuf:"bytes,3,opt,name=current_state,json=currentState,proto3" json:"current_state,omitempty"`
+	// Labels to merge into the instance labels, they must stay within the join token scope
+	Labels        map[string]string `protobuf:"bytes,4,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReportStateRequest) Reset() {
+	*x = ReportStateRequest{}
+	mi := &file_dides_v1_dides_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReportStateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReportStateRequest) ProtoMessage() {}
+
+func (x *ReportStateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReportStateRequest.ProtoReflect.Descriptor instead.
+func (*ReportStateRequest) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ReportStateRequest) GetInstanceId() string {
+	if x != nil {
+		return x.InstanceId
+	}
+	return ""
+}
+
+func (x *ReportStateRequest) GetStatus() InstanceStatus {
+	if x != nil && x.Status != nil {
+		return *x.Status
+	}
+	return InstanceStatus_INSTANCE_STATUS_UNKNOWN
+}
+
+func (x *ReportStateRequest) GetCurrentState() *State {
+	if x != nil {
+		return x.CurrentState
+	}
+	return nil
+}
+
+func (x *ReportStateRequest) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+type ReportStateResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Instance      *Instance              `protobuf:"bytes,1,opt,name=instance,proto3" json:"instance,omitempty"`
+	UpdateNeeded  bool                   `protobuf:"varint,2,opt,name=update_needed,json=updateNeeded,proto3" json:"update_needed,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReportStateResponse) Reset() {
+	*x = ReportStateResponse{}
+	mi := &file_dides_v1_dides_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReportStateResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReportStateResponse) ProtoMessage() {}
+
+func (x *ReportStateResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReportStateResponse.ProtoReflect.Descriptor instead.
+func (*ReportStateResponse) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ReportStateResponse) GetInstance() *Instance {
+	if x != nil {
+		return x.Instance
+	}
+	return nil
+}
+
+func (x *ReportStateResponse) GetUpdateNeeded() bool {
+	if x != nil {
+		return x.UpdateNeeded
+	}
+	return false
+}
+
+type WatchDesiredStateRequest struct {
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	InstanceId string                 `protobuf:"bytes,1,opt,name=instance_id,json=instanceId,proto3" json:"instance_id,omitempty"`
+	// Last revision known by the agent, the stream starts with the desired state when it differs
+	Revision      int64 `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchDesiredStateRequest) Reset() {
+	*x = WatchDesiredStateRequest{}
+	mi := &file_dides_v1_dides_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchDesiredStateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchDesiredStateRequest) ProtoMessage() {}
+
+func (x *WatchDesiredStateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchDesiredStateRequest.ProtoReflect.Descriptor instead.
+func (*WatchDesiredStateRequest) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *WatchDesiredStateRequest) GetInstanceId() string {
+	if x != nil {
+		return x.InstanceId
+	}
+	return ""
+}
+
+func (x *WatchDesiredStateRequest) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+type DesiredState struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	DesiredState  *State                 `protobuf:"bytes,1,opt,name=desired_state,json=desiredState,proto3" json:"desired_state,omitempty"`
+	Revision      int64                  `protobuf:"varint,2,opt,name=revision,proto3" json:"revision,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DesiredState) Reset() {
+	*x = DesiredState{}
+	mi := &file_dides_v1_dides_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DesiredState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DesiredState) ProtoMessage() {}
+
+func (x *DesiredState) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DesiredState.ProtoReflect.Descriptor instead.
+func (*DesiredState) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *DesiredState) GetDesiredState() *State {
+	if x != nil {
+		return x.DesiredState
+	}
+	return nil
+}
+
+func (x *DesiredState) GetRevision() int64 {
+	if x != nil {
+		return x.Revision
+	}
+	return 0
+}
+
+type DeploymentConfiguration struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	BatchSize        int32                  `protobuf:"varint,1,opt,name=batch_size,json=batchSize,proto3" json:"batch_size,omitempty"`
+	FailureThreshold int32                  `protobuf:"varint,2,opt,name=failure_threshold,json=failureThreshold,proto3" json:"failure_threshold,omitempty"`
+	// Empty to restore the last completed deployment, "per_instance" to restore each instance to its previous state
+	RollbackMode  string `protobuf:"bytes,3,opt,name=rollback_mode,json=rollbackMode,proto3" json:"rollback_mode,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeploymentConfiguration) Reset() {
+	*x = DeploymentConfiguration{}
+	mi := &file_dides_v1_dides_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeploymentConfiguration) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeploymentConfiguration) ProtoMessage() {}
+
+func (x *DeploymentConfiguration) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeploymentConfiguration.ProtoReflect.Descriptor instead.
+func (*DeploymentConfiguration) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *DeploymentConfiguration) GetBatchSize() int32 {
+	if x != nil {
+		return x.BatchSize
+	}
+	return 0
+}
+
+func (x *DeploymentConfiguration) GetFailureThreshold() int32 {
+	if x != nil {
+		return x.FailureThreshold
+	}
+	return 0
+}
+
+func (x *DeploymentConfiguration) GetRollbackMode() string {
+	if x != nil {
+		return x.RollbackMode
+	}
+	return ""
+}
+
+type DeploymentRequest struct {
+	state                protoimpl.MessageState `protogen:"open.v1"`
+	CodeVersion          string                 `protobuf:"bytes,1,opt,name=code_version,json=codeVersion,proto3" json:"code_version,omitempty"`
+	ConfigurationVersion string                 `protobuf:"bytes,2,opt,name=configuration_version,json=configurationVersion,proto3" json:"configuration_version,omitempty"`
+	Labels               map[string]string      `protobuf:"bytes,3,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// Set-based label selector combined with the labels, e.g. "env=prod,zone in (a,b),!canary"
+	Selector      string                   `protobuf:"bytes,4,opt,name=selector,proto3" json:"selector,omitempty"`
+	Configuration *DeploymentConfiguration `protobuf:"bytes,5,opt,name=configuration,proto3" json:"configuration,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeploymentRequest) Reset() {
+	*x = DeploymentRequest{}
+	mi := &file_dides_v1_dides_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeploymentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeploymentRequest) ProtoMessage() {}
+
+func (x *DeploymentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeploymentRequest.ProtoReflect.Descriptor instead.
+func (*DeploymentRequest) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *DeploymentRequest) GetCodeVersion() string {
+	if x != nil {
+		return x.CodeVersion
+	}
+	return ""
+}
+
+func (x *DeploymentRequest) GetConfigurationVersion() string {
+	if x != nil {
+		return x.ConfigurationVersion
+	}
+	return ""
+}
+
+func (x *DeploymentRequest) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *DeploymentRequest) GetSelector() string {
+	if x != nil {
+		return x.Selector
+	}
+	return ""
+}
+
+func (x *DeploymentRequest) GetConfiguration() *DeploymentConfiguration {
+	if x != nil {
+		return x.Configuration
+	}
+	return nil
+}
+
+type DeploymentProgress struct {
+	state               protoimpl.MessageState `protogen:"open.v1"`
+	TotalInstances      int32                  `protobuf:"varint,1,opt,name=total_instances,json=totalInstances,proto3" json:"total_instances,omitempty"`
+	InProgressInstances int32                  `protobuf:"varint,2,opt,name=in_progress_instances,json=inProgressInstances,proto3" json:"in_progress_instances,omitempty"`
+	CompletedInstances  int32                  `protobuf:"varint,3,opt,name=completed_instances,json=completedInstances,proto3" json:"completed_instances,omitempty"`
+	FailedInstances     int32                  `protobuf:"varint,4,opt,name=failed_instances,json=failedInstances,proto3" json:"failed_instances,omitempty"`
+	unknownFields       protoimpl.UnknownFields
+	sizeCache           protoimpl.SizeCache
+}
+
+func (x *DeploymentProgress) Reset() {
+	*x = DeploymentProgress{}
+	mi := &file_dides_v1_dides_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeploymentProgress) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeploymentProgress) ProtoMessage() {}
+
+func (x *DeploymentProgress) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeploymentProgress.ProtoReflect.Descriptor instead.
+func (*DeploymentProgress) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *DeploymentProgress) GetTotalInstances() int32 {
+	if x != nil {
+		return x.TotalInstances
+	}
+	return 0
+}
+
+func (x *DeploymentProgress) GetInProgressInstances() int32 {
+	if x != nil {
+		return x.InProgressInstances
+	}
+	return 0
+}
+
+func (x *DeploymentProgress) GetCompletedInstances() int32 {
+	if x != nil {
+		return x.CompletedInstances
+	}
+	return 0
+}
+
+func (x *DeploymentProgress) GetFailedInstances() int32 {
+	if x != nil {
+		return x.FailedInstances
+	}
+	return 0
+}
+
+type Deployment struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Id        string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Request   *DeploymentRequest     `protobuf:"bytes,2,opt,name=request,proto3" json:"request,omitempty"`
+	Status    DeploymentStatus       `protobuf:"varint,3,opt,name=status,proto3,enum=dides.v1.DeploymentStatus" json:"status,omitempty"`
+	CreatedAt *timestamppb.Timestamp `protobuf:"bytes,4,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	Progress  *DeploymentProgress    `protobuf:"bytes,5,opt,name=progress,proto3" json:"progress,omitempty"`
+	// Target state per instance ID of a per-instance rollback
+	Targets       map[string]*State `protobuf:"bytes,6,rep,name=targets,proto3" json:"targets,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Deployment) Reset() {
+	*x = Deployment{}
+	mi := &file_dides_v1_dides_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Deployment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Deployment) ProtoMessage() {}
+
+func (x *Deployment) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Deployment.ProtoReflect.Descriptor instead.
+func (*Deployment) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *Deployment) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Deployment) GetRequest() *DeploymentRequest {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+func (x *Deployment) GetStatus() DeploymentStatus {
+	if x != nil {
+		return x.Status
+	}
+	return DeploymentStatus_DEPLOYMENT_STATUS_UNKNOWN
+}
+
+func (x *Deployment) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *Deployment) GetProgress() *DeploymentProgress {
+	if x != nil {
+		return x.Progress
+	}
+	return nil
+}
+
+func (x *Deployment) GetTargets() map[string]*State {
+	if x != nil {
+		return x.Targets
+	}
+	return nil
+}
+
+type TriggerDeploymentRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Request       *DeploymentRequest     `protobuf:"bytes,1,opt,name=request,proto3" json:"request,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TriggerDeploymentRequest) Reset() {
+	*x = TriggerDeploymentRequest{}
+	mi := &file_dides_v1_dides_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TriggerDeploymentRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TriggerDeploymentRequest) ProtoMessage() {}
+
+func (x *TriggerDeploymentRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TriggerDeploymentRequest.ProtoReflect.Descriptor instead.
+func (*TriggerDeploymentRequest) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *TriggerDeploymentRequest) GetRequest() *DeploymentRequest {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+type TriggerDeploymentResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Request       *DeploymentRequest     `protobuf:"bytes,1,opt,name=request,proto3" json:"request,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *TriggerDeploymentResponse) Reset() {
+	*x = TriggerDeploymentResponse{}
+	mi := &file_dides_v1_dides_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TriggerDeploymentResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TriggerDeploymentResponse) ProtoMessage() {}
+
+func (x *TriggerDeploymentResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TriggerDeploymentResponse.ProtoReflect.Descriptor instead.
+func (*TriggerDeploymentResponse) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *TriggerDeploymentResponse) GetRequest() *DeploymentRequest {
+	if x != nil {
+		return x.Request
+	}
+	return nil
+}
+
+type GetDeploymentStatusRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetDeploymentStatusRequest) Reset() {
+	*x = GetDeploymentStatusRequest{}
+	mi := &file_dides_v1_dides_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetDeploymentStatusRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetDeploymentStatusRequest) ProtoMessage() {}
+
+func (x *GetDeploymentStatusRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetDeploymentStatusRequest.ProtoReflect.Descriptor instead.
+func (*GetDeploymentStatusRequest) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{14}
+}
+
+type GetDeploymentStatusResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Deployments   []*Deployment          `protobuf:"bytes,1,rep,name=deployments,proto3" json:"deployments,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetDeploymentStatusResponse) Reset() {
+	*x = GetDeploymentStatusResponse{}
+	mi := &file_dides_v1_dides_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetDeploymentStatusResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetDeploymentStatusResponse) ProtoMessage() {}
+
+func (x *GetDeploymentStatusResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetDeploymentStatusResponse.ProtoReflect.Descriptor instead.
+func (*GetDeploymentStatusResponse) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *GetDeploymentStatusResponse) GetDeployments() []*Deployment {
+	if x != nil {
+		return x.Deployments
+	}
+	return nil
+}
+
+type RollbackRequest struct {
+	state         protoimpl.MessageState   `protogen:"open.v1"`
+	Labels        map[string]string        `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Selector      string                   `protobuf:"bytes,2,opt,name=selector,proto3" json:"selector,omitempty"`
+	Configuration *DeploymentConfiguration `protobuf:"bytes,3,opt,name=configuration,proto3" json:"configuration,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RollbackRequest) Reset() {
+	*x = RollbackRequest{}
+	mi := &file_dides_v1_dides_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RollbackRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RollbackRequest) ProtoMessage() {}
+
+func (x *RollbackRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RollbackRequest.ProtoReflect.Descriptor instead.
+func (*RollbackRequest) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *RollbackRequest) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *RollbackRequest) GetSelector() string {
+	if x != nil {
+		return x.Selector
+	}
+	return ""
+}
+
+func (x *RollbackRequest) GetConfiguration() *DeploymentConfiguration {
+	if x != nil {
+		return x.Configuration
+	}
+	return nil
+}
+
+type RollbackResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Selector of the instances rolled back
+	Selector      string `protobuf:"bytes,1,opt,name=selector,proto3" json:"selector,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RollbackResponse) Reset() {
+	*x = RollbackResponse{}
+	mi := &file_dides_v1_dides_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RollbackResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RollbackResponse) ProtoMessage() {}
+
+func (x *RollbackResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_dides_v1_dides_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RollbackResponse.ProtoReflect.Descriptor instead.
+func (*RollbackResponse) Descriptor() ([]byte, []int) {
+	return file_dides_v1_dides_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *RollbackResponse) GetSelector() string {
+	if x != nil {
+		return x.Selector
+	}
+	return ""
+}
+
+var File_dides_v1_dides_proto protoreflect.FileDescriptor
+
+const file_dides_v1_dides_proto_rawDesc = "" +
+	"\n" +
+	"\x14dides/v1/dides.proto\x12\bdides.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"_\n" +
+	"\x05State\x12!\n" +
+	"\fcode_version\x18\x01 \x01(\tR\vcodeVersion\x123\n" +
+	"\x15configuration_version\x18\x02 \x01(\tR\x14configurationVersion\"\xa3\x04\n" +
+	"\bInstance\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x0e\n" +
+	"\x02ip\x18\x02 \x01(\tR\x02ip\x12\x12\n" +
+	"\x04name\x18\x03 \x01(\tR\x04name\x126\n" +
+	"\x06labels\x18\x04 \x03(\v2\x1e.dides.v1.Instance.LabelsEntryR\x06labels\x127\n" +
+	"\tlast_ping\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\blastPing\x120\n" +
+	"\x06status\x18\x06 \x01(\x0e2\x18.dides.v1.InstanceStatusR\x06status\x124\n" +
+	"\rcurrent_state\x18\a \x01(\v2\x0f.dides.v1.StateR\fcurrentState\x124\n" +
+	"\rdesired_state\x18\b \x01(\v2\x0f.dides.v1.StateR\fdesiredState\x12)\n" +
+	"\x10desired_revision\x18\t \x01(\x03R\x0fdesiredRevision\x126\n" +
+	"\x0eprevious_state\x18\n" +
+	" \x01(\v2\x0f.dides.v1.StateR\rpreviousState\x12\x1a\n" +
+	"\bcordoned\x18\v \x01(\bR\bcordoned\x12\x1a\n" +
+	"\bdraining\x18\f \x01(\bR\bdraining\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xd7\x01\n" +
+	"\x0fRegisterRequest\x12\x0e\n" +
+	"\x02ip\x18\x01 \x01(\tR\x02ip\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12=\n" +
+	"\x06labels\x18\x03 \x03(\v2%.dides.v1.RegisterRequest.LabelsEntryR\x06labels\x12\x14\n" +
+	"\x05token\x18\x04 \x01(\tR\x05token\x12\x10\n" +
+	"\x03csr\x18\x05 \x01(\tR\x03csr\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x84\x01\n" +
+	"\x10RegisterResponse\x12.\n" +
+	"\binstance\x18\x01 \x01(\v2\x12.dides.v1.InstanceR\binstance\x12\x1e\n" +
+	"\n" +
+	"credential\x18\x02 \x01(\tR\n" +
+	"credential\x12 \n" +
+	"\vcertificate\x18\x03 \x01(\tR\vcertificate\"\xaa\x02\n" +
+	"\x12ReportStateRequest\x12\x1f\n" +
+	"\vinstance_id\x18\x01 \x01(\tR\n" +
+	"instanceId\x125\n" +
+	"\x06status\x18\x02 \x01(\x0e2\x18.dides.v1.InstanceStatusH\x00R\x06status\x88\x01\x01\x124\n" +
+	"\rcurrent_state\x18\x03 \x01(\v2\x0f.dides.v1.StateR\fcurrentState\x12@\n" +
+	"\x06labels\x18\x04 \x03(\v2(.dides.v1.ReportStateRequest.LabelsEntryR\x06labels\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01B\t\n" +
+	"\a_status\"j\n" +
+	"\x13ReportStateResponse\x12.\n" +
+	"\binstance\x18\x01 \x01(\v2\x12.dides.v1.InstanceR\binstance\x12#\n" +
+	"\rupdate_needed\x18\x02 \x01(\bR\fupdateNeeded\"W\n" +
+	"\x18WatchDesiredStateRequest\x12\x1f\n" +
+	"\vinstance_id\x18\x01 \x01(\tR\n" +
+	"instanceId\x12\x1a\n" +
+	"\brevision\x18\x02 \x01(\x03R\brevision\"`\n" +
+	"\fDesiredState\x124\n" +
+	"\rdesired_state\x18\x01 \x01(\v2\x0f.dides.v1.StateR\fdesiredState\x12\x1a\n" +
+	"\brevision\x18\x02 \x01(\x03R\brevision\"\x8a\x01\n" +
+	"\x17DeploymentConfiguration\x12\x1d\n" +
+	"\n" +
+	"batch_size\x18\x01 \x01(\x05R\tbatchSize\x12+\n" +
+	"\x11failure_threshold\x18\x02 \x01(\x05R\x10failureThreshold\x12#\n" +
+	"\rrollback_mode\x18\x03 \x01(\tR\frollbackMode\"\xcc\x02\n" +
+	"\x11DeploymentRequest\x12!\n" +
+	"\fcode_version\x18\x01 \x01(\tR\vcodeVersion\x123\n" +
+	"\x15configuration_version\x18\x02 \x01(\tR\x14configurationVersion\x12?\n" +
+	"\x06labels\x18\x03 \x03(\v2'.dides.v1.DeploymentRequest.LabelsEntryR\x06labels\x12\x1a\n" +
+	"\bselector\x18\x04 \x01(\tR\bselector\x12G\n" +
+	"\rconfiguration\x18\x05 \x01(\v2!.dides.v1.DeploymentConfigurationR\rconfiguration\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xcd\x01\n" +
+	"\x12DeploymentProgress\x12'\n" +
+	"\x0ftotal_instances\x18\x01 \x01(\x05R\x0etotalInstances\x122\n" +
+	"\x15in_progress_instances\x18\x02 \x01(\x05R\x13inProgressInstances\x12/\n" +
+	"\x13completed_instances\x18\x03 \x01(\x05R\x12completedInstances\x12)\n" +
+	"\x10failed_instances\x18\x04 \x01(\x05R\x0ffailedInstances\"\x86\x03\n" +
+	"\n" +
+	"Deployment\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x125\n" +
+	"\arequest\x18\x02 \x01(\v2\x1b.dides.v1.DeploymentRequestR\arequest\x122\n" +
+	"\x06status\x18\x03 \x01(\x0e2\x1a.dides.v1.DeploymentStatusR\x06status\x129\n" +
+	"\n" +
+	"created_at\x18\x04 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x128\n" +
+	"\bprogress\x18\x05 \x01(\v2\x1c.dides.v1.DeploymentProgressR\bprogress\x12;\n" +
+	"\atargets\x18\x06 \x03(\v2!.dides.v1.Deployment.TargetsEntryR\atargets\x1aK\n" +
+	"\fTargetsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12%\n" +
+	"\x05value\x18\x02 \x01(\v2\x0f.dides.v1.StateR\x05value:\x028\x01\"Q\n" +
+	"\x18TriggerDeploymentRequest\x125\n" +
+	"\arequest\x18\x01 \x01(\v2\x1b.dides.v1.DeploymentRequestR\arequest\"R\n" +
+	"\x19TriggerDeploymentResponse\x125\n" +
+	"\arequest\x18\x01 \x01(\v2\x1b.dides.v1.DeploymentRequestR\arequest\"\x1c\n" +
+	"\x1aGetDeploymentStatusRequest\"U\n" +
+	"\x1bGetDeploymentStatusResponse\x126\n" +
+	"\vdeployments\x18\x01 \x03(\v2\x14.dides.v1.DeploymentR\vdeployments\"\xf0\x01\n" +
+	"\x0fRollbackRequest\x12=\n" +
+	"\x06labels\x18\x01 \x03(\v2%.dides.v1.RollbackRequest.LabelsEntryR\x06labels\x12\x1a\n" +
+	"\bselector\x18\x02 \x01(\tR\bselector\x12G\n" +
+	"\rconfiguration\x18\x03 \x01(\v2!.dides.v1.DeploymentConfigurationR\rconfiguration\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\".\n" +
+	"\x10RollbackResponse\x12\x1a\n" +
+	"\bselector\x18\x01 \x01(\tR\bselector*f\n" +
+	"\x0eInstanceStatus\x12\x1b\n" +
+	"\x17INSTANCE_STATUS_UNKNOWN\x10\x00\x12\x1b\n" +
+	"\x17INSTANCE_STATUS_HEALTHY\x10\x01\x12\x1a\n" +
+	"\x16INSTANCE_STATUS_FAILED\x10\x02*\x8f\x01\n" +
+	"\x10DeploymentStatus\x12\x1d\n" +
+	"\x19DEPLOYMENT_STATUS_UNKNOWN\x10\x00\x12\x1d\n" +
+	"\x19DEPLOYMENT_STATUS_RUNNING\x10\x01\x12\x1f\n" +
+	"\x1bDEPLOYMENT_STATUS_COMPLETED\x10\x02\x12\x1c\n" +
+	"\x18DEPLOYMENT_STATUS_FAILED\x10\x032\xf4\x01\n" +
+	"\x10InventoryService\x12A\n" +
+	"\bRegister\x12\x19.dides.v1.RegisterRequest\x1a\x1a.dides.v1.RegisterResponse\x12J\n" +
+	"\vReportState\x12\x1c.dides.v1.ReportStateRequest\x1a\x1d.dides.v1.ReportStateResponse\x12Q\n" +
+	"\x11WatchDesiredState\x12\".dides.v1.WatchDesiredStateRequest\x1a\x16.dides.v1.DesiredState0\x012\x98\x02\n" +
+	"\x11DeploymentService\x12\\\n" +
+	"\x11TriggerDeployment\x12\".dides.v1.TriggerDeploymentRequest\x1a#.dides.v1.TriggerDeploymentResponse\x12b\n" +
+	"\x13GetDeploymentStatus\x12$.dides.v1.GetDeploymentStatusRequest\x1a%.dides.v1.GetDeploymentStatusResponse\x12A\n" +
+	"\bRollback\x12\x19.dides.v1.RollbackRequest\x1a\x1a.dides.v1.RollbackResponseB,Z*github.com/xnok/dides/api/dides/v1;didesv1b\x06proto3"
+
+var (
+	file_dides_v1_dides_proto_rawDescOnce sync.Once
+	file_dides_v1_dides_proto_rawDescData []byte
+)
+
+func file_dides_v1_dides_proto_rawDescGZIP() []byte {
+	file_dides_v1_dides_proto_rawDescOnce.Do(func() {
+		file_dides_v1_dides_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_dides_v1_dides_proto_rawDesc), len(file_dides_v1_dides_proto_rawDesc)))
+	})
+	return file_dides_v1_dides_proto_rawDescData
+}
+
+var file_dides_v1_dides_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_dides_v1_dides_proto_msgTypes = make([]protoimpl.MessageInfo, 24)
+var file_dides_v1_dides_proto_goTypes = []any{
+	(InstanceStatus)(0),                 // 0: dides.v1.InstanceStatus
+	(DeploymentStatus)(0),               // 1: dides.v1.DeploymentStatus
+	(*State)(nil),                       // 2: dides.v1.State
+	(*Instance)(nil),                    // 3: dides.v1.Instance
+	(*RegisterRequest)(nil),             // 4: dides.v1.RegisterRequest
+	(*RegisterResponse)(nil),            // 5: dides.v1.RegisterResponse
+	(*ReportStateRequest)(nil),          // 6: dides.v1.ReportStateRequest
+	(*ReportStateResponse)(nil),         // 7: dides.v1.ReportStateResponse
+	(*WatchDesiredStateRequest)(nil),    // 8: dides.v1.WatchDesiredStateRequest
+	(*DesiredState)(nil),                // 9: dides.v1.DesiredState
+	(*DeploymentConfiguration)(nil),     // 10: dides.v1.DeploymentConfiguration
+	(*DeploymentRequest)(nil),           // 11: dides.v1.DeploymentRequest
+	(*DeploymentProgress)(nil),          // 12: dides.v1.DeploymentProgress
+	(*Deployment)(nil),                  // 13: dides.v1.Deployment
+	(*TriggerDeploymentRequest)(nil),    // 14: dides.v1.TriggerDeploymentRequest
+	(*TriggerDeploymentResponse)(nil),   // 15: dides.v1.TriggerDeploymentResponse
+	(*GetDeploymentStatusRequest)(nil),  // 16: dides.v1.GetDeploymentStatusRequest
+	(*GetDeploymentStatusResponse)(nil), // 17: dides.v1.GetDeploymentStatusResponse
+	(*RollbackRequest)(nil),             // 18: dides.v1.RollbackRequest
+	(*RollbackResponse)(nil),            // 19: dides.v1.RollbackResponse
+	nil,                                 // 20: dides.v1.Instance.LabelsEntry
+	nil,                                 // 21: dides.v1.RegisterRequest.LabelsEntry
+	nil,                                 // 22: dides.v1.ReportStateRequest.LabelsEntry
+	nil,                                 // 23: dides.v1.DeploymentRequest.LabelsEntry
+	nil,                                 // 24: dides.v1.Deployment.TargetsEntry
+	nil,                                 // 25: dides.v1.RollbackRequest.LabelsEntry
+	(*timestamppb.Timestamp)(nil),       // 26: google.protobuf.Timestamp
+}
+var file_dides_v1_dides_proto_depIdxs = []int32{
+	20, // 0: dides.v1.Instance.labels:type_name -> dides.v1.Instance.LabelsEntry
+	26, // 1: dides.v1.Instance.last_ping:type_name -> google.protobuf.Timestamp
+	0,  // 2: dides.v1.Instance.status:type_name -> dides.v1.InstanceStatus
+	2,  // 3: dides.v1.Instance.current_state:type_name -> dides.v1.State
+	2,  // 4: dides.v1.Instance.desired_state:type_name -> dides.v1.State
+	2,  // 5: dides.v1.Instance.previous_state:type_name -> dides.v1.State
+	21, // 6: dides.v1.RegisterRequest.labels:type_name -> dides.v1.RegisterRequest.LabelsEntry
+	3,  // 7: dides.v1.RegisterResponse.instance:type_name -> dides.v1.Instance
+	0,  // 8: dides.v1.ReportStateRequest.status:type_name -> dides.v1.InstanceStatus
+	2,  // 9: dides.v1.ReportStateRequest.current_state:type_name -> dides.v1.State
+	22, // 10: dides.v1.ReportStateRequest.labels:type_name -> dides.v1.ReportStateRequest.LabelsEntry
+	3,  // 11: dides.v1.ReportStateResponse.instance:type_name -> dides.v1.Instance
+	2,  // 12: dides.v1.DesiredState.desired_state:type_name -> dides.v1.State
+	23, // 13: dides.v1.DeploymentRequest.labels:type_name -> dides.v1.DeploymentRequest.LabelsEntry
+	10, // 14: dides.v1.DeploymentRequest.configuration:type_name -> dides.v1.DeploymentConfiguration
+	11, // 15: dides.v1.Deployment.request:type_name -> dides.v1.DeploymentRequest
+	1,  // 16: dides.v1.Deployment.status:type_name -> dides.v1.DeploymentStatus
+	26, // 17: dides.v1.Deployment.created_at:type_name -> google.protobuf.Timestamp
+	12, // 18: dides.v1.Deployment.progress:type_name -> dides.v1.DeploymentProgress
+	24, // 19: dides.v1.Deployment.targets:type_name -> dides.v1.Deployment.TargetsEntry
+	11, // 20: dides.v1.TriggerDeploymentRequest.request:type_name -> dides.v1.DeploymentRequest
+	11, // 21: dides.v1.TriggerDeploymentResponse.request:type_name -> dides.v1.DeploymentRequest
+	13, // 22: dides.v1.GetDeploymentStatusResponse.deployments:type_name -> dides.v1.Deployment
+	25, // 23: dides.v1.RollbackRequest.labels:type_name -> dides.v1.RollbackRequest.LabelsEntry
+	10, // 24: dides.v1.RollbackRequest.configuration:type_name -> dides.v1.DeploymentConfiguration
+	2,  // 25: dides.v1.Deployment.TargetsEntry.value:type_name -> dides.v1.State
+	4,  // 26: dides.v1.InventoryService.Register:input_type -> dides.v1.RegisterRequest
+	6,  // 27: dides.v1.InventoryService.ReportState:input_type -> dides.v1.ReportStateRequest
+	8,  // 28: dides.v1.InventoryService.WatchDesiredState:input_type -> dides.v1.WatchDesiredStateRequest
+	14, // 29: dides.v1.DeploymentService.TriggerDeployment:input_type -> dides.v1.TriggerDeploymentRequest
+	16, // 30: dides.v1.DeploymentService.GetDeploymentStatus:input_type -> dides.v1.GetDeploymentStatusRequest
+	18, // 31: dides.v1.DeploymentService.Rollback:input_type -> dides.v1.RollbackRequest
+	5,  // 32: dides.v1.InventoryService.Register:output_type -> dides.v1.RegisterResponse
+	7,  // 33: dides.v1.InventoryService.ReportState:output_type -> dides.v1.ReportStateResponse
+	9,  // 34: dides.v1.InventoryService.WatchDesiredState:output_type -> dides.v1.DesiredState
+	15, // 35: dides.v1.DeploymentService.TriggerDeployment:output_type -> dides.v1.TriggerDeploymentResponse
+	17, // 36: dides.v1.DeploymentService.GetDeploymentStatus:output_type -> dides.v1.GetDeploymentStatusResponse
+	19, // 37: dides.v1.DeploymentService.Rollback:output_type -> dides.v1.RollbackResponse
+	32, // [32:38] is the sub-list for method output_type
+	26, // [26:32] is the sub-list for method input_type
+	26, // [26:26] is the sub-list for extension type_name
+	26, // [26:26] is the sub-list for extension extendee
+	0,  // [0:26] is the sub-list for field type_name
+}
+
+func init() { file_dides_v1_dides_proto_init() }
+func file_dides_v1_dides_proto_init() {
+	if File_dides_v1_dides_proto != nil {
+		return
+	}
+	file_dides_v1_dides_proto_msgTypes[4].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_dides_v1_dides_proto_rawDesc), len(file_dides_v1_dides_proto_rawDesc)),
+			NumEnums:      2,
+			NumMessages:   24,
+			NumExtensions: 0,
+			NumServices:   2,
+		},
+		GoTypes:           file_dides_v1_dides_proto_goTypes,
+		DependencyIndexes: file_dides_v1_dides_proto_depIdxs,
+		EnumInfos:         file_dides_v1_dides_proto_enumTypes,
+		MessageInfos:      file_dides_v1_dides_proto_msgTypes,
+	}.Build()
+	File_dides_v1_dides_proto = out.File
+	file_dides_v1_dides_proto_goTypes = nil
+	file_dides_v1_dides_proto_depIdxs = nil
+}
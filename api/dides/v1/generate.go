@@ -0,0 +1,4 @@
+// Package didesv1 is the gRPC contract of the controller, generated from dides.proto
+package didesv1
+
+//go:generate protoc -I ../.. --go_out=../.. --go_opt=paths=source_relative --go-grpc_out=../.. --go-grpc_opt=paths=source_relative dides/v1/dides.proto
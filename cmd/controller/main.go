@@ -1,95 +1,378 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/auth"
+	"github.com/xnok/dides/internal/clock"
 	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/grpcapi"
 	inmemory "github.com/xnok/dides/internal/infra/in-memory"
 	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/metrics"
+	"github.com/xnok/dides/internal/pki"
+	"github.com/xnok/dides/internal/selector"
+	"github.com/xnok/dides/internal/tracing"
+	"github.com/xnok/dides/internal/transaction"
+	"github.com/xnok/dides/internal/webhook"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // TODO: rework router/handler instanciation and move to DI
 var (
 	registrationService *inventory.RegistrationService
 	updateService       *inventory.UpdateService
+	lifecycleService    *inventory.LifecycleService
+	tokenService        *inventory.TokenService
+	certificateService  *inventory.CertificateService
+	watchService        *inventory.WatchService
 	triggerService      *deployment.TriggerService
+	auditLog            *audit.Log
+	webhooks            *webhook.Dispatcher
+	collector           *metrics.Collector
+
+	// authority signs the instance client certificates and the controller server certificate
+	authority *pki.CA
+	// authenticator resolves the operator API keys, the operator API is open when nil
+	authenticator *auth.Authenticator
 
 	addr = ":3000"
 )
 
+const (
+	// defaultWatchTimeout is how long agents wait for their desired state to change unless they ask otherwise
+	defaultWatchTimeout = 30 * time.Second
+	// maxWatchTimeout bounds the time a watch holds a connection
+	maxWatchTimeout = 5 * time.Minute
+	// drainSweepInterval is how often the draining instances gone unreachable are removed
+	drainSweepInterval = inventory.HeartbeatTTL / 2
+)
+
 func main() {
-	// Initialize the in-memory store and services
+	enableTLS := flag.Bool("tls", false, "serve over mutual TLS using the built-in certificate authority")
+	tlsHosts := flag.String("tls-hosts", "localhost,127.0.0.1", "comma separated host names and IPs of the controller certificate")
+	caFile := flag.String("ca-cert", "dides-ca.pem", "file the certificate authority is written to when TLS is enabled")
+	apiKeysFile := flag.String("api-keys", "", "YAML file with the operator API keys, the operator API is open without it")
+	grpcAddr := flag.String("grpc-addr", ":3001", "address of the gRPC API, empty to disable it")
+	traceExporter := flag.String("trace-exporter", "", "export the trace spans to \"stdout\" or \"otlp\" (configured with the OTEL_EXPORTER_OTLP_* variables), tracing is off without it")
+	flag.Parse()
+
+	// Initialize the tracing, the spans are dropped when no exporter is set
+	shutdownTracing, err := tracing.Setup(context.Background(), *traceExporter, "dides-controller", os.Stdout)
+	if err != nil {
+		log.Fatalf("Failed to setup tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Initialize the operator API authentication
+	if *apiKeysFile == "" {
+		log.Printf("No API keys file, the operator API is not authenticated")
+	} else {
+		config, err := auth.LoadConfigFromFile(*apiKeysFile)
+		if err != nil {
+			log.Fatalf("Failed to load API keys: %v", err)
+		}
+		authenticator, err = auth.NewAuthenticator(config.APIKeys)
+		if err != nil {
+			log.Fatalf("Failed to load API keys: %v", err)
+		}
+	}
+
+	// Initialize the certificate authority, it only lives as long as the controller
+	authority, err = pki.NewCA("dides-ca", clock.Real{})
+	if err != nil {
+		log.Fatalf("Failed to create the certificate authority: %v", err)
+	}
+
+	// Initialize the in-memory store and services, they all take the time from the wall clock
+	wallClock := clock.Real{}
 	InventoryStore := inmemory.NewInventoryStore()
-	registrationService = inventory.NewRegistrationService(InventoryStore)
-	updateService = inventory.NewUpdateService(InventoryStore)
+	// The services trace every call to the inventory store, the unit of work and the metrics take the store itself
+	tracedInventoryStore := tracing.NewInventoryStore(InventoryStore)
+	tokenStore := inmemory.NewTokenStore()
+	auditLog = audit.NewLog(inmemory.NewAuditStore(), wallClock)
+	registrationService = inventory.NewRegistrationService(tracedInventoryStore, tokenStore, auditLog, wallClock)
+	updateService = inventory.NewUpdateService(tracedInventoryStore, auditLog, wallClock)
+	lifecycleService = inventory.NewLifecycleService(tracedInventoryStore, auditLog, wallClock)
+	tokenService = inventory.NewTokenService(tokenStore, auditLog, wallClock)
+	certificateService = inventory.NewCertificateService(tracedInventoryStore, authority, auditLog)
+	notifier := inmemory.NewNotifier()
+	watchService = inventory.NewWatchService(tracedInventoryStore, notifier)
 
 	// Initialize the deployment store and trigger service
-	deploymentStore := inmemory.NewDeploymentStore()
+	deploymentStore := inmemory.NewDeploymentStore(wallClock)
 	deploymentLock := inmemory.NewInMemoryLocker()
-	inventoryStateService := inventory.NewStateService(InventoryStore)
+	inventoryStateService := inventory.NewStateService(tracedInventoryStore, notifier, wallClock)
+
+	// Deployments and their instance updates are kept or undone together
+	transactions := transaction.NewManager(deploymentStore, InventoryStore)
+
+	// Trace the store, the locker, the strategy and the inventory calls of the deployments
+	tracedStore := tracing.NewStore(deploymentStore)
+	tracedLock := tracing.NewLocker(deploymentLock)
 
 	// Create rolling deployment strategy and inject it into the trigger service
-	rollingStrategy := deployment.NewRollingDeployment(deploymentStore, inventoryStateService)
-	triggerService = deployment.NewTriggerService(deploymentStore, deploymentLock, rollingStrategy)
+	// The event bus forwards every deployment event to the webhook subscriptions and the metrics
+	webhooks = webhook.NewDispatcher(inmemory.NewWebhookStore(), nil, webhook.DefaultRetryPolicy, wallClock)
+	collector = metrics.NewCollector(deploymentStore, InventoryStore, wallClock)
+	eventBus := inmemory.NewEventBus(wallClock, webhooks, collector)
+	rollingStrategy := deployment.NewRollingDeployment(tracedStore, tracing.NewInventory(inventoryStateService), eventBus)
+	triggerService = deployment.NewTriggerService(tracedStore, tracedLock, tracing.NewStrategy(rollingStrategy), auditLog, eventBus, transactions)
+
+	// Draining instances that stopped sending heartbeats would otherwise never be removed
+	go sweepDrained(context.Background(), drainSweepInterval)
 
 	// Setup REST Router
 	r := setupRouter()
 
-	// Log that the server is starting
-	log.Printf("Server starting on %s", addr)
+	if !*enableTLS {
+		// Serve the gRPC API next to the REST API
+		go serveGRPC(*grpcAddr, nil)
+
+		// Log that the server is starting
+		log.Printf("Server starting on %s", addr)
+
+		// Start the HTTP server
+		if err := http.ListenAndServe(addr, r); err != nil {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+		return
+	}
+
+	// Agents need the certificate authority to trust the controller
+	if err := os.WriteFile(*caFile, authority.CertificatePEM(), 0o644); err != nil {
+		log.Fatalf("Failed to write the certificate authority: %v", err)
+	}
+
+	config, err := tlsConfig(authority, strings.Split(*tlsHosts, ","))
+	if err != nil {
+		log.Fatalf("Failed to create the TLS configuration: %v", err)
+	}
 
-	// Start the HTTP server
-	if err := http.ListenAndServe(addr, r); err != nil {
+	go serveGRPC(*grpcAddr, config)
+
+	log.Printf("Server starting on %s with mutual TLS, certificate authority written to %s", addr, *caFile)
+
+	server := &http.Server{Addr: addr, Handler: r, TLSConfig: config}
+	if err := server.ListenAndServeTLS("", ""); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 }
 
+// sweepDrained removes the draining instances gone unreachable at every interval, until the context is done
+func sweepDrained(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, key := range lifecycleService.RemoveUnreachableDrained(ctx) {
+				log.Printf("Removed draining instance %s, it stopped sending heartbeats", key)
+			}
+		}
+	}
+}
+
+// serveGRPC serves the gRPC API on its own address, over mutual TLS when a TLS configuration is given
+func serveGRPC(address string, config *tls.Config) {
+	if address == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("gRPC server failed to start: %v", err)
+	}
+
+	log.Printf("gRPC server starting on %s", address)
+	if err := setupGRPCServer(config).Serve(listener); err != nil {
+		log.Fatalf("gRPC server failed: %v", err)
+	}
+}
+
+// setupGRPCServer creates the gRPC server backed by the same services as the REST router
+func setupGRPCServer(config *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(grpcapi.UnaryRequestID)}
+	if config != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	}
+
+	server := grpc.NewServer(options...)
+	grpcapi.Register(server,
+		grpcapi.NewInventoryServer(registrationService, updateService, watchService, certificateService),
+		grpcapi.NewDeploymentServer(triggerService, authenticator),
+	)
+	return server
+}
+
+// tlsConfig serves the controller certificate and verifies the client certificates signed by the authority
+// Client certificates are optional at the TLS level since instances get theirs at registration
+func tlsConfig(ca *pki.CA, hosts []string) (*tls.Config, error) {
+	cert, err := ca.ServerCertificate(hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    ca.Pool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// requireRole authenticates the operator API key and checks it has the role
+// The key is expected in the X-API-Key header or as a bearer token in the Authorization header
+// The principal is added to the request context so the services can check its scope
+func requireRole(role auth.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if authenticator == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := r.Header.Get("X-API-Key")
+			if key == "" {
+				key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			}
+
+			principal, err := authenticator.Authenticate(key)
+			if err != nil {
+				http.Error(w, "Missing or invalid API key", http.StatusUnauthorized)
+				return
+			}
+
+			if !principal.Role.Includes(role) {
+				http.Error(w, "API key does not have the "+string(role)+" role", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
 // setupRouter creates and configures the HTTP router
 func setupRouter() *chi.Mux {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
+	r.Use(tracing.Middleware)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
+	// The metrics wrap the recoverer so the requests that panic are measured as 500
+	r.Use(collector.Middleware)
 	r.Use(middleware.Recoverer)
 
+	// Prometheus metrics of the deployments, the instances and the HTTP handlers
+	r.With(requireRole(auth.Viewer)).Get("/metrics", collector.Handler().ServeHTTP)
+
 	// Inventory manages the list of instances
 	r.Route("/inventory", func(r chi.Router) {
-		// List all instances
-		r.Get("/instances", listInstances)
+		// List all instances, optionally filtered with ?selector=
+		r.With(requireRole(auth.Viewer)).Get("/instances", listInstances)
 		// Register an instance to the system
 		r.Post("/instances/register", registerInstance)
 		// Instance status update - typically instance health-check reporting
-		r.Patch("/instances/{instanceID}", updateInstance)
+		// The instance must present the credential issued at registration
+		r.With(authenticateInstance).Patch("/instances/{instanceID}", updateInstance)
+		// Long-poll the desired state, returns as soon as it differs from ?revision= or after ?timeout=
+		r.With(authenticateInstance).Get("/instances/{instanceID}/desired-state", watchDesiredState)
+		// Remove an instance from the inventory
+		r.With(requireRole(auth.Admin)).Delete("/instances/{instanceID}", deregisterInstance)
+		// Exclude an instance from future deployments, or make it available again
+		r.With(requireRole(auth.Admin)).Post("/instances/{instanceID}/cordon", cordonInstance)
+		r.With(requireRole(auth.Admin)).Post("/instances/{instanceID}/uncordon", uncordonInstance)
+		// Cordon an instance and remove it once its in-flight update is over
+		r.With(requireRole(auth.Admin)).Post("/instances/{instanceID}/drain", drainInstance)
+		// Rotate the client certificate of an instance, or revoke it
+		r.With(authenticateInstance).Post("/instances/{instanceID}/certificate", rotateCertificate)
+		r.With(requireRole(auth.Admin)).Delete("/instances/{instanceID}/certificate", revokeCertificate)
+		// Certificate authority the instances and the controller certificates are signed by
+		r.Get("/ca.pem", caCertificate)
+
+		// Join tokens allow instances to register
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(auth.Admin))
+			r.Post("/tokens", createJoinToken)
+			r.Get("/tokens", listJoinTokens)
+			r.Delete("/tokens/{tokenID}", revokeJoinToken)
+		})
 	})
 
 	// Interact with the deployment process
 	// Since only one in-flight deployment is allowed, we skip the need for an id
 	r.Route("/deploy", func(r chi.Router) {
 		// Trigger a deploment
-		r.Post("/", deployTrigger)
+		r.With(requireRole(auth.Deployer)).Post("/", deployTrigger)
+		// Preview a deployment without triggering it
+		r.With(requireRole(auth.Viewer)).Post("/plan", deploymentPlan)
 		// Get all running deployments
-		r.Get("/status", deploymentStatus)
+		r.With(requireRole(auth.Viewer)).Get("/status", deploymentStatus)
 		// force the deployment to progress (mostly for testing)
-		r.Post("/progress", deploymentProgress)
+		r.With(requireRole(auth.Deployer)).Post("/progress", deploymentProgress)
 		// Trigger a rollback to previous deployment
-		r.Post("/rollback", deploymentRollback)
+		r.With(requireRole(auth.Deployer)).Post("/rollback", deploymentRollback)
+		// Stream the progress of a deployment as Server-Sent Events
+		r.With(requireRole(auth.Viewer)).Get("/{deploymentID}/events", deploymentEvents)
+	})
+
+	// Audit log of the deployment and inventory mutations
+	r.Route("/audit", func(r chi.Router) {
+		r.Use(requireRole(auth.Admin))
+		// Query the entries with ?actor=, ?action=, ?target=, ?request_id=, ?since=, ?until= and ?limit=
+		r.Get("/", listAuditEntries)
+		// Export the matching entries as JSON lines
+		r.Get("/export", exportAuditEntries)
+	})
+
+	// Outbound webhooks notified of the deployment events
+	r.Route("/webhooks", func(r chi.Router) {
+		r.Use(requireRole(auth.Admin))
+		r.Post("/", createWebhook)
+		r.Get("/", listWebhooks)
+		r.Delete("/{subscriptionID}", deleteWebhook)
+		// List the deliveries with ?status=, failed lists the dead letters
+		r.Get("/deliveries", listWebhookDeliveries)
+		r.Post("/deliveries/{deliveryID}/redeliver", redeliverWebhook)
 	})
 
 	return r
 }
 
-// listInstances returns all instances in the inventory
+// listInstances returns the instances in the inventory matching the optional label selector
 func listInstances(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// Get all instances using the registration service
-	instances, err := registrationService.ListAllInstances(ctx)
+	// Parse the label selector from the query string
+	sel, err := selector.Parse(r.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, "Invalid label selector", http.StatusBadRequest)
+		return
+	}
+
+	// Get the matching instances using the registration service
+	instances, err := registrationService.ListInstances(ctx, sel)
 	if err != nil {
 		http.Error(w, "Failed to retrieve instances", http.StatusInternalServerError)
 		return
@@ -118,29 +401,89 @@ func registerInstance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// An instance registering again proves its identity as on the instance routes
+	req.Credential = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		req.Certificate = r.TLS.PeerCertificates[0]
+	}
+
 	// Register the instance using the registration service
-	instance, err := registrationService.RegisterInstance(ctx, req)
+	instance, credential, err := registrationService.RegisterInstance(ctx, req)
 	if err != nil {
 		if err == inventory.ErrInvalidToken {
 			http.Error(w, "Invalid registration token", http.StatusUnauthorized)
 			return
 		}
+		if err == inventory.ErrLabelsOutOfScope {
+			http.Error(w, "Labels are outside the join token scope", http.StatusForbidden)
+			return
+		}
+		if err == inventory.ErrInstanceConflict || err == inventory.ErrLabelsBoundToCertificate {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, pki.ErrInvalidCSR) {
+			http.Error(w, "Invalid certificate signing request", http.StatusBadRequest)
+			return
+		}
 		http.Error(w, "Failed to register instance", http.StatusInternalServerError)
 		return
 	}
 
+	response := inventory.RegistrationResponse{
+		Message:    "Instance registered successfully",
+		Instance:   instance,
+		Credential: credential,
+	}
+
+	// Sign the client certificate bound to the assigned ID
+	if req.CSR != "" {
+		response.Certificate, err = certificateService.IssueCertificate(ctx, instance.Key(), req.CSR)
+		if err != nil {
+			http.Error(w, "Failed to issue instance certificate", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Return success response
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 
-	response := map[string]interface{}{
-		"message":  "Instance registered successfully",
-		"instance": instance,
-	}
-
 	json.NewEncoder(w).Encode(response)
 }
 
+// authenticateInstance rejects requests that do not prove to come from the instance
+// Over mutual TLS the client certificate must be the current one of the instance, the credential is not accepted,
+// otherwise the credential issued at registration is expected as a bearer token in the Authorization header
+func authenticateInstance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		instanceID := chi.URLParam(r, "instanceID")
+
+		var err error
+		switch {
+		case r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+			err = certificateService.Authenticate(ctx, instanceID, r.TLS.PeerCertificates[0])
+		case r.TLS != nil:
+			err = inventory.ErrInvalidCertificate
+		default:
+			credential := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			err = registrationService.Authenticate(ctx, instanceID, credential)
+		}
+		if err != nil {
+			if err == inventory.ErrInstanceNotFound {
+				http.Error(w, "Instance not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Invalid instance credential or certificate", http.StatusUnauthorized)
+			return
+		}
+
+		// The instance is the actor of the changes it reports
+		next.ServeHTTP(w, r.WithContext(audit.WithActor(ctx, "instance/"+instanceID)))
+	})
+}
+
 // updateInstance modify the state of the instance record and return desired state
 func updateInstance(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -163,10 +506,18 @@ func updateInstance(w http.ResponseWriter, r *http.Request) {
 	// Update the instance using the update service
 	instance, err := updateService.UpdateInstance(ctx, instanceID, req)
 	if err != nil {
-		if err == inmemory.ErrInstanceNotFound {
+		if err == inmemory.ErrInstanceNotFound || err == inventory.ErrInstanceNotFound {
 			http.Error(w, "Instance not found", http.StatusNotFound)
 			return
 		}
+		if err == inventory.ErrLabelsOutOfScope {
+			http.Error(w, "Labels are outside the join token scope", http.StatusForbidden)
+			return
+		}
+		if err == inventory.ErrLabelsBoundToCertificate {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		if err == inventory.ErrUpdateValidation {
 			http.Error(w, "Invalid update request", http.StatusBadRequest)
 			return
@@ -180,10 +531,11 @@ func updateInstance(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 
 	response := map[string]interface{}{
-		"message":       "Instance updated successfully",
-		"instance":      instance,
-		"desired_state": instance.DesiredState,
-		"current_state": instance.CurrentState,
+		"message":          "Instance updated successfully",
+		"instance":         instance,
+		"desired_state":    instance.DesiredState,
+		"desired_revision": instance.DesiredRevision,
+		"current_state":    instance.CurrentState,
 		"update_needed": instance.CurrentState.CodeVersion != instance.DesiredState.CodeVersion ||
 			instance.CurrentState.ConfigurationVersion != instance.DesiredState.ConfigurationVersion,
 	}
@@ -191,6 +543,243 @@ func updateInstance(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// watchDesiredState waits for the desired state of the instance to change from the known revision
+// It answers 304 Not Modified when the timeout expires first, the agent then watches again
+func watchDesiredState(w http.ResponseWriter, r *http.Request) {
+	instanceID := chi.URLParam(r, "instanceID")
+
+	var revision int64
+	if value := r.URL.Query().Get("revision"); value != "" {
+		var err error
+		if revision, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, "Invalid revision", http.StatusBadRequest)
+			return
+		}
+	}
+
+	timeout := defaultWatchTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(timeout, maxWatchTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	response, err := watchService.WatchDesiredState(ctx, instanceID, revision)
+	if err != nil {
+		if err == inventory.ErrInstanceNotFound {
+			http.Error(w, "Instance not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to watch desired state", http.StatusInternalServerError)
+		return
+	}
+
+	if response.Revision == revision {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deregisterInstance removes an instance from the inventory
+func deregisterInstance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	instanceID := chi.URLParam(r, "instanceID")
+	if err := lifecycleService.Deregister(ctx, instanceID); err != nil {
+		if err == inventory.ErrInstanceNotFound {
+			http.Error(w, "Instance not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to deregister instance", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cordonInstance excludes an instance from future deployments
+func cordonInstance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	instance, err := lifecycleService.Cordon(ctx, chi.URLParam(r, "instanceID"))
+	writeLifecycleResponse(w, "Instance cordoned successfully", instance, err)
+}
+
+// uncordonInstance makes a cordoned instance available to deployments again
+func uncordonInstance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	instance, err := lifecycleService.Uncordon(ctx, chi.URLParam(r, "instanceID"))
+	writeLifecycleResponse(w, "Instance uncordoned successfully", instance, err)
+}
+
+// drainInstance cordons an instance and removes it once it has no update in flight
+func drainInstance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	instance, removed, err := lifecycleService.Drain(ctx, chi.URLParam(r, "instanceID"))
+	message := "Instance draining, it will be removed once its update is over"
+	if removed {
+		message = "Instance drained and removed"
+	}
+	writeLifecycleResponse(w, message, instance, err)
+}
+
+// writeLifecycleResponse writes the result of a cordon, uncordon or drain operation
+func writeLifecycleResponse(w http.ResponseWriter, message string, instance *inventory.Instance, err error) {
+	if err != nil {
+		if err == inventory.ErrInstanceNotFound {
+			http.Error(w, "Instance not found", http.StatusNotFound)
+			return
+		}
+		if err == inventory.ErrInstanceDraining {
+			http.Error(w, "Instance is draining", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to update instance", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := map[string]interface{}{
+		"message":  message,
+		"instance": instance,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// rotateCertificate signs a new client certificate for the instance, the previous one is no longer accepted
+func rotateCertificate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req inventory.CertificateRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	certificate, err := certificateService.IssueCertificate(ctx, chi.URLParam(r, "instanceID"), req.CSR)
+	if err != nil {
+		if errors.Is(err, pki.ErrInvalidCSR) {
+			http.Error(w, "Invalid certificate signing request", http.StatusBadRequest)
+			return
+		}
+		if err == inventory.ErrInstanceNotFound {
+			http.Error(w, "Instance not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to issue instance certificate", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := map[string]interface{}{
+		"message":     "Certificate issued successfully",
+		"certificate": certificate,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// revokeCertificate stops accepting the client certificate of the instance
+func revokeCertificate(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := certificateService.RevokeCertificate(ctx, chi.URLParam(r, "instanceID")); err != nil {
+		if err == inventory.ErrInstanceNotFound {
+			http.Error(w, "Instance not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to revoke instance certificate", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// caCertificate returns the PEM encoded certificate authority
+func caCertificate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(http.StatusOK)
+	w.Write(authority.CertificatePEM())
+}
+
+// createJoinToken issues a join token instances can register with, the response is the only one holding its secret
+func createJoinToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req inventory.JoinTokenRequest
+
+	// Parse the request body
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	token, err := tokenService.CreateJoinToken(ctx, req)
+	if err != nil {
+		if errors.Is(err, inventory.ErrInvalidJoinTokenRequest) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to create join token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+// listJoinTokens returns all join tokens without their secret
+func listJoinTokens(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	tokens, err := tokenService.ListJoinTokens(ctx)
+	if err != nil {
+		http.Error(w, "Failed to retrieve join tokens", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"tokens": tokens,
+		"count":  len(tokens),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// revokeJoinToken prevents any further registration with a join token
+func revokeJoinToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if err := tokenService.RevokeJoinToken(ctx, chi.URLParam(r, "tokenID")); err != nil {
+		if err == inventory.ErrJoinTokenNotFound {
+			http.Error(w, "Join token not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to revoke join token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // deployTrigger starts a deployment to a given set of instances
 func deployTrigger(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -205,10 +794,18 @@ func deployTrigger(w http.ResponseWriter, r *http.Request) {
 	// Trigger the deployment using the trigger service
 	err := triggerService.TriggerDeployment(ctx, &req)
 	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		if errors.Is(err, deployment.ErrRolloutInProgress) {
 			http.Error(w, "Deployment is already in progress", http.StatusConflict)
 			return
 		}
+		if errors.Is(err, deployment.ErrInvalidDeploymentRequest) {
+			http.Error(w, "Invalid deployment request", http.StatusBadRequest)
+			return
+		}
 
 		http.Error(w, "Failed to trigger deployment", http.StatusInternalServerError)
 		return
@@ -226,6 +823,39 @@ func deployTrigger(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// deploymentPlan returns what a deployment would do without triggering it
+func deploymentPlan(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req deployment.DeploymentRequest
+
+	// Parse the request body
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Plan the deployment using the trigger service
+	plan, err := triggerService.PlanDeployment(ctx, &req)
+	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, deployment.ErrInvalidDeploymentRequest) {
+			http.Error(w, "Invalid deployment request", http.StatusBadRequest)
+			return
+		}
+
+		http.Error(w, "Failed to plan deployment", http.StatusInternalServerError)
+		return
+	}
+
+	// Return the plan
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(plan)
+}
+
 // deploymentStatus returns the status and progress of a deployment
 func deploymentStatus(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -233,6 +863,10 @@ func deploymentStatus(w http.ResponseWriter, r *http.Request) {
 	// Get all running deployments
 	deployments, err := triggerService.GetDeploymentStatus(ctx)
 	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		http.Error(w, "Failed to get deployment status", http.StatusInternalServerError)
 		return
 	}
@@ -256,6 +890,10 @@ func deploymentProgress(w http.ResponseWriter, r *http.Request) {
 	// Progress the deployment
 	record, err := triggerService.ProgressDeployment(ctx)
 	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		http.Error(w, "Failed to progress deployment", http.StatusInternalServerError)
 		return
 	}
@@ -281,6 +919,7 @@ func deploymentRollback(w http.ResponseWriter, r *http.Request) {
 	// Define the rollback request structure
 	var req struct {
 		Labels        map[string]string        `json:"labels"`
+		Selector      string                   `json:"selector,omitempty"`
 		Configuration deployment.Configuration `json:"configuration"`
 	}
 
@@ -290,9 +929,19 @@ func deploymentRollback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sel, err := selector.Build(req.Labels, req.Selector)
+	if err != nil {
+		http.Error(w, "Invalid label selector", http.StatusBadRequest)
+		return
+	}
+
 	// Trigger the rollback using the trigger service
-	err := triggerService.TriggerRollback(ctx, req.Labels, req.Configuration)
+	err = triggerService.TriggerRollback(ctx, sel, req.Configuration)
 	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
 		if errors.Is(err, deployment.ErrRolloutInProgress) {
 			http.Error(w, "Deployment is already in progress", http.StatusConflict)
 			return
@@ -301,6 +950,10 @@ func deploymentRollback(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "No previous successful deployment found for rollback", http.StatusNotFound)
 			return
 		}
+		if errors.Is(err, deployment.ErrNoPreviousStateFound) {
+			http.Error(w, "No instance has a previous state to roll back to", http.StatusNotFound)
+			return
+		}
 
 		http.Error(w, "Failed to trigger rollback", http.StatusInternalServerError)
 		return
@@ -311,10 +964,297 @@ func deploymentRollback(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusCreated)
 
 	response := map[string]interface{}{
-		"message": "Rollback triggered successfully",
-		"labels":  req.Labels,
-		"config":  req.Configuration,
+		"message":  "Rollback triggered successfully",
+		"labels":   req.Labels,
+		"selector": sel.String(),
+		"config":   req.Configuration,
 	}
 
 	json.NewEncoder(w).Encode(response)
 }
+
+// deploymentEvents streams the events of a deployment as Server-Sent Events until its final event
+// Clients resume after the Last-Event-ID header, or the last_event_id query parameter
+func deploymentEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	deploymentID := chi.URLParam(r, "deploymentID")
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var after int64
+	if lastEventID != "" {
+		var err error
+		if after, err = strconv.ParseInt(lastEventID, 10, 64); err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	backlog, events, cancel, err := triggerService.WatchDeployment(ctx, deploymentID, after)
+	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, deployment.ErrDeploymentNotFound) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to watch deployment", http.StatusInternalServerError)
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range backlog {
+		writeEvent(w, event)
+		if event.Final() {
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+
+	if events == nil {
+		return
+	}
+
+	// Comments keep the connection open through proxies while the deployment waits on its instances
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			// The stream fell behind, the client reconnects with the last event ID it received
+			if !ok {
+				return
+			}
+			writeEvent(w, event)
+			flusher.Flush()
+			if event.Final() {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes a deployment event in the Server-Sent Events format
+func writeEvent(w http.ResponseWriter, event deployment.Event) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
+
+// listAuditEntries returns the audit entries matching the query string
+func listAuditEntries(w http.ResponseWriter, r *http.Request) {
+	entries, ok := queryAuditEntries(w, r)
+	if !ok {
+		return
+	}
+
+	response := audit.QueryResponse{
+		Entries: entries,
+		Count:   len(entries),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// exportAuditEntries streams the audit entries matching the query string as JSON lines
+func exportAuditEntries(w http.ResponseWriter, r *http.Request) {
+	entries, ok := queryAuditEntries(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	audit.WriteJSONLines(w, entries)
+}
+
+// queryAuditEntries parses the audit query from the query string and runs it, it writes the error response if any
+func queryAuditEntries(w http.ResponseWriter, r *http.Request) ([]*audit.Entry, bool) {
+	values := r.URL.Query()
+	query := audit.Query{
+		Actor:     values.Get("actor"),
+		RequestID: values.Get("request_id"),
+		Action:    audit.Action(values.Get("action")),
+		Target:    values.Get("target"),
+	}
+
+	var err error
+	if since := values.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			http.Error(w, "Invalid since, expected an RFC 3339 time", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			http.Error(w, "Invalid until, expected an RFC 3339 time", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return nil, false
+		}
+	}
+
+	entries, err := auditLog.Query(r.Context(), query)
+	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return nil, false
+		}
+		if errors.Is(err, audit.ErrInvalidQuery) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		http.Error(w, "Failed to query the audit log", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return entries, true
+}
+
+// createWebhook subscribes an URL to the deployment events, the response carries the signing secret
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	var req webhook.SubscriptionRequest
+
+	// Parse the request body
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	subscription, err := webhooks.CreateSubscription(r.Context(), &req)
+	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, webhook.ErrInvalidSubscription) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to create webhook subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(subscription)
+}
+
+// listWebhooks returns the webhook subscriptions without their secret
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := webhooks.ListSubscriptions(r.Context())
+	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Failed to retrieve webhook subscriptions", http.StatusInternalServerError)
+		return
+	}
+
+	response := webhook.SubscriptionsResponse{
+		Subscriptions: subscriptions,
+		Count:         len(subscriptions),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deleteWebhook removes a webhook subscription
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := webhooks.DeleteSubscription(r.Context(), chi.URLParam(r, "subscriptionID")); err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, webhook.ErrSubscriptionNotFound) {
+			http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to delete webhook subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listWebhookDeliveries returns the webhook deliveries, filtered by the optional status
+func listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	status := webhook.DeliveryStatus(r.URL.Query().Get("status"))
+	switch status {
+	case "", webhook.Pending, webhook.Delivered, webhook.Failed:
+	default:
+		http.Error(w, "Invalid status, expected pending, delivered or failed", http.StatusBadRequest)
+		return
+	}
+
+	deliveries, err := webhooks.ListDeliveries(r.Context(), status)
+	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		http.Error(w, "Failed to retrieve webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	response := webhook.DeliveriesResponse{
+		Deliveries: deliveries,
+		Count:      len(deliveries),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// redeliverWebhook attempts a failed delivery again
+func redeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	delivery, err := webhooks.Redeliver(r.Context(), chi.URLParam(r, "deliveryID"))
+	if err != nil {
+		if errors.Is(err, auth.ErrForbidden) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, webhook.ErrDeliveryNotFound) || errors.Is(err, webhook.ErrSubscriptionNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, webhook.ErrDeliveryPending) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to redeliver webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(delivery)
+}
@@ -1,85 +1,221 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	didesv1 "github.com/xnok/dides/api/dides/v1"
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/auth"
+	"github.com/xnok/dides/internal/clock"
 	"github.com/xnok/dides/internal/deployment"
 	inmemory "github.com/xnok/dides/internal/infra/in-memory"
 	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/metrics"
+	"github.com/xnok/dides/internal/pki"
+	"github.com/xnok/dides/internal/tracing"
+	"github.com/xnok/dides/internal/transaction"
+	"github.com/xnok/dides/internal/webhook"
 	"github.com/xnok/dides/pkg/simulator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 func setupTestServer() *httptest.Server {
+	return httptest.NewServer(setupTestRouter())
+}
+
+// setupTestServerWithClock serves the controller with the services and stores taking the time from clk
+func setupTestServerWithClock(clk clock.Clock) *httptest.Server {
+	return httptest.NewServer(setupTestRouterWithClock(clk))
+}
+
+// setupTLSTestServer serves the controller over mutual TLS, the same way main does with -tls
+func setupTLSTestServer() *httptest.Server {
+	server := httptest.NewUnstartedServer(setupTestRouter())
+
+	config, err := tlsConfig(authority, []string{"127.0.0.1"})
+	if err != nil {
+		panic(err)
+	}
+	server.TLS = config
+	server.StartTLS()
+
+	return server
+}
+
+func setupTestRouter() *chi.Mux {
+	return setupTestRouterWithClock(clock.Real{})
+}
+
+func setupTestRouterWithClock(clk clock.Clock) *chi.Mux {
+	// The operator API is open unless a test enables the authentication
+	authenticator = nil
+
+	var err error
+	authority, err = pki.NewCA("test-ca", clk)
+	if err != nil {
+		panic(err)
+	}
+
 	// Initialize the in-memory stores and services (same as main)
 	inventoryStore := inmemory.NewInventoryStore()
-	registrationService = inventory.NewRegistrationService(inventoryStore)
-	updateService = inventory.NewUpdateService(inventoryStore)
+	// The services trace every call to the inventory store, the unit of work and the metrics take the store itself
+	tracedInventoryStore := tracing.NewInventoryStore(inventoryStore)
+	tokenStore := inmemory.NewTokenStore()
+	auditLog = audit.NewLog(inmemory.NewAuditStore(), clk)
+	registrationService = inventory.NewRegistrationService(tracedInventoryStore, tokenStore, auditLog, clk)
+	updateService = inventory.NewUpdateService(tracedInventoryStore, auditLog, clk)
+	lifecycleService = inventory.NewLifecycleService(tracedInventoryStore, auditLog, clk)
+	tokenService = inventory.NewTokenService(tokenStore, auditLog, clk)
+	certificateService = inventory.NewCertificateService(tracedInventoryStore, authority, auditLog)
+	notifier := inmemory.NewNotifier()
+	watchService = inventory.NewWatchService(tracedInventoryStore, notifier)
+
+	// Unscoped join token used by the tests to register instances
+	tokenStore.SaveToken(&inventory.JoinToken{ID: "test", TokenHash: inventory.HashJoinToken("test-token"), ExpiresAt: clk.Now().Add(time.Hour)})
 
-	deploymentStore := inmemory.NewDeploymentStore()
+	deploymentStore := inmemory.NewDeploymentStore(clk)
 	deploymentLock := inmemory.NewInMemoryLocker()
-	inventoryStateService := inventory.NewStateService(inventoryStore)
+	inventoryStateService := inventory.NewStateService(tracedInventoryStore, notifier, clk)
+	transactions := transaction.NewManager(deploymentStore, inventoryStore)
 
 	// Create rolling deployment strategy and inject it into the trigger service
-	rollingStrategy := deployment.NewRollingDeployment(deploymentStore, inventoryStateService)
-	triggerService = deployment.NewTriggerService(deploymentStore, deploymentLock, rollingStrategy)
+	webhooks = webhook.NewDispatcher(inmemory.NewWebhookStore(), nil, webhook.RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+	}, clk)
+	collector = metrics.NewCollector(deploymentStore, inventoryStore, clk)
+	eventBus := inmemory.NewEventBus(clk, webhooks, collector)
+	tracedStore := tracing.NewStore(deploymentStore)
+	tracedLock := tracing.NewLocker(deploymentLock)
+	rollingStrategy := deployment.NewRollingDeployment(tracedStore, tracing.NewInventory(inventoryStateService), eventBus)
+	triggerService = deployment.NewTriggerService(tracedStore, tracedLock, tracing.NewStrategy(rollingStrategy), auditLog, eventBus, transactions)
 
 	// Setup the router (same as main)
-	r := setupRouter()
+	return setupRouter()
+}
+
+// TestController_Scenarios runs the scenario files against the controller with a simulated fleet
+func TestController_Scenarios(t *testing.T) {
+	files, err := filepath.Glob("../../testdata/scenarios/*.yaml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No scenario files found: %v", err)
+	}
+
+	for _, file := range files {
+		scenario, err := simulator.LoadScenarioFromFile(file)
+		if err != nil {
+			t.Fatalf("Failed to load scenario: %v", err)
+		}
+
+		t.Run(scenario.Name, func(t *testing.T) {
+			// The controller and the agents share a fake clock, the apply delays elapse as soon as the runner advances it
+			clk := simulator.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+			server := setupTestServerWithClock(clk)
+			defer server.Close()
 
-	return httptest.NewServer(r)
+			runner := &simulator.Runner{
+				ControllerURL: server.URL,
+				Token:         "test-token",
+				Clock:         clk,
+				Agent: simulator.AgentOptions{
+					HeartbeatInterval: 50 * time.Millisecond,
+					ApplyDelay:        time.Minute,
+					WatchTimeout:      time.Second,
+				},
+			}
+			if err := runner.Run(context.Background(), scenario); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
 }
 
-func TestController_RegisterInstancesFromConfig(t *testing.T) {
-	// Start test server
+// TestController_LoadTest rolls out a deployment to a fleet generated from templates with the load test mode
+func TestController_LoadTest(t *testing.T) {
 	server := setupTestServer()
 	defer server.Close()
 
-	// Load simulator config using the utility
-	configFile := "../../testdata/simulator.config.yaml"
-	config, err := simulator.LoadConfigFromFile(configFile)
-	if err != nil {
-		t.Fatalf("Failed to load config: %v", err)
-	}
-
-	if len(config.Instances) == 0 {
-		t.Fatal("No instances found in config file")
-	}
+	config := simulator.NewConfigBuilder().
+		AddTemplate(simulator.InstanceTemplate{Name: "web", IP: "10.0.0.1", Count: 150, Labels: map[string]string{"env": "production"}}).
+		AddTemplate(simulator.InstanceTemplate{Name: "dev", IP: "10.1.0.1", Count: 50, Labels: map[string]string{"env": "dev"}}).
+		Build()
 
-	// Create test utilities
-	testUtils := simulator.NewTestUtilities(server, config)
-	testData := simulator.NewTestDataGenerator()
+	report, err := simulator.NewLoadTest(config, simulator.LoadOptions{
+		ControllerURL:     server.URL,
+		Token:             "test-token",
+		Workers:           8,
+		HeartbeatInterval: 100 * time.Millisecond,
+		ProgressInterval:  20 * time.Millisecond,
+		Duration:          100 * time.Millisecond,
+		Timeout:           20 * time.Second,
+		Deployment: &deployment.DeploymentRequest{
+			CodeVersion:          "v2.0.0",
+			ConfigurationVersion: "config-v2",
+			Selector:             "env=production",
+			Configuration:        deployment.Configuration{BatchSize: 50, FailureThreshold: 1},
+		},
+		Logger: log.New(io.Discard, "", 0),
+	}).Run(context.Background())
+	require.NoError(t, err)
 
-	// 1. Register all instances using the utility
-	registeredNames := testUtils.RegisterAllInstances(t, "test-token")
-	t.Logf("Successfully registered %d instances from config: %v", len(registeredNames), registeredNames)
+	assert.Equal(t, 200, report.Registered)
+	assert.Zero(t, report.Client.Registration.Errors)
+	assert.Zero(t, report.Client.PatchInstance.Errors)
+	assert.Positive(t, report.Client.PatchInstance.Count)
+	assert.Positive(t, report.Client.ProgressDeployment.Count)
 
-	// 1.1 validate the registration
-	instances := testUtils.GetAllInstances(t)
-	if len(instances) != len(registeredNames) {
-		t.Fatalf("Expected %d instances, got %d", len(registeredNames), len(instances))
-	}
+	// The controller measured the successful calls of the simulator, and the heartbeats in flight when it stopped
+	require.NotNil(t, report.Controller)
+	assert.Equal(t, 200, report.Controller.Registration.Count)
+	assert.GreaterOrEqual(t, report.Controller.PatchInstance.Count, report.Client.PatchInstance.Count)
+	assert.Equal(t, report.Client.ProgressDeployment.Count, report.Controller.ProgressDeployment.Count)
+	assert.Positive(t, report.Controller.PatchInstance.P99)
+	assert.LessOrEqual(t, report.Controller.PatchInstance.P50, report.Controller.PatchInstance.Max)
+	require.NotNil(t, report.Rollout)
+	assert.Equal(t, "completed", report.Rollout.Status)
+	assert.Equal(t, deployment.DeploymentProgress{TotalMatchingInstances: 150, CompletedInstances: 150}, report.Rollout.Progress)
+}
 
-	// 2. Simulate the instances sending updates
-	for i := range registeredNames {
-		testUtils.UpdateInstance(t, registeredNames[i], testData.CreateUnknownUpdate())
-	}
+func TestController_PlanDeployment(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
 
-	// 3. Validate we can retrieve all instances after updates
-	updatedInstances := testUtils.GetAllInstances(t)
-	if len(updatedInstances) != len(registeredNames) {
-		t.Fatalf("Expected %d instances after updates, got %d", len(registeredNames), len(updatedInstances))
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
 	}
-	t.Logf("Successfully retrieved %d instances after updates", len(updatedInstances))
 
-	// ------------------------------------------------------
-	// Simulate Deployment Logic
-	// ------------------------------------------------------
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	testUtils.RegisterAllInstances(t, "test-token")
 
-	// 4. Trigger a deployment
 	deploymentRequest := testData.CreateDeploymentRequest(
 		"v2.0.0",
 		"config-v2",
@@ -88,163 +224,955 @@ func TestController_RegisterInstancesFromConfig(t *testing.T) {
 		},
 	)
 
+	// 1. Plan the deployment: 3 production instances in batches of 2
+	plan, planResp := testUtils.PlanDeployment(t, deploymentRequest)
+	assert.Equal(t, http.StatusOK, planResp.StatusCode)
+	assert.Equal(t, 3, plan.MatchingInstances)
+	assert.Equal(t, 0, plan.UpToDateInstances)
+	assert.Equal(t, [][]string{
+		{testUtils.InstanceID("instance-1"), testUtils.InstanceID("instance-2")},
+		{testUtils.InstanceID("instance-3")},
+	}, plan.Batches)
+	assert.Equal(t, 1, plan.FailureThreshold)
+	assert.Contains(t, plan.Warnings, "no previous Completed deployment, rollback impossible")
+
+	// 2. Planning did not start anything
+	deployments, _ := testUtils.GetAllDeployments(t)
+	assert.Equal(t, 0, deployments.Count)
+	assert.Empty(t, getInflightInstances(testUtils.GetAllInstances(t), "v2.0.0"))
+
+	// 3. The first batch of the trigger matches the plan
 	deployResp := testUtils.TriggerDeployment(t, deploymentRequest)
 	assert.Equal(t, http.StatusCreated, deployResp.StatusCode)
-	t.Logf("Successfully triggered deployment for version %s", deploymentRequest.CodeVersion)
+	assert.ElementsMatch(t, []string{"instance-1", "instance-2"}, getInflightInstances(testUtils.GetAllInstances(t), "v2.0.0"))
+}
 
-	// 5. Triggering a deployment while pending is not possible
-	deploymentRequest = testData.CreateDeploymentRequest(
-		"v2.0.1",
-		"config-v2",
-		map[string]string{
-			"env": "production",
-		},
-	)
-	deployResp = testUtils.TriggerDeployment(t, deploymentRequest)
-	assert.Equal(t, http.StatusConflict, deployResp.StatusCode)
+func TestController_LabelSelectors(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
 
-	// Wait for the deployment to progress
-	time.Sleep(100 * time.Millisecond)
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	testUtils.RegisterAllInstances(t, "test-token")
 
-	// 6. Deployment is in progress - batch size need to be respected
-	deployments, deploymentResp := testUtils.GetAllDeployments(t)
-	assert.Equal(t, http.StatusOK, deploymentResp.StatusCode)
-	assert.Equal(t, 1, deployments.Count)
+	// 1. List instances with a set-based selector
+	resp := testUtils.MakeHTTPRequest(t, http.MethodGet, "/inventory/instances?selector="+url.QueryEscape("role=web,env notin (dev)"), nil)
+	var list inventory.ListResponse
+	testUtils.DecodeResponse(t, resp, &list)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 3, list.Count)
 
-	updatedInstances = testUtils.GetAllInstances(t)
-	inflight := getInflightInstances(updatedInstances, "v2.0.0")
-	assert.Equal(t, 2, len(inflight))
+	// 2. Invalid selectors are rejected
+	resp = testUtils.MakeHTTPRequest(t, http.MethodGet, "/inventory/instances?selector="+url.QueryEscape("env in (prod"), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 
-	// 7. Progress the deployment - nothing should happen yet (instances haven't updated their current state)
-	progress, progressResp := testUtils.ProgressDeployment(t)
-	assert.Equal(t, http.StatusOK, progressResp.StatusCode)
-	assert.Equal(t, deployment.Running, progress.Status)
-	t.Logf("Successfully progressed deployment. Status: %v, Progress: %+v", progress.Status, progress.Progress)
+	// 3. Deployments combine labels and selector
+	deploymentRequest := testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"role": "web"})
+	deploymentRequest.Selector = "env!=dev"
 
-	// 8. instance report their status
-	for i := range inflight {
-		testUtils.UpdateInstance(t, inflight[i], testData.CreateHealthyUpdate("v2.0.0", "config-v2"))
+	plan, planResp := testUtils.PlanDeployment(t, deploymentRequest)
+	assert.Equal(t, http.StatusOK, planResp.StatusCode)
+	assert.Equal(t, 3, plan.MatchingInstances)
+
+	deploymentRequest.Selector = "env in (prod"
+	planResp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/deploy/plan", deploymentRequest)
+	assert.Equal(t, http.StatusBadRequest, planResp.StatusCode)
+}
+
+func TestController_InstanceLifecycle(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
 	}
 
-	// 8.1 Progress the deployment to the next step
-	progress, progressResp = testUtils.ProgressDeployment(t)
-	assert.Equal(t, http.StatusOK, progressResp.StatusCode)
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	testUtils.RegisterAllInstances(t, "test-token")
+	total := len(testUtils.GetAllInstances(t))
+
+	// 1. A cordoned instance is still listed but excluded from deployments
+	resp := testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/instances/"+testUtils.InstanceID("instance-3")+"/cordon", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, testUtils.GetAllInstances(t), total)
+
+	deploymentRequest := testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"env": "production"})
+	plan, _ := testUtils.PlanDeployment(t, deploymentRequest)
+	assert.Equal(t, 2, plan.MatchingInstances)
+
+	deployResp := testUtils.TriggerDeployment(t, deploymentRequest)
+	assert.Equal(t, http.StatusCreated, deployResp.StatusCode)
+	assert.ElementsMatch(t, []string{"instance-1", "instance-2"}, getInflightInstances(testUtils.GetAllInstances(t), "v2.0.0"))
+
+	// 2. Draining an instance with an update in flight keeps it until the update is over
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/instances/"+testUtils.InstanceID("instance-1")+"/drain", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, testUtils.GetAllInstances(t), total)
+
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/instances/"+testUtils.InstanceID("instance-1")+"/uncordon", nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	testUtils.UpdateInstance(t, "instance-1", testData.CreateHealthyUpdate("v2.0.0", "config-v2"))
+	assert.Len(t, testUtils.GetAllInstances(t), total-1)
+
+	// 3. Deregistration removes the instance right away
+	resp = testUtils.MakeHTTPRequest(t, http.MethodDelete, "/inventory/instances/"+testUtils.InstanceID("instance-4"), nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Len(t, testUtils.GetAllInstances(t), total-2)
+
+	resp = testUtils.MakeHTTPRequest(t, http.MethodDelete, "/inventory/instances/"+testUtils.InstanceID("instance-4"), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// 4. The running deployment only counts the instances left
+	progress, _ := testUtils.ProgressDeployment(t)
+	assert.Equal(t, 1, progress.Progress.TotalMatchingInstances)
 	assert.Equal(t, deployment.Running, progress.Status)
-	assert.Equal(t, deployment.DeploymentProgress{
-		TotalMatchingInstances: 3,
-		CompletedInstances:     2,
-		InProgressInstances:    1,
-		FailedInstances:        0,
-	}, progress.Progress)
 
-	// Wait for the deployment to progress
-	time.Sleep(100 * time.Millisecond)
+	testUtils.UpdateInstance(t, "instance-2", testData.CreateHealthyUpdate("v2.0.0", "config-v2"))
+	progress, _ = testUtils.ProgressDeployment(t)
+	assert.Equal(t, deployment.Completed, progress.Status)
+}
 
-	updatedInstances = testUtils.GetAllInstances(t)
-	inflight = getInflightInstances(updatedInstances, "v2.0.0")
-	assert.Equal(t, 1, len(inflight))
+func TestController_DrainUnreachable(t *testing.T) {
+	clk := simulator.NewFakeClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	server := setupTestServerWithClock(clk)
+	defer server.Close()
 
-	// 9. instance report their status
-	for i := range inflight {
-		testUtils.UpdateInstance(t, inflight[i], testData.CreateHealthyUpdate("v2.0.0", "config-v2"))
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Wait for the deployment to progress
-	progress, progressResp = testUtils.ProgressDeployment(t)
-	assert.Equal(t, http.StatusOK, progressResp.StatusCode)
-	assert.Equal(t, deployment.Completed, progress.Status)
-	assert.Equal(t, deployment.DeploymentProgress{
-		TotalMatchingInstances: 3,
-		CompletedInstances:     3,
-		InProgressInstances:    0,
-		FailedInstances:        0,
-	}, progress.Progress)
-
-	// ------------------------------------------------------
-	// Simulate Deployment With Failures
-	// ------------------------------------------------------
-
-	// 10. Trigger a deployment with one instance failing
-	deploymentRequest = testData.CreateDeploymentRequest(
-		"v3.0.0",
-		"config-v3",
-		map[string]string{
-			"env": "production",
-		},
-	)
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	testUtils.RegisterAllInstances(t, "test-token")
+	total := len(testUtils.GetAllInstances(t))
+
+	deploymentRequest := testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"env": "production"})
+	deployResp := testUtils.TriggerDeployment(t, deploymentRequest)
+	assert.Equal(t, http.StatusCreated, deployResp.StatusCode)
+
+	// 1. A draining instance with an update in flight is kept while it sends heartbeats
+	resp := testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/instances/"+testUtils.InstanceID("instance-1")+"/drain", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, lifecycleService.RemoveUnreachableDrained(context.Background()))
+	assert.Len(t, testUtils.GetAllInstances(t), total)
+
+	// 2. The sweep removes it once it went unreachable, its update will never be reported over
+	clk.Advance(inventory.HeartbeatTTL + time.Second)
+	assert.Equal(t, []string{testUtils.InstanceID("instance-1")}, lifecycleService.RemoveUnreachableDrained(context.Background()))
+	assert.Len(t, testUtils.GetAllInstances(t), total-1)
+
+	// 3. Draining an unreachable instance removes it right away
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/instances/"+testUtils.InstanceID("instance-2")+"/drain", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, testUtils.GetAllInstances(t), total-2)
+}
+
+func TestController_JoinTokens(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	production, _ := testUtils.GetInstanceByName("instance-1")
+	dev, _ := testUtils.GetInstanceByName("instance-4")
+
+	// 1. Create a join token scoped to dev instances that can be used once
+	resp := testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/tokens", inventory.JoinTokenRequest{Selector: "env=dev", TTL: "1h", MaxUses: 1})
+	var token inventory.JoinToken
+	testUtils.DecodeResponse(t, resp, &token)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NotEmpty(t, token.Token)
+	assert.NotEmpty(t, token.ID)
+
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/tokens", inventory.JoinTokenRequest{TTL: "-1h"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// 2. Labels outside the scope are rejected without using the token
+	resp = testUtils.RegisterInstance(t, *production, token.Token)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = testUtils.RegisterInstance(t, *dev, token.Token)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NotEmpty(t, testUtils.Credential(dev.Name))
+
+	// 3. The token is used up
+	resp = testUtils.RegisterInstance(t, *dev, token.Token)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = testUtils.RegisterInstance(t, *production, "unknown-token")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// 4. Updates require the credential of the instance
+	resp = testUtils.UpdateInstance(t, dev.Name, testData.CreateHealthyUpdate("v1.0.0", "config-v1"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-	deployResp = testUtils.TriggerDeployment(t, deploymentRequest)
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPatch, "/inventory/instances/"+testUtils.InstanceID(dev.Name), inventory.UpdateRequest{})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	testUtils.RegisterInstance(t, *production, "test-token")
+	req, _ := http.NewRequest(http.MethodPatch, server.URL+"/inventory/instances/"+testUtils.InstanceID(dev.Name), nil)
+	req.Header.Set("Authorization", "Bearer "+testUtils.Credential(production.Name))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to update instance: %v", err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// 5. Labels cannot be moved outside the scope after registration
+	resp = testUtils.UpdateInstance(t, dev.Name, inventory.InstancePatch{Labels: map[string]string{"env": "production"}})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// 6. The secrets are only returned on creation
+	resp = testUtils.MakeHTTPRequest(t, http.MethodGet, "/inventory/tokens", nil)
+	var list struct {
+		Tokens []inventory.JoinToken `json:"tokens"`
+	}
+	testUtils.DecodeResponse(t, resp, &list)
+	assert.Len(t, list.Tokens, 2)
+	for _, listed := range list.Tokens {
+		assert.Empty(t, listed.Token)
+	}
+
+	// 7. Revoked tokens are addressed by their ID and disappear
+	resp = testUtils.MakeHTTPRequest(t, http.MethodDelete, "/inventory/tokens/"+token.Token, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = testUtils.MakeHTTPRequest(t, http.MethodDelete, "/inventory/tokens/"+token.ID, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = testUtils.MakeHTTPRequest(t, http.MethodDelete, "/inventory/tokens/"+token.ID, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestController_ReRegistration(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	testUtils.RegisterAllInstances(t, "test-token")
+
+	instance, _ := testUtils.GetInstanceByName("instance-1")
+	id := testUtils.InstanceID(instance.Name)
+	assert.NotEmpty(t, id)
+
+	deployResp := testUtils.TriggerDeployment(t, testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"env": "production"}))
 	assert.Equal(t, http.StatusCreated, deployResp.StatusCode)
-	t.Logf("Successfully triggered deployment for version %s", deploymentRequest.CodeVersion)
+	testUtils.UpdateInstance(t, instance.Name, testData.CreateHealthyUpdate("v1.0.0", "config-v1"))
 
-	// Wait for the deployment to progress
-	time.Sleep(100 * time.Millisecond)
+	// 1. Registering again keeps the ID and the states
+	resp := testUtils.RegisterInstance(t, *instance, "test-token")
+	var registration inventory.RegistrationResponse
+	testUtils.DecodeResponse(t, resp, &registration)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, id, registration.Instance.ID)
+	assert.Equal(t, "v2.0.0", registration.Instance.DesiredState.CodeVersion)
+	assert.Equal(t, "v1.0.0", registration.Instance.CurrentState.CodeVersion)
+	assert.Len(t, testUtils.GetAllInstances(t), len(config.Instances))
 
-	deployments, deploymentResp = testUtils.GetAllDeployments(t)
-	assert.Equal(t, http.StatusOK, deploymentResp.StatusCode)
-	assert.Equal(t, 1, deployments.Count)
+	// 2. The new credential replaces the previous one
+	resp = testUtils.UpdateInstance(t, instance.Name, testData.CreateUnknownUpdate())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-	updatedInstances = testUtils.GetAllInstances(t)
-	inflight = getInflightInstances(updatedInstances, "v3.0.0")
-	assert.Equal(t, 2, len(inflight))
+	// 3. Registering again without the credential is a takeover attempt
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/instances/register", instance.ToRegistrationRequest("test-token"))
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
 
-	// 11. Progress the deployment - nothing should happen yet (instances haven't updated their current state)
-	progress, progressResp = testUtils.ProgressDeployment(t)
-	assert.Equal(t, http.StatusOK, progressResp.StatusCode)
-	assert.Equal(t, deployment.Running, progress.Status)
-	t.Logf("Successfully progressed deployment. Status: %v, Progress: %+v", progress.Status, progress.Progress)
-
-	// 12. instance report their status - one fails
-	testUtils.UpdateInstance(t, inflight[0], testData.CreateHealthyUpdate("v3.0.0", "config-v3"))
-	testUtils.UpdateInstance(t, inflight[1], testData.CreateFailedUpdate("v3.0.0", "config-v3"))
-
-	// 12.1 Progress the deployment to the next step - should trigger a rollback
-	progress, progressResp = testUtils.ProgressDeployment(t)
-	assert.Equal(t, http.StatusOK, progressResp.StatusCode)
-	assert.Equal(t, deployment.Failed, progress.Status)
-	assert.Equal(t, deployment.DeploymentProgress{
-		TotalMatchingInstances: 3,
-		CompletedInstances:     1, // 1 successful
-		InProgressInstances:    0,
-		FailedInstances:        1,
-	}, progress.Progress)
-
-	// 13. Deployment is failed - a rollback should have been triggered automatically
-	time.Sleep(100 * time.Millisecond)
-
-	deployments, deploymentResp = testUtils.GetAllDeployments(t)
-	assert.Equal(t, http.StatusOK, deploymentResp.StatusCode)
-	assert.Equal(t, 1, deployments.Count)                                     // The rollback deployment
-	assert.Equal(t, "v2.0.0", deployments.Deployments[0].Request.CodeVersion) // Rollback to previous version
-
-	t.Logf("Successfully triggered automatic rollback to version %s", deployments.Deployments[0].Request.CodeVersion)
-
-	// 14. Progress the rollback deployment
-	time.Sleep(300 * time.Millisecond)
-	progress, progressResp = testUtils.ProgressDeployment(t)
-	assert.Equal(t, http.StatusOK, progressResp.StatusCode)
-	assert.Equal(t, deployment.Running, progress.Status)
+	// 4. Registering again with another token keeps the scope of the first registration
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/tokens", inventory.JoinTokenRequest{Selector: "env=production"})
+	var token inventory.JoinToken
+	testUtils.DecodeResponse(t, resp, &token)
+	resp = testUtils.RegisterInstance(t, *instance, token.Token)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = testUtils.UpdateInstance(t, instance.Name, inventory.InstancePatch{Labels: map[string]string{"env": "dev"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
 
-	updatedInstances = testUtils.GetAllInstances(t)
-	inflight = getInflightInstances(updatedInstances, "v2.0.0")
-	assert.Equal(t, 2, len(inflight))
+	// 5. Another instance cannot reuse the name or the IP
+	nameCollision := *instance
+	nameCollision.IP = "10.10.10.10"
+	resp = testUtils.RegisterInstance(t, nameCollision, "test-token")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
 
-	// 15. instance report their status
-	for i := range inflight {
-		testUtils.UpdateInstance(t, inflight[i], testData.CreateHealthyUpdate("v2.0.0", "config-v2"))
+	ipCollision := *instance
+	ipCollision.Name = "instance-42"
+	resp = testUtils.RegisterInstance(t, ipCollision, "test-token")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestController_MutualTLS(t *testing.T) {
+	server := setupTLSTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
 	}
 
-	// 15.1 Progress the deployment to the next step
-	progress, progressResp = testUtils.ProgressDeployment(t)
-	assert.Equal(t, http.StatusOK, progressResp.StatusCode)
-	assert.Equal(t, deployment.Completed, progress.Status)
-	assert.Equal(t, deployment.DeploymentProgress{
-		TotalMatchingInstances: 3,
-		CompletedInstances:     3, // 3 instances are at the target version
-		InProgressInstances:    0,
-		FailedInstances:        0,
-	}, progress.Progress)
+	testData := simulator.NewTestDataGenerator()
+	anonymous := newTLSClient(t, nil, "")
+
+	// 1. Register two instances with a CSR, without a client certificate yet
+	register := func(instanceConfig simulator.InstanceConfig) (*inventory.RegistrationResponse, *ecdsa.PrivateKey) {
+		key, csr, err := pki.NewCSR(instanceConfig.Name)
+		if err != nil {
+			t.Fatalf("Failed to create CSR: %v", err)
+		}
+
+		req := instanceConfig.ToRegistrationRequest("test-token")
+		req.CSR = csr
+
+		resp := doJSON(t, anonymous, http.MethodPost, server.URL+"/inventory/instances/register", req)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var registration inventory.RegistrationResponse
+		json.NewDecoder(resp.Body).Decode(&registration)
+		assert.NotEmpty(t, registration.Certificate)
+		return &registration, key
+	}
+
+	web, webKey := register(config.Instances[0])
+	other, _ := register(config.Instances[1])
+	webClient := newTLSClient(t, webKey, web.Certificate)
+
+	patch := inventory.UpdateRequest{Updates: testData.CreateHealthyUpdate("v1.0.0", "config-v1")}
+
+	// 2. The client certificate authenticates the instance, no credential needed
+	resp := doJSON(t, webClient, http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, patch)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = doJSON(t, anonymous, http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, patch)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The credential is not accepted over mutual TLS
+	body, _ := json.Marshal(patch)
+	req, _ := http.NewRequest(http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+web.Credential)
+	resp, err = anonymous.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to update instance: %v", err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The labels are bound to the certificate
+	labelPatch := inventory.UpdateRequest{Updates: inventory.InstancePatch{Labels: map[string]string{"team": "web"}}}
+	resp = doJSON(t, webClient, http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, labelPatch)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	// 3. The certificate is bound to the instance ID
+	resp = doJSON(t, webClient, http.MethodPatch, server.URL+"/inventory/instances/"+other.Instance.ID, patch)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 
+	// 4. Rotation replaces the certificate, the previous one is rejected
+	rotatedKey, csr, _ := pki.NewCSR(web.Instance.Name)
+	resp = doJSON(t, webClient, http.MethodPost, server.URL+"/inventory/instances/"+web.Instance.ID+"/certificate", inventory.CertificateRequest{CSR: csr})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var rotated map[string]string
+	json.NewDecoder(resp.Body).Decode(&rotated)
+	rotatedClient := newTLSClient(t, rotatedKey, rotated["certificate"])
+
+	resp = doJSON(t, newTLSClient(t, webKey, web.Certificate), http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, patch)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doJSON(t, rotatedClient, http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, patch)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// 5. Registering again is authenticated by the certificate as well
+	resp = doJSON(t, anonymous, http.MethodPost, server.URL+"/inventory/instances/register", config.Instances[0].ToRegistrationRequest("test-token"))
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = doJSON(t, rotatedClient, http.MethodPost, server.URL+"/inventory/instances/register", config.Instances[0].ToRegistrationRequest("test-token"))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// The labels are bound to the certificate, registering again with other labels requires a CSR
+	relabeled := config.Instances[0].ToRegistrationRequest("test-token")
+	relabeled.Instance.Labels = map[string]string{"env": "staging"}
+	resp = doJSON(t, rotatedClient, http.MethodPost, server.URL+"/inventory/instances/register", relabeled)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp = doJSON(t, newTLSClient(t, rotatedKey, rotated["certificate"]), http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, patch)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// With a CSR, the certificate is issued again for the new labels and the previous one is rejected
+	relabeledKey, csr, _ := pki.NewCSR(web.Instance.Name)
+	relabeled.CSR = csr
+	resp = doJSON(t, newTLSClient(t, rotatedKey, rotated["certificate"]), http.MethodPost, server.URL+"/inventory/instances/register", relabeled)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	var registration inventory.RegistrationResponse
+	json.NewDecoder(resp.Body).Decode(&registration)
+	relabeledClient := newTLSClient(t, relabeledKey, registration.Certificate)
+
+	resp = doJSON(t, newTLSClient(t, rotatedKey, rotated["certificate"]), http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, patch)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = doJSON(t, relabeledClient, http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, patch)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// 6. A revoked certificate is rejected
+	resp = doJSON(t, anonymous, http.MethodDelete, server.URL+"/inventory/instances/"+web.Instance.ID+"/certificate", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = doJSON(t, newTLSClient(t, relabeledKey, registration.Certificate), http.MethodPatch, server.URL+"/inventory/instances/"+web.Instance.ID, patch)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+// newTLSClient creates a client trusting the controller authority, with a client certificate when a key is given
+func newTLSClient(t *testing.T, key *ecdsa.PrivateKey, certPEM string) *http.Client {
+	t.Helper()
+
+	config := &tls.Config{RootCAs: authority.Pool()}
+	if key != nil {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			t.Fatalf("Failed to decode certificate %q", certPEM)
+		}
+		config.Certificates = []tls.Certificate{{Certificate: [][]byte{block.Bytes}, PrivateKey: key}}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+// doJSON sends the body as JSON with the given client
+func doJSON(t *testing.T, client *http.Client, method, target string, body interface{}) *http.Response {
+	t.Helper()
+
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+
+	req, err := http.NewRequest(method, target, &payload)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	return resp
+}
+
+func TestController_OperatorAuth(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	simulator.NewTestUtilities(server, config).RegisterAllInstances(t, "test-token")
+
+	authenticator, err = auth.NewAuthenticator([]auth.APIKey{
+		{Name: "ops", Key: "admin-key", Role: auth.Admin},
+		{Name: "web-team", Key: "web-key", Role: auth.Deployer, Selector: "role=web"},
+		{Name: "dashboard", Key: "viewer-key", Role: auth.Viewer},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+
+	testData := simulator.NewTestDataGenerator()
+	request := func(method, path, key string, body interface{}) *http.Response {
+		var payload bytes.Buffer
+		json.NewEncoder(&payload).Encode(body)
+
+		req, _ := http.NewRequest(method, server.URL+path, &payload)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		return resp
+	}
+
+	webDeployment := testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"role": "web", "env": "production"})
+	dbDeployment := testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"role": "db"})
+
+	// 1. Requests without a valid key are rejected
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/deploy/status", "", nil).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/deploy/status", "unknown-key", nil).StatusCode)
+
+	// 2. Viewers can read and plan but not deploy
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/deploy/status", "viewer-key", nil).StatusCode)
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/deploy/plan", "viewer-key", webDeployment).StatusCode)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/deploy/", "viewer-key", webDeployment).StatusCode)
+
+	// 3. Scoped deployers can only deploy within their scope
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/deploy/", "web-key", dbDeployment).StatusCode)
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/deploy/plan", "web-key", dbDeployment).StatusCode)
+	assert.Equal(t, http.StatusCreated, request(http.MethodPost, "/deploy/", "web-key", webDeployment).StatusCode)
+
+	// 4. Managing the inventory requires the admin role
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/inventory/tokens", "web-key", inventory.JoinTokenRequest{}).StatusCode)
+	assert.Equal(t, http.StatusCreated, request(http.MethodPost, "/inventory/tokens", "admin-key", inventory.JoinTokenRequest{}).StatusCode)
+}
+
+func TestController_AuditLog(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	names := testUtils.RegisterAllInstances(t, "test-token")
+
+	// 1. Trigger a deployment and let an instance report its update
+	deployResp := testUtils.TriggerDeployment(t, testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"role": "web"}))
+	assert.Equal(t, http.StatusCreated, deployResp.StatusCode)
+	testUtils.UpdateInstance(t, names[0], testData.CreateHealthyUpdate("v2.0.0", "config-v2"))
+	// A heartbeat reporting the same state changes nothing
+	testUtils.UpdateInstance(t, names[0], testData.CreateHealthyUpdate("v2.0.0", "config-v2"))
+
+	// 2. The deployment is recorded with the request that triggered it
+	var response audit.QueryResponse
+	resp := testUtils.MakeHTTPRequest(t, http.MethodGet, "/audit/?action=deployment.trigger", nil)
+	testUtils.DecodeResponse(t, resp, &response)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	if assert.Equal(t, 1, response.Count) {
+		assert.Equal(t, audit.Anonymous, response.Entries[0].Actor)
+		assert.NotEmpty(t, response.Entries[0].RequestID)
+		assert.NotEmpty(t, response.Entries[0].Changes)
+	}
+
+	// 3. The registration and the instance update are recorded once, with the instance as actor
+	instanceID := testUtils.InstanceID(names[0])
+	resp = testUtils.MakeHTTPRequest(t, http.MethodGet, "/audit/?target="+instanceID, nil)
+	testUtils.DecodeResponse(t, resp, &response)
+	if assert.Equal(t, 2, response.Count) {
+		assert.Equal(t, audit.InstanceRegister, response.Entries[0].Action)
+		assert.Equal(t, audit.InstanceUpdate, response.Entries[1].Action)
+		assert.Equal(t, "instance/"+instanceID, response.Entries[1].Actor)
+	}
+
+	// 4. The lifecycle and the join tokens managed by the admins are recorded
+	testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/instances/"+instanceID+"/cordon", nil)
+	testUtils.MakeHTTPRequest(t, http.MethodDelete, "/inventory/instances/"+instanceID+"/certificate", nil)
+	testUtils.MakeHTTPRequest(t, http.MethodDelete, "/inventory/instances/"+instanceID, nil)
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/inventory/tokens", inventory.JoinTokenRequest{})
+	var token inventory.JoinToken
+	testUtils.DecodeResponse(t, resp, &token)
+	testUtils.MakeHTTPRequest(t, http.MethodDelete, "/inventory/tokens/"+token.ID, nil)
+
+	for _, action := range []audit.Action{audit.InstanceCordon, audit.InstanceDeregister, audit.JoinTokenCreate, audit.JoinTokenRevoke} {
+		resp = testUtils.MakeHTTPRequest(t, http.MethodGet, "/audit/?action="+string(action), nil)
+		testUtils.DecodeResponse(t, resp, &response)
+		assert.Equal(t, 1, response.Count, action)
+	}
+	for _, change := range response.Entries[0].Changes {
+		assert.NotEqual(t, token.Token, change.Before, "the secret of a join token is never recorded")
+	}
+
+	// 5. Entries are exported as JSON lines
+	resp = testUtils.MakeHTTPRequest(t, http.MethodGet, "/audit/export", nil)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	decoder := json.NewDecoder(resp.Body)
+	var lines int
+	for decoder.More() {
+		var entry audit.Entry
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatalf("Failed to decode exported entry: %v", err)
+		}
+		lines++
+	}
+	assert.Equal(t, len(names)+6, lines)
+
+	// 6. Invalid queries are rejected
+	resp = testUtils.MakeHTTPRequest(t, http.MethodGet, "/audit/?since=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestController_DeploymentEvents(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	testUtils.RegisterAllInstances(t, "test-token")
+
+	// 1. Trigger a deployment over 3 instances in batches of 2
+	deployResp := testUtils.TriggerDeployment(t, testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"env": "production"}))
+	assert.Equal(t, http.StatusCreated, deployResp.StatusCode)
+
+	deployments, _ := testUtils.GetAllDeployments(t)
+	if !assert.Equal(t, 1, deployments.Count) {
+		return
+	}
+	deploymentID := deployments.Deployments[0].ID
+
+	// Unknown deployments cannot be watched
+	resp := testUtils.MakeHTTPRequest(t, http.MethodGet, "/deploy/unknown/events", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// 2. Watch the deployment while it progresses to completion
+	stream := make(chan []deployment.Event, 1)
+	go func() {
+		stream <- readEvents(t, server.URL+"/deploy/"+deploymentID+"/events", "")
+	}()
+
+	for i := 0; i < 2; i++ {
+		for _, name := range getInflightInstances(testUtils.GetAllInstances(t), "v2.0.0") {
+			testUtils.UpdateInstance(t, name, testData.CreateHealthyUpdate("v2.0.0", "config-v2"))
+		}
+		testUtils.ProgressDeployment(t)
+	}
+
+	var events []deployment.Event
+	select {
+	case events = <-stream:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stream to end with the deployment")
+	}
+
+	var types []deployment.EventType
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []deployment.EventType{
+		deployment.EventStarted,
+		deployment.EventBatchStarted,
+		deployment.EventProgress,
+		deployment.EventInstanceCompleted,
+		deployment.EventInstanceCompleted,
+		deployment.EventBatchStarted,
+		deployment.EventProgress,
+		deployment.EventInstanceCompleted,
+		deployment.EventProgress,
+		deployment.EventCompleted,
+	}, types)
+	assert.Equal(t, 3, events[len(events)-1].Progress.CompletedInstances)
+
+	// 3. Resuming the stream only returns the events after the last one received
+	resumed := readEvents(t, server.URL+"/deploy/"+deploymentID+"/events", strconv.FormatInt(events[5].ID, 10))
+	assert.Equal(t, events[6:], resumed)
+}
+
+func TestController_Webhooks(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	testUtils.RegisterAllInstances(t, "test-token")
+
+	// The receiver rejects the deliveries until it is told to accept them
+	var accepting atomic.Bool
+	received := make(chan deployment.Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accepting.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event deployment.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer receiver.Close()
+
+	// 1. Subscribe to the start of the deployments
+	resp := testUtils.MakeHTTPRequest(t, http.MethodPost, "/webhooks/", webhook.SubscriptionRequest{URL: "ftp://example.com"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/webhooks/", webhook.SubscriptionRequest{
+		URL:    receiver.URL,
+		Events: []deployment.EventType{deployment.EventStarted},
+	})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var subscription webhook.Subscription
+	testUtils.DecodeResponse(t, resp, &subscription)
+	assert.NotEmpty(t, subscription.Secret)
+
+	// 2. The receiver is down, the delivery ends in the dead letters after its retries
+	deployResp := testUtils.TriggerDeployment(t, testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"env": "production"}))
+	assert.Equal(t, http.StatusCreated, deployResp.StatusCode)
+
+	var deliveries webhook.DeliveriesResponse
+	deadline := time.Now().Add(2 * time.Second)
+	for deliveries.Count == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		resp = testUtils.MakeHTTPRequest(t, http.MethodGet, "/webhooks/deliveries?status=failed", nil)
+		testUtils.DecodeResponse(t, resp, &deliveries)
+	}
+	if !assert.Equal(t, 1, deliveries.Count) {
+		return
+	}
+	deadLetter := deliveries.Deliveries[0]
+	assert.Equal(t, deployment.EventStarted, deadLetter.Event.Type)
+	assert.Equal(t, 3, deadLetter.Attempts)
+
+	// 3. Redeliver once the receiver is back
+	accepting.Store(true)
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/webhooks/deliveries/"+deadLetter.ID+"/redeliver", nil)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	select {
+	case event := <-received:
+		assert.Equal(t, deadLetter.Event, event)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the dead letter to be redelivered")
+	}
+
+	resp = testUtils.MakeHTTPRequest(t, http.MethodPost, "/webhooks/deliveries/unknown/redeliver", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = testUtils.MakeHTTPRequest(t, http.MethodGet, "/webhooks/deliveries?status=lost", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// 4. The listed subscription hides its secret, deleting it stops the deliveries
+	var subscriptions webhook.SubscriptionsResponse
+	testUtils.DecodeResponse(t, testUtils.MakeHTTPRequest(t, http.MethodGet, "/webhooks/", nil), &subscriptions)
+	if assert.Equal(t, 1, subscriptions.Count) {
+		assert.Empty(t, subscriptions.Subscriptions[0].Secret)
+	}
+	resp = testUtils.MakeHTTPRequest(t, http.MethodDelete, "/webhooks/"+subscription.ID, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = testUtils.MakeHTTPRequest(t, http.MethodDelete, "/webhooks/"+subscription.ID, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestController_Metrics(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	testUtils.RegisterAllInstances(t, "test-token")
+
+	deployResp := testUtils.TriggerDeployment(t, testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"env": "production"}))
+	assert.Equal(t, http.StatusCreated, deployResp.StatusCode)
+
+	resp := testUtils.MakeHTTPRequest(t, http.MethodGet, "/metrics", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	exposition := string(body)
+
+	assert.Contains(t, exposition, `dides_deployments{status="running"} 1`)
+	assert.Contains(t, exposition, `dides_deployments_started_total 1`)
+	assert.Contains(t, exposition, `dides_deployment_progress_instances{deployment_id="`)
+	assert.Contains(t, exposition, `dides_instances{status="unknown"} 4`)
+	assert.Contains(t, exposition, `dides_http_request_duration_seconds_count{code="201",method="POST",route="/deploy"} 1`)
+}
+
+func TestController_WatchDesiredState(t *testing.T) {
+	server := setupTestServer()
+	defer server.Close()
+
+	config, err := simulator.LoadConfigFromFile("../../testdata/simulator.config.yaml")
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	testUtils := simulator.NewTestUtilities(server, config)
+	testData := simulator.NewTestDataGenerator()
+	testUtils.RegisterAllInstances(t, "test-token")
+
+	// 1. Without a desired state change the watch times out
+	_, resp := testUtils.WatchDesiredState(t, "instance-1", 0, 10*time.Millisecond)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// 2. The watch returns as soon as a deployment updates the desired state of the instance
+	watched := make(chan *inventory.DesiredStateResponse, 1)
+	go func() {
+		response, _ := testUtils.WatchDesiredState(t, "instance-1", 0, 5*time.Second)
+		watched <- response
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	deployResp := testUtils.TriggerDeployment(t, testData.CreateDeploymentRequest("v2.0.0", "config-v2", map[string]string{"env": "production"}))
+	assert.Equal(t, http.StatusCreated, deployResp.StatusCode)
+
+	select {
+	case response := <-watched:
+		if assert.NotNil(t, response) {
+			assert.Equal(t, int64(1), response.Revision)
+			assert.Equal(t, "v2.0.0", response.DesiredState.CodeVersion)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the watch to return on the deployment")
+	}
+
+	// 3. An agent that is up to date with the revision waits again
+	_, resp = testUtils.WatchDesiredState(t, "instance-1", 1, 10*time.Millisecond)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	// 4. Watching requires the instance credential
+	resp, err = http.Get(server.URL + "/inventory/instances/" + testUtils.InstanceID("instance-1") + "/desired-state")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestController_GRPC(t *testing.T) {
+	setupTestRouter()
+
+	listener := bufconn.Listen(1 << 20)
+	server := setupGRPCServer(nil)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	inventoryClient := didesv1.NewInventoryServiceClient(conn)
+	deploymentClient := didesv1.NewDeploymentServiceClient(conn)
+
+	// 1. Register an instance with the join token
+	registered, err := inventoryClient.Register(ctx, &didesv1.RegisterRequest{
+		Ip:     "10.0.0.1",
+		Name:   "grpc-1",
+		Labels: map[string]string{"env": "production"},
+		Token:  "test-token",
+	})
+	if err != nil {
+		t.Fatalf("Failed to register: %v", err)
+	}
+	instanceID := registered.GetInstance().GetId()
+	assert.NotEmpty(t, registered.GetCredential())
+
+	_, err = inventoryClient.Register(ctx, &didesv1.RegisterRequest{Ip: "10.0.0.2", Name: "grpc-2", Token: "unknown"})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 2. Instance calls require the credential
+	_, err = inventoryClient.ReportState(ctx, &didesv1.ReportStateRequest{InstanceId: instanceID})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	instanceCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+registered.GetCredential())
+	healthy := didesv1.InstanceStatus_INSTANCE_STATUS_HEALTHY
+	reported, err := inventoryClient.ReportState(instanceCtx, &didesv1.ReportStateRequest{
+		InstanceId:   instanceID,
+		Status:       &healthy,
+		CurrentState: &didesv1.State{CodeVersion: "v1.0.0"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to report state: %v", err)
+	}
+	assert.Equal(t, healthy, reported.GetInstance().GetStatus())
+
+	// 3. The desired state watch receives the deployment
+	stream, err := inventoryClient.WatchDesiredState(instanceCtx, &didesv1.WatchDesiredStateRequest{InstanceId: instanceID})
+	if err != nil {
+		t.Fatalf("Failed to watch desired state: %v", err)
+	}
+
+	_, err = deploymentClient.TriggerDeployment(ctx, &didesv1.TriggerDeploymentRequest{Request: &didesv1.DeploymentRequest{
+		CodeVersion:   "v2.0.0",
+		Labels:        map[string]string{"env": "production"},
+		Configuration: &didesv1.DeploymentConfiguration{BatchSize: 1, FailureThreshold: 1},
+	}})
+	if err != nil {
+		t.Fatalf("Failed to trigger deployment: %v", err)
+	}
+
+	desired, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Failed to receive desired state: %v", err)
+	}
+	assert.Equal(t, int64(1), desired.GetRevision())
+	assert.Equal(t, "v2.0.0", desired.GetDesiredState().GetCodeVersion())
+
+	// 4. The deployment is running and a second one is rejected
+	deployments, err := deploymentClient.GetDeploymentStatus(ctx, &didesv1.GetDeploymentStatusRequest{})
+	if err != nil {
+		t.Fatalf("Failed to get deployment status: %v", err)
+	}
+	if assert.Len(t, deployments.GetDeployments(), 1) {
+		assert.Equal(t, didesv1.DeploymentStatus_DEPLOYMENT_STATUS_RUNNING, deployments.GetDeployments()[0].GetStatus())
+		assert.Equal(t, int32(1), deployments.GetDeployments()[0].GetProgress().GetInProgressInstances())
+	}
+
+	_, err = deploymentClient.TriggerDeployment(ctx, &didesv1.TriggerDeploymentRequest{Request: &didesv1.DeploymentRequest{
+		CodeVersion:   "v3.0.0",
+		Configuration: &didesv1.DeploymentConfiguration{BatchSize: 1, FailureThreshold: 1},
+	}})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// 5. Without a completed deployment there is nothing to roll back to
+	_, err = deploymentClient.Rollback(ctx, &didesv1.RollbackRequest{
+		Labels:        map[string]string{"env": "production"},
+		Configuration: &didesv1.DeploymentConfiguration{BatchSize: 1, FailureThreshold: 1},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// readEvents reads the Server-Sent Events of a deployment until the server ends the stream
+func readEvents(t *testing.T, target string, lastEventID string) []deployment.Event {
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Failed to watch deployment: %v", err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var events []deployment.Event
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var event deployment.Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Errorf("Failed to decode event %q: %v", data, err)
+			return events
+		}
+		events = append(events, event)
+	}
+	return events
 }
 
 func getInflightInstances(instances []*inventory.Instance, targetVersion string) []string {
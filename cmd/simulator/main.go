@@ -1,5 +1,199 @@
-package simulator
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/pkg/simulator"
+)
 
 func main() {
+	configFile := flag.String("config", "testdata/simulator.config.yaml", "simulator config with the instances to simulate")
+	controllerURL := flag.String("controller", "http://localhost:3000", "base URL of the controller REST API")
+	token := flag.String("token", "", "join token used by the agents to register, one is created with -api-key when empty")
+	apiKey := flag.String("api-key", "", "operator API key used to create the join token and progress the deployments")
+	heartbeatInterval := flag.Duration("heartbeat", simulator.DefaultHeartbeatInterval, "interval between two heartbeats of an agent")
+	applyDelay := flag.Duration("apply-delay", simulator.DefaultApplyDelay, "time an agent takes to apply a new desired state")
+	watchTimeout := flag.Duration("watch-timeout", simulator.DefaultWatchTimeout, "time a desired state watch waits before it is renewed")
+	seed := flag.Int64("seed", 0, "seed of the random failures, overrides the seed of the config when set")
+	progressInterval := flag.Duration("progress-interval", 0, "progress the active deployment at this interval, the deployments are progressed by hand when 0")
+	load := flag.Bool("load", false, "run a load test of the fleet instead of the agents and write its report")
+	workers := flag.Int("workers", simulator.DefaultLoadWorkers, "concurrent connections of the load test")
+	duration := flag.Duration("duration", simulator.DefaultLoadDuration, "time the load test heartbeats before the deployment, or in total without -deploy")
+	deploy := flag.String("deploy", "", "code_version/configuration_version rolled out by the load test, only the heartbeats are measured when empty")
+	deploySelector := flag.String("selector", "", "label selector of the load test deployment, every instance when empty")
+	batchSize := flag.Int("batch-size", 1000, "batch size of the load test deployment")
+	failureThreshold := flag.Int("failure-threshold", 1, "failure threshold of the load test deployment")
+	rolloutTimeout := flag.Duration("rollout-timeout", simulator.DefaultLoadTimeout, "longest the load test rollout may take")
+	reportFile := flag.String("report", "-", "file the load test report is written to, - for the standard output")
+	flag.Parse()
+
+	config, err := simulator.LoadConfigFromFile(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to load simulator config: %v", err)
+	}
+	if *seed != 0 {
+		config.Seed = *seed
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Without a token the simulator creates one that can register the whole fleet
+	if *token == "" {
+		*token, err = createJoinToken(ctx, *controllerURL, *apiKey, len(config.Instances))
+		if err != nil {
+			log.Fatalf("Failed to create a join token: %v", err)
+		}
+	}
+
+	if *load {
+		options := simulator.LoadOptions{
+			ControllerURL:     *controllerURL,
+			Token:             *token,
+			APIKey:            *apiKey,
+			Workers:           *workers,
+			HeartbeatInterval: *heartbeatInterval,
+			ProgressInterval:  *progressInterval,
+			Duration:          *duration,
+			Timeout:           *rolloutTimeout,
+		}
+		if *deploy != "" {
+			code, configuration, ok := strings.Cut(*deploy, "/")
+			if !ok {
+				log.Fatalf("Invalid -deploy %q, expected code_version/configuration_version", *deploy)
+			}
+			options.Deployment = &deployment.DeploymentRequest{
+				CodeVersion:          code,
+				ConfigurationVersion: configuration,
+				Selector:             *deploySelector,
+				Configuration: deployment.Configuration{
+					BatchSize:        *batchSize,
+					FailureThreshold: *failureThreshold,
+				},
+			}
+		}
+		runLoadTest(ctx, config, options, *reportFile)
+		return
+	}
+
+	if *progressInterval > 0 {
+		go progressDeployments(ctx, *controllerURL, *apiKey, *progressInterval)
+	}
+
+	fleet := simulator.NewFleet(config, simulator.AgentOptions{
+		ControllerURL:     *controllerURL,
+		Token:             *token,
+		HeartbeatInterval: *heartbeatInterval,
+		ApplyDelay:        *applyDelay,
+		WatchTimeout:      *watchTimeout,
+	})
+
+	log.Printf("Simulating %d instances against %s with seed %d", len(fleet.Agents), *controllerURL, config.Seed)
+	if err := fleet.Run(ctx); err != nil {
+		log.Fatalf("Some instances failed to register: %v", err)
+	}
+	log.Printf("Simulator stopped")
+}
+
+// runLoadTest runs the load test and writes its report, even when the rollout did not finish
+func runLoadTest(ctx context.Context, config *simulator.Config, options simulator.LoadOptions, reportFile string) {
+	log.Printf("Load testing %s with %d instances", options.ControllerURL, len(config.Instances))
+	report, runErr := simulator.NewLoadTest(config, options).Run(ctx)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to encode the load test report: %v", err)
+	}
+	data = append(data, '\n')
+	if reportFile == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = os.WriteFile(reportFile, data, 0o644)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write the load test report: %v", err)
+	}
+	if runErr != nil {
+		log.Fatalf("Load test failed: %v", runErr)
+	}
+}
+
+// createJoinToken creates a join token that can be used once per simulated instance
+func createJoinToken(ctx context.Context, controllerURL, apiKey string, instances int) (string, error) {
+	var token inventory.JoinToken
+	err := operatorRequest(ctx, controllerURL+"/inventory/tokens", apiKey, inventory.JoinTokenRequest{MaxUses: instances}, http.StatusCreated, &token)
+	return token.Token, err
+}
+
+// progressDeployments progresses the active deployment at every interval until the context is cancelled
+// Only the changes are logged, the controller answers the same way on every tick while no deployment runs
+func progressDeployments(ctx context.Context, controllerURL, apiKey string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var progress deployment.DeploymentProgressResponse
+		var message string
+		if err := operatorRequest(ctx, controllerURL+"/deploy/progress", apiKey, nil, http.StatusOK, &progress); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			message = fmt.Sprintf("Deployment not progressed: %v", err)
+		} else {
+			message = fmt.Sprintf("Deployment progressed: status %d, %+v", progress.Status, progress.Progress)
+		}
+		if message != last {
+			log.Print(message)
+			last = message
+		}
+	}
+}
+
+// operatorRequest posts the body with the operator API key and decodes the response into target
+func operatorRequest(ctx context.Context, target, apiKey string, body interface{}, expectedStatus int, response interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode != expectedStatus {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
 }
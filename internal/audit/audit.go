@@ -0,0 +1,263 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/xnok/dides/internal/auth"
+	"github.com/xnok/dides/internal/clock"
+)
+
+var (
+	ErrInvalidQuery = errors.New("invalid audit query")
+)
+
+// Action is the kind of mutation an entry records
+type Action string
+
+const (
+	DeploymentTrigger  Action = "deployment.trigger"
+	DeploymentProgress Action = "deployment.progress"
+	DeploymentCancel   Action = "deployment.cancel"
+	DeploymentRollback Action = "deployment.rollback"
+	InstanceUpdate     Action = "instance.update"
+	InstanceState      Action = "instance.state"
+	InstanceRegister   Action = "instance.register"
+	InstanceDeregister Action = "instance.deregister"
+	InstanceCordon     Action = "instance.cordon"
+	InstanceUncordon   Action = "instance.uncordon"
+	InstanceDrain      Action = "instance.drain"
+	CertificateRevoke  Action = "certificate.revoke"
+	JoinTokenCreate    Action = "token.create"
+	JoinTokenRevoke    Action = "token.revoke"
+)
+
+// Anonymous is the actor of the mutations made without an operator API key or an instance credential
+const Anonymous = "anonymous"
+
+// Change is the before and after value of a field, nested fields are dot separated
+type Change struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Entry is a mutation recorded in the audit log
+type Entry struct {
+	// Sequence number assigned by the store, entries are never updated nor deleted
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	RequestID string    `json:"request_id,omitempty"`
+	Action    Action    `json:"action"`
+	// Target is the deployment ID or the instance ID the action applies to
+	Target  string   `json:"target"`
+	Changes []Change `json:"changes"`
+}
+
+// Query filters the audit entries, empty fields match every entry
+type Query struct {
+	Actor     string
+	RequestID string
+	Action    Action
+	Target    string
+	Since     time.Time
+	Until     time.Time
+	// Limit keeps the most recent entries, 0 keeps them all
+	Limit int
+}
+
+// Validate checks the query bounds
+func (q Query) Validate() error {
+	if q.Limit < 0 {
+		return fmt.Errorf("%w: limit must be positive", ErrInvalidQuery)
+	}
+	if !q.Since.IsZero() && !q.Until.IsZero() && q.Until.Before(q.Since) {
+		return fmt.Errorf("%w: until is before since", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// Matches checks if the entry satisfies the query filters
+func (q Query) Matches(entry *Entry) bool {
+	if q.Actor != "" && entry.Actor != q.Actor {
+		return false
+	}
+	if q.RequestID != "" && entry.RequestID != q.RequestID {
+		return false
+	}
+	if q.Action != "" && entry.Action != q.Action {
+		return false
+	}
+	if q.Target != "" && entry.Target != q.Target {
+		return false
+	}
+	if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && entry.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Store persists the audit entries, it is append-only
+type Store interface {
+	// Append assigns the next ID to the entry and stores it
+	Append(entry *Entry) error
+	// List returns the entries matching the query, oldest first
+	List(query Query) ([]*Entry, error)
+}
+
+// QueryResponse represents the response of an audit query
+type QueryResponse struct {
+	Entries []*Entry `json:"entries"`
+	Count   int      `json:"count"`
+}
+
+// Log records the mutations made by the services with the actor and request behind them
+type Log struct {
+	store Store
+	clock clock.Clock
+}
+
+// NewLog creates an audit log backed by the store, the entries are timestamped with the wall clock when clk is nil
+func NewLog(store Store, clk clock.Clock) *Log {
+	return &Log{store: store, clock: clock.OrReal(clk)}
+}
+
+// Record appends an entry with the changes between before and after, nil before records a creation
+// Mutations that change nothing, like a heartbeat reporting the same state, are not recorded
+func (l *Log) Record(ctx context.Context, action Action, target string, before, after interface{}) error {
+	changes, err := Diff(before, after)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	return l.store.Append(&Entry{
+		Time:      l.clock.Now(),
+		Actor:     ActorFromContext(ctx),
+		RequestID: middleware.GetReqID(ctx),
+		Action:    action,
+		Target:    target,
+		Changes:   changes,
+	})
+}
+
+// Query returns the entries matching the query, it requires the admin role
+func (l *Log) Query(ctx context.Context, query Query) ([]*Entry, error) {
+	if err := auth.RequireRole(ctx, auth.Admin); err != nil {
+		return nil, err
+	}
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	return l.store.List(query)
+}
+
+// WriteJSONLines exports the entries as one JSON document per line
+func WriteJSONLines(w io.Writer, entries []*Entry) error {
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type actorKey struct{}
+
+// WithActor returns a context carrying the actor of the request, for callers that are not operators such as instances
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the operator behind the request, or else the actor set with WithActor
+func ActorFromContext(ctx context.Context) string {
+	if principal, ok := auth.PrincipalFromContext(ctx); ok {
+		return principal.Name
+	}
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return Anonymous
+}
+
+// Diff compares the JSON form of two values field by field, sorted by field
+func Diff(before, after interface{}) ([]Change, error) {
+	beforeFields, err := flatten(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := flatten(after)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for field, value := range afterFields {
+		previous, ok := beforeFields[field]
+		if !ok || !reflect.DeepEqual(previous, value) {
+			changes = append(changes, Change{Field: field, Before: previous, After: value})
+		}
+	}
+	for field, previous := range beforeFields {
+		if _, ok := afterFields[field]; !ok {
+			changes = append(changes, Change{Field: field, Before: previous})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+	return changes, nil
+}
+
+// flatten returns the leaf values of the JSON form of a value keyed by their dot separated path
+func flatten(value interface{}) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	if value == nil || (reflect.ValueOf(value).Kind() == reflect.Ptr && reflect.ValueOf(value).IsNil()) {
+		return fields, nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+
+	flattenInto(fields, "", decoded)
+	return fields, nil
+}
+
+func flattenInto(fields map[string]interface{}, prefix string, value interface{}) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		if value != nil {
+			fields[prefix] = value
+		}
+		return
+	}
+
+	for key, nested := range object {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		flattenInto(fields, key, nested)
+	}
+}
@@ -0,0 +1,139 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/xnok/dides/internal/auth"
+)
+
+type sliceStore struct {
+	entries []*Entry
+}
+
+func (s *sliceStore) Append(entry *Entry) error {
+	entry.ID = int64(len(s.entries) + 1)
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *sliceStore) List(query Query) ([]*Entry, error) {
+	var entries []*Entry
+	for _, entry := range s.entries {
+		if query.Matches(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+type record struct {
+	Status int               `json:"status"`
+	Labels map[string]string `json:"labels"`
+}
+
+func TestDiff(t *testing.T) {
+	before := &record{Status: 1, Labels: map[string]string{"env": "dev", "role": "web"}}
+	after := &record{Status: 2, Labels: map[string]string{"env": "prod", "zone": "a"}}
+
+	changes, err := Diff(before, after)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []Change{
+		{Field: "labels.env", Before: "dev", After: "prod"},
+		{Field: "labels.role", Before: "web"},
+		{Field: "labels.zone", After: "a"},
+		{Field: "status", Before: 1.0, After: 2.0},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %v", len(expected), changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Expected change %v, got %v", expected[i], changes[i])
+		}
+	}
+
+	// A creation lists every field
+	var created *record
+	changes, _ = Diff(created, before)
+	if len(changes) != 3 {
+		t.Errorf("Expected 3 changes for a creation, got %v", changes)
+	}
+}
+
+func TestLog_Record(t *testing.T) {
+	store := &sliceStore{}
+	log := NewLog(store, nil)
+
+	ctx := context.WithValue(context.Background(), middleware.RequestIDKey, "req-1")
+	ctx = auth.WithPrincipal(ctx, &auth.Principal{Name: "ops", Role: auth.Admin})
+
+	if err := log.Record(ctx, DeploymentTrigger, "1", nil, &record{Status: 1}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Nothing changed, nothing is recorded
+	if err := log.Record(ctx, DeploymentProgress, "1", &record{Status: 1}, &record{Status: 1}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	entries, err := log.Query(ctx, Query{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+	if entries[0].Actor != "ops" || entries[0].RequestID != "req-1" || entries[0].Target != "1" {
+		t.Errorf("Expected the entry of ops for request req-1 on 1, got %+v", entries[0])
+	}
+
+	// Only admins may read the audit log
+	viewer := auth.WithPrincipal(context.Background(), &auth.Principal{Name: "dashboard", Role: auth.Viewer})
+	if _, err := log.Query(viewer, Query{}); err == nil {
+		t.Error("Expected viewers not to read the audit log")
+	}
+
+	// Instances are recorded by the actor set in the context
+	if actor := ActorFromContext(WithActor(context.Background(), "instance/i-1")); actor != "instance/i-1" {
+		t.Errorf("Expected actor instance/i-1, got %s", actor)
+	}
+	if actor := ActorFromContext(context.Background()); actor != Anonymous {
+		t.Errorf("Expected anonymous actor, got %s", actor)
+	}
+}
+
+func TestWriteJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	entries := []*Entry{
+		{ID: 1, Actor: "ops", Action: DeploymentTrigger, Target: "1"},
+		{ID: 2, Actor: "instance/i-1", Action: InstanceUpdate, Target: "i-1"},
+	}
+
+	if err := WriteJSONLines(&buf, entries); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	var lines int
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Expected each line to be an entry, got %q: %v", scanner.Text(), err)
+		}
+		lines++
+		if entry.ID != int64(lines) {
+			t.Errorf("Expected entry %d, got %d", lines, entry.ID)
+		}
+	}
+	if lines != 2 {
+		t.Errorf("Expected 2 lines, got %d", lines)
+	}
+}
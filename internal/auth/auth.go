@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/xnok/dides/internal/selector"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrUnauthenticated = errors.New("missing or invalid API key")
+	ErrForbidden       = errors.New("operation not allowed")
+	ErrInvalidAPIKey   = errors.New("invalid API key configuration")
+)
+
+// Role grants access to the operator API, each role includes the permissions of the previous ones
+type Role string
+
+const (
+	// Viewer can read deployments and plan them
+	Viewer Role = "viewer"
+	// Deployer can trigger, progress and roll back deployments
+	Deployer Role = "deployer"
+	// Admin can also manage the inventory: join tokens, instance lifecycle and certificates
+	Admin Role = "admin"
+)
+
+// level orders the roles, unknown roles have no permission
+func (r Role) level() int {
+	switch r {
+	case Viewer:
+		return 1
+	case Deployer:
+		return 2
+	case Admin:
+		return 3
+	}
+	return 0
+}
+
+// Includes checks if the role has at least the permissions of the other role
+func (r Role) Includes(other Role) bool {
+	return r.level() > 0 && r.level() >= other.level()
+}
+
+// Principal is the operator behind a request
+type Principal struct {
+	Name string
+	Role Role
+	// Scope restricts the instances the operator may deploy to, empty allows every instance
+	Scope selector.Selector
+}
+
+// CanTarget checks if every instance matched by the selector is within the scope of the principal
+func (p *Principal) CanTarget(sel selector.Selector) bool {
+	return sel.Implies(p.Scope)
+}
+
+// Authorize checks the principal has the role and may target the instances matched by the selector
+func (p *Principal) Authorize(role Role, sel selector.Selector) error {
+	if !p.Role.Includes(role) {
+		return fmt.Errorf("%w: %s requires the %s role", ErrForbidden, p.Name, role)
+	}
+	if !p.CanTarget(sel) {
+		return fmt.Errorf("%w: %s may only target %s", ErrForbidden, p.Name, p.Scope.String())
+	}
+	return nil
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal of the request, if the operator API authentication is enabled
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+// Authorize checks the principal of the context, if any, has the role and may target the selector
+// Requests without principal come from the controller itself or from a controller without authentication
+func Authorize(ctx context.Context, role Role, sel selector.Selector) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return principal.Authorize(role, sel)
+}
+
+// RequireRole checks the principal of the context, if any, has the role, whatever its scope
+func RequireRole(ctx context.Context, role Role) error {
+	principal, ok := PrincipalFromContext(ctx)
+	if !ok || principal.Role.Includes(role) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s requires the %s role", ErrForbidden, principal.Name, role)
+}
+
+// APIKey is an operator API key as configured in the API keys file
+type APIKey struct {
+	Name     string `yaml:"name"`
+	Key      string `yaml:"key"`
+	Role     Role   `yaml:"role"`
+	Selector string `yaml:"selector,omitempty"`
+}
+
+// Config is the content of the API keys file
+type Config struct {
+	APIKeys []APIKey `yaml:"api_keys"`
+}
+
+// LoadConfigFromFile loads the API keys from a YAML file
+func LoadConfigFromFile(filePath string) (*Config, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys file: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys file: %w", err)
+	}
+
+	return &config, nil
+}
+
+// Authenticator resolves API keys to principals
+type Authenticator struct {
+	// principals by hash of the API key
+	principals map[string]*Principal
+}
+
+// NewAuthenticator creates an authenticator accepting the given API keys
+func NewAuthenticator(keys []APIKey) (*Authenticator, error) {
+	principals := make(map[string]*Principal, len(keys))
+	for _, key := range keys {
+		if key.Name == "" || key.Key == "" || key.Role.level() == 0 {
+			return nil, fmt.Errorf("%w: %q needs a name, a key and a viewer, deployer or admin role", ErrInvalidAPIKey, key.Name)
+		}
+
+		scope, err := selector.Parse(key.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrInvalidAPIKey, key.Name, err)
+		}
+
+		principals[hashKey(key.Key)] = &Principal{Name: key.Name, Role: key.Role, Scope: scope}
+	}
+
+	return &Authenticator{principals: principals}, nil
+}
+
+// Authenticate returns the principal owning the API key
+func (a *Authenticator) Authenticate(key string) (*Principal, error) {
+	if key == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	principal, ok := a.principals[hashKey(key)]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return principal, nil
+}
+
+// hashKey returns the form API keys are looked up by, so they are not kept in clear
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/xnok/dides/internal/selector"
+)
+
+func TestRole_Includes(t *testing.T) {
+	tests := []struct {
+		role, other Role
+		includes    bool
+	}{
+		{Admin, Deployer, true},
+		{Admin, Viewer, true},
+		{Deployer, Deployer, true},
+		{Deployer, Admin, false},
+		{Viewer, Deployer, false},
+		{Role("root"), Viewer, false},
+	}
+
+	for _, tt := range tests {
+		if tt.role.Includes(tt.other) != tt.includes {
+			t.Errorf("Expected %s includes %s to be %v", tt.role, tt.other, tt.includes)
+		}
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	authenticator, err := NewAuthenticator([]APIKey{
+		{Name: "ops", Key: "ops-key", Role: Admin},
+		{Name: "web-team", Key: "web-key", Role: Deployer, Selector: "role=web"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	principal, err := authenticator.Authenticate("web-key")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if principal.Name != "web-team" || principal.Scope.String() != "role=web" {
+		t.Errorf("Expected web-team scoped to role=web, got %+v", principal)
+	}
+
+	for _, key := range []string{"", "unknown"} {
+		if _, err := authenticator.Authenticate(key); err != ErrUnauthenticated {
+			t.Errorf("Expected ErrUnauthenticated for %q, got %v", key, err)
+		}
+	}
+
+	// Keys need a known role and a valid selector
+	for _, key := range []APIKey{
+		{Name: "bad-role", Key: "key", Role: Role("root")},
+		{Name: "bad-selector", Key: "key", Role: Viewer, Selector: "role in (web"},
+	} {
+		if _, err := NewAuthenticator([]APIKey{key}); !errors.Is(err, ErrInvalidAPIKey) {
+			t.Errorf("Expected ErrInvalidAPIKey for %s, got %v", key.Name, err)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	web := selector.FromLabels(map[string]string{"role": "web"})
+	webProd := selector.FromLabels(map[string]string{"role": "web", "env": "prod"})
+	db := selector.FromLabels(map[string]string{"role": "db"})
+
+	ctx := WithPrincipal(context.Background(), &Principal{Name: "web-team", Role: Deployer, Scope: web})
+
+	if err := Authorize(ctx, Deployer, webProd); err != nil {
+		t.Errorf("Expected deploying to a subset of the scope to be allowed, got %v", err)
+	}
+	if err := Authorize(ctx, Deployer, db); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected deploying outside the scope to be forbidden, got %v", err)
+	}
+	if err := Authorize(ctx, Deployer, nil); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected deploying to every instance to be forbidden, got %v", err)
+	}
+	if err := Authorize(ctx, Admin, webProd); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Expected admin operations to be forbidden, got %v", err)
+	}
+
+	// Without principal, the operator API authentication is disabled
+	if err := Authorize(context.Background(), Admin, nil); err != nil {
+		t.Errorf("Expected no error without principal, got %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package clock
+
+import "time"
+
+// Clock tells the current time and waits for durations to elapse
+// The services and stores take their timestamps and delays from a clock so the tests and the simulator can control the time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the wall clock
+type Real struct{}
+
+// Now returns the current local time
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for the duration to elapse on the wall clock
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// OrReal returns the clock, or the wall clock when it is nil
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real{}
+	}
+	return c
+}
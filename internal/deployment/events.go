@@ -0,0 +1,89 @@
+package deployment
+
+import (
+	"context"
+	"time"
+
+	"github.com/xnok/dides/internal/transaction"
+)
+
+//go:generate mockgen -source=events.go -destination=mocks/mock_events.go -package=mocks
+
+// EventType is the kind of change streamed to the clients watching a deployment
+type EventType string
+
+const (
+	// EventStarted is the first event of a deployment, sent before its first batch starts
+	EventStarted EventType = "started"
+	// EventProgress is sent when the progress counters of the deployment change
+	EventProgress EventType = "progress"
+	// EventBatchStarted is sent when the desired state of a batch of instances is updated
+	EventBatchStarted EventType = "batch_started"
+	// EventInstanceCompleted is sent when an instance of the deployment reaches its target state
+	EventInstanceCompleted EventType = "instance_completed"
+	// EventInstanceFailed is sent when an instance of the deployment fails to reach its target state
+	EventInstanceFailed EventType = "instance_failed"
+	// EventRollback is sent when the failure threshold is exceeded and a rollback deployment starts
+	EventRollback EventType = "rollback"
+	// EventCompleted is the last event of a completed deployment
+	EventCompleted EventType = "completed"
+	// EventFailed is the last event of a failed or cancelled deployment
+	EventFailed EventType = "failed"
+)
+
+// Event is a change of a deployment
+type Event struct {
+	// ID is assigned by the event bus, clients resume the stream after the last ID they received
+	ID           int64              `json:"id"`
+	DeploymentID string             `json:"deployment_id"`
+	Type         EventType          `json:"type"`
+	Time         time.Time          `json:"time"`
+	Status       DeploymentStatus   `json:"status"`
+	Progress     DeploymentProgress `json:"progress"`
+	// Instances started by a batch, or the instance that completed or failed
+	Instances []string `json:"instances,omitempty"`
+	// RollbackID is the deployment rolling back the failed deployment
+	RollbackID string `json:"rollback_id,omitempty"`
+}
+
+// Final checks if the event is the last one of the deployment
+func (e Event) Final() bool {
+	return e.Type == EventCompleted || e.Type == EventFailed
+}
+
+// newEvent returns an event with the current status and progress of the deployment
+// Its time is set by the event bus when it is published
+func newEvent(record *DeploymentRecord, eventType EventType) Event {
+	return Event{
+		DeploymentID: record.ID,
+		Type:         eventType,
+		Status:       record.Status,
+		Progress:     record.Progress,
+	}
+}
+
+// Publisher publishes the changes of the deployments
+type Publisher interface {
+	Publish(event Event)
+}
+
+// EventBus delivers the published events to the clients watching a deployment
+type EventBus interface {
+	Publisher
+	// Subscribe returns the events of the deployment published after lastEventID, then the ones published from now on
+	// The channel is closed when the subscriber falls behind, it can subscribe again from the last event it received
+	Subscribe(deploymentID string, lastEventID int64) ([]Event, <-chan Event, func())
+}
+
+// publishAfterCommit publishes the events once the unit of work of the context is committed, right away when there is none
+// Events of writes that are rolled back are never published
+func publishAfterCommit(ctx context.Context, publisher Publisher, events ...Event) {
+	if publisher == nil || len(events) == 0 {
+		return
+	}
+	transaction.AfterCommit(ctx, func() {
+		for _, event := range events {
+			publisher.Publish(event)
+		}
+	})
+}
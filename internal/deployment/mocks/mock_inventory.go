@@ -10,6 +10,7 @@ import (
 
 	gomock "github.com/golang/mock/gomock"
 	inventory "github.com/xnok/dides/internal/inventory"
+	selector "github.com/xnok/dides/internal/selector"
 )
 
 // MockInventoryService is a mock of InventoryService interface.
@@ -36,134 +37,104 @@ func (m *MockInventoryService) EXPECT() *MockInventoryServiceMockRecorder {
 }
 
 // CountByLabels mocks base method.
-func (m *MockInventoryService) CountByLabels(ctx context.Context, labels map[string]string) (int, error) {
+func (m *MockInventoryService) CountByLabels(ctx context.Context, sel selector.Selector) (int, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CountByLabels", ctx, labels)
+	ret := m.ctrl.Call(m, "CountByLabels", ctx, sel)
 	ret0, _ := ret[0].(int)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // CountByLabels indicates an expected call of CountByLabels.
-func (mr *MockInventoryServiceMockRecorder) CountByLabels(ctx, labels interface{}) *gomock.Call {
+func (mr *MockInventoryServiceMockRecorder) CountByLabels(ctx, sel interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountByLabels", reflect.TypeOf((*MockInventoryService)(nil).CountByLabels), ctx, labels)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountByLabels", reflect.TypeOf((*MockInventoryService)(nil).CountByLabels), ctx, sel)
 }
 
-// CountCompleted mocks base method.
-func (m *MockInventoryService) CountCompleted(ctx context.Context, labels map[string]string, desiredState inventory.State) (int, error) {
+// CountProgress mocks base method.
+func (m *MockInventoryService) CountProgress(ctx context.Context, sel selector.Selector, desiredState inventory.State, targets map[string]inventory.State) (inventory.Progress, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CountCompleted", ctx, labels, desiredState)
-	ret0, _ := ret[0].(int)
+	ret := m.ctrl.Call(m, "CountProgress", ctx, sel, desiredState, targets)
+	ret0, _ := ret[0].(inventory.Progress)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CountCompleted indicates an expected call of CountCompleted.
-func (mr *MockInventoryServiceMockRecorder) CountCompleted(ctx, labels, desiredState interface{}) *gomock.Call {
+// CountProgress indicates an expected call of CountProgress.
+func (mr *MockInventoryServiceMockRecorder) CountProgress(ctx, sel, desiredState, targets interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountCompleted", reflect.TypeOf((*MockInventoryService)(nil).CountCompleted), ctx, labels, desiredState)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountProgress", reflect.TypeOf((*MockInventoryService)(nil).CountProgress), ctx, sel, desiredState, targets)
 }
 
-// CountFailed mocks base method.
-func (m *MockInventoryService) CountFailed(ctx context.Context, labels map[string]string, desiredState inventory.State) (int, error) {
+// GetInstances mocks base method.
+func (m *MockInventoryService) GetInstances(ctx context.Context, keys []string) ([]*inventory.Instance, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CountFailed", ctx, labels, desiredState)
-	ret0, _ := ret[0].(int)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// CountFailed indicates an expected call of CountFailed.
-func (mr *MockInventoryServiceMockRecorder) CountFailed(ctx, labels, desiredState interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountFailed", reflect.TypeOf((*MockInventoryService)(nil).CountFailed), ctx, labels, desiredState)
-}
-
-// CountInProgress mocks base method.
-func (m *MockInventoryService) CountInProgress(ctx context.Context, labels map[string]string, desiredState inventory.State) (int, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CountInProgress", ctx, labels, desiredState)
-	ret0, _ := ret[0].(int)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// CountInProgress indicates an expected call of CountInProgress.
-func (mr *MockInventoryServiceMockRecorder) CountInProgress(ctx, labels, desiredState interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountInProgress", reflect.TypeOf((*MockInventoryService)(nil).CountInProgress), ctx, labels, desiredState)
-}
-
-// CountNeedingUpdate mocks base method.
-func (m *MockInventoryService) CountNeedingUpdate(ctx context.Context, labels map[string]string, desiredState inventory.State) (int, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "CountNeedingUpdate", ctx, labels, desiredState)
-	ret0, _ := ret[0].(int)
+	ret := m.ctrl.Call(m, "GetInstances", ctx, keys)
+	ret0, _ := ret[0].([]*inventory.Instance)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// CountNeedingUpdate indicates an expected call of CountNeedingUpdate.
-func (mr *MockInventoryServiceMockRecorder) CountNeedingUpdate(ctx, labels, desiredState interface{}) *gomock.Call {
+// GetInstances indicates an expected call of GetInstances.
+func (mr *MockInventoryServiceMockRecorder) GetInstances(ctx, keys interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CountNeedingUpdate", reflect.TypeOf((*MockInventoryService)(nil).CountNeedingUpdate), ctx, labels, desiredState)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInstances", reflect.TypeOf((*MockInventoryService)(nil).GetInstances), ctx, keys)
 }
 
 // GetInstancesByLabels mocks base method.
-func (m *MockInventoryService) GetInstancesByLabels(ctx context.Context, labels map[string]string) ([]*inventory.Instance, error) {
+func (m *MockInventoryService) GetInstancesByLabels(ctx context.Context, sel selector.Selector) ([]*inventory.Instance, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetInstancesByLabels", ctx, labels)
+	ret := m.ctrl.Call(m, "GetInstancesByLabels", ctx, sel)
 	ret0, _ := ret[0].([]*inventory.Instance)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetInstancesByLabels indicates an expected call of GetInstancesByLabels.
-func (mr *MockInventoryServiceMockRecorder) GetInstancesByLabels(ctx, labels interface{}) *gomock.Call {
+func (mr *MockInventoryServiceMockRecorder) GetInstancesByLabels(ctx, sel interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInstancesByLabels", reflect.TypeOf((*MockInventoryService)(nil).GetInstancesByLabels), ctx, labels)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetInstancesByLabels", reflect.TypeOf((*MockInventoryService)(nil).GetInstancesByLabels), ctx, sel)
 }
 
 // GetNeedingUpdate mocks base method.
-func (m *MockInventoryService) GetNeedingUpdate(ctx context.Context, labels map[string]string, desiredState inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
+func (m *MockInventoryService) GetNeedingUpdate(ctx context.Context, sel selector.Selector, desiredState inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetNeedingUpdate", ctx, labels, desiredState, opts)
+	ret := m.ctrl.Call(m, "GetNeedingUpdate", ctx, sel, desiredState, opts)
 	ret0, _ := ret[0].([]*inventory.Instance)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetNeedingUpdate indicates an expected call of GetNeedingUpdate.
-func (mr *MockInventoryServiceMockRecorder) GetNeedingUpdate(ctx, labels, desiredState, opts interface{}) *gomock.Call {
+func (mr *MockInventoryServiceMockRecorder) GetNeedingUpdate(ctx, sel, desiredState, opts interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNeedingUpdate", reflect.TypeOf((*MockInventoryService)(nil).GetNeedingUpdate), ctx, labels, desiredState, opts)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetNeedingUpdate", reflect.TypeOf((*MockInventoryService)(nil).GetNeedingUpdate), ctx, sel, desiredState, opts)
 }
 
 // ResetFailedInstances mocks base method.
-func (m *MockInventoryService) ResetFailedInstances(ctx context.Context, labels map[string]string) error {
+func (m *MockInventoryService) ResetFailedInstances(ctx context.Context, sel selector.Selector) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "ResetFailedInstances", ctx, labels)
+	ret := m.ctrl.Call(m, "ResetFailedInstances", ctx, sel)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // ResetFailedInstances indicates an expected call of ResetFailedInstances.
-func (mr *MockInventoryServiceMockRecorder) ResetFailedInstances(ctx, labels interface{}) *gomock.Call {
+func (mr *MockInventoryServiceMockRecorder) ResetFailedInstances(ctx, sel interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetFailedInstances", reflect.TypeOf((*MockInventoryService)(nil).ResetFailedInstances), ctx, labels)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetFailedInstances", reflect.TypeOf((*MockInventoryService)(nil).ResetFailedInstances), ctx, sel)
 }
 
-// UpdateDesiredState mocks base method.
-func (m *MockInventoryService) UpdateDesiredState(ctx context.Context, instanceKey string, state inventory.State) error {
+// UpdateDesiredStates mocks base method.
+func (m *MockInventoryService) UpdateDesiredStates(ctx context.Context, states map[string]inventory.State, revisions map[string]int64) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateDesiredState", ctx, instanceKey, state)
+	ret := m.ctrl.Call(m, "UpdateDesiredStates", ctx, states, revisions)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// UpdateDesiredState indicates an expected call of UpdateDesiredState.
-func (mr *MockInventoryServiceMockRecorder) UpdateDesiredState(ctx, instanceKey, state interface{}) *gomock.Call {
+// UpdateDesiredStates indicates an expected call of UpdateDesiredStates.
+func (mr *MockInventoryServiceMockRecorder) UpdateDesiredStates(ctx, states, revisions interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDesiredState", reflect.TypeOf((*MockInventoryService)(nil).UpdateDesiredState), ctx, instanceKey, state)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateDesiredStates", reflect.TypeOf((*MockInventoryService)(nil).UpdateDesiredStates), ctx, states, revisions)
 }
@@ -9,7 +9,9 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	audit "github.com/xnok/dides/internal/audit"
 	deployment "github.com/xnok/dides/internal/deployment"
+	selector "github.com/xnok/dides/internal/selector"
 )
 
 // MockStore is a mock of Store interface.
@@ -35,62 +37,92 @@ func (m *MockStore) EXPECT() *MockStoreMockRecorder {
 	return m.recorder
 }
 
+// GetByID mocks base method.
+func (m *MockStore) GetByID(ctx context.Context, id string) (*deployment.DeploymentRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetByID", ctx, id)
+	ret0, _ := ret[0].(*deployment.DeploymentRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetByID indicates an expected call of GetByID.
+func (mr *MockStoreMockRecorder) GetByID(ctx, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByID", reflect.TypeOf((*MockStore)(nil).GetByID), ctx, id)
+}
+
 // GetByLabelsAndStatus mocks base method.
-func (m *MockStore) GetByLabelsAndStatus(labels map[string]string, status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
+func (m *MockStore) GetByLabelsAndStatus(ctx context.Context, sel selector.Selector, status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetByLabelsAndStatus", labels, status)
+	ret := m.ctrl.Call(m, "GetByLabelsAndStatus", ctx, sel, status)
 	ret0, _ := ret[0].([]*deployment.DeploymentRecord)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetByLabelsAndStatus indicates an expected call of GetByLabelsAndStatus.
-func (mr *MockStoreMockRecorder) GetByLabelsAndStatus(labels, status interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) GetByLabelsAndStatus(ctx, sel, status interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByLabelsAndStatus", reflect.TypeOf((*MockStore)(nil).GetByLabelsAndStatus), labels, status)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByLabelsAndStatus", reflect.TypeOf((*MockStore)(nil).GetByLabelsAndStatus), ctx, sel, status)
 }
 
 // GetByStatus mocks base method.
-func (m *MockStore) GetByStatus(status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
+func (m *MockStore) GetByStatus(ctx context.Context, status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetByStatus", status)
+	ret := m.ctrl.Call(m, "GetByStatus", ctx, status)
 	ret0, _ := ret[0].([]*deployment.DeploymentRecord)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetByStatus indicates an expected call of GetByStatus.
-func (mr *MockStoreMockRecorder) GetByStatus(status interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) GetByStatus(ctx, status interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByStatus", reflect.TypeOf((*MockStore)(nil).GetByStatus), status)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByStatus", reflect.TypeOf((*MockStore)(nil).GetByStatus), ctx, status)
+}
+
+// GetOverlappingByStatus mocks base method.
+func (m *MockStore) GetOverlappingByStatus(ctx context.Context, sel selector.Selector, status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOverlappingByStatus", ctx, sel, status)
+	ret0, _ := ret[0].([]*deployment.DeploymentRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOverlappingByStatus indicates an expected call of GetOverlappingByStatus.
+func (mr *MockStoreMockRecorder) GetOverlappingByStatus(ctx, sel, status interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOverlappingByStatus", reflect.TypeOf((*MockStore)(nil).GetOverlappingByStatus), ctx, sel, status)
 }
 
 // Save mocks base method.
-func (m *MockStore) Save(req *deployment.DeploymentRecord) error {
+func (m *MockStore) Save(ctx context.Context, req *deployment.DeploymentRecord) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Save", req)
+	ret := m.ctrl.Call(m, "Save", ctx, req)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Save indicates an expected call of Save.
-func (mr *MockStoreMockRecorder) Save(req interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) Save(ctx, req interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockStore)(nil).Save), req)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockStore)(nil).Save), ctx, req)
 }
 
 // Update mocks base method.
-func (m *MockStore) Update(record *deployment.DeploymentRecord) error {
+func (m *MockStore) Update(ctx context.Context, record *deployment.DeploymentRecord) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Update", record)
+	ret := m.ctrl.Call(m, "Update", ctx, record)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Update indicates an expected call of Update.
-func (mr *MockStoreMockRecorder) Update(record interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) Update(ctx, record interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockStore)(nil).Update), record)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockStore)(nil).Update), ctx, record)
 }
 
 // MockLocker is a mock of Locker interface.
@@ -143,3 +175,77 @@ func (mr *MockLockerMockRecorder) Unlock(ctx, key interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unlock", reflect.TypeOf((*MockLocker)(nil).Unlock), ctx, key)
 }
+
+// MockUnitOfWork is a mock of UnitOfWork interface.
+type MockUnitOfWork struct {
+	ctrl     *gomock.Controller
+	recorder *MockUnitOfWorkMockRecorder
+}
+
+// MockUnitOfWorkMockRecorder is the mock recorder for MockUnitOfWork.
+type MockUnitOfWorkMockRecorder struct {
+	mock *MockUnitOfWork
+}
+
+// NewMockUnitOfWork creates a new mock instance.
+func NewMockUnitOfWork(ctrl *gomock.Controller) *MockUnitOfWork {
+	mock := &MockUnitOfWork{ctrl: ctrl}
+	mock.recorder = &MockUnitOfWorkMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockUnitOfWork) EXPECT() *MockUnitOfWorkMockRecorder {
+	return m.recorder
+}
+
+// Do mocks base method.
+func (m *MockUnitOfWork) Do(ctx context.Context, fn func(context.Context) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Do", ctx, fn)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Do indicates an expected call of Do.
+func (mr *MockUnitOfWorkMockRecorder) Do(ctx, fn interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Do", reflect.TypeOf((*MockUnitOfWork)(nil).Do), ctx, fn)
+}
+
+// MockAuditLog is a mock of AuditLog interface.
+type MockAuditLog struct {
+	ctrl     *gomock.Controller
+	recorder *MockAuditLogMockRecorder
+}
+
+// MockAuditLogMockRecorder is the mock recorder for MockAuditLog.
+type MockAuditLogMockRecorder struct {
+	mock *MockAuditLog
+}
+
+// NewMockAuditLog creates a new mock instance.
+func NewMockAuditLog(ctrl *gomock.Controller) *MockAuditLog {
+	mock := &MockAuditLog{ctrl: ctrl}
+	mock.recorder = &MockAuditLogMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAuditLog) EXPECT() *MockAuditLogMockRecorder {
+	return m.recorder
+}
+
+// Record mocks base method.
+func (m *MockAuditLog) Record(ctx context.Context, action audit.Action, target string, before, after interface{}) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Record", ctx, action, target, before, after)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Record indicates an expected call of Record.
+func (mr *MockAuditLogMockRecorder) Record(ctx, action, target, before, after interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Record", reflect.TypeOf((*MockAuditLog)(nil).Record), ctx, action, target, before, after)
+}
@@ -10,6 +10,8 @@ import (
 
 	gomock "github.com/golang/mock/gomock"
 	deployment "github.com/xnok/dides/internal/deployment"
+	inventory "github.com/xnok/dides/internal/inventory"
+	selector "github.com/xnok/dides/internal/selector"
 )
 
 // MockDeploymentStrategy is a mock of DeploymentStrategy interface.
@@ -35,6 +37,21 @@ func (m *MockDeploymentStrategy) EXPECT() *MockDeploymentStrategyMockRecorder {
 	return m.recorder
 }
 
+// PlanDeployment mocks base method.
+func (m *MockDeploymentStrategy) PlanDeployment(ctx context.Context, req *deployment.DeploymentRequest) (*deployment.DeploymentPlan, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PlanDeployment", ctx, req)
+	ret0, _ := ret[0].(*deployment.DeploymentPlan)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PlanDeployment indicates an expected call of PlanDeployment.
+func (mr *MockDeploymentStrategyMockRecorder) PlanDeployment(ctx, req interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PlanDeployment", reflect.TypeOf((*MockDeploymentStrategy)(nil).PlanDeployment), ctx, req)
+}
+
 // ProgressDeployment mocks base method.
 func (m *MockDeploymentStrategy) ProgressDeployment(ctx context.Context, record *deployment.DeploymentRecord) (*deployment.DeploymentRecord, error) {
 	m.ctrl.T.Helper()
@@ -51,17 +68,32 @@ func (mr *MockDeploymentStrategyMockRecorder) ProgressDeployment(ctx, record int
 }
 
 // ResetFailedInstances mocks base method.
-func (m *MockDeploymentStrategy) ResetFailedInstances(ctx context.Context, labels map[string]string) error {
+func (m *MockDeploymentStrategy) ResetFailedInstances(ctx context.Context, sel selector.Selector) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "ResetFailedInstances", ctx, labels)
+	ret := m.ctrl.Call(m, "ResetFailedInstances", ctx, sel)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // ResetFailedInstances indicates an expected call of ResetFailedInstances.
-func (mr *MockDeploymentStrategyMockRecorder) ResetFailedInstances(ctx, labels interface{}) *gomock.Call {
+func (mr *MockDeploymentStrategyMockRecorder) ResetFailedInstances(ctx, sel interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetFailedInstances", reflect.TypeOf((*MockDeploymentStrategy)(nil).ResetFailedInstances), ctx, sel)
+}
+
+// ResolvePreviousStates mocks base method.
+func (m *MockDeploymentStrategy) ResolvePreviousStates(ctx context.Context, sel selector.Selector, from inventory.State) (map[string]inventory.State, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolvePreviousStates", ctx, sel, from)
+	ret0, _ := ret[0].(map[string]inventory.State)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ResolvePreviousStates indicates an expected call of ResolvePreviousStates.
+func (mr *MockDeploymentStrategyMockRecorder) ResolvePreviousStates(ctx, sel, from interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResetFailedInstances", reflect.TypeOf((*MockDeploymentStrategy)(nil).ResetFailedInstances), ctx, labels)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolvePreviousStates", reflect.TypeOf((*MockDeploymentStrategy)(nil).ResolvePreviousStates), ctx, sel, from)
 }
 
 // StartDeployment mocks base method.
@@ -1,6 +1,11 @@
 package deployment
 
-import "time"
+import (
+	"time"
+
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+)
 
 type DeploymentStatus int
 
@@ -11,6 +16,16 @@ const (
 	Failed
 )
 
+// RollbackMode selects how a rollback decides which state to restore
+type RollbackMode string
+
+const (
+	// RollbackToLastCompleted restores the version of the last Completed deployment on every instance matching the labels
+	RollbackToLastCompleted RollbackMode = ""
+	// RollbackPerInstance restores each instance touched by the last deployment to its own PreviousState
+	RollbackPerInstance RollbackMode = "per_instance"
+)
+
 // DeploymentRequest represents a request to deploy a new version to set of instance
 type DeploymentRequest struct {
 	CodeVersion          string `json:"code_version"`
@@ -18,15 +33,25 @@ type DeploymentRequest struct {
 
 	// Labels to filter deployments
 	Labels map[string]string `json:"labels"`
+	// Selector to filter deployments with set-based and negative matching, e.g. "env=prod,zone in (a,b),!canary"
+	// It is combined with Labels, instances must satisfy both
+	Selector string `json:"selector,omitempty"`
 	// Configuration for deployment
 	Configuration Configuration `json:"configuration"`
 }
 
+// LabelSelector returns the selector combining the request Labels and Selector
+func (r DeploymentRequest) LabelSelector() (selector.Selector, error) {
+	return selector.Build(r.Labels, r.Selector)
+}
+
 type Configuration struct {
 	// BatchSize indicate how many updates run concurrently across nodes, but the batch size must be respected
 	BatchSize int `json:"batch_size"`
 	// FailureThreshold Abort the rollout if failures exceed a limit (either total or percentage)
 	FailureThreshold int `json:"failure_threshold"`
+	// RollbackMode selects how manual and automatic rollbacks restore instances
+	RollbackMode RollbackMode `json:"rollback_mode,omitempty"`
 }
 
 // DeploymentRecord represents an record for the deployment history
@@ -37,6 +62,10 @@ type DeploymentRecord struct {
 	CreatedAt time.Time         `json:"created_at"`
 	// Progress tracking for rolling deployments
 	Progress DeploymentProgress `json:"progress"`
+	// Targets holds a target state per instance key, it replaces the request versions for per-instance rollbacks
+	Targets map[string]inventory.State `json:"targets,omitempty"`
+	// Revision is incremented by the store on every write, an update of an older revision fails with ErrDeploymentConflict
+	Revision int64 `json:"revision"`
 }
 
 // DeploymentProgress tracks the progress of a deployment
@@ -49,6 +78,8 @@ type DeploymentProgress struct {
 	CompletedInstances int `json:"completed_instances"`
 	// Number of instances that failed to update
 	FailedInstances int `json:"failed_instances"`
+	// Number of instances that did not send a heartbeat recently, they are also counted above
+	UnreachableInstances int `json:"unreachable_instances"`
 }
 
 // DeploymentProgressResponse represents the response from progressing a deployment
@@ -64,3 +95,18 @@ type DeploymentStatusResponse struct {
 	Deployments []*DeploymentRecord `json:"deployments"`
 	Count       int                 `json:"count"`
 }
+
+// DeploymentPlan describes what a deployment request would do if it was triggered
+type DeploymentPlan struct {
+	Request DeploymentRequest `json:"request"`
+	// Number of instances that match the deployment labels
+	MatchingInstances int `json:"matching_instances"`
+	// Number of matching instances already running the target state
+	UpToDateInstances int `json:"up_to_date_instances"`
+	// Keys of the instances to update, grouped by batch in the order they would be started
+	Batches [][]string `json:"batches"`
+	// Number of failed instances that aborts the rollout and triggers an automatic rollback
+	FailureThreshold int `json:"failure_threshold"`
+	// Warnings about conditions that would prevent or endanger the rollout
+	Warnings []string `json:"warnings"`
+}
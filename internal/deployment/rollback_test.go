@@ -2,12 +2,15 @@ package deployment_test
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	"github.com/xnok/dides/internal/auth"
 	"github.com/xnok/dides/internal/deployment"
 	"github.com/xnok/dides/internal/deployment/mocks"
 	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
 )
 
 func TestTriggerService_TriggerRollback(t *testing.T) {
@@ -17,10 +20,11 @@ func TestTriggerService_TriggerRollback(t *testing.T) {
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
 
 	ctx := context.Background()
 	labels := map[string]string{"env": "prod", "service": "api"}
+	sel := selector.FromLabels(labels)
 	config := deployment.Configuration{
 		BatchSize:        2,
 		FailureThreshold: 1,
@@ -39,20 +43,20 @@ func TestTriggerService_TriggerRollback(t *testing.T) {
 	}
 
 	// Set expectations for locker
-	mockLocker.EXPECT().Lock(ctx, "deployment").Return(nil).Times(1)
-	mockLocker.EXPECT().Unlock(ctx, "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
 
 	// Check for running deployments (should be none)
-	mockStore.EXPECT().GetByStatus(deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
 
 	// Reset failed instances before rollback
-	mockStrategy.EXPECT().ResetFailedInstances(gomock.Any(), labels).Return(nil).Times(1)
+	mockStrategy.EXPECT().ResetFailedInstances(gomock.Any(), sel).Return(nil).Times(1)
 
 	// Get previous completed deployments
-	mockStore.EXPECT().GetByLabelsAndStatus(labels, deployment.Completed).Return([]*deployment.DeploymentRecord{previousDeployment}, nil).Times(1)
+	mockStore.EXPECT().GetByLabelsAndStatus(gomock.Any(), sel, deployment.Completed).Return([]*deployment.DeploymentRecord{previousDeployment}, nil).Times(1)
 
 	// Save the rollback deployment record
-	mockStore.EXPECT().Save(gomock.Any()).DoAndReturn(func(record *deployment.DeploymentRecord) error {
+	mockStore.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, record *deployment.DeploymentRecord) error {
 		// Verify the rollback request has the previous deployment's versions
 		if record.Request.CodeVersion != "v1.0.0" {
 			t.Errorf("Expected CodeVersion v1.0.0, got %s", record.Request.CodeVersion)
@@ -67,7 +71,7 @@ func TestTriggerService_TriggerRollback(t *testing.T) {
 	// Start the rollback deployment
 	mockStrategy.EXPECT().StartDeployment(gomock.Any(), gomock.Any()).Return(nil).Times(1)
 
-	err := service.TriggerRollback(ctx, labels, config)
+	err := service.TriggerRollback(ctx, sel, config)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -80,29 +84,30 @@ func TestTriggerService_TriggerRollback_NoPreviousDeployment(t *testing.T) {
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
 
 	ctx := context.Background()
 	labels := map[string]string{"env": "prod", "service": "api"}
+	sel := selector.FromLabels(labels)
 	config := deployment.Configuration{
 		BatchSize:        2,
 		FailureThreshold: 1,
 	}
 
 	// Set expectations for locker
-	mockLocker.EXPECT().Lock(ctx, "deployment").Return(nil).Times(1)
-	mockLocker.EXPECT().Unlock(ctx, "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
 
 	// Check for running deployments (should be none)
-	mockStore.EXPECT().GetByStatus(deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
 
 	// Reset failed instances before rollback
-	mockStrategy.EXPECT().ResetFailedInstances(gomock.Any(), labels).Return(nil).Times(1)
+	mockStrategy.EXPECT().ResetFailedInstances(gomock.Any(), sel).Return(nil).Times(1)
 
 	// Get previous completed deployments (none found)
-	mockStore.EXPECT().GetByLabelsAndStatus(labels, deployment.Completed).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+	mockStore.EXPECT().GetByLabelsAndStatus(gomock.Any(), sel, deployment.Completed).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
 
-	err := service.TriggerRollback(ctx, labels, config)
+	err := service.TriggerRollback(ctx, sel, config)
 	if err != deployment.ErrNoPreviousDeploymentFound {
 		t.Errorf("Expected ErrNoPreviousDeploymentFound, got %v", err)
 	}
@@ -115,10 +120,11 @@ func TestTriggerService_TriggerRollback_CancelsInProgressDeployment(t *testing.T
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
 
 	ctx := context.Background()
 	labels := map[string]string{"env": "prod", "service": "api"}
+	sel := selector.FromLabels(labels)
 	config := deployment.Configuration{
 		BatchSize:        2,
 		FailureThreshold: 1,
@@ -148,14 +154,14 @@ func TestTriggerService_TriggerRollback_CancelsInProgressDeployment(t *testing.T
 	}
 
 	// Set expectations for locker
-	mockLocker.EXPECT().Lock(ctx, "deployment").Return(nil).Times(1)
-	mockLocker.EXPECT().Unlock(ctx, "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
 
 	// Check for running deployments (should find one) - called twice by isRolloutInProgress and for cancellation
-	mockStore.EXPECT().GetByStatus(deployment.Running).Return([]*deployment.DeploymentRecord{runningDeployment}, nil).Times(2)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{runningDeployment}, nil).Times(2)
 
 	// Cancel the running deployment
-	mockStore.EXPECT().Update(gomock.Any()).DoAndReturn(func(record *deployment.DeploymentRecord) error {
+	mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, record *deployment.DeploymentRecord) error {
 		// Verify the running deployment is marked as failed
 		if record.Status != deployment.Failed {
 			t.Errorf("Expected status Failed, got %v", record.Status)
@@ -164,13 +170,13 @@ func TestTriggerService_TriggerRollback_CancelsInProgressDeployment(t *testing.T
 	}).Times(1)
 
 	// Reset failed instances before rollback
-	mockStrategy.EXPECT().ResetFailedInstances(gomock.Any(), labels).Return(nil).Times(1)
+	mockStrategy.EXPECT().ResetFailedInstances(gomock.Any(), sel).Return(nil).Times(1)
 
 	// Get previous completed deployments
-	mockStore.EXPECT().GetByLabelsAndStatus(labels, deployment.Completed).Return([]*deployment.DeploymentRecord{previousDeployment}, nil).Times(1)
+	mockStore.EXPECT().GetByLabelsAndStatus(gomock.Any(), sel, deployment.Completed).Return([]*deployment.DeploymentRecord{previousDeployment}, nil).Times(1)
 
 	// Save the rollback deployment record
-	mockStore.EXPECT().Save(gomock.Any()).DoAndReturn(func(record *deployment.DeploymentRecord) error {
+	mockStore.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, record *deployment.DeploymentRecord) error {
 		// Verify the rollback request has the previous deployment's versions
 		if record.Request.CodeVersion != "v1.0.0" {
 			t.Errorf("Expected CodeVersion v1.0.0, got %s", record.Request.CodeVersion)
@@ -185,19 +191,190 @@ func TestTriggerService_TriggerRollback_CancelsInProgressDeployment(t *testing.T
 	// Start the rollback deployment
 	mockStrategy.EXPECT().StartDeployment(gomock.Any(), gomock.Any()).Return(nil).Times(1)
 
-	err := service.TriggerRollback(ctx, labels, config)
+	err := service.TriggerRollback(ctx, sel, config)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 }
 
+func TestTriggerService_TriggerRollback_InProgressOutsideScope(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockLocker := mocks.NewMockLocker(ctrl)
+	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
+
+	// The team may only deploy to web instances
+	ctx := auth.WithPrincipal(context.Background(), &auth.Principal{
+		Name:  "web-team",
+		Role:  auth.Deployer,
+		Scope: selector.FromLabels(map[string]string{"role": "web"}),
+	})
+	config := deployment.Configuration{
+		BatchSize:        2,
+		FailureThreshold: 1,
+	}
+
+	// Another team is deploying to the db instances
+	runningDeployment := &deployment.DeploymentRecord{
+		ID: "deployment-running",
+		Request: deployment.DeploymentRequest{
+			CodeVersion: "v2.0.0",
+			Labels:      map[string]string{"role": "db"},
+		},
+		Status: deployment.Running,
+	}
+
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{runningDeployment}, nil).Times(2)
+
+	// No update expected, the running deployment is outside the scope of the caller and is not cancelled
+
+	err := service.TriggerRollback(ctx, selector.FromLabels(map[string]string{"role": "web"}), config)
+	if !errors.Is(err, deployment.ErrRolloutInProgress) {
+		t.Errorf("Expected ErrRolloutInProgress, got %v", err)
+	}
+}
+
+func TestTriggerService_TriggerRollback_PerInstance(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockLocker := mocks.NewMockLocker(ctrl)
+	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
+
+	ctx := context.Background()
+	labels := map[string]string{"env": "prod"}
+	sel := selector.FromLabels(labels)
+	config := deployment.Configuration{
+		BatchSize:        2,
+		FailureThreshold: 1,
+		RollbackMode:     deployment.RollbackPerInstance,
+	}
+
+	// The failed deployment touched instances that were running different versions
+	failedDeployment := &deployment.DeploymentRecord{
+		ID: "deployment-failed",
+		Request: deployment.DeploymentRequest{
+			CodeVersion:          "v3.0.0",
+			ConfigurationVersion: "config-v3.0",
+			Labels:               labels,
+		},
+		Status: deployment.Failed,
+	}
+	from := inventory.State{CodeVersion: "v3.0.0", ConfigurationVersion: "config-v3.0"}
+	targets := map[string]inventory.State{
+		"instance-1": {CodeVersion: "v2.0.0", ConfigurationVersion: "config-v2.0"},
+		"instance-2": {CodeVersion: "v1.0.0", ConfigurationVersion: "config-v1.0"},
+	}
+
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+	mockStrategy.EXPECT().ResetFailedInstances(gomock.Any(), sel).Return(nil).Times(1)
+
+	// Find the last deployment to roll back from
+	mockStore.EXPECT().GetOverlappingByStatus(gomock.Any(), sel, deployment.Failed).Return([]*deployment.DeploymentRecord{failedDeployment}, nil).Times(1)
+	mockStore.EXPECT().GetOverlappingByStatus(gomock.Any(), sel, deployment.Completed).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+
+	// Resolve the previous state of each touched instance
+	mockStrategy.EXPECT().ResolvePreviousStates(gomock.Any(), sel, from).Return(targets, nil).Times(1)
+
+	// Save the rollback deployment record with a target per instance
+	mockStore.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, record *deployment.DeploymentRecord) error {
+		if len(record.Targets) != 2 {
+			t.Errorf("Expected 2 targets, got %d", len(record.Targets))
+		}
+		if record.Targets["instance-2"].CodeVersion != "v1.0.0" {
+			t.Errorf("Expected instance-2 to roll back to v1.0.0, got %s", record.Targets["instance-2"].CodeVersion)
+		}
+		record.ID = "rollback-deployment-001"
+		return nil
+	}).Times(1)
+
+	mockStrategy.EXPECT().StartDeployment(gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+	err := service.TriggerRollback(ctx, sel, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestRollingDeployment_ProgressDeployment_PerInstanceTargets(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockInventory := mocks.NewMockInventoryService(ctrl)
+	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory, nil)
+
+	ctx := context.Background()
+	labels := map[string]string{"env": "prod"}
+	sel := selector.FromLabels(labels)
+	v1 := inventory.State{CodeVersion: "v1.0.0", ConfigurationVersion: "config-v1.0"}
+	v2 := inventory.State{CodeVersion: "v2.0.0", ConfigurationVersion: "config-v2.0"}
+	v3 := inventory.State{CodeVersion: "v3.0.0", ConfigurationVersion: "config-v3.0"}
+
+	record := &deployment.DeploymentRecord{
+		ID: "rollback-deployment-001",
+		Request: deployment.DeploymentRequest{
+			Labels: labels,
+			Configuration: deployment.Configuration{
+				BatchSize:        1,
+				FailureThreshold: 1,
+				RollbackMode:     deployment.RollbackPerInstance,
+			},
+		},
+		Status: deployment.Running,
+		Progress: deployment.DeploymentProgress{
+			TotalMatchingInstances: 2,
+		},
+		Targets: map[string]inventory.State{
+			"instance-1": v2,
+			"instance-2": v1,
+		},
+	}
+
+	// instance-1 is back on its previous version, instance-2 was not started yet, instance-3 was not touched
+	instances := []*inventory.Instance{
+		{Name: "instance-1", Status: inventory.HEALTHY, CurrentState: v2, DesiredState: v2},
+		{Name: "instance-2", Status: inventory.HEALTHY, CurrentState: v3, DesiredState: v3},
+		{Name: "instance-3", Status: inventory.HEALTHY, CurrentState: v3, DesiredState: v3},
+	}
+
+	mockInventory.EXPECT().GetInstancesByLabels(gomock.Any(), sel).Return(instances, nil).Times(1)
+	mockInventory.EXPECT().CountProgress(gomock.Any(), sel, inventory.State{}, record.Targets).Return(inventory.Progress{Total: 2, NeedingUpdate: 1, Completed: 1}, nil).Times(1)
+	mockInventory.EXPECT().UpdateDesiredStates(gomock.Any(), map[string]inventory.State{"instance-2": v1}, map[string]int64{"instance-2": 0}).Return(nil).Times(1)
+	mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+	updated, err := rollingDeployment.ProgressDeployment(ctx, record)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if updated.Status != deployment.Running {
+		t.Errorf("Expected status Running, got %v", updated.Status)
+	}
+	if updated.Progress.CompletedInstances != 1 {
+		t.Errorf("Expected 1 completed instance, got %d", updated.Progress.CompletedInstances)
+	}
+	if updated.Progress.InProgressInstances != 1 {
+		t.Errorf("Expected 1 in-progress instance, got %d", updated.Progress.InProgressInstances)
+	}
+}
+
 func TestRollingDeployment_FailureThresholdExceeded(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	mockStore := mocks.NewMockStore(ctrl)
 	mockInventory := mocks.NewMockInventoryService(ctrl)
-	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory)
+	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory, nil)
 
 	ctx := context.Background()
 
@@ -221,9 +398,7 @@ func TestRollingDeployment_FailureThresholdExceeded(t *testing.T) {
 	}
 
 	// Mock expectations - simulate failure threshold exceeded
-	mockInventory.EXPECT().CountFailed(gomock.Any(), record.Request.Labels, desiredState).Return(2, nil).Times(1) // 2 failures > threshold (1)
-	mockInventory.EXPECT().CountCompleted(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1)
-	mockInventory.EXPECT().CountInProgress(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1)
+	mockInventory.EXPECT().CountProgress(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, nil).Return(inventory.Progress{Total: 4, InProgress: 0, Completed: 0, Failed: 2}, nil).Times(1) // 2 failures > threshold (1)
 
 	updatedRecord, err := rollingDeployment.ProgressDeployment(ctx, record)
 
@@ -3,52 +3,71 @@ package deployment
 import (
 	"context"
 	"errors"
+	"maps"
+	"slices"
+	"sync"
 
 	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+	"github.com/xnok/dides/internal/transaction"
 )
 
 // RollingDeployment implements the rolling deployment strategy
 type RollingDeployment struct {
 	store     Store
 	inventory InventoryService
+	events    Publisher
+
+	// started holds the instances started by each deployment that did not complete yet, by deployment ID, with the outcome already published for them
+	mu      sync.Mutex
+	started map[string]map[string]EventType
 }
 
 //go:generate mockgen -source=rolling_deployment.go -destination=mocks/mock_inventory.go -package=mocks
 
 type InventoryService interface {
-	// GetInstancesByLabels returns instances that match the given labels
-	GetInstancesByLabels(ctx context.Context, labels map[string]string) ([]*inventory.Instance, error)
-	// UpdateDesiredState sets the desired state for an instance
-	UpdateDesiredState(ctx context.Context, instanceKey string, state inventory.State) error
-
-	// CountByLabels returns the total number of instances that match the given labels
-	CountByLabels(ctx context.Context, labels map[string]string) (int, error)
-	// CountNeedingUpdate returns the total number of instances that need to be updated (haven't been started yet)
-	CountNeedingUpdate(ctx context.Context, labels map[string]string, desiredState inventory.State) (int, error)
+	// GetInstancesByLabels returns instances that match the given label selector
+	GetInstancesByLabels(ctx context.Context, sel selector.Selector) ([]*inventory.Instance, error)
+	// GetInstances returns the instances with the given keys, in the same order, the removed ones are left out
+	GetInstances(ctx context.Context, keys []string) ([]*inventory.Instance, error)
+	// UpdateDesiredStates sets the desired state of every instance by key, none is updated when one fails
+	// An instance with a revision in revisions is only updated at that revision, otherwise it fails with inventory.ErrRevisionConflict
+	UpdateDesiredStates(ctx context.Context, states map[string]inventory.State, revisions map[string]int64) error
+
+	// CountByLabels returns the total number of instances that match the given label selector
+	CountByLabels(ctx context.Context, sel selector.Selector) (int, error)
 	// GetNeedingUpdate returns instances that need to be updated (options can limit the number of results for batching)
-	GetNeedingUpdate(ctx context.Context, labels map[string]string, desiredState inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error)
-	// CountInProgress returns the total number of instances currently being updated (desiredState == targetState but currentState != desiredState)
-	CountInProgress(ctx context.Context, labels map[string]string, desiredState inventory.State) (int, error)
-	// CountCompleted returns the total number of instances that have completed the update
-	CountCompleted(ctx context.Context, labels map[string]string, desiredState inventory.State) (int, error)
-	// CountFailed returns the total number of instances that have failed the update
-	CountFailed(ctx context.Context, labels map[string]string, desiredState inventory.State) (int, error)
-	// ResetFailedInstances resets the status of failed instances matching the labels to UNKNOWN
-	ResetFailedInstances(ctx context.Context, labels map[string]string) error
-}
-
-// NewRollingDeployment creates a new rolling deployment strategy
-func NewRollingDeployment(store Store, inventory InventoryService) *RollingDeployment {
+	GetNeedingUpdate(ctx context.Context, sel selector.Selector, desiredState inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error)
+	// CountProgress returns the needing update, in progress, completed, failed and unreachable counts in a single read
+	// targets moves each instance to its own state instead of the desired state, nil for a single desired state
+	CountProgress(ctx context.Context, sel selector.Selector, desiredState inventory.State, targets map[string]inventory.State) (inventory.Progress, error)
+	// ResetFailedInstances resets the status of failed instances matching the label selector to UNKNOWN
+	ResetFailedInstances(ctx context.Context, sel selector.Selector) error
+}
+
+// NewRollingDeployment creates a new rolling deployment strategy, events may be nil to publish nothing
+func NewRollingDeployment(store Store, inventory InventoryService, events Publisher) *RollingDeployment {
 	return &RollingDeployment{
 		store:     store,
 		inventory: inventory,
+		events:    events,
+		started:   make(map[string]map[string]EventType),
 	}
 }
 
 // StartDeployment prepares the deployment by getting instances and validating the configuration
 func (rd *RollingDeployment) StartDeployment(ctx context.Context, record *DeploymentRecord) error {
+	if len(record.Targets) > 0 {
+		return rd.startTargets(ctx, record)
+	}
+
+	sel, err := record.Request.LabelSelector()
+	if err != nil {
+		return err
+	}
+
 	// 1. Check if the labels match any instances to validate the deployment request
-	totalInstances, err := rd.inventory.CountByLabels(ctx, record.Request.Labels)
+	totalInstances, err := rd.inventory.CountByLabels(ctx, sel)
 	if err != nil {
 		return err
 	}
@@ -69,7 +88,7 @@ func (rd *RollingDeployment) StartDeployment(ctx context.Context, record *Deploy
 	opts := &inventory.GetNeedingUpdateOptions{
 		Limit: record.Request.Configuration.BatchSize,
 	}
-	instances, err := rd.inventory.GetNeedingUpdate(ctx, record.Request.Labels, desiredState, opts)
+	instances, err := rd.inventory.GetNeedingUpdate(ctx, sel, desiredState, opts)
 	if err != nil {
 		return err
 	}
@@ -78,28 +97,34 @@ func (rd *RollingDeployment) StartDeployment(ctx context.Context, record *Deploy
 		// All instances are already at the desired state, mark deployment as completed
 		record.Status = Completed
 		record.Progress.CompletedInstances = totalInstances
-		return rd.store.Update(record)
+		return rd.update(ctx, record, DeploymentProgress{}, nil)
 	}
 
 	// 4. Update the state for initial batch
-	// TODO: Consider using UpdateMany such that it can be done in a transaction (so it can be rolled back)
-	for _, instance := range instances {
-		if err := rd.inventory.UpdateDesiredState(ctx, instance.Name, desiredState); err != nil {
-			return err
-		}
-		record.Progress.InProgressInstances++
+	started, err := rd.startBatch(ctx, record, instances, func(*inventory.Instance) inventory.State { return desiredState })
+	if err != nil {
+		return err
 	}
 
-	return rd.store.Update(record)
+	return rd.update(ctx, record, DeploymentProgress{}, started)
 }
 
-// ResetFailedInstances resets the status of failed instances matching the labels to UNKNOWN
-func (rd *RollingDeployment) ResetFailedInstances(ctx context.Context, labels map[string]string) error {
-	return rd.inventory.ResetFailedInstances(ctx, labels)
+// ResetFailedInstances resets the status of failed instances matching the label selector to UNKNOWN
+func (rd *RollingDeployment) ResetFailedInstances(ctx context.Context, sel selector.Selector) error {
+	return rd.inventory.ResetFailedInstances(ctx, sel)
 }
 
 // ProgressDeployment checks instance states and progresses the deployment
 func (rd *RollingDeployment) ProgressDeployment(ctx context.Context, record *DeploymentRecord) (*DeploymentRecord, error) {
+	if len(record.Targets) > 0 {
+		return rd.progressTargets(ctx, record)
+	}
+
+	sel, err := record.Request.LabelSelector()
+	if err != nil {
+		return nil, err
+	}
+
 	// 0. Determine desired state from the deployment request
 	desiredState := inventory.State{
 		CodeVersion:          record.Request.CodeVersion,
@@ -110,67 +135,438 @@ func (rd *RollingDeployment) ProgressDeployment(ctx context.Context, record *Dep
 	// State Refresh Logic
 	// ------------------------------------------------------
 
-	// 1. Check number of failed instances and update record
-	failed, err := rd.inventory.CountFailed(ctx, record.Request.Labels, desiredState)
+	previous := record.Progress
+
+	// 1. Count every bucket at once, instances may have been cordoned or removed since the deployment started
+	progress, err := rd.inventory.CountProgress(ctx, sel, desiredState, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// 2. How many of the current batch are done?
-	completed, err := rd.inventory.CountCompleted(ctx, record.Request.Labels, desiredState)
+	// ------------------------------------------------------
+	// State Update Logic
+	// ------------------------------------------------------
+	limit, err := rd.refreshProgress(record, progress)
+	if reportErr := rd.reportInstances(ctx, record, desiredState); reportErr != nil {
+		return record, reportErr
+	}
+	if err != nil {
+		rd.publishProgress(ctx, record, previous, nil)
+		return record, err
+	}
+	if limit == 0 {
+		return record, rd.update(ctx, record, previous, nil)
+	}
+
+	// 2. Get the next batch = batch_size - inflight
+	opts := &inventory.GetNeedingUpdateOptions{
+		Limit: limit,
+	}
+	instances, err := rd.inventory.GetNeedingUpdate(ctx, sel, desiredState, opts)
+	if err != nil {
+		return record, err
+	}
+
+	// 3. Update the state for next batch
+	started, err := rd.startBatch(ctx, record, instances, func(*inventory.Instance) inventory.State { return desiredState })
+	if err != nil {
+		return record, err
+	}
+
+	return record, rd.update(ctx, record, previous, started)
+}
+
+// PlanDeployment computes the batches a deployment would go through without updating any instance
+func (rd *RollingDeployment) PlanDeployment(ctx context.Context, req *DeploymentRequest) (*DeploymentPlan, error) {
+	desiredState := inventory.State{
+		CodeVersion:          req.CodeVersion,
+		ConfigurationVersion: req.ConfigurationVersion,
+	}
+
+	sel, err := req.LabelSelector()
 	if err != nil {
 		return nil, err
 	}
 
-	// 3. How many are still in progress (desiredState == targetState but currentState != desiredState)?
-	inProgress, err := rd.inventory.CountInProgress(ctx, record.Request.Labels, desiredState)
+	// 1. Select the instances the same way StartDeployment and ProgressDeployment do
+	totalInstances, err := rd.inventory.CountByLabels(ctx, sel)
 	if err != nil {
 		return nil, err
 	}
 
-	record.Progress.FailedInstances = failed
-	record.Progress.CompletedInstances = completed
-	record.Progress.InProgressInstances = inProgress
+	instances, err := rd.inventory.GetNeedingUpdate(ctx, sel, desiredState, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	// ------------------------------------------------------
-	// State Update Logic
-	// ------------------------------------------------------
+	plan := &DeploymentPlan{
+		Request:           *req,
+		MatchingInstances: totalInstances,
+		UpToDateInstances: totalInstances - len(instances),
+		Batches:           [][]string{},
+		FailureThreshold:  req.Configuration.FailureThreshold,
+		Warnings:          []string{},
+	}
+
+	if totalInstances == 0 {
+		plan.Warnings = append(plan.Warnings, "no instances match the specified labels, the deployment cannot start")
+	} else if len(instances) == 0 {
+		plan.Warnings = append(plan.Warnings, "all matching instances already run the target state, the deployment completes immediately")
+	}
+
+	// 2. Group the instances to update by batch
+	batchSize := req.Configuration.BatchSize
+	for start := 0; start < len(instances); start += batchSize {
+		end := min(start+batchSize, len(instances))
+
+		batch := make([]string, 0, end-start)
+		for _, instance := range instances[start:end] {
+			batch = append(batch, instance.Key())
+		}
+		plan.Batches = append(plan.Batches, batch)
+	}
+
+	// 3. Check the failure threshold against the number of instances to update
+	if plan.FailureThreshold == 0 {
+		plan.Warnings = append(plan.Warnings, "failure_threshold is 0, the deployment is marked failed on the first progress check")
+	} else if len(instances) > 0 && plan.FailureThreshold > len(instances) {
+		plan.Warnings = append(plan.Warnings, "failure_threshold is greater than the number of instances to update, automatic rollback cannot trigger")
+	}
+
+	return plan, nil
+}
+
+// refreshProgress records the progress counters on the record and decides how the deployment moves on
+// It returns how many instances can be started in the next batch, 0 when the deployment must wait or is done
+func (rd *RollingDeployment) refreshProgress(record *DeploymentRecord, progress inventory.Progress) (int, error) {
+	record.Progress.TotalMatchingInstances = progress.Total
+	record.Progress.FailedInstances = progress.Failed
+	record.Progress.CompletedInstances = progress.Completed
+	record.Progress.InProgressInstances = progress.InProgress
+	record.Progress.UnreachableInstances = progress.Unreachable
 
 	// 1. If failure threshold exceeded, return special error for automatic rollback handling
-	if failed >= record.Request.Configuration.FailureThreshold {
+	if progress.Failed >= record.Request.Configuration.FailureThreshold {
 		record.Status = Failed
-		return record, ErrFailureThresholdExceeded
+		return 0, ErrFailureThresholdExceeded
 	}
 
-	// 2. If there are still instances in progress, wait for them to complete
-	if completed >= record.Progress.TotalMatchingInstances {
+	// 2. If all instances are done, the deployment is completed
+	if progress.Completed >= progress.Total {
 		record.Status = Completed
-		record.Progress.CompletedInstances = completed
-		return record, rd.store.Update(record)
+		return 0, nil
 	}
 
 	// 3. If the current batch is still in progress, wait
-	if inProgress == record.Request.Configuration.BatchSize {
-		return record, rd.store.Update(record)
+	if progress.InProgress >= record.Request.Configuration.BatchSize {
+		return 0, nil
 	}
 
-	// 4. Get the next batch = batch_size - inflight
-	opts := &inventory.GetNeedingUpdateOptions{
-		Limit: record.Request.Configuration.BatchSize - record.Progress.InProgressInstances,
+	// 4. The next batch = batch_size - inflight
+	return record.Request.Configuration.BatchSize - progress.InProgress, nil
+}
+
+// ResolvePreviousStates returns the last known good state of every instance matching the label selector that was moved to the from state
+func (rd *RollingDeployment) ResolvePreviousStates(ctx context.Context, sel selector.Selector, from inventory.State) (map[string]inventory.State, error) {
+	instances, err := rd.inventory.GetInstancesByLabels(ctx, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make(map[string]inventory.State)
+	for _, instance := range instances {
+		// Only instances touched by the deployment that know where to go back to
+		if instance.DesiredState != from || instance.PreviousState.IsZero() || instance.PreviousState == from {
+			continue
+		}
+		targets[instance.Key()] = instance.PreviousState
 	}
-	instances, err := rd.inventory.GetNeedingUpdate(ctx, record.Request.Labels, desiredState, opts)
+
+	return targets, nil
+}
+
+// targetInstances returns the instances matching the label selector that have a target state in the record, ordered by name
+func (rd *RollingDeployment) targetInstances(ctx context.Context, record *DeploymentRecord) ([]*inventory.Instance, error) {
+	sel, err := record.Request.LabelSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	instances, err := rd.inventory.GetInstancesByLabels(ctx, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	var targeted []*inventory.Instance
+	for _, instance := range instances {
+		if _, ok := record.Targets[instance.Key()]; ok {
+			targeted = append(targeted, instance)
+		}
+	}
+
+	inventory.SortInstances(targeted)
+
+	return targeted, nil
+}
+
+// startTargets starts a deployment that moves each instance to its own target state
+func (rd *RollingDeployment) startTargets(ctx context.Context, record *DeploymentRecord) error {
+	instances, err := rd.targetInstances(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	if len(instances) == 0 {
+		return errors.New("no instances match the specified targets")
+	}
+
+	record.Progress.TotalMatchingInstances = len(instances)
+
+	// Update the state for the initial batch
+	var batch []*inventory.Instance
+	for _, instance := range instances {
+		if len(batch) >= record.Request.Configuration.BatchSize {
+			break
+		}
+		if instance.NeedsUpdate(record.Targets[instance.Key()]) {
+			batch = append(batch, instance)
+		}
+	}
+
+	started, err := rd.startBatch(ctx, record, batch, func(instance *inventory.Instance) inventory.State {
+		return record.Targets[instance.Key()]
+	})
+	if err != nil {
+		return err
+	}
+
+	if record.Progress.InProgressInstances == 0 {
+		// All instances are already at their target state, mark deployment as completed
+		record.Status = Completed
+		record.Progress.CompletedInstances = len(instances)
+	}
+
+	return rd.update(ctx, record, DeploymentProgress{}, started)
+}
+
+// progressTargets progresses a deployment that moves each instance to its own target state
+func (rd *RollingDeployment) progressTargets(ctx context.Context, record *DeploymentRecord) (*DeploymentRecord, error) {
+	instances, err := rd.targetInstances(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := record.Progress
+
+	sel, err := record.Request.LabelSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	// Count each instance against its own target state, targeted instances may have been cordoned or removed since the deployment started
+	progress, err := rd.inventory.CountProgress(ctx, sel, inventory.State{}, record.Targets)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []*inventory.Instance
+	for _, instance := range instances {
+		target := record.Targets[instance.Key()]
+		if !instance.IsInProgress(target) && instance.NeedsUpdate(target) {
+			pending = append(pending, instance)
+		}
+	}
+
+	// Only the targeted instances started by the deployment are reported, the others were already at their target
+	startedByDeployment := rd.startedInstances(record.ID)
+	var reported []*inventory.Instance
+	for _, instance := range instances {
+		if _, ok := startedByDeployment[instance.Key()]; ok {
+			reported = append(reported, instance)
+		}
+	}
+
+	limit, err := rd.refreshProgress(record, progress)
+	rd.publishInstances(ctx, record, reported, func(instance *inventory.Instance) inventory.State {
+		return record.Targets[instance.Key()]
+	})
+	if err != nil {
+		rd.publishProgress(ctx, record, previous, nil)
+		return record, err
+	}
+
+	// Update the state for next batch
+	started, err := rd.startBatch(ctx, record, pending[:min(limit, len(pending))], func(instance *inventory.Instance) inventory.State {
+		return record.Targets[instance.Key()]
+	})
 	if err != nil {
 		return record, err
 	}
 
-	// 5. Update the state for next batch
-	// TODO: Consider using UpdateMany such that it can be done in a transaction (so it can be rolled back)
+	return record, rd.update(ctx, record, previous, started)
+}
+
+// startBatch moves the instances to their target state at once and counts them in progress
+// The instances are only moved at the revision they were read, one changed since fails the batch with inventory.ErrRevisionConflict
+// The record is left untouched when the inventory rejects the batch, it returns the started instance keys in order
+func (rd *RollingDeployment) startBatch(ctx context.Context, record *DeploymentRecord, instances []*inventory.Instance, target func(*inventory.Instance) inventory.State) ([]string, error) {
+	if len(instances) == 0 {
+		return nil, nil
+	}
+
+	started := make([]string, 0, len(instances))
+	states := make(map[string]inventory.State, len(instances))
+	revisions := make(map[string]int64, len(instances))
+	for _, instance := range instances {
+		started = append(started, instance.Key())
+		states[instance.Key()] = target(instance)
+		revisions[instance.Key()] = instance.Revision
+	}
+
+	if err := rd.inventory.UpdateDesiredStates(ctx, states, revisions); err != nil {
+		return nil, err
+	}
+	record.Progress.InProgressInstances += len(started)
+
+	return started, nil
+}
+
+// update saves the record and publishes what changed since the previous progress
+// A record changed since it was read fails with ErrDeploymentConflict, the unit of work is run again from a fresh read
+func (rd *RollingDeployment) update(ctx context.Context, record *DeploymentRecord, previous DeploymentProgress, started []string) error {
+	if err := rd.store.Update(ctx, record); err != nil {
+		return err
+	}
+
+	rd.publishProgress(ctx, record, previous, started)
+	return nil
+}
+
+// publishProgress publishes the batch started, the new progress and the completion of the deployment once the unit of work is committed
+// The started instances are then reported by the next progress checks, until the deployment is over
+// The failure is published by the trigger service once the rollback is started
+func (rd *RollingDeployment) publishProgress(ctx context.Context, record *DeploymentRecord, previous DeploymentProgress, started []string) {
+	if rd.events == nil {
+		return
+	}
+
+	var events []Event
+	if len(started) > 0 {
+		event := newEvent(record, EventBatchStarted)
+		event.Instances = started
+		events = append(events, event)
+	}
+
+	if record.Progress != previous {
+		events = append(events, newEvent(record, EventProgress))
+	}
+
+	id, running := record.ID, record.Status == Running
+	transaction.AfterCommit(ctx, func() {
+		rd.mu.Lock()
+		defer rd.mu.Unlock()
+
+		if !running {
+			delete(rd.started, id)
+			return
+		}
+		if len(started) == 0 {
+			return
+		}
+		if rd.started[id] == nil {
+			rd.started[id] = make(map[string]EventType)
+		}
+		for _, key := range started {
+			if _, ok := rd.started[id][key]; !ok {
+				rd.started[id][key] = ""
+			}
+		}
+	})
+
+	if record.Status == Completed {
+		events = append(events, newEvent(record, EventCompleted))
+	}
+
+	publishAfterCommit(ctx, rd.events, events...)
+}
+
+// reportInstances publishes the instances started by the deployment that completed or failed since the last progress check
+// Only the started instances are read, not every instance matching the deployment
+func (rd *RollingDeployment) reportInstances(ctx context.Context, record *DeploymentRecord, desiredState inventory.State) error {
+	if rd.events == nil {
+		return nil
+	}
+
+	started := rd.startedInstances(record.ID)
+	if len(started) == 0 {
+		return nil
+	}
+
+	instances, err := rd.inventory.GetInstances(ctx, slices.Sorted(maps.Keys(started)))
+	if err != nil {
+		return err
+	}
+
+	rd.publishInstances(ctx, record, instances, func(*inventory.Instance) inventory.State {
+		return desiredState
+	})
+	return nil
+}
+
+// publishInstances publishes the outcome of each instance against its target state once the unit of work is committed, once per outcome
+func (rd *RollingDeployment) publishInstances(ctx context.Context, record *DeploymentRecord, instances []*inventory.Instance, target func(*inventory.Instance) inventory.State) {
+	if rd.events == nil {
+		return
+	}
+
+	var events []Event
+	inventory.SortInstances(instances)
 	for _, instance := range instances {
-		if err := rd.inventory.UpdateDesiredState(ctx, instance.Name, desiredState); err != nil {
-			return record, err
+		var outcome EventType
+		switch {
+		case instance.IsCompleted(target(instance)):
+			outcome = EventInstanceCompleted
+		case instance.IsFailed(target(instance)):
+			outcome = EventInstanceFailed
+		default:
+			continue
 		}
-		record.Progress.InProgressInstances++
+
+		event := newEvent(record, outcome)
+		event.Instances = []string{instance.Key()}
+		events = append(events, event)
 	}
 
-	return record, rd.store.Update(record)
+	transaction.AfterCommit(ctx, func() {
+		rd.mu.Lock()
+		defer rd.mu.Unlock()
+
+		reported, ok := rd.started[record.ID]
+		if !ok {
+			return
+		}
+
+		for _, event := range events {
+			key := event.Instances[0]
+			if outcome, ok := reported[key]; !ok || outcome == event.Type {
+				continue
+			}
+			rd.events.Publish(event)
+
+			// A completed instance is not read again, only the instances in flight or failed are
+			if event.Type == EventInstanceCompleted {
+				delete(reported, key)
+				continue
+			}
+			reported[key] = event.Type
+		}
+	})
+}
+
+// startedInstances returns a copy of the instances started by the deployment with the outcome already published for them
+func (rd *RollingDeployment) startedInstances(id string) map[string]EventType {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	return maps.Clone(rd.started[id])
 }
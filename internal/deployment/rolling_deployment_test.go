@@ -9,6 +9,7 @@ import (
 	"github.com/xnok/dides/internal/deployment"
 	"github.com/xnok/dides/internal/deployment/mocks"
 	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
 )
 
 func TestTriggerService_GetDeploymentStatus(t *testing.T) {
@@ -18,7 +19,7 @@ func TestTriggerService_GetDeploymentStatus(t *testing.T) {
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
 
 	// Test successful case
 	t.Run("success", func(t *testing.T) {
@@ -33,7 +34,7 @@ func TestTriggerService_GetDeploymentStatus(t *testing.T) {
 			},
 		}
 
-		mockStore.EXPECT().GetByStatus(deployment.Running).Return(expectedDeployments, nil).Times(1)
+		mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return(expectedDeployments, nil).Times(1)
 
 		result, err := service.GetDeploymentStatus(context.Background())
 		if err != nil {
@@ -52,7 +53,7 @@ func TestTriggerService_GetDeploymentStatus(t *testing.T) {
 	// Test store error
 	t.Run("store_error", func(t *testing.T) {
 		storeErr := errors.New("store error")
-		mockStore.EXPECT().GetByStatus(deployment.Running).Return(nil, storeErr).Times(1)
+		mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return(nil, storeErr).Times(1)
 
 		result, err := service.GetDeploymentStatus(context.Background())
 		if err != storeErr {
@@ -71,7 +72,7 @@ func TestRollingDeployment_StartDeployment(t *testing.T) {
 
 	mockStore := mocks.NewMockStore(ctrl)
 	mockInventory := mocks.NewMockInventoryService(ctrl)
-	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory)
+	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory, nil)
 
 	// Test case: No instances need update - deployment completed immediately
 	t.Run("no_instances_need_update", func(t *testing.T) {
@@ -94,9 +95,9 @@ func TestRollingDeployment_StartDeployment(t *testing.T) {
 		}
 
 		// Mock expectations
-		mockInventory.EXPECT().CountByLabels(gomock.Any(), record.Request.Labels).Return(5, nil).Times(1)
-		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), record.Request.Labels, desiredState, gomock.Any()).Return([]*inventory.Instance{}, nil).Times(1)
-		mockStore.EXPECT().Update(gomock.Any()).DoAndReturn(func(r *deployment.DeploymentRecord) error {
+		mockInventory.EXPECT().CountByLabels(gomock.Any(), selector.FromLabels(record.Request.Labels)).Return(5, nil).Times(1)
+		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, gomock.Any()).Return([]*inventory.Instance{}, nil).Times(1)
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, r *deployment.DeploymentRecord) error {
 			// Verify the deployment is marked as completed
 			if r.Status != deployment.Completed {
 				t.Errorf("Expected status to be Completed, got %v", r.Status)
@@ -139,11 +140,10 @@ func TestRollingDeployment_StartDeployment(t *testing.T) {
 		}
 
 		// Mock expectations
-		mockInventory.EXPECT().CountByLabels(gomock.Any(), record.Request.Labels).Return(10, nil).Times(1)
-		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), record.Request.Labels, desiredState, gomock.Any()).Return(instances, nil).Times(1)
-		mockInventory.EXPECT().UpdateDesiredState(gomock.Any(), "instance-1", desiredState).Return(nil).Times(1)
-		mockInventory.EXPECT().UpdateDesiredState(gomock.Any(), "instance-2", desiredState).Return(nil).Times(1)
-		mockStore.EXPECT().Update(gomock.Any()).DoAndReturn(func(r *deployment.DeploymentRecord) error {
+		mockInventory.EXPECT().CountByLabels(gomock.Any(), selector.FromLabels(record.Request.Labels)).Return(10, nil).Times(1)
+		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, gomock.Any()).Return(instances, nil).Times(1)
+		mockInventory.EXPECT().UpdateDesiredStates(gomock.Any(), map[string]inventory.State{"instance-1": desiredState, "instance-2": desiredState}, map[string]int64{"instance-1": 0, "instance-2": 0}).Return(nil).Times(1)
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, r *deployment.DeploymentRecord) error {
 			// Verify the progress is updated correctly
 			if r.Progress.TotalMatchingInstances != 10 {
 				t.Errorf("Expected 10 total instances, got %d", r.Progress.TotalMatchingInstances)
@@ -171,13 +171,100 @@ func TestRollingDeployment_StartDeployment(t *testing.T) {
 		}
 
 		countErr := errors.New("count error")
-		mockInventory.EXPECT().CountByLabels(gomock.Any(), record.Request.Labels).Return(0, countErr).Times(1)
+		mockInventory.EXPECT().CountByLabels(gomock.Any(), selector.FromLabels(record.Request.Labels)).Return(0, countErr).Times(1)
 
 		err := rollingDeployment.StartDeployment(context.Background(), record)
 		if err != countErr {
 			t.Errorf("Expected count error, got %v", err)
 		}
 	})
+
+	// Test case: the batch is rejected as a whole, the record is neither counted nor saved
+	t.Run("update_desired_states_error", func(t *testing.T) {
+		record := &deployment.DeploymentRecord{
+			Request: deployment.DeploymentRequest{
+				CodeVersion:          "v1.0.0",
+				ConfigurationVersion: "config-v1.0",
+				Labels:               map[string]string{"env": "prod"},
+				Configuration:        deployment.Configuration{BatchSize: 2},
+			},
+		}
+		desiredState := inventory.State{CodeVersion: "v1.0.0", ConfigurationVersion: "config-v1.0"}
+		instances := []*inventory.Instance{{Name: "instance-1"}, {Name: "instance-2"}}
+
+		updateErr := errors.New("instance not found")
+		mockInventory.EXPECT().CountByLabels(gomock.Any(), selector.FromLabels(record.Request.Labels)).Return(2, nil).Times(1)
+		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, gomock.Any()).Return(instances, nil).Times(1)
+		mockInventory.EXPECT().UpdateDesiredStates(gomock.Any(), gomock.Any(), gomock.Any()).Return(updateErr).Times(1)
+
+		err := rollingDeployment.StartDeployment(context.Background(), record)
+		if err != updateErr {
+			t.Errorf("Expected update error, got %v", err)
+		}
+		if record.Progress.InProgressInstances != 0 {
+			t.Errorf("Expected no instance in progress, got %d", record.Progress.InProgressInstances)
+		}
+	})
+}
+
+func TestRollingDeployment_PlanDeployment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockInventory := mocks.NewMockInventoryService(ctrl)
+	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory, nil)
+
+	req := &deployment.DeploymentRequest{
+		CodeVersion:          "v2.0.0",
+		ConfigurationVersion: "config-v2.0",
+		Labels:               map[string]string{"env": "prod"},
+		Configuration: deployment.Configuration{
+			BatchSize:        2,
+			FailureThreshold: 1,
+		},
+	}
+
+	desiredState := inventory.State{
+		CodeVersion:          "v2.0.0",
+		ConfigurationVersion: "config-v2.0",
+	}
+
+	instances := []*inventory.Instance{
+		{Name: "instance-1"},
+		{Name: "instance-2"},
+		{Name: "instance-3"},
+	}
+
+	// Only reads from the inventory, no desired state and no record update
+	mockInventory.EXPECT().CountByLabels(gomock.Any(), selector.FromLabels(req.Labels)).Return(4, nil).Times(1)
+	mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), selector.FromLabels(req.Labels), desiredState, nil).Return(instances, nil).Times(1)
+
+	plan, err := rollingDeployment.PlanDeployment(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if plan.MatchingInstances != 4 {
+		t.Errorf("Expected 4 matching instances, got %d", plan.MatchingInstances)
+	}
+	if plan.UpToDateInstances != 1 {
+		t.Errorf("Expected 1 up to date instance, got %d", plan.UpToDateInstances)
+	}
+
+	expectedBatches := [][]string{{"instance-1", "instance-2"}, {"instance-3"}}
+	if len(plan.Batches) != len(expectedBatches) {
+		t.Fatalf("Expected %d batches, got %d", len(expectedBatches), len(plan.Batches))
+	}
+	for i := range expectedBatches {
+		if len(plan.Batches[i]) != len(expectedBatches[i]) || plan.Batches[i][0] != expectedBatches[i][0] {
+			t.Errorf("Expected batch %d to be %v, got %v", i, expectedBatches[i], plan.Batches[i])
+		}
+	}
+
+	if len(plan.Warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", plan.Warnings)
+	}
 }
 
 func TestRollingDeployment_CompleteDeploymentScenario(t *testing.T) {
@@ -186,7 +273,7 @@ func TestRollingDeployment_CompleteDeploymentScenario(t *testing.T) {
 
 	mockStore := mocks.NewMockStore(ctrl)
 	mockInventory := mocks.NewMockInventoryService(ctrl)
-	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory)
+	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory, nil)
 
 	ctx := context.Background()
 
@@ -284,19 +371,18 @@ func TestRollingDeployment_CompleteDeploymentScenario(t *testing.T) {
 		t.Log("Step 1: Starting deployment")
 
 		// Mock expectations for StartDeployment
-		mockInventory.EXPECT().CountByLabels(gomock.Any(), record.Request.Labels).Return(5, nil).Times(1)
-		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), record.Request.Labels, desiredState, gomock.Any()).DoAndReturn(
-			func(ctx context.Context, labels map[string]string, state inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
+		mockInventory.EXPECT().CountByLabels(gomock.Any(), selector.FromLabels(record.Request.Labels)).Return(5, nil).Times(1)
+		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, sel selector.Selector, state inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
 				// Return first 2 instances for the first batch
 				return allInstances[:2], nil
 			}).Times(1)
 
-		// Expect UpdateDesiredState calls for first batch (instances 1 and 2)
-		mockInventory.EXPECT().UpdateDesiredState(gomock.Any(), "instance-1", desiredState).Return(nil).Times(1)
-		mockInventory.EXPECT().UpdateDesiredState(gomock.Any(), "instance-2", desiredState).Return(nil).Times(1)
+		// Expect a single UpdateDesiredStates call for first batch (instances 1 and 2)
+		mockInventory.EXPECT().UpdateDesiredStates(gomock.Any(), map[string]inventory.State{"instance-1": desiredState, "instance-2": desiredState}, map[string]int64{"instance-1": 0, "instance-2": 0}).Return(nil).Times(1)
 
 		// Expect store update with initial progress
-		mockStore.EXPECT().Update(gomock.Any()).DoAndReturn(func(r *deployment.DeploymentRecord) error {
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, r *deployment.DeploymentRecord) error {
 			validateProgress(r.Progress, step1Progress, "Step 1")
 			return nil
 		}).Times(1)
@@ -310,18 +396,16 @@ func TestRollingDeployment_CompleteDeploymentScenario(t *testing.T) {
 		t.Log("Step 2: First progress check - instances 1 and 2 still updating")
 
 		// Mock expectations for first ProgressDeployment call
-		mockInventory.EXPECT().CountFailed(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1)
-		mockInventory.EXPECT().CountCompleted(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1)  // Still updating
-		mockInventory.EXPECT().CountInProgress(gomock.Any(), record.Request.Labels, desiredState).Return(2, nil).Times(1) // 2 instances in progress
+		mockInventory.EXPECT().CountProgress(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, nil).Return(inventory.Progress{Total: 5, InProgress: 2, Completed: 0, Failed: 0}, nil).Times(1)
 
 		// No new instances to start (batch limit reached)
-		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), record.Request.Labels, desiredState, gomock.Any()).DoAndReturn(
-			func(ctx context.Context, labels map[string]string, state inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
+		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, sel selector.Selector, state inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
 				// No new instances since we're at batch limit
 				return []*inventory.Instance{}, nil
 			}).Times(1)
 
-		mockStore.EXPECT().Update(gomock.Any()).DoAndReturn(func(r *deployment.DeploymentRecord) error {
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, r *deployment.DeploymentRecord) error {
 			validateProgress(r.Progress, step2Progress, "Step 2")
 			return nil
 		}).Times(1)
@@ -337,10 +421,8 @@ func TestRollingDeployment_CompleteDeploymentScenario(t *testing.T) {
 		// Step 3: Instances 1 and 2 complete, but algorithm might not start new instances yet
 		t.Log("Step 3: Instances 1 and 2 complete, checking progress")
 
-		mockInventory.EXPECT().CountFailed(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1)
-		mockInventory.EXPECT().CountCompleted(gomock.Any(), record.Request.Labels, desiredState).Return(2, nil).Times(1)  // 2 completed
-		mockInventory.EXPECT().CountInProgress(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1) // 0 in progress
-		mockStore.EXPECT().Update(gomock.Any()).DoAndReturn(func(r *deployment.DeploymentRecord) error {
+		mockInventory.EXPECT().CountProgress(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, nil).Return(inventory.Progress{Total: 5, InProgress: 0, Completed: 2, Failed: 0}, nil).Times(1)
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, r *deployment.DeploymentRecord) error {
 			validateProgress(r.Progress, step3Progress, "Step 3")
 			return nil
 		}).Times(1)
@@ -353,10 +435,8 @@ func TestRollingDeployment_CompleteDeploymentScenario(t *testing.T) {
 		// Step 4: Progress deployment - instances 3 and 4 still updating
 		t.Log("Step 4: Progress check - instances 3 and 4 still updating")
 
-		mockInventory.EXPECT().CountFailed(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1)
-		mockInventory.EXPECT().CountCompleted(gomock.Any(), record.Request.Labels, desiredState).Return(2, nil).Times(1)  // Still 2 completed
-		mockInventory.EXPECT().CountInProgress(gomock.Any(), record.Request.Labels, desiredState).Return(2, nil).Times(1) // 2 instances in progress
-		mockStore.EXPECT().Update(gomock.Any()).DoAndReturn(func(r *deployment.DeploymentRecord) error {
+		mockInventory.EXPECT().CountProgress(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, nil).Return(inventory.Progress{Total: 5, InProgress: 2, Completed: 2, Failed: 0}, nil).Times(1)
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, r *deployment.DeploymentRecord) error {
 			validateProgress(r.Progress, step4Progress, "Step 4")
 			return nil
 		}).Times(1)
@@ -369,15 +449,13 @@ func TestRollingDeployment_CompleteDeploymentScenario(t *testing.T) {
 		// Step 5: Instances 3 and 4 complete, start final instance (instance 5)
 		t.Log("Step 5: Instances 3 and 4 complete, starting final instance 5")
 
-		mockInventory.EXPECT().CountFailed(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1)
-		mockInventory.EXPECT().CountCompleted(gomock.Any(), record.Request.Labels, desiredState).Return(4, nil).Times(1)  // 4 completed
-		mockInventory.EXPECT().CountInProgress(gomock.Any(), record.Request.Labels, desiredState).Return(1, nil).Times(1) // 1 instance in progress
-		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), record.Request.Labels, desiredState, gomock.Any()).DoAndReturn(
-			func(ctx context.Context, labels map[string]string, state inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
+		mockInventory.EXPECT().CountProgress(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, nil).Return(inventory.Progress{Total: 5, InProgress: 1, Completed: 4, Failed: 0}, nil).Times(1)
+		mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, gomock.Any()).DoAndReturn(
+			func(ctx context.Context, sel selector.Selector, state inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
 				// No new instances we are waiting for the last one to finish
 				return []*inventory.Instance{}, nil
 			}).Times(1)
-		mockStore.EXPECT().Update(gomock.Any()).DoAndReturn(func(r *deployment.DeploymentRecord) error {
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, r *deployment.DeploymentRecord) error {
 			validateProgress(r.Progress, step5Progress, "Step 5")
 			return nil
 		}).Times(1)
@@ -390,11 +468,9 @@ func TestRollingDeployment_CompleteDeploymentScenario(t *testing.T) {
 		// Step 6: All instances complete - deployment finished
 		t.Log("Step 6: All instances complete - deployment finished")
 
-		mockInventory.EXPECT().CountFailed(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1)
-		mockInventory.EXPECT().CountCompleted(gomock.Any(), record.Request.Labels, desiredState).Return(5, nil).Times(1)  // All 5 completed
-		mockInventory.EXPECT().CountInProgress(gomock.Any(), record.Request.Labels, desiredState).Return(0, nil).Times(1) // None in progress
+		mockInventory.EXPECT().CountProgress(gomock.Any(), selector.FromLabels(record.Request.Labels), desiredState, nil).Return(inventory.Progress{Total: 5, InProgress: 0, Completed: 5, Failed: 0}, nil).Times(1)
 
-		mockStore.EXPECT().Update(gomock.Any()).DoAndReturn(func(r *deployment.DeploymentRecord) error {
+		mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, r *deployment.DeploymentRecord) error {
 			if r.Status != deployment.Completed {
 				t.Errorf("Expected status to be Completed, got %v", r.Status)
 			}
@@ -424,14 +500,14 @@ func TestTriggerService_ProgressDeployment(t *testing.T) {
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
 
 	ctx := context.Background()
 
 	// Test case: Lock error
 	t.Run("lock_error", func(t *testing.T) {
 		lockErr := errors.New("lock error")
-		mockLocker.EXPECT().Lock(ctx, "deployment").Return(lockErr).Times(1)
+		mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(lockErr).Times(1)
 
 		result, err := service.ProgressDeployment(ctx)
 		if err != lockErr {
@@ -444,9 +520,9 @@ func TestTriggerService_ProgressDeployment(t *testing.T) {
 
 	// Test case: No running deployments
 	t.Run("no_running_deployments", func(t *testing.T) {
-		mockLocker.EXPECT().Lock(ctx, "deployment").Return(nil).Times(1)
-		mockLocker.EXPECT().Unlock(ctx, "deployment").Return(nil).Times(1)
-		mockStore.EXPECT().GetByStatus(deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+		mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+		mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
+		mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
 
 		result, err := service.ProgressDeployment(ctx)
 		if err != nil {
@@ -464,9 +540,9 @@ func TestTriggerService_ProgressDeployment(t *testing.T) {
 			{ID: "deployment-2", Status: deployment.Running},
 		}
 
-		mockLocker.EXPECT().Lock(ctx, "deployment").Return(nil).Times(1)
-		mockLocker.EXPECT().Unlock(ctx, "deployment").Return(nil).Times(1)
-		mockStore.EXPECT().GetByStatus(deployment.Running).Return(deployments, nil).Times(1)
+		mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+		mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
+		mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return(deployments, nil).Times(1)
 
 		result, err := service.ProgressDeployment(ctx)
 		if err != deployment.ErrMoreThanOneInflightDeployment {
@@ -499,10 +575,10 @@ func TestTriggerService_ProgressDeployment(t *testing.T) {
 			Status: deployment.Completed,
 		}
 
-		mockLocker.EXPECT().Lock(ctx, "deployment").Return(nil).Times(1)
-		mockLocker.EXPECT().Unlock(ctx, "deployment").Return(nil).Times(1)
-		mockStore.EXPECT().GetByStatus(deployment.Running).Return([]*deployment.DeploymentRecord{deploymentRecord}, nil).Times(1)
-		mockStrategy.EXPECT().ProgressDeployment(ctx, deploymentRecord).Return(updatedRecord, nil).Times(1)
+		mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+		mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
+		mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{deploymentRecord}, nil).Times(1)
+		mockStrategy.EXPECT().ProgressDeployment(gomock.Any(), deploymentRecord).Return(updatedRecord, nil).Times(1)
 
 		result, err := service.ProgressDeployment(ctx)
 		if err != nil {
@@ -517,3 +593,156 @@ func TestTriggerService_ProgressDeployment(t *testing.T) {
 		}
 	})
 }
+
+func TestRollingDeployment_ProgressDeployment_InstanceRemoved(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockInventory := mocks.NewMockInventoryService(ctrl)
+	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory, nil)
+
+	record := &deployment.DeploymentRecord{
+		ID: "deployment-shrink",
+		Request: deployment.DeploymentRequest{
+			CodeVersion: "v2.0.0",
+			Labels:      map[string]string{"env": "prod"},
+			Configuration: deployment.Configuration{
+				BatchSize:        2,
+				FailureThreshold: 1,
+			},
+		},
+		Status:   deployment.Running,
+		Progress: deployment.DeploymentProgress{TotalMatchingInstances: 4, InProgressInstances: 1, CompletedInstances: 2},
+	}
+
+	desiredState := inventory.State{CodeVersion: "v2.0.0"}
+	sel := selector.FromLabels(record.Request.Labels)
+
+	// The instance that was still updating got deregistered, the remaining ones are done
+	mockInventory.EXPECT().CountProgress(gomock.Any(), sel, desiredState, nil).Return(inventory.Progress{Total: 3, InProgress: 0, Completed: 3, Failed: 0}, nil).Times(1)
+	mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+	result, err := rollingDeployment.ProgressDeployment(context.Background(), record)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Progress.TotalMatchingInstances != 3 {
+		t.Errorf("Expected 3 total instances, got %d", result.Progress.TotalMatchingInstances)
+	}
+	if result.Status != deployment.Completed {
+		t.Errorf("Expected status Completed, got %v", result.Status)
+	}
+}
+
+func TestRollingDeployment_ProgressDeployment_Conflict(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockInventory := mocks.NewMockInventoryService(ctrl)
+	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory, nil)
+
+	record := &deployment.DeploymentRecord{
+		ID: "deployment-001",
+		Request: deployment.DeploymentRequest{
+			CodeVersion:   "v2.0.0",
+			Labels:        map[string]string{"env": "prod"},
+			Configuration: deployment.Configuration{BatchSize: 2, FailureThreshold: 1},
+		},
+		Status:   deployment.Running,
+		Revision: 3,
+	}
+	desiredState := inventory.State{CodeVersion: "v2.0.0"}
+	sel := selector.FromLabels(map[string]string{"env": "prod"})
+
+	// The record changed since it was read, the conflict is returned as is for the unit of work to run again
+	mockInventory.EXPECT().CountProgress(gomock.Any(), sel, desiredState, nil).Return(inventory.Progress{Total: 2, InProgress: 2}, nil).Times(1)
+	mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).Return(deployment.ErrDeploymentConflict).Times(1)
+
+	_, err := rollingDeployment.ProgressDeployment(context.Background(), record)
+	if !errors.Is(err, deployment.ErrDeploymentConflict) {
+		t.Errorf("Expected ErrDeploymentConflict, got %v", err)
+	}
+}
+
+func TestRollingDeployment_ProgressDeployment_PublishesEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockInventory := mocks.NewMockInventoryService(ctrl)
+	mockEvents := mocks.NewMockPublisher(ctrl)
+	rollingDeployment := deployment.NewRollingDeployment(mockStore, mockInventory, mockEvents)
+
+	ctx := context.Background()
+	labels := map[string]string{"env": "prod"}
+	record := &deployment.DeploymentRecord{
+		ID: "deployment-events",
+		Request: deployment.DeploymentRequest{
+			CodeVersion:   "v2.0.0",
+			Labels:        labels,
+			Configuration: deployment.Configuration{BatchSize: 2, FailureThreshold: 1},
+		},
+		Status: deployment.Running,
+	}
+
+	desiredState := inventory.State{CodeVersion: "v2.0.0"}
+	previousState := inventory.State{CodeVersion: "v1.0.0"}
+	sel := selector.FromLabels(labels)
+
+	// web-2 is already at the desired state, the deployment only starts web-1 and web-3
+	batch := []*inventory.Instance{
+		{ID: "i-1", Name: "web-1", CurrentState: previousState, DesiredState: previousState, Status: inventory.HEALTHY},
+		{ID: "i-3", Name: "web-3", CurrentState: previousState, DesiredState: previousState, Status: inventory.HEALTHY},
+	}
+	mockInventory.EXPECT().CountByLabels(gomock.Any(), sel).Return(3, nil).Times(1)
+	mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), sel, desiredState, gomock.Any()).Return(batch, nil).Times(1)
+	mockInventory.EXPECT().UpdateDesiredStates(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+	// The same state is observed twice, web-1 completed and web-3 is still in progress
+	// Only the started instances are read back to report them
+	started := []*inventory.Instance{
+		{ID: "i-1", Name: "web-1", DesiredState: desiredState, CurrentState: desiredState, Status: inventory.HEALTHY},
+		{ID: "i-3", Name: "web-3", DesiredState: desiredState, CurrentState: previousState, Status: inventory.HEALTHY},
+	}
+	mockInventory.EXPECT().CountProgress(gomock.Any(), sel, desiredState, nil).Return(inventory.Progress{Total: 3, InProgress: 1, Completed: 2}, nil).Times(2)
+	// Once reported completed, web-1 is not read again
+	mockInventory.EXPECT().GetInstances(gomock.Any(), []string{"i-1", "i-3"}).Return(started, nil).Times(1)
+	mockInventory.EXPECT().GetInstances(gomock.Any(), []string{"i-3"}).Return(started[1:], nil).Times(1)
+	mockInventory.EXPECT().GetNeedingUpdate(gomock.Any(), sel, desiredState, gomock.Any()).Return(nil, nil).Times(2)
+	mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).Return(nil).Times(3)
+
+	// The completion of web-1 and the new progress are only published once, web-2 is never reported
+	gomock.InOrder(
+		mockEvents.EXPECT().Publish(gomock.Any()).Do(func(event deployment.Event) {
+			if event.Type != deployment.EventBatchStarted || len(event.Instances) != 2 {
+				t.Errorf("Expected the batch of web-1 and web-3 to be started, got %+v", event)
+			}
+		}),
+		mockEvents.EXPECT().Publish(gomock.Any()).Do(func(event deployment.Event) {
+			if event.Type != deployment.EventProgress || event.Progress.InProgressInstances != 2 {
+				t.Errorf("Expected progress with 2 instances in progress, got %+v", event)
+			}
+		}),
+		mockEvents.EXPECT().Publish(gomock.Any()).Do(func(event deployment.Event) {
+			if event.Type != deployment.EventInstanceCompleted || len(event.Instances) != 1 || event.Instances[0] != "i-1" {
+				t.Errorf("Expected i-1 to be completed, got %+v", event)
+			}
+		}),
+		mockEvents.EXPECT().Publish(gomock.Any()).Do(func(event deployment.Event) {
+			if event.Type != deployment.EventProgress || event.Progress.CompletedInstances != 2 {
+				t.Errorf("Expected progress with 2 completed instances, got %+v", event)
+			}
+		}),
+	)
+
+	if err := rollingDeployment.StartDeployment(ctx, record); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := rollingDeployment.ProgressDeployment(ctx, record); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+}
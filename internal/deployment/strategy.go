@@ -1,6 +1,11 @@
 package deployment
 
-import "context"
+import (
+	"context"
+
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+)
 
 // DeploymentStrategy defines the interface for different deployment strategies
 type DeploymentStrategy interface {
@@ -10,6 +15,12 @@ type DeploymentStrategy interface {
 	// ProgressDeployment advances the deployment to the next stage
 	ProgressDeployment(ctx context.Context, record *DeploymentRecord) (*DeploymentRecord, error)
 
-	// ResetFailedInstances resets the status of failed instances matching the labels to UNKNOWN
-	ResetFailedInstances(ctx context.Context, labels map[string]string) error
+	// PlanDeployment computes what StartDeployment and ProgressDeployment would do for the request without mutating any store
+	PlanDeployment(ctx context.Context, req *DeploymentRequest) (*DeploymentPlan, error)
+
+	// ResetFailedInstances resets the status of failed instances matching the label selector to UNKNOWN
+	ResetFailedInstances(ctx context.Context, sel selector.Selector) error
+
+	// ResolvePreviousStates returns the last known good state of every instance matching the label selector that was moved to the from state
+	ResolvePreviousStates(ctx context.Context, sel selector.Selector, from inventory.State) (map[string]inventory.State, error)
 }
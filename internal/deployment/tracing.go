@@ -0,0 +1,62 @@
+package deployment
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the deployment service, they are dropped until a tracer provider is registered
+var tracer = otel.Tracer("github.com/xnok/dides/internal/deployment")
+
+// Span attribute keys shared by the deployment spans and the decorated stores
+const (
+	AttributeDeploymentID     = attribute.Key("dides.deployment.id")
+	AttributeDeploymentStatus = attribute.Key("dides.deployment.status")
+	AttributeLabels           = attribute.Key("dides.labels")
+	AttributeCodeVersion      = attribute.Key("dides.code_version")
+	AttributeConfigVersion    = attribute.Key("dides.configuration_version")
+)
+
+// RequestAttributes returns the label selector and the versions targeted by the request
+func RequestAttributes(req *DeploymentRequest) []attribute.KeyValue {
+	if req == nil {
+		return nil
+	}
+	attributes := []attribute.KeyValue{
+		AttributeCodeVersion.String(req.CodeVersion),
+		AttributeConfigVersion.String(req.ConfigurationVersion),
+	}
+	if sel, err := req.LabelSelector(); err == nil {
+		attributes = append(attributes, AttributeLabels.String(sel.String()))
+	}
+	return attributes
+}
+
+// RecordAttributes returns the ID, the status and the request attributes of the deployment
+func RecordAttributes(record *DeploymentRecord) []attribute.KeyValue {
+	if record == nil {
+		return nil
+	}
+	return append(RequestAttributes(&record.Request),
+		AttributeDeploymentID.String(record.ID),
+		AttributeDeploymentStatus.Int(int(record.Status)),
+	)
+}
+
+// startSpan starts a child span of the span in the context
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan records the error, if any, on the span and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -4,10 +4,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/auth"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+	"github.com/xnok/dides/internal/transaction"
 )
 
 const (
 	lockKey = "deployment"
+
+	// maxUpdateAttempts is how many times a unit of work conflicting with a concurrent change is run before the conflict is returned
+	maxUpdateAttempts = 3
 )
 
 //go:generate mockgen -source=trigger.go -destination=mocks/mock_store.go -package=mocks
@@ -19,14 +29,23 @@ var (
 	ErrDeploymentNotFound            = errors.New("deployment not found")
 	ErrMoreThanOneInflightDeployment = errors.New("more than one inflight deployment found")
 	ErrNoPreviousDeploymentFound     = errors.New("no previous successful deployment found for rollback")
+	ErrNoPreviousStateFound          = errors.New("no instance has a previous state to roll back to")
 	ErrFailureThresholdExceeded      = errors.New("deployment failure threshold exceeded")
+	ErrEventsDisabled                = errors.New("deployment events are not enabled")
+	ErrDeploymentConflict            = errors.New("deployment was changed since it was read")
 )
 
 type Store interface {
-	Save(req *DeploymentRecord) error
-	GetByStatus(status DeploymentStatus) ([]*DeploymentRecord, error)
-	Update(record *DeploymentRecord) error
-	GetByLabelsAndStatus(labels map[string]string, status DeploymentStatus) ([]*DeploymentRecord, error)
+	Save(ctx context.Context, req *DeploymentRecord) error
+	GetByStatus(ctx context.Context, status DeploymentStatus) ([]*DeploymentRecord, error)
+	// Update saves the record if its revision is still the stored one and increments it, or fails with ErrDeploymentConflict
+	Update(ctx context.Context, record *DeploymentRecord) error
+	// GetByID returns the deployment with the ID, or ErrDeploymentNotFound
+	GetByID(ctx context.Context, id string) (*DeploymentRecord, error)
+	// GetByLabelsAndStatus returns the deployments with the status that only target instances matched by the selector, most recent first
+	GetByLabelsAndStatus(ctx context.Context, sel selector.Selector, status DeploymentStatus) ([]*DeploymentRecord, error)
+	// GetOverlappingByStatus returns the deployments with the status that may target an instance matched by the selector, most recent first
+	GetOverlappingByStatus(ctx context.Context, sel selector.Selector, status DeploymentStatus) ([]*DeploymentRecord, error)
 }
 
 type Locker interface {
@@ -34,20 +53,60 @@ type Locker interface {
 	Unlock(ctx context.Context, key string) error
 }
 
+// UnitOfWork runs fn in a transaction spanning the deployment and inventory stores, its writes are all kept or all undone
+// A unit of work started from the context of another one joins it, the events and audit entries wait for it to be committed
+type UnitOfWork interface {
+	Do(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// AuditLog records who changed which deployment and how
+type AuditLog interface {
+	Record(ctx context.Context, action audit.Action, target string, before, after interface{}) error
+}
+
 type TriggerService struct {
 	store    Store
 	lock     Locker
 	strategy DeploymentStrategy
+	audit    AuditLog
+	events   EventBus
+	work     UnitOfWork
 }
 
-func NewTriggerService(store Store, lock Locker, strategy DeploymentStrategy) *TriggerService {
+// NewTriggerService creates the deployment service, auditLog and events may be nil to disable the audit and the events
+// work may be nil when the stores do not support transactions, each write is then kept on its own
+func NewTriggerService(store Store, lock Locker, strategy DeploymentStrategy, auditLog AuditLog, events EventBus, work UnitOfWork) *TriggerService {
 	return &TriggerService{
 		store:    store,
 		lock:     lock,
 		strategy: strategy,
+		audit:    auditLog,
+		events:   events,
+		work:     work,
+	}
+}
+
+// inTransaction runs fn in a unit of work, if the stores support it
+// A unit of work that conflicts with a concurrent change of a deployment or an instance is undone and run again,
+// fn must read what it changes afresh every time it runs
+func (s *TriggerService) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if s.work == nil {
+		return fn(ctx)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.work.Do(ctx, fn)
+		if !isConflict(err) || attempt == maxUpdateAttempts {
+			return err
+		}
 	}
 }
 
+// isConflict checks if the error comes from a conditional update of a deployment or an instance changed since it was read
+func isConflict(err error) bool {
+	return errors.Is(err, ErrDeploymentConflict) || errors.Is(err, inventory.ErrRevisionConflict)
+}
+
 // Validate the deployment request
 func (r DeploymentRequest) Validate() error {
 	// TODO: validate the content of the request (eg. is the version valid)
@@ -55,11 +114,26 @@ func (r DeploymentRequest) Validate() error {
 		return ErrInvalidDeploymentRequest
 	}
 
-	if r.Configuration.BatchSize <= 0 {
+	if _, err := r.LabelSelector(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidDeploymentRequest, err)
+	}
+
+	return r.Configuration.Validate()
+}
+
+// Validate the deployment configuration
+func (c Configuration) Validate() error {
+	if c.BatchSize <= 0 {
+		return ErrInvalidDeploymentRequest
+	}
+
+	if c.FailureThreshold < 0 {
 		return ErrInvalidDeploymentRequest
 	}
 
-	if r.Configuration.FailureThreshold < 0 {
+	switch c.RollbackMode {
+	case RollbackToLastCompleted, RollbackPerInstance:
+	default:
 		return ErrInvalidDeploymentRequest
 	}
 
@@ -67,11 +141,18 @@ func (r DeploymentRequest) Validate() error {
 }
 
 // TriggerDeployment initiates a new deployment
-func (s *TriggerService) TriggerDeployment(ctx context.Context, req *DeploymentRequest) error {
+func (s *TriggerService) TriggerDeployment(ctx context.Context, req *DeploymentRequest) (err error) {
+	ctx, span := startSpan(ctx, "TriggerService.TriggerDeployment", RequestAttributes(req)...)
+	defer func() { EndSpan(span, err) }()
+
 	if err := req.Validate(); err != nil {
 		return err
 	}
 
+	if err := authorizeRequest(ctx, auth.Deployer, req); err != nil {
+		return err
+	}
+
 	// Concurrency check we need a lock here in case two or more requests has arrived
 	if err := s.lock.Lock(ctx, lockKey); err != nil {
 		return err
@@ -79,31 +160,97 @@ func (s *TriggerService) TriggerDeployment(ctx context.Context, req *DeploymentR
 	defer s.lock.Unlock(ctx, lockKey)
 
 	// 1. Feature Request: If a deployment rollout is in progress, a new deployment rollout cannot start
-	if s.isRolloutInProgress() {
+	if s.isRolloutInProgress(ctx) {
 		return ErrRolloutInProgress
 	}
 
-	// 2. Save the deployment record
-	record := &DeploymentRecord{
-		ID:      "", // Will be generated by the store
-		Request: *req,
-		Status:  Running,
+	// 2. Save the deployment record and start it in a single unit of work, a deployment that cannot start is not kept
+	return s.inTransaction(ctx, func(ctx context.Context) error {
+		record := &DeploymentRecord{
+			ID:      "", // Will be generated by the store
+			Request: *req,
+			Status:  Running,
+		}
+		if err := s.store.Save(ctx, record); err != nil {
+			return err
+		}
+		span.SetAttributes(AttributeDeploymentID.String(record.ID))
+
+		// 3. trigger the deployment using the strategy
+		s.publish(ctx, record, EventStarted)
+		if err := s.strategy.StartDeployment(ctx, record); err != nil {
+			return err
+		}
+
+		s.record(ctx, audit.DeploymentTrigger, nil, record)
+		return nil
+	})
+}
+
+// PlanDeployment returns what TriggerDeployment would do for the request without mutating any store
+func (s *TriggerService) PlanDeployment(ctx context.Context, req *DeploymentRequest) (_ *DeploymentPlan, err error) {
+	ctx, span := startSpan(ctx, "TriggerService.PlanDeployment", RequestAttributes(req)...)
+	defer func() { EndSpan(span, err) }()
+
+	if err := req.Validate(); err != nil {
+		return nil, err
 	}
-	if err := s.store.Save(record); err != nil {
-		return err
+
+	if err := authorizeRequest(ctx, auth.Viewer, req); err != nil {
+		return nil, err
 	}
 
-	// 3. trigger the deployment using the strategy
-	if err := s.strategy.StartDeployment(ctx, record); err != nil {
-		return err
+	// 1. Use the strategy to compute the batches
+	plan, err := s.strategy.PlanDeployment(ctx, req)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	// 2. Check the request would be accepted
+	if s.isRolloutInProgress(ctx) {
+		plan.Warnings = append(plan.Warnings, "a deployment rollout is in progress, the request would be rejected")
+	}
+
+	// 3. Check a rollback would be possible
+	if req.Configuration.RollbackMode == RollbackToLastCompleted {
+		sel, err := req.LabelSelector()
+		if err != nil {
+			return nil, err
+		}
+
+		previousDeployments, err := s.store.GetByLabelsAndStatus(ctx, sel, Completed)
+		if err != nil {
+			return nil, err
+		}
+
+		rollbackPossible := false
+		for _, deployment := range previousDeployments {
+			if len(deployment.Targets) == 0 {
+				rollbackPossible = true
+				break
+			}
+		}
+
+		if !rollbackPossible {
+			plan.Warnings = append(plan.Warnings, "no previous Completed deployment, rollback impossible")
+		}
+	}
+
+	return plan, nil
+}
+
+// authorizeRequest checks the operator of the context may run the request with the role
+func authorizeRequest(ctx context.Context, role auth.Role, req *DeploymentRequest) error {
+	sel, err := req.LabelSelector()
+	if err != nil {
+		return err
+	}
+	return auth.Authorize(ctx, role, sel)
 }
 
 // isRolloutInProgress checks if any deployment is currently running
-func (s *TriggerService) isRolloutInProgress() bool {
-	runningDeployments, err := s.store.GetByStatus(Running)
+func (s *TriggerService) isRolloutInProgress(ctx context.Context) bool {
+	runningDeployments, err := s.store.GetByStatus(ctx, Running)
 	if err != nil {
 		return false
 	}
@@ -112,116 +259,219 @@ func (s *TriggerService) isRolloutInProgress() bool {
 }
 
 // GetDeploymentStatus returns all currently running deployments
-func (s *TriggerService) GetDeploymentStatus(ctx context.Context) ([]*DeploymentRecord, error) {
-	return s.store.GetByStatus(Running)
+func (s *TriggerService) GetDeploymentStatus(ctx context.Context) (_ []*DeploymentRecord, err error) {
+	ctx, span := startSpan(ctx, "TriggerService.GetDeploymentStatus")
+	defer func() { EndSpan(span, err) }()
+
+	if err := auth.RequireRole(ctx, auth.Viewer); err != nil {
+		return nil, err
+	}
+	return s.store.GetByStatus(ctx, Running)
 }
 
 // ProgressDeployment checks instance states and progresses the deployment
-func (s *TriggerService) ProgressDeployment(ctx context.Context) (*DeploymentRecord, error) {
+func (s *TriggerService) ProgressDeployment(ctx context.Context) (_ *DeploymentRecord, err error) {
+	ctx, span := startSpan(ctx, "TriggerService.ProgressDeployment")
+	defer func() { EndSpan(span, err) }()
+
 	if err := s.lock.Lock(ctx, lockKey); err != nil {
 		return nil, err
 	}
 	defer s.lock.Unlock(ctx, lockKey)
 
-	// 1. Get the deployment record
-	records, err := s.store.GetByStatus(Running)
-	if err != nil {
-		return nil, err
-	}
+	// The deployment is read, progressed, marked failed over its failure threshold and rolled back in a single unit of work
+	// When the rollback cannot start, the unit is undone and the deployment is only marked failed in a new one
+	var updatedRecord, rollback *DeploymentRecord
+	var rollbackErr error
+	exceeded := false
+	progress := func(withRollback bool) error {
+		return s.inTransaction(ctx, func(ctx context.Context) error {
+			updatedRecord, rollback, rollbackErr, exceeded = nil, nil, nil, false
+
+			// 1. Get the deployment record
+			records, err := s.store.GetByStatus(ctx, Running)
+			if err != nil {
+				return err
+			}
 
-	if len(records) == 0 {
-		return nil, nil
-	}
+			if len(records) == 0 {
+				return nil
+			}
 
-	if len(records) != 1 {
-		return nil, ErrMoreThanOneInflightDeployment
-	}
+			if len(records) != 1 {
+				return ErrMoreThanOneInflightDeployment
+			}
 
-	// 2. Use the strategy to progress the deployment
-	updatedRecord, err := s.strategy.ProgressDeployment(ctx, records[0])
-	if err != nil {
-		// Check if failure threshold was exceeded in which case we trigger automatic rollback
-		if errors.Is(err, ErrFailureThresholdExceeded) {
-			// Mark the current deployment as failed
-			updatedRecord.Status = Failed
-			if updateErr := s.store.Update(updatedRecord); updateErr != nil {
-				return updatedRecord, updateErr
+			span.SetAttributes(RecordAttributes(records[0])...)
+			if err := authorizeRequest(ctx, auth.Deployer, &records[0].Request); err != nil {
+				return err
 			}
 
-			// Trigger automatic rollback deployment without acquiring locks (we already have them)
-			if rollbackErr := s.createRollbackDeployment(ctx, updatedRecord.Request.Labels, updatedRecord.Request.Configuration); rollbackErr != nil {
-				// If rollback fails, just return the original error
-				return updatedRecord, err
+			// 2. Use the strategy to progress the deployment
+			before := *records[0]
+			updatedRecord, err = s.strategy.ProgressDeployment(ctx, records[0])
+			if errors.Is(err, ErrFailureThresholdExceeded) {
+				// Mark the current deployment as failed
+				exceeded = true
+				updatedRecord.Status = Failed
+				err = s.store.Update(ctx, updatedRecord)
+			}
+			if err != nil {
+				return err
 			}
 
-			return updatedRecord, nil
-		}
-		return updatedRecord, err
+			s.record(ctx, audit.DeploymentProgress, &before, updatedRecord)
+			if !exceeded {
+				return nil
+			}
+
+			// 3. Failure threshold exceeded, we trigger automatic rollback without acquiring locks (we already have them)
+			if withRollback {
+				rollback, rollbackErr = s.rollbackFailed(ctx, updatedRecord)
+				if rollbackErr != nil && s.work != nil {
+					return rollbackErr
+				}
+			}
+			if rollback != nil {
+				event := newEvent(updatedRecord, EventRollback)
+				event.RollbackID = rollback.ID
+				publishAfterCommit(ctx, s.events, event)
+			}
+			s.publish(ctx, updatedRecord, EventFailed)
+			return nil
+		})
 	}
 
+	err = progress(true)
+	if err != nil && rollbackErr != nil && !isConflict(err) {
+		// If rollback fails, the deployment is still marked as failed and the original error returned
+		err = progress(false)
+	}
+	if err != nil {
+		return updatedRecord, err
+	}
+	if exceeded && rollback == nil {
+		return updatedRecord, ErrFailureThresholdExceeded
+	}
 	return updatedRecord, nil
 }
 
+// rollbackFailed starts the rollback of the deployment that exceeded its failure threshold to the previous completed one
+func (s *TriggerService) rollbackFailed(ctx context.Context, record *DeploymentRecord) (*DeploymentRecord, error) {
+	sel, err := record.Request.LabelSelector()
+	if err != nil {
+		return nil, err
+	}
+	return s.startRollback(ctx, sel, record.Request.Configuration)
+}
+
 // TriggerRollback creates a new deployment that rolls back to the previous successful deployment
 // Rollback has priority - if a deployment is in progress, it will be cancelled
-func (s *TriggerService) TriggerRollback(ctx context.Context, labels map[string]string, config Configuration) error {
+func (s *TriggerService) TriggerRollback(ctx context.Context, sel selector.Selector, config Configuration) (err error) {
+	ctx, span := startSpan(ctx, "TriggerService.TriggerRollback", AttributeLabels.String(sel.String()))
+	defer func() { EndSpan(span, err) }()
+
+	if err := auth.Authorize(ctx, auth.Deployer, sel); err != nil {
+		return err
+	}
+
 	// Concurrency check - we need a lock here in case requests arrive simultaneously
 	if err := s.lock.Lock(ctx, lockKey); err != nil {
 		return err
 	}
 	defer s.lock.Unlock(ctx, lockKey)
 
-	return s.createRollbackDeployment(ctx, labels, config)
+	rollback, err := s.createRollbackDeployment(ctx, sel, config)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(AttributeDeploymentID.String(rollback.ID))
+	return nil
 }
 
 // createRollbackDeployment creates a rollback deployment without acquiring locks (for internal use)
 // Rollback has priority - if a deployment is in progress, it will be cancelled
-func (s *TriggerService) createRollbackDeployment(ctx context.Context, labels map[string]string, config Configuration) error {
+// Cancelling the running deployments, resetting the failed instances and starting the rollback is a single unit of work
+func (s *TriggerService) createRollbackDeployment(ctx context.Context, sel selector.Selector, config Configuration) (*DeploymentRecord, error) {
+	var record *DeploymentRecord
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		record, err = s.startRollback(ctx, sel, config)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// startRollback cancels the running deployments and starts the rollback deployment
+func (s *TriggerService) startRollback(ctx context.Context, sel selector.Selector, config Configuration) (*DeploymentRecord, error) {
 	// 1. Cancel any deployment currently in progress (rollback has priority)
-	if s.isRolloutInProgress() {
-		runningDeployments, err := s.store.GetByStatus(Running)
+	if s.isRolloutInProgress(ctx) {
+		runningDeployments, err := s.store.GetByStatus(ctx, Running)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		// Only a caller allowed to deploy every running deployment may cancel them
+		for _, deployment := range runningDeployments {
+			if err := authorizeRequest(ctx, auth.Deployer, &deployment.Request); err != nil {
+				return nil, ErrRolloutInProgress
+			}
 		}
 
 		// Cancel all running deployments
 		for _, deployment := range runningDeployments {
+			before := *deployment
 			deployment.Status = Failed
-			if err := s.store.Update(deployment); err != nil {
-				return err
+			if err := s.store.Update(ctx, deployment); err != nil {
+				return nil, err
 			}
+			s.record(ctx, audit.DeploymentCancel, &before, deployment)
+			s.publish(ctx, deployment, EventFailed)
 		}
 	}
 
 	// 2. Reset failed instances before starting rollback
-	if err := s.strategy.ResetFailedInstances(ctx, labels); err != nil {
-		return fmt.Errorf("failed to reset failed instances: %w", err)
+	if err := s.strategy.ResetFailedInstances(ctx, sel); err != nil {
+		return nil, fmt.Errorf("failed to reset failed instances: %w", err)
 	}
 
-	// 2. Find the most recent completed deployment with the same labels
-	previousDeployments, err := s.store.GetByLabelsAndStatus(labels, Completed)
+	if config.RollbackMode == RollbackPerInstance {
+		return s.createPerInstanceRollback(ctx, sel, config)
+	}
+
+	// 2. Find the most recent completed deployment within the same labels
+	previousDeployments, err := s.store.GetByLabelsAndStatus(ctx, sel, Completed)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(previousDeployments) == 0 {
-		return ErrNoPreviousDeploymentFound
+	// 3. Get the most recent completed deployment (first in the sorted list), per-instance rollbacks have no single version
+	var previousDeployment *DeploymentRecord
+	for _, deployment := range previousDeployments {
+		if len(deployment.Targets) == 0 {
+			previousDeployment = deployment
+			break
+		}
 	}
 
-	// 3. Get the most recent completed deployment (first in the sorted list)
-	previousDeployment := previousDeployments[0]
+	if previousDeployment == nil {
+		return nil, ErrNoPreviousDeploymentFound
+	}
 
 	// 4. Create a rollback deployment request
 	rollbackRequest := &DeploymentRequest{
 		CodeVersion:          previousDeployment.Request.CodeVersion,
 		ConfigurationVersion: previousDeployment.Request.ConfigurationVersion,
-		Labels:               labels,
+		Selector:             sel.String(),
 		Configuration:        config,
 	}
 
 	// 5. Validate the rollback request
 	if err := rollbackRequest.Validate(); err != nil {
-		return err
+		return nil, err
 	}
 
 	// 6. Save the deployment record
@@ -230,10 +480,160 @@ func (s *TriggerService) createRollbackDeployment(ctx context.Context, labels ma
 		Request: *rollbackRequest,
 		Status:  Running,
 	}
-	if err := s.store.Save(record); err != nil {
-		return err
+	if err := s.store.Save(ctx, record); err != nil {
+		return nil, err
 	}
 
 	// 7. Start the rollback deployment using the strategy
-	return s.strategy.StartDeployment(ctx, record)
+	s.publish(ctx, record, EventStarted)
+	if err := s.strategy.StartDeployment(ctx, record); err != nil {
+		return nil, err
+	}
+
+	s.record(ctx, audit.DeploymentRollback, nil, record)
+	return record, nil
+}
+
+// createPerInstanceRollback creates a rollback deployment that restores each instance touched by the last deployment to its own previous state
+func (s *TriggerService) createPerInstanceRollback(ctx context.Context, sel selector.Selector, config Configuration) (*DeploymentRecord, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	// 1. Find the last deployment that moved the instances away from their previous state
+	lastDeployment, err := s.lastDeployment(ctx, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Resolve the state to restore for each instance it touched
+	from := inventory.State{
+		CodeVersion:          lastDeployment.Request.CodeVersion,
+		ConfigurationVersion: lastDeployment.Request.ConfigurationVersion,
+	}
+	targets, err := s.strategy.ResolvePreviousStates(ctx, sel, from)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(targets) == 0 {
+		return nil, ErrNoPreviousStateFound
+	}
+
+	// 3. Save the deployment record
+	record := &DeploymentRecord{
+		ID: "", // Will be generated by the store
+		Request: DeploymentRequest{
+			Selector:      sel.String(),
+			Configuration: config,
+		},
+		Status:  Running,
+		Targets: targets,
+	}
+	if err := s.store.Save(ctx, record); err != nil {
+		return nil, err
+	}
+
+	// 4. Start the rollback deployment using the strategy
+	s.publish(ctx, record, EventStarted)
+	if err := s.strategy.StartDeployment(ctx, record); err != nil {
+		return nil, err
+	}
+
+	s.record(ctx, audit.DeploymentRollback, nil, record)
+	return record, nil
+}
+
+// publish sends an event with the current status and progress of the deployment once the unit of work is committed, if events are enabled
+func (s *TriggerService) publish(ctx context.Context, record *DeploymentRecord, eventType EventType) {
+	publishAfterCommit(ctx, s.events, newEvent(record, eventType))
+}
+
+// finalEvent returns the final event of a finished deployment with its current status and progress, at the last event ID of the client
+func finalEvent(record *DeploymentRecord, lastEventID int64) Event {
+	event := newEvent(record, EventFailed)
+	if record.Status == Completed {
+		event.Type = EventCompleted
+	}
+	event.ID = lastEventID
+	return event
+}
+
+// WatchDeployment returns the events of the deployment published after lastEventID and a channel of the next ones
+// The channel is nil when the deployment is over and every event is returned, cancel releases the subscription
+func (s *TriggerService) WatchDeployment(ctx context.Context, id string, lastEventID int64) ([]Event, <-chan Event, func(), error) {
+	if s.events == nil {
+		return nil, nil, nil, ErrEventsDisabled
+	}
+
+	record, err := s.store.GetByID(ctx, id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err := authorizeRequest(ctx, auth.Viewer, &record.Request); err != nil {
+		return nil, nil, nil, err
+	}
+
+	backlog, events, cancel := s.events.Subscribe(id, lastEventID)
+
+	// The final event of a finished deployment was published before the record was read
+	if record.Status != Running {
+		cancel()
+		// The history of a deployment finished long ago is dropped by the event bus, its final event is rebuilt from the record
+		if len(backlog) == 0 || !backlog[len(backlog)-1].Final() {
+			backlog = append(backlog, finalEvent(record, lastEventID))
+		}
+		return backlog, nil, func() {}, nil
+	}
+
+	return backlog, events, cancel, nil
+}
+
+// record adds the change of a deployment to the audit log once the unit of work is committed, if any
+// The change is made by then, an audit entry that cannot be recorded is logged instead of failing the request
+func (s *TriggerService) record(ctx context.Context, action audit.Action, before, after *DeploymentRecord) {
+	if s.audit == nil || after == nil {
+		return
+	}
+
+	var beforeCopy *DeploymentRecord
+	if before != nil {
+		beforeCopy = new(DeploymentRecord)
+		*beforeCopy = *before
+	}
+	afterCopy := *after
+	transaction.AfterCommit(ctx, func() {
+		if err := s.audit.Record(ctx, action, afterCopy.ID, beforeCopy, &afterCopy); err != nil {
+			log.Printf("Failed to record audit entry %s of deployment %s: %v", action, afterCopy.ID, err)
+		}
+	})
+}
+
+// lastDeployment returns the most recent Failed or Completed deployment overlapping the selector that targeted a single state
+func (s *TriggerService) lastDeployment(ctx context.Context, sel selector.Selector) (*DeploymentRecord, error) {
+	var last *DeploymentRecord
+	for _, status := range []DeploymentStatus{Failed, Completed} {
+		records, err := s.store.GetOverlappingByStatus(ctx, sel, status)
+		if err != nil {
+			return nil, err
+		}
+
+		// Records are sorted most recent first
+		for _, record := range records {
+			if len(record.Targets) > 0 {
+				continue
+			}
+			if last == nil || record.CreatedAt.After(last.CreatedAt) {
+				last = record
+			}
+			break
+		}
+	}
+
+	if last == nil {
+		return nil, ErrNoPreviousDeploymentFound
+	}
+
+	return last, nil
 }
@@ -6,8 +6,13 @@ import (
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/auth"
 	"github.com/xnok/dides/internal/deployment"
 	"github.com/xnok/dides/internal/deployment/mocks"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+	"github.com/xnok/dides/internal/transaction"
 )
 
 func TestTriggerService_TriggerDeployment(t *testing.T) {
@@ -17,7 +22,8 @@ func TestTriggerService_TriggerDeployment(t *testing.T) {
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	mockAudit := mocks.NewMockAuditLog(ctrl)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, mockAudit, nil, nil)
 
 	ctx := context.Background()
 	req := deployment.DeploymentRequest{
@@ -31,19 +37,21 @@ func TestTriggerService_TriggerDeployment(t *testing.T) {
 	}
 
 	// Set expectations for locker
-	mockLocker.EXPECT().Lock(ctx, "deployment").Return(nil).Times(1)
-	mockLocker.EXPECT().Unlock(ctx, "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
 
 	// Set expectations: GetByStatus should be called to check for running deployments
-	mockStore.EXPECT().GetByStatus(deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
 	// Save should be called once with a deployment record and return nil
-	mockStore.EXPECT().Save(gomock.Any()).DoAndReturn(func(record *deployment.DeploymentRecord) error {
+	mockStore.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, record *deployment.DeploymentRecord) error {
 		// Simulate ID assignment
 		record.ID = "deployment-001"
 		return nil
 	}).Times(1)
 	// Mock strategy StartDeployment call
 	mockStrategy.EXPECT().StartDeployment(gomock.Any(), gomock.Any()).Return(nil).Times(1)
+	// The new deployment is recorded in the audit log
+	mockAudit.EXPECT().Record(gomock.Any(), audit.DeploymentTrigger, "deployment-001", gomock.Nil(), gomock.Any()).Return(nil).Times(1)
 
 	err := service.TriggerDeployment(ctx, &req)
 	if err != nil {
@@ -58,7 +66,7 @@ func TestTriggerService_TriggerDeployment_EmptyCodeVersion(t *testing.T) {
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
 
 	ctx := context.Background()
 	req := deployment.DeploymentRequest{
@@ -74,6 +82,61 @@ func TestTriggerService_TriggerDeployment_EmptyCodeVersion(t *testing.T) {
 	}
 }
 
+func TestTriggerService_TriggerDeployment_InvalidLabels(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	service := deployment.NewTriggerService(mocks.NewMockStore(ctrl), mocks.NewMockLocker(ctrl), mocks.NewMockDeploymentStrategy(ctrl), nil, nil, nil)
+
+	// The selector of a rollback to the deployment is its string form, the labels must be valid in it
+	req := deployment.DeploymentRequest{
+		CodeVersion:   "v1.2.3",
+		Labels:        map[string]string{"env": "prod,role=web"},
+		Configuration: deployment.Configuration{BatchSize: 2},
+	}
+
+	if err := service.TriggerDeployment(context.Background(), &req); !errors.Is(err, deployment.ErrInvalidDeploymentRequest) {
+		t.Errorf("Expected ErrInvalidDeploymentRequest, got %v", err)
+	}
+}
+
+func TestTriggerService_TriggerDeployment_OutsideScope(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockLocker := mocks.NewMockLocker(ctrl)
+	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
+
+	// The team may only deploy to web instances
+	ctx := auth.WithPrincipal(context.Background(), &auth.Principal{
+		Name:  "web-team",
+		Role:  auth.Deployer,
+		Scope: selector.FromLabels(map[string]string{"role": "web"}),
+	})
+	req := deployment.DeploymentRequest{
+		CodeVersion: "v1.2.3",
+		Labels:      map[string]string{"env": "prod"},
+		Configuration: deployment.Configuration{
+			BatchSize:        2,
+			FailureThreshold: 1,
+		},
+	}
+
+	// No expectations since authorization should fail before any store or locker calls
+
+	err := service.TriggerDeployment(ctx, &req)
+	if !errors.Is(err, auth.ErrForbidden) {
+		t.Errorf("Expected ErrForbidden, got %v", err)
+	}
+
+	err = service.TriggerRollback(ctx, selector.FromLabels(map[string]string{"role": "db"}), req.Configuration)
+	if !errors.Is(err, auth.ErrForbidden) {
+		t.Errorf("Expected ErrForbidden for rollback, got %v", err)
+	}
+}
+
 func TestTriggerService_TriggerDeployment_StoreError(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -81,7 +144,7 @@ func TestTriggerService_TriggerDeployment_StoreError(t *testing.T) {
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
 
 	ctx := context.Background()
 	req := deployment.DeploymentRequest{
@@ -94,13 +157,13 @@ func TestTriggerService_TriggerDeployment_StoreError(t *testing.T) {
 	}
 
 	// Set expectations for locker
-	mockLocker.EXPECT().Lock(ctx, "deployment").Return(nil).Times(1)
-	mockLocker.EXPECT().Unlock(ctx, "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
 
 	// Set expectations: GetByStatus should be called to check for running deployments
-	mockStore.EXPECT().GetByStatus(deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
 	// Save should be called and return an error
-	mockStore.EXPECT().Save(gomock.Any()).Return(deployment.ErrInvalidDeploymentRequest).Times(1)
+	mockStore.EXPECT().Save(gomock.Any(), gomock.Any()).Return(deployment.ErrInvalidDeploymentRequest).Times(1)
 
 	err := service.TriggerDeployment(ctx, &req)
 	if err != deployment.ErrInvalidDeploymentRequest {
@@ -115,7 +178,7 @@ func TestTriggerService_TriggerDeployment_RolloutInProgress(t *testing.T) {
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
 
 	ctx := context.Background()
 	req := deployment.DeploymentRequest{
@@ -133,11 +196,11 @@ func TestTriggerService_TriggerDeployment_RolloutInProgress(t *testing.T) {
 	}
 
 	// Set expectations for locker
-	mockLocker.EXPECT().Lock(ctx, "deployment").Return(nil).Times(1)
-	mockLocker.EXPECT().Unlock(ctx, "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
 
 	// GetByStatus should return a running deployment
-	mockStore.EXPECT().GetByStatus(deployment.Running).Return([]*deployment.DeploymentRecord{runningDeployment}, nil).Times(1)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{runningDeployment}, nil).Times(1)
 
 	err := service.TriggerDeployment(ctx, &req)
 	if err != deployment.ErrRolloutInProgress {
@@ -152,7 +215,7 @@ func TestTriggerService_TriggerDeployment_LockError(t *testing.T) {
 	mockStore := mocks.NewMockStore(ctrl)
 	mockLocker := mocks.NewMockLocker(ctrl)
 	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
-	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
 
 	ctx := context.Background()
 	req := deployment.DeploymentRequest{
@@ -166,10 +229,297 @@ func TestTriggerService_TriggerDeployment_LockError(t *testing.T) {
 
 	// Lock should fail
 	lockErr := errors.New("failed to acquire lock")
-	mockLocker.EXPECT().Lock(ctx, "deployment").Return(lockErr).Times(1)
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(lockErr).Times(1)
 
 	err := service.TriggerDeployment(ctx, &req)
 	if err != lockErr {
 		t.Errorf("Expected lock error, got %v", err)
 	}
 }
+
+func TestTriggerService_PlanDeployment(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockLocker := mocks.NewMockLocker(ctrl)
+	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
+
+	ctx := context.Background()
+	req := deployment.DeploymentRequest{
+		CodeVersion:          "v1.2.3",
+		ConfigurationVersion: "config-v1.0",
+		Labels:               map[string]string{"env": "prod"},
+		Configuration: deployment.Configuration{
+			BatchSize:        2,
+			FailureThreshold: 1,
+		},
+	}
+
+	// Planning never locks, saves or updates anything
+	mockStrategy.EXPECT().PlanDeployment(gomock.Any(), &req).Return(&deployment.DeploymentPlan{
+		Request:           req,
+		MatchingInstances: 3,
+		Batches:           [][]string{{"instance-1", "instance-2"}, {"instance-3"}},
+		FailureThreshold:  1,
+		Warnings:          []string{},
+	}, nil).Times(1)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+	mockStore.EXPECT().GetByLabelsAndStatus(gomock.Any(), selector.FromLabels(req.Labels), deployment.Completed).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+
+	plan, err := service.PlanDeployment(ctx, &req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(plan.Batches) != 2 {
+		t.Errorf("Expected 2 batches, got %d", len(plan.Batches))
+	}
+
+	if len(plan.Warnings) != 1 || plan.Warnings[0] != "no previous Completed deployment, rollback impossible" {
+		t.Errorf("Expected rollback warning, got %v", plan.Warnings)
+	}
+}
+
+func TestTriggerService_PlanDeployment_InvalidRequest(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockLocker := mocks.NewMockLocker(ctrl)
+	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, nil)
+
+	req := deployment.DeploymentRequest{
+		CodeVersion: "v1.2.3",
+	}
+
+	_, err := service.PlanDeployment(context.Background(), &req)
+	if err != deployment.ErrInvalidDeploymentRequest {
+		t.Errorf("Expected ErrInvalidDeploymentRequest, got %v", err)
+	}
+}
+
+func TestTriggerService_TriggerDeployment_UnitOfWork(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockLocker := mocks.NewMockLocker(ctrl)
+	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
+	mockWork := mocks.NewMockUnitOfWork(ctrl)
+	mockAudit := mocks.NewMockAuditLog(ctrl)
+	mockEvents := mocks.NewMockEventBus(ctrl)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, mockAudit, mockEvents, mockWork)
+
+	req := deployment.DeploymentRequest{
+		CodeVersion:   "v1.2.3",
+		Labels:        map[string]string{"env": "prod"},
+		Configuration: deployment.Configuration{BatchSize: 2, FailureThreshold: 1},
+	}
+
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return([]*deployment.DeploymentRecord{}, nil).Times(1)
+
+	// The record is saved and started in the unit of work, which undoes the save when the start fails
+	// The started event and the audit entry are dropped with it, the mocks fail on any call
+	startErr := errors.New("no instances match the specified labels")
+	inWork := false
+	mockWork.EXPECT().Do(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, fn func(context.Context) error) error {
+		inWork = true
+		defer func() { inWork = false }()
+		return transaction.NewManager().Do(ctx, fn)
+	}).Times(1)
+	mockStore.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, record *deployment.DeploymentRecord) error {
+		if !inWork {
+			t.Errorf("Expected the record to be saved in the unit of work")
+		}
+		return nil
+	}).Times(1)
+	mockStrategy.EXPECT().StartDeployment(gomock.Any(), gomock.Any()).DoAndReturn(func(context.Context, *deployment.DeploymentRecord) error {
+		if !inWork {
+			t.Errorf("Expected the deployment to start in the unit of work")
+		}
+		return startErr
+	}).Times(1)
+
+	if err := service.TriggerDeployment(context.Background(), &req); !errors.Is(err, startErr) {
+		t.Errorf("Expected the start error, got %v", err)
+	}
+}
+
+func TestTriggerService_ProgressDeployment_RetriesOnConflict(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockLocker := mocks.NewMockLocker(ctrl)
+	mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
+	mockWork := mocks.NewMockUnitOfWork(ctrl)
+	service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, mockWork)
+
+	running := func(revision int64) []*deployment.DeploymentRecord {
+		return []*deployment.DeploymentRecord{{
+			ID:       "deployment-001",
+			Request:  deployment.DeploymentRequest{CodeVersion: "v2.0.0", Configuration: deployment.Configuration{BatchSize: 2, FailureThreshold: 1}},
+			Status:   deployment.Running,
+			Revision: revision,
+		}}
+	}
+
+	mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
+	mockWork.EXPECT().Do(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, fn func(context.Context) error) error {
+		return fn(ctx)
+	}).Times(2)
+
+	// The first unit of work conflicts with an instance changed meanwhile, the second one reads the deployment again
+	gomock.InOrder(
+		mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return(running(3), nil),
+		mockStrategy.EXPECT().ProgressDeployment(gomock.Any(), gomock.Any()).Return(nil, inventory.ErrRevisionConflict),
+		mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return(running(4), nil),
+		mockStrategy.EXPECT().ProgressDeployment(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, record *deployment.DeploymentRecord) (*deployment.DeploymentRecord, error) {
+			if record.Revision != 4 {
+				t.Errorf("Expected the fresh record, got revision %d", record.Revision)
+			}
+			return record, nil
+		}),
+	)
+
+	record, err := service.ProgressDeployment(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if record.Revision != 4 {
+		t.Errorf("Expected the record of the second unit of work, got revision %d", record.Revision)
+	}
+}
+
+func TestTriggerService_ProgressDeployment_RollsBackInTheUnitOfWork(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		previous  []*deployment.DeploymentRecord
+		wantUnits int
+		wantErr   error
+	}{
+		{
+			name:      "rollback started",
+			previous:  []*deployment.DeploymentRecord{{ID: "deployment-000", Request: deployment.DeploymentRequest{CodeVersion: "v1.0.0", ConfigurationVersion: "c1"}, Status: deployment.Completed}},
+			wantUnits: 1,
+		},
+		{
+			// The unit of work is undone and the deployment is only marked failed in a second one
+			name:      "no previous deployment",
+			wantUnits: 2,
+			wantErr:   deployment.ErrFailureThresholdExceeded,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			mockStore := mocks.NewMockStore(ctrl)
+			mockLocker := mocks.NewMockLocker(ctrl)
+			mockStrategy := mocks.NewMockDeploymentStrategy(ctrl)
+			mockWork := mocks.NewMockUnitOfWork(ctrl)
+			service := deployment.NewTriggerService(mockStore, mockLocker, mockStrategy, nil, nil, mockWork)
+
+			running := func() []*deployment.DeploymentRecord {
+				return []*deployment.DeploymentRecord{{
+					ID:      "deployment-001",
+					Request: deployment.DeploymentRequest{CodeVersion: "v2.0.0", ConfigurationVersion: "c1", Labels: map[string]string{"env": "prod"}, Configuration: deployment.Configuration{BatchSize: 2, FailureThreshold: 1}},
+					Status:  deployment.Running,
+				}}
+			}
+			exceeded := func(_ context.Context, record *deployment.DeploymentRecord) (*deployment.DeploymentRecord, error) {
+				return record, deployment.ErrFailureThresholdExceeded
+			}
+
+			mockLocker.EXPECT().Lock(gomock.Any(), "deployment").Return(nil).Times(1)
+			mockLocker.EXPECT().Unlock(gomock.Any(), "deployment").Return(nil).Times(1)
+			inWork, units := false, 0
+			mockWork.EXPECT().Do(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx context.Context, fn func(context.Context) error) error {
+				inWork = true
+				units++
+				defer func() { inWork = false }()
+				return transaction.NewManager().Do(ctx, fn)
+			}).Times(tc.wantUnits)
+			mockStore.EXPECT().Update(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, record *deployment.DeploymentRecord) error {
+				if !inWork || record.Status != deployment.Failed {
+					t.Errorf("Expected the deployment marked failed in the unit of work, got %v", record.Status)
+				}
+				return nil
+			}).Times(tc.wantUnits)
+
+			// The rollback reads the deployments again after the failed one is marked, in the same unit of work
+			calls := []*gomock.Call{
+				mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return(running(), nil),
+				mockStrategy.EXPECT().ProgressDeployment(gomock.Any(), gomock.Any()).DoAndReturn(exceeded),
+				mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return(nil, nil),
+				mockStrategy.EXPECT().ResetFailedInstances(gomock.Any(), gomock.Any()).Return(nil),
+				mockStore.EXPECT().GetByLabelsAndStatus(gomock.Any(), gomock.Any(), deployment.Completed).Return(tc.previous, nil),
+			}
+			if tc.previous != nil {
+				calls = append(calls,
+					mockStore.EXPECT().Save(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, record *deployment.DeploymentRecord) error {
+						if units != 1 || record.Request.CodeVersion != "v1.0.0" {
+							t.Errorf("Expected the rollback to v1.0.0 saved in the first unit of work, got %s in unit %d", record.Request.CodeVersion, units)
+						}
+						record.ID = "deployment-002"
+						return nil
+					}),
+					mockStrategy.EXPECT().StartDeployment(gomock.Any(), gomock.Any()).Return(nil),
+				)
+			} else {
+				calls = append(calls,
+					mockStore.EXPECT().GetByStatus(gomock.Any(), deployment.Running).Return(running(), nil),
+					mockStrategy.EXPECT().ProgressDeployment(gomock.Any(), gomock.Any()).DoAndReturn(exceeded),
+				)
+			}
+			gomock.InOrder(calls...)
+
+			record, err := service.ProgressDeployment(context.Background())
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected %v, got %v", tc.wantErr, err)
+			}
+			if record.Status != deployment.Failed {
+				t.Errorf("Expected the deployment failed, got %v", record.Status)
+			}
+		})
+	}
+}
+
+func TestTriggerService_WatchDeployment_RebuildsTheDroppedFinalEvent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockStore := mocks.NewMockStore(ctrl)
+	mockEvents := mocks.NewMockEventBus(ctrl)
+	service := deployment.NewTriggerService(mockStore, mocks.NewMockLocker(ctrl), mocks.NewMockDeploymentStrategy(ctrl), nil, mockEvents, nil)
+
+	record := &deployment.DeploymentRecord{
+		ID:       "deployment-001",
+		Request:  deployment.DeploymentRequest{CodeVersion: "v2.0.0"},
+		Status:   deployment.Completed,
+		Progress: deployment.DeploymentProgress{TotalMatchingInstances: 2, CompletedInstances: 2},
+	}
+	mockStore.EXPECT().GetByID(gomock.Any(), "deployment-001").Return(record, nil)
+
+	// The event bus dropped the history of the deployment finished long ago
+	mockEvents.EXPECT().Subscribe("deployment-001", int64(7)).Return(nil, make(chan deployment.Event), func() {})
+
+	backlog, events, cancel, err := service.WatchDeployment(context.Background(), "deployment-001", 7)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer cancel()
+
+	if events != nil {
+		t.Errorf("Expected no channel for a finished deployment")
+	}
+	if len(backlog) != 1 || backlog[0].Type != deployment.EventCompleted || backlog[0].ID != 7 || backlog[0].Progress != record.Progress {
+		t.Errorf("Expected the final event rebuilt from the record, got %+v", backlog)
+	}
+}
@@ -0,0 +1,99 @@
+package grpcapi
+
+import (
+	didesv1 "github.com/xnok/dides/api/dides/v1"
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func toState(state inventory.State) *didesv1.State {
+	return &didesv1.State{
+		CodeVersion:          state.CodeVersion,
+		ConfigurationVersion: state.ConfigurationVersion,
+	}
+}
+
+func fromState(state *didesv1.State) inventory.State {
+	return inventory.State{
+		CodeVersion:          state.GetCodeVersion(),
+		ConfigurationVersion: state.GetConfigurationVersion(),
+	}
+}
+
+func toInstance(instance *inventory.Instance) *didesv1.Instance {
+	return &didesv1.Instance{
+		Id:              instance.ID,
+		Ip:              instance.IP,
+		Name:            instance.Name,
+		Labels:          instance.Labels,
+		LastPing:        timestamppb.New(instance.LastPing),
+		Status:          didesv1.InstanceStatus(instance.Status),
+		CurrentState:    toState(instance.CurrentState),
+		DesiredState:    toState(instance.DesiredState),
+		DesiredRevision: instance.DesiredRevision,
+		PreviousState:   toState(instance.PreviousState),
+		Cordoned:        instance.Cordoned,
+		Draining:        instance.Draining,
+	}
+}
+
+func toConfiguration(config deployment.Configuration) *didesv1.DeploymentConfiguration {
+	return &didesv1.DeploymentConfiguration{
+		BatchSize:        int32(config.BatchSize),
+		FailureThreshold: int32(config.FailureThreshold),
+		RollbackMode:     string(config.RollbackMode),
+	}
+}
+
+func fromConfiguration(config *didesv1.DeploymentConfiguration) deployment.Configuration {
+	return deployment.Configuration{
+		BatchSize:        int(config.GetBatchSize()),
+		FailureThreshold: int(config.GetFailureThreshold()),
+		RollbackMode:     deployment.RollbackMode(config.GetRollbackMode()),
+	}
+}
+
+func toDeploymentRequest(req deployment.DeploymentRequest) *didesv1.DeploymentRequest {
+	return &didesv1.DeploymentRequest{
+		CodeVersion:          req.CodeVersion,
+		ConfigurationVersion: req.ConfigurationVersion,
+		Labels:               req.Labels,
+		Selector:             req.Selector,
+		Configuration:        toConfiguration(req.Configuration),
+	}
+}
+
+func fromDeploymentRequest(req *didesv1.DeploymentRequest) deployment.DeploymentRequest {
+	return deployment.DeploymentRequest{
+		CodeVersion:          req.GetCodeVersion(),
+		ConfigurationVersion: req.GetConfigurationVersion(),
+		Labels:               req.GetLabels(),
+		Selector:             req.GetSelector(),
+		Configuration:        fromConfiguration(req.GetConfiguration()),
+	}
+}
+
+func toDeployment(record *deployment.DeploymentRecord) *didesv1.Deployment {
+	var targets map[string]*didesv1.State
+	if len(record.Targets) > 0 {
+		targets = make(map[string]*didesv1.State, len(record.Targets))
+		for key, state := range record.Targets {
+			targets[key] = toState(state)
+		}
+	}
+
+	return &didesv1.Deployment{
+		Id:        record.ID,
+		Request:   toDeploymentRequest(record.Request),
+		Status:    didesv1.DeploymentStatus(record.Status),
+		CreatedAt: timestamppb.New(record.CreatedAt),
+		Progress: &didesv1.DeploymentProgress{
+			TotalInstances:      int32(record.Progress.TotalMatchingInstances),
+			InProgressInstances: int32(record.Progress.InProgressInstances),
+			CompletedInstances:  int32(record.Progress.CompletedInstances),
+			FailedInstances:     int32(record.Progress.FailedInstances),
+		},
+		Targets: targets,
+	}
+}
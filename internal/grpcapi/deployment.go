@@ -0,0 +1,105 @@
+package grpcapi
+
+import (
+	"context"
+
+	didesv1 "github.com/xnok/dides/api/dides/v1"
+	"github.com/xnok/dides/internal/auth"
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/selector"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DeploymentServer serves the operator-facing gRPC API with the same service as the REST API
+type DeploymentServer struct {
+	didesv1.UnimplementedDeploymentServiceServer
+
+	deployments   *deployment.TriggerService
+	authenticator *auth.Authenticator
+}
+
+// NewDeploymentServer creates the operator-facing gRPC server, the API is open when authenticator is nil
+func NewDeploymentServer(deployments *deployment.TriggerService, authenticator *auth.Authenticator) *DeploymentServer {
+	return &DeploymentServer{
+		deployments:   deployments,
+		authenticator: authenticator,
+	}
+}
+
+// TriggerDeployment starts a rolling deployment
+func (s *DeploymentServer) TriggerDeployment(ctx context.Context, req *didesv1.TriggerDeploymentRequest) (*didesv1.TriggerDeploymentResponse, error) {
+	ctx, err := s.authenticate(ctx, auth.Deployer)
+	if err != nil {
+		return nil, err
+	}
+
+	request := fromDeploymentRequest(req.GetRequest())
+	if err := s.deployments.TriggerDeployment(ctx, &request); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &didesv1.TriggerDeploymentResponse{Request: toDeploymentRequest(request)}, nil
+}
+
+// GetDeploymentStatus returns the running deployments
+func (s *DeploymentServer) GetDeploymentStatus(ctx context.Context, req *didesv1.GetDeploymentStatusRequest) (*didesv1.GetDeploymentStatusResponse, error) {
+	ctx, err := s.authenticate(ctx, auth.Viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := s.deployments.GetDeploymentStatus(ctx)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	response := &didesv1.GetDeploymentStatusResponse{}
+	for _, record := range records {
+		response.Deployments = append(response.Deployments, toDeployment(record))
+	}
+	return response, nil
+}
+
+// Rollback starts a deployment restoring the previous state of the instances matching the labels and selector
+func (s *DeploymentServer) Rollback(ctx context.Context, req *didesv1.RollbackRequest) (*didesv1.RollbackResponse, error) {
+	ctx, err := s.authenticate(ctx, auth.Deployer)
+	if err != nil {
+		return nil, err
+	}
+
+	sel, err := selector.Build(req.GetLabels(), req.GetSelector())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid label selector")
+	}
+
+	if err := s.deployments.TriggerRollback(ctx, sel, fromConfiguration(req.GetConfiguration())); err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &didesv1.RollbackResponse{Selector: sel.String()}, nil
+}
+
+// authenticate resolves the API key of the x-api-key or authorization metadata and checks it has the role
+// The returned context carries the principal so the deployment service checks its scope
+func (s *DeploymentServer) authenticate(ctx context.Context, role auth.Role) (context.Context, error) {
+	if s.authenticator == nil {
+		return ctx, nil
+	}
+
+	key := bearer(ctx)
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-api-key")) > 0 {
+		key = md.Get("x-api-key")[0]
+	}
+
+	principal, err := s.authenticator.Authenticate(key)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "missing or invalid API key")
+	}
+	if !principal.Role.Includes(role) {
+		return nil, status.Errorf(codes.PermissionDenied, "API key does not have the %s role", role)
+	}
+
+	return auth.WithPrincipal(ctx, principal), nil
+}
@@ -0,0 +1,48 @@
+package grpcapi
+
+import (
+	"context"
+	"testing"
+
+	didesv1 "github.com/xnok/dides/api/dides/v1"
+	"github.com/xnok/dides/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeploymentServer_Authenticate(t *testing.T) {
+	authenticator, err := auth.NewAuthenticator([]auth.APIKey{
+		{Name: "dashboard", Key: "viewer-key", Role: auth.Viewer},
+		{Name: "web-team", Key: "web-key", Role: auth.Deployer, Selector: "role=web"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	server := NewDeploymentServer(nil, authenticator)
+
+	withKey := func(header, key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(header, key))
+	}
+
+	// Calls without a valid key are rejected
+	_, err = server.TriggerDeployment(context.Background(), &didesv1.TriggerDeploymentRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated without key, got %v", err)
+	}
+
+	// Viewers cannot deploy
+	_, err = server.TriggerDeployment(withKey("x-api-key", "viewer-key"), &didesv1.TriggerDeploymentRequest{})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for a viewer, got %v", err)
+	}
+
+	// The principal is passed on to the deployment service to check its scope
+	ctx, err := server.authenticate(withKey("authorization", "Bearer web-key"), auth.Deployer)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if principal, ok := auth.PrincipalFromContext(ctx); !ok || principal.Name != "web-team" {
+		t.Errorf("Expected web-team principal in the context, got %v", principal)
+	}
+}
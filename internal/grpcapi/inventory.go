@@ -0,0 +1,174 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+
+	didesv1 "github.com/xnok/dides/api/dides/v1"
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/inventory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// InventoryServer serves the agent-facing gRPC API with the same services as the REST API
+type InventoryServer struct {
+	didesv1.UnimplementedInventoryServiceServer
+
+	registration *inventory.RegistrationService
+	updates      *inventory.UpdateService
+	watches      *inventory.WatchService
+	certificates *inventory.CertificateService
+}
+
+// NewInventoryServer creates the agent-facing gRPC server
+func NewInventoryServer(registration *inventory.RegistrationService, updates *inventory.UpdateService, watches *inventory.WatchService, certificates *inventory.CertificateService) *InventoryServer {
+	return &InventoryServer{
+		registration: registration,
+		updates:      updates,
+		watches:      watches,
+		certificates: certificates,
+	}
+}
+
+// Register registers an instance with a join token and signs its client certificate when it sends a CSR
+func (s *InventoryServer) Register(ctx context.Context, req *didesv1.RegisterRequest) (*didesv1.RegisterResponse, error) {
+	registration := inventory.RegistrationRequest{
+		Instance: inventory.Instance{
+			IP:     req.GetIp(),
+			Name:   req.GetName(),
+			Labels: req.GetLabels(),
+		},
+		Token: req.GetToken(),
+		CSR:   req.GetCsr(),
+		// An instance registering again proves its identity as on the other calls
+		Credential:  bearer(ctx),
+		Certificate: verifiedCertificate(ctx),
+	}
+
+	instance, credential, err := s.registration.RegisterInstance(ctx, registration)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	response := &didesv1.RegisterResponse{
+		Instance:   toInstance(instance),
+		Credential: credential,
+	}
+
+	// Sign the client certificate bound to the assigned ID
+	if req.GetCsr() != "" {
+		response.Certificate, err = s.certificates.IssueCertificate(ctx, instance.Key(), req.GetCsr())
+		if err != nil {
+			return nil, toStatus(err)
+		}
+	}
+
+	return response, nil
+}
+
+// ReportState updates the status, current state and labels reported by the instance
+func (s *InventoryServer) ReportState(ctx context.Context, req *didesv1.ReportStateRequest) (*didesv1.ReportStateResponse, error) {
+	ctx, err := s.authenticate(ctx, req.GetInstanceId())
+	if err != nil {
+		return nil, err
+	}
+
+	patch := inventory.InstancePatch{
+		Labels: req.GetLabels(),
+	}
+	if req.Status != nil {
+		instanceStatus := inventory.Status(req.GetStatus())
+		patch.Status = &instanceStatus
+	}
+	if req.CurrentState != nil {
+		currentState := fromState(req.GetCurrentState())
+		patch.CurrentState = &currentState
+	}
+
+	instance, err := s.updates.UpdateInstance(ctx, req.GetInstanceId(), inventory.UpdateRequest{Updates: patch})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+
+	return &didesv1.ReportStateResponse{
+		Instance:     toInstance(instance),
+		UpdateNeeded: instance.CurrentState != instance.DesiredState,
+	}, nil
+}
+
+// WatchDesiredState sends the desired state of the instance every time its revision changes, until the client cancels
+func (s *InventoryServer) WatchDesiredState(req *didesv1.WatchDesiredStateRequest, stream didesv1.InventoryService_WatchDesiredStateServer) error {
+	ctx, err := s.authenticate(stream.Context(), req.GetInstanceId())
+	if err != nil {
+		return err
+	}
+
+	revision := req.GetRevision()
+	for {
+		response, err := s.watches.WatchDesiredState(ctx, req.GetInstanceId(), revision)
+		if err != nil {
+			return toStatus(err)
+		}
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+
+		revision = response.Revision
+		if err := stream.Send(&didesv1.DesiredState{
+			DesiredState: toState(response.DesiredState),
+			Revision:     response.Revision,
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// authenticate checks the client certificate of the instance over TLS, or else the credential in the authorization metadata
+// The returned context records the instance as the actor of its changes
+func (s *InventoryServer) authenticate(ctx context.Context, instanceID string) (context.Context, error) {
+	var err error
+	state := peerTLS(ctx)
+	switch {
+	case state != nil && len(state.VerifiedChains) > 0:
+		err = s.certificates.Authenticate(ctx, instanceID, state.PeerCertificates[0])
+	case state != nil:
+		err = inventory.ErrInvalidCertificate
+	default:
+		err = s.registration.Authenticate(ctx, instanceID, bearer(ctx))
+	}
+	if err != nil {
+		if errors.Is(err, inventory.ErrInstanceNotFound) {
+			return nil, status.Error(codes.NotFound, "instance not found")
+		}
+		return nil, status.Error(codes.Unauthenticated, "invalid instance credential or certificate")
+	}
+
+	return audit.WithActor(ctx, "instance/"+instanceID), nil
+}
+
+// verifiedCertificate returns the client certificate verified during the TLS handshake, if any
+func verifiedCertificate(ctx context.Context) *x509.Certificate {
+	state := peerTLS(ctx)
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// peerTLS returns the state of the TLS connection of the call, nil when it is not served over TLS
+func peerTLS(ctx context.Context) *tls.ConnectionState {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return &info.State
+}
@@ -0,0 +1,44 @@
+package grpcapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	inmemory "github.com/xnok/dides/internal/infra/in-memory"
+	"github.com/xnok/dides/internal/inventory"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestInventoryServer_Authenticate(t *testing.T) {
+	store := inmemory.NewInventoryStore()
+	tokens := inmemory.NewTokenStore()
+	tokens.SaveToken(&inventory.JoinToken{ID: "test", TokenHash: inventory.HashJoinToken("test-token"), ExpiresAt: time.Now().Add(time.Hour)})
+
+	registration := inventory.NewRegistrationService(store, tokens, nil, nil)
+	server := NewInventoryServer(registration, nil, nil, inventory.NewCertificateService(store, nil, nil))
+
+	instance, credential, err := registration.RegisterInstance(context.Background(), inventory.RegistrationRequest{
+		Instance: inventory.Instance{Name: "web-1", IP: "10.0.0.1"},
+		Token:    "test-token",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	withCredential := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+credential))
+
+	// Without TLS the credential authenticates the instance
+	if _, err := server.authenticate(withCredential, instance.ID); err != nil {
+		t.Errorf("Expected the credential to be accepted without TLS, got %v", err)
+	}
+
+	// Over TLS only a verified client certificate does
+	overTLS := peer.NewContext(withCredential, &peer.Peer{AuthInfo: credentials.TLSInfo{}})
+	if _, err := server.authenticate(overTLS, instance.ID); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated for a credential over TLS, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5/middleware"
+	didesv1 "github.com/xnok/dides/api/dides/v1"
+	"github.com/xnok/dides/internal/auth"
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/pki"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Register adds the inventory and deployment services to the gRPC server
+func Register(server *grpc.Server, inventoryServer *InventoryServer, deploymentServer *DeploymentServer) {
+	didesv1.RegisterInventoryServiceServer(server, inventoryServer)
+	didesv1.RegisterDeploymentServiceServer(server, deploymentServer)
+}
+
+// bearer returns the token of the authorization metadata
+func bearer(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// toStatus maps the errors of the services to gRPC status codes, as the REST API maps them to HTTP status codes
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, inventory.ErrInvalidToken):
+		return status.Error(codes.Unauthenticated, "invalid registration token")
+	case errors.Is(err, inventory.ErrLabelsOutOfScope):
+		return status.Error(codes.PermissionDenied, "labels are outside the join token scope")
+	case errors.Is(err, inventory.ErrInstanceConflict):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, inventory.ErrLabelsBoundToCertificate):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, inventory.ErrInstanceNotFound):
+		return status.Error(codes.NotFound, "instance not found")
+	case errors.Is(err, inventory.ErrUpdateValidation), errors.Is(err, pki.ErrInvalidCSR):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, auth.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, deployment.ErrInvalidDeploymentRequest):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, deployment.ErrRolloutInProgress):
+		return status.Error(codes.FailedPrecondition, "deployment is already in progress")
+	case errors.Is(err, deployment.ErrNoPreviousDeploymentFound), errors.Is(err, deployment.ErrNoPreviousStateFound):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// UnaryRequestID gives each call the request ID of the x-request-id metadata, or a new one
+// It is the gRPC counterpart of the chi RequestID middleware, the audit log records it
+func UnaryRequestID(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-request-id")) > 0 {
+		requestID = md.Get("x-request-id")[0]
+	}
+	if requestID == "" {
+		requestID = fmt.Sprintf("grpc-%06d", atomic.AddUint64(&requestCounter, 1))
+	}
+
+	return handler(context.WithValue(ctx, middleware.RequestIDKey, requestID), req)
+}
+
+var requestCounter uint64
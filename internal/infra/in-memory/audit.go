@@ -0,0 +1,49 @@
+package inmemory
+
+import (
+	"sync"
+
+	"github.com/xnok/dides/internal/audit"
+)
+
+// AuditStore is an in-memory implementation of the audit.Store interface
+type AuditStore struct {
+	mu      sync.RWMutex
+	entries []audit.Entry
+}
+
+// NewAuditStore creates a new in-memory audit store
+func NewAuditStore() *AuditStore {
+	return &AuditStore{}
+}
+
+// Append assigns the next sequence number to the entry and stores a copy of it
+func (s *AuditStore) Append(entry *audit.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = int64(len(s.entries) + 1)
+	s.entries = append(s.entries, *entry)
+	return nil
+}
+
+// List returns copies of the entries matching the query, oldest first
+func (s *AuditStore) List(query audit.Query) ([]*audit.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []*audit.Entry
+	for i := range s.entries {
+		if query.Matches(&s.entries[i]) {
+			entryCopy := s.entries[i]
+			entries = append(entries, &entryCopy)
+		}
+	}
+
+	// Keep the most recent entries
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+
+	return entries, nil
+}
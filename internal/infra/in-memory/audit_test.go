@@ -0,0 +1,45 @@
+package inmemory
+
+import (
+	"testing"
+
+	"github.com/xnok/dides/internal/audit"
+)
+
+func TestAuditStore_List(t *testing.T) {
+	store := NewAuditStore()
+
+	for _, entry := range []*audit.Entry{
+		{Actor: "ops", Action: audit.DeploymentTrigger, Target: "deployment-1"},
+		{Actor: "i-1", Action: audit.InstanceUpdate, Target: "i-1"},
+		{Actor: "ops", Action: audit.DeploymentProgress, Target: "deployment-1"},
+	} {
+		if err := store.Append(entry); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	// Entries are numbered in the order they were appended
+	entries, _ := store.List(audit.Query{})
+	if len(entries) != 3 || entries[0].ID != 1 || entries[2].ID != 3 {
+		t.Fatalf("Expected entries 1 to 3 in order, got %v", entries)
+	}
+
+	entries, _ = store.List(audit.Query{Target: "deployment-1"})
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries for deployment-1, got %d", len(entries))
+	}
+
+	// The limit keeps the most recent entries
+	entries, _ = store.List(audit.Query{Actor: "ops", Limit: 1})
+	if len(entries) != 1 || entries[0].Action != audit.DeploymentProgress {
+		t.Errorf("Expected the last entry of ops, got %v", entries)
+	}
+
+	// Returned entries are copies, the log cannot be rewritten
+	entries[0].Actor = "someone else"
+	entries, _ = store.List(audit.Query{Actor: "ops"})
+	if len(entries) != 2 {
+		t.Errorf("Expected stored entries to be unchanged, got %v", entries)
+	}
+}
@@ -1,12 +1,15 @@
 package inmemory
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"sync"
 	"time"
 
+	"github.com/xnok/dides/internal/clock"
 	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/selector"
 )
 
 // deploymentEntry represents an internal storage entry with metadata
@@ -31,18 +34,20 @@ type DeploymentStore struct {
 	mu          sync.RWMutex
 	deployments map[string]*deploymentEntry // key is deployment ID
 	nextID      int
+	clock       clock.Clock
 }
 
-// NewDeploymentStore creates a new in-memory deployment store
-func NewDeploymentStore() *DeploymentStore {
+// NewDeploymentStore creates a new in-memory deployment store, the timestamps come from the wall clock when clk is nil
+func NewDeploymentStore(clk clock.Clock) *DeploymentStore {
 	return &DeploymentStore{
 		deployments: make(map[string]*deploymentEntry),
 		nextID:      1,
+		clock:       clock.OrReal(clk),
 	}
 }
 
 // Save stores a deployment record in memory and returns the deployment ID
-func (s *DeploymentStore) Save(record *deployment.DeploymentRecord) error {
+func (s *DeploymentStore) Save(ctx context.Context, record *deployment.DeploymentRecord) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -51,26 +56,35 @@ func (s *DeploymentStore) Save(record *deployment.DeploymentRecord) error {
 		record.ID = s.generateID()
 	}
 
-	now := time.Now()
+	now := s.clock.Now()
 
 	// Set CreatedAt if not already set
 	if record.CreatedAt.IsZero() {
 		record.CreatedAt = now
 	}
 
+	// A new record starts at the first revision
+	record.Revision = 1
+	if existing, exists := s.deployments[record.ID]; exists {
+		record.Revision = existing.Record.Revision + 1
+	}
+
+	// Store a copy so the undo log of a transaction is not changed behind its back
+	recordCopy := *record
 	entry := &deploymentEntry{
 		ID:        record.ID,
-		Record:    record,
+		Record:    &recordCopy,
 		CreatedAt: record.CreatedAt,
 		UpdatedAt: now,
 	}
 
+	s.track(ctx, record.ID)
 	s.deployments[record.ID] = entry
 	return nil
 }
 
-// Update updates an existing deployment record
-func (s *DeploymentStore) Update(record *deployment.DeploymentRecord) error {
+// Update updates an existing deployment record, it fails with deployment.ErrDeploymentConflict when its revision is not the stored one
+func (s *DeploymentStore) Update(ctx context.Context, record *deployment.DeploymentRecord) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -79,15 +93,27 @@ func (s *DeploymentStore) Update(record *deployment.DeploymentRecord) error {
 		return deployment.ErrDeploymentNotFound
 	}
 
+	// The record must be the last one read or written
+	if entry.Record.Revision != record.Revision {
+		return deployment.ErrDeploymentConflict
+	}
+
 	// Update the record and timestamp
-	entry.Record = record
-	entry.UpdatedAt = time.Now()
+	s.track(ctx, record.ID)
+	record.Revision++
+	recordCopy := *record
+	s.deployments[record.ID] = &deploymentEntry{
+		ID:        entry.ID,
+		Record:    &recordCopy,
+		CreatedAt: entry.CreatedAt,
+		UpdatedAt: s.clock.Now(),
+	}
 
 	return nil
 }
 
 // GetByID retrieves a deployment by ID
-func (s *DeploymentStore) GetByID(id string) (*deployment.DeploymentRecord, error) {
+func (s *DeploymentStore) GetByID(ctx context.Context, id string) (*deployment.DeploymentRecord, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -144,7 +170,7 @@ func (s *DeploymentStore) GetAll() []*DeploymentRecordWithID {
 }
 
 // GetByStatus returns all deployments with the specified status
-func (s *DeploymentStore) GetByStatus(status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
+func (s *DeploymentStore) GetByStatus(ctx context.Context, status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -160,14 +186,14 @@ func (s *DeploymentStore) GetByStatus(status deployment.DeploymentStatus) ([]*de
 	return matches, nil
 }
 
-// GetByLabels returns deployments that match all provided labels
-func (s *DeploymentStore) GetByLabels(labels map[string]string) []*deployment.DeploymentRecord {
+// GetByLabels returns deployments that only target instances matched by the label selector
+func (s *DeploymentStore) GetByLabels(sel selector.Selector) []*deployment.DeploymentRecord {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	var matches []*deployment.DeploymentRecord
 	for _, entry := range s.deployments {
-		if s.matchesLabels(entry, labels) {
+		if s.matchesLabels(entry, sel) {
 			recordCopy := *entry.Record
 			matches = append(matches, &recordCopy)
 		}
@@ -176,15 +202,31 @@ func (s *DeploymentStore) GetByLabels(labels map[string]string) []*deployment.De
 	return matches
 }
 
-// GetByLabelsAndStatus returns deployments that match all provided labels and have the specified status
+// GetByLabelsAndStatus returns deployments that only target instances matched by the label selector and have the specified status
 // Results are sorted by creation time in descending order (most recent first)
-func (s *DeploymentStore) GetByLabelsAndStatus(labels map[string]string, status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
+func (s *DeploymentStore) GetByLabelsAndStatus(ctx context.Context, sel selector.Selector, status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
+	return s.getByStatus(status, func(entry *deploymentEntry) bool {
+		return s.matchesLabels(entry, sel)
+	}), nil
+}
+
+// GetOverlappingByStatus returns deployments that may target an instance matched by the label selector and have the specified status
+// Results are sorted by creation time in descending order (most recent first)
+func (s *DeploymentStore) GetOverlappingByStatus(ctx context.Context, sel selector.Selector, status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error) {
+	return s.getByStatus(status, func(entry *deploymentEntry) bool {
+		recordSelector, err := entry.Record.Request.LabelSelector()
+		return err == nil && recordSelector.Overlaps(sel)
+	}), nil
+}
+
+// getByStatus returns the deployments with the status accepted by the filter, most recent first
+func (s *DeploymentStore) getByStatus(status deployment.DeploymentStatus, filter func(entry *deploymentEntry) bool) []*deployment.DeploymentRecord {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	var matches []*deployment.DeploymentRecord
 	for _, entry := range s.deployments {
-		if entry.Record.Status == status && s.matchesLabels(entry, labels) {
+		if entry.Record.Status == status && filter(entry) {
 			recordCopy := *entry.Record
 			matches = append(matches, &recordCopy)
 		}
@@ -195,7 +237,7 @@ func (s *DeploymentStore) GetByLabelsAndStatus(labels map[string]string, status
 		return matches[i].CreatedAt.After(matches[j].CreatedAt)
 	})
 
-	return matches, nil
+	return matches
 }
 
 // UpdateStatus updates the status of a deployment
@@ -208,9 +250,10 @@ func (s *DeploymentStore) UpdateStatus(id string, status deployment.DeploymentSt
 		return deployment.ErrDeploymentNotFound
 	}
 
-	// Update status and timestamp
+	// Update status, revision and timestamp
 	entry.Record.Status = status
-	entry.UpdatedAt = time.Now()
+	entry.Record.Revision++
+	entry.UpdatedAt = s.clock.Now()
 
 	return nil
 }
@@ -243,17 +286,12 @@ func (s *DeploymentStore) generateID() string {
 	return fmt.Sprintf("deployment-%03d", id)
 }
 
-// matchesLabels checks if a deployment has all the specified labels
-func (s *DeploymentStore) matchesLabels(entry *deploymentEntry, labels map[string]string) bool {
-	if entry.Record.Request.Labels == nil {
-		return len(labels) == 0
-	}
-
-	for key, value := range labels {
-		if recordValue, exists := entry.Record.Request.Labels[key]; !exists || recordValue != value {
-			return false
-		}
+// matchesLabels checks if a deployment only targets instances matched by the label selector
+func (s *DeploymentStore) matchesLabels(entry *deploymentEntry, sel selector.Selector) bool {
+	recordSelector, err := entry.Record.Request.LabelSelector()
+	if err != nil {
+		return false
 	}
 
-	return true
+	return recordSelector.Implies(sel)
 }
@@ -1,13 +1,15 @@
 package inmemory
 
 import (
+	"context"
 	"testing"
 
 	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/selector"
 )
 
 func TestDeploymentStore_Save(t *testing.T) {
-	store := NewDeploymentStore()
+	store := NewDeploymentStore(nil)
 
 	req := deployment.DeploymentRequest{
 		CodeVersion:          "v1.2.3",
@@ -20,7 +22,7 @@ func TestDeploymentStore_Save(t *testing.T) {
 		Status:  deployment.Running,
 	}
 
-	err := store.Save(record)
+	err := store.Save(context.Background(), record)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -55,7 +57,7 @@ func TestDeploymentStore_Save(t *testing.T) {
 }
 
 func TestDeploymentStore_Get(t *testing.T) {
-	store := NewDeploymentStore()
+	store := NewDeploymentStore(nil)
 
 	req := deployment.DeploymentRequest{
 		CodeVersion: "v1.0.0",
@@ -67,7 +69,7 @@ func TestDeploymentStore_Get(t *testing.T) {
 		Status:  deployment.Running,
 	}
 
-	err := store.Save(record)
+	err := store.Save(context.Background(), record)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -98,7 +100,7 @@ func TestDeploymentStore_Get(t *testing.T) {
 }
 
 func TestDeploymentStore_GetByStatus(t *testing.T) {
-	store := NewDeploymentStore()
+	store := NewDeploymentStore(nil)
 
 	// Save multiple deployments
 	req1 := deployment.DeploymentRequest{CodeVersion: "v1.0.0"}
@@ -109,12 +111,12 @@ func TestDeploymentStore_GetByStatus(t *testing.T) {
 	record2 := &deployment.DeploymentRecord{Request: req2, Status: deployment.Running}
 	record3 := &deployment.DeploymentRecord{Request: req3, Status: deployment.Running}
 
-	store.Save(record1)
-	store.Save(record2)
-	store.Save(record3)
+	store.Save(context.Background(), record1)
+	store.Save(context.Background(), record2)
+	store.Save(context.Background(), record3)
 
 	// All should be Pending initially
-	pending, err := store.GetByStatus(deployment.Running)
+	pending, err := store.GetByStatus(context.Background(), deployment.Running)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -130,11 +132,11 @@ func TestDeploymentStore_GetByStatus(t *testing.T) {
 	}
 
 	// Check status distribution
-	completed, err := store.GetByStatus(deployment.Completed)
+	completed, err := store.GetByStatus(context.Background(), deployment.Completed)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
-	running, err := store.GetByStatus(deployment.Running)
+	running, err := store.GetByStatus(context.Background(), deployment.Running)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -149,7 +151,7 @@ func TestDeploymentStore_GetByStatus(t *testing.T) {
 }
 
 func TestDeploymentStore_GetByLabels(t *testing.T) {
-	store := NewDeploymentStore()
+	store := NewDeploymentStore(nil)
 
 	req1 := deployment.DeploymentRequest{
 		CodeVersion: "v1.0.0",
@@ -170,18 +172,18 @@ func TestDeploymentStore_GetByLabels(t *testing.T) {
 	record2 := &deployment.DeploymentRecord{Request: req2, Status: deployment.Running}
 	record3 := &deployment.DeploymentRecord{Request: req3, Status: deployment.Running}
 
-	store.Save(record1)
-	store.Save(record2)
-	store.Save(record3)
+	store.Save(context.Background(), record1)
+	store.Save(context.Background(), record2)
+	store.Save(context.Background(), record3)
 
 	// Find by single label
-	webDeployments := store.GetByLabels(map[string]string{"app": "web"})
+	webDeployments := store.GetByLabels(selector.FromLabels(map[string]string{"app": "web"}))
 	if len(webDeployments) != 2 {
 		t.Errorf("Expected 2 web deployments, got %d", len(webDeployments))
 	}
 
 	// Find by multiple labels
-	prodWebDeployments := store.GetByLabels(map[string]string{"env": "prod", "app": "web"})
+	prodWebDeployments := store.GetByLabels(selector.FromLabels(map[string]string{"env": "prod", "app": "web"}))
 	if len(prodWebDeployments) != 1 {
 		t.Errorf("Expected 1 prod web deployment, got %d", len(prodWebDeployments))
 	}
@@ -191,12 +193,65 @@ func TestDeploymentStore_GetByLabels(t *testing.T) {
 	}
 }
 
+func TestDeploymentStore_GetByLabelsAndStatus_Selector(t *testing.T) {
+	store := NewDeploymentStore(nil)
+
+	zoneA := &deployment.DeploymentRecord{
+		Request: deployment.DeploymentRequest{CodeVersion: "v1.0.0", Labels: map[string]string{"env": "prod"}, Selector: "zone in (a)"},
+		Status:  deployment.Completed,
+	}
+	allZones := &deployment.DeploymentRecord{
+		Request: deployment.DeploymentRequest{CodeVersion: "v1.1.0", Labels: map[string]string{"env": "prod"}},
+		Status:  deployment.Completed,
+	}
+	webEverywhere := &deployment.DeploymentRecord{
+		Request: deployment.DeploymentRequest{CodeVersion: "v1.2.0", Labels: map[string]string{"role": "web"}},
+		Status:  deployment.Completed,
+	}
+	store.Save(context.Background(), zoneA)
+	store.Save(context.Background(), allZones)
+	store.Save(context.Background(), webEverywhere)
+
+	sel, err := selector.Parse("env=prod,zone in (a,b)")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Only the deployment restricted to zone a stays within the selector
+	within, err := store.GetByLabelsAndStatus(context.Background(), sel, deployment.Completed)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(within) != 1 || within[0].Request.CodeVersion != "v1.0.0" {
+		t.Errorf("Expected only v1.0.0, got %d deployments", len(within))
+	}
+
+	// Every deployment may have touched an instance of the selector
+	overlapping, err := store.GetOverlappingByStatus(context.Background(), sel, deployment.Completed)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(overlapping) != 3 {
+		t.Errorf("Expected 3 overlapping deployments, got %d", len(overlapping))
+	}
+
+	// No deployment targets dev instances
+	dev, _ := selector.Parse("env=dev")
+	overlapping, err = store.GetOverlappingByStatus(context.Background(), dev, deployment.Completed)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(overlapping) != 1 || overlapping[0].Request.CodeVersion != "v1.2.0" {
+		t.Errorf("Expected only the web deployment to overlap env=dev, got %d deployments", len(overlapping))
+	}
+}
+
 func TestDeploymentStore_UpdateStatus(t *testing.T) {
-	store := NewDeploymentStore()
+	store := NewDeploymentStore(nil)
 
 	req := deployment.DeploymentRequest{CodeVersion: "v1.0.0"}
 	record := &deployment.DeploymentRecord{Request: req, Status: deployment.Running}
-	store.Save(record)
+	store.Save(context.Background(), record)
 
 	deployments := store.GetAll()
 	deploymentID := deployments[0].ID
@@ -224,12 +279,45 @@ func TestDeploymentStore_UpdateStatus(t *testing.T) {
 	}
 }
 
+func TestDeploymentStore_UpdateConflict(t *testing.T) {
+	ctx := context.Background()
+	store := NewDeploymentStore(nil)
+
+	record := &deployment.DeploymentRecord{Request: deployment.DeploymentRequest{CodeVersion: "v1.0.0"}, Status: deployment.Running}
+	store.Save(ctx, record)
+	if record.Revision != 1 {
+		t.Fatalf("Expected a new record at revision 1, got %d", record.Revision)
+	}
+
+	// Two callers read the same revision, the second update is rejected
+	first, _ := store.GetByID(ctx, record.ID)
+	second, _ := store.GetByID(ctx, record.ID)
+
+	first.Progress.CompletedInstances = 1
+	if err := store.Update(ctx, first); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if first.Revision != 2 {
+		t.Errorf("Expected the update to increment the revision to 2, got %d", first.Revision)
+	}
+
+	second.Status = deployment.Failed
+	if err := store.Update(ctx, second); err != deployment.ErrDeploymentConflict {
+		t.Fatalf("Expected ErrDeploymentConflict, got %v", err)
+	}
+
+	stored, _ := store.GetByID(ctx, record.ID)
+	if stored.Status != deployment.Running || stored.Progress.CompletedInstances != 1 {
+		t.Errorf("Expected the first update to be kept, got %+v", stored)
+	}
+}
+
 func TestDeploymentStore_Delete(t *testing.T) {
-	store := NewDeploymentStore()
+	store := NewDeploymentStore(nil)
 
 	req := deployment.DeploymentRequest{CodeVersion: "v1.0.0"}
 	record := &deployment.DeploymentRecord{Request: req, Status: deployment.Running}
-	store.Save(record)
+	store.Save(context.Background(), record)
 
 	if store.Count() != 1 {
 		t.Fatalf("Expected 1 deployment, got %d", store.Count())
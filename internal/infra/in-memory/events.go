@@ -0,0 +1,140 @@
+package inmemory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/xnok/dides/internal/clock"
+	"github.com/xnok/dides/internal/deployment"
+)
+
+const (
+	// eventHistory is the number of events kept per deployment for the clients resuming a stream
+	eventHistory = 1000
+	// eventRetention is how long the events of a finished deployment are kept after its final event
+	eventRetention = time.Hour
+	// subscriberBuffer is the number of events a subscriber can fall behind before being dropped
+	subscriberBuffer = 64
+)
+
+// EventBus is an in-memory implementation of the deployment.EventBus interface
+type EventBus struct {
+	mu          sync.Mutex
+	lastID      int64
+	history     map[string][]deployment.Event // key is deployment ID
+	subscribers map[string]map[chan deployment.Event]struct{}
+	// finished are the deployments that published their final event, in the order they finished
+	finished []finishedDeployment
+	// forward receives every event once it has an ID, such as the webhook dispatcher
+	forward []deployment.Publisher
+	clock   clock.Clock
+}
+
+// finishedDeployment is a deployment whose history is dropped once the retention after its final event is over
+type finishedDeployment struct {
+	id string
+	at time.Time
+}
+
+// NewEventBus creates a new in-memory event bus, forwarding every published event to the given publishers
+// The events are timestamped with the wall clock when clk is nil
+func NewEventBus(clk clock.Clock, forward ...deployment.Publisher) *EventBus {
+	return &EventBus{
+		history:     make(map[string][]deployment.Event),
+		subscribers: make(map[string]map[chan deployment.Event]struct{}),
+		forward:     forward,
+		clock:       clock.OrReal(clk),
+	}
+}
+
+// Publish assigns the next ID to the event, keeps it for resumption and sends it to the subscribers of the deployment
+// Subscribers that fell behind are dropped, their channel is closed, the forward publishers receive every event
+func (b *EventBus) Publish(event deployment.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	b.lastID++
+	event.ID = b.lastID
+	if event.Time.IsZero() {
+		event.Time = now
+	}
+
+	history := append(b.history[event.DeploymentID], event)
+	if len(history) > eventHistory {
+		history = history[len(history)-eventHistory:]
+	}
+	b.history[event.DeploymentID] = history
+
+	// The history of a finished deployment is only kept for the clients resuming its stream shortly after
+	if event.Final() {
+		b.finished = append(b.finished, finishedDeployment{id: event.DeploymentID, at: now})
+	}
+	b.prune(now)
+
+	for subscriber := range b.subscribers[event.DeploymentID] {
+		select {
+		case subscriber <- event:
+		default:
+			b.unsubscribe(event.DeploymentID, subscriber)
+		}
+	}
+
+	for _, publisher := range b.forward {
+		publisher.Publish(event)
+	}
+}
+
+// prune drops the history of the deployments that finished more than the retention before now
+// It must be called with the lock held
+func (b *EventBus) prune(now time.Time) {
+	expired := 0
+	for _, finished := range b.finished {
+		if now.Sub(finished.at) < eventRetention {
+			break
+		}
+		delete(b.history, finished.id)
+		expired++
+	}
+	b.finished = b.finished[expired:]
+}
+
+// Subscribe returns the kept events of the deployment after lastEventID and a channel receiving the next ones
+func (b *EventBus) Subscribe(deploymentID string, lastEventID int64) ([]deployment.Event, <-chan deployment.Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var backlog []deployment.Event
+	for _, event := range b.history[deploymentID] {
+		if event.ID > lastEventID {
+			backlog = append(backlog, event)
+		}
+	}
+
+	subscriber := make(chan deployment.Event, subscriberBuffer)
+	if b.subscribers[deploymentID] == nil {
+		b.subscribers[deploymentID] = make(map[chan deployment.Event]struct{})
+	}
+	b.subscribers[deploymentID][subscriber] = struct{}{}
+
+	cancel := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.unsubscribe(deploymentID, subscriber)
+	}
+
+	return backlog, subscriber, cancel
+}
+
+// unsubscribe removes and closes the subscriber channel, if still subscribed
+func (b *EventBus) unsubscribe(deploymentID string, subscriber chan deployment.Event) {
+	if _, ok := b.subscribers[deploymentID][subscriber]; !ok {
+		return
+	}
+
+	delete(b.subscribers[deploymentID], subscriber)
+	if len(b.subscribers[deploymentID]) == 0 {
+		delete(b.subscribers, deploymentID)
+	}
+	close(subscriber)
+}
@@ -0,0 +1,95 @@
+package inmemory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/pkg/simulator"
+)
+
+func TestEventBus_Subscribe(t *testing.T) {
+	bus := NewEventBus(nil)
+
+	bus.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventBatchStarted})
+	bus.Publish(deployment.Event{DeploymentID: "2", Type: deployment.EventBatchStarted})
+	bus.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventProgress})
+
+	// The backlog only holds the events of the deployment after the last event ID
+	backlog, events, cancel := bus.Subscribe("1", 1)
+	defer cancel()
+	if len(backlog) != 1 || backlog[0].ID != 3 || backlog[0].Type != deployment.EventProgress {
+		t.Fatalf("Expected event 3 in the backlog, got %v", backlog)
+	}
+
+	// Next events are delivered on the channel
+	bus.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventCompleted})
+	event := <-events
+	if event.ID != 4 || !event.Final() {
+		t.Errorf("Expected final event 4, got %v", event)
+	}
+
+	// Once cancelled the channel is closed
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("Expected channel to be closed after cancel")
+	}
+}
+
+func TestEventBus_SlowSubscriber(t *testing.T) {
+	bus := NewEventBus(nil)
+	_, events, cancel := bus.Subscribe("1", 0)
+	defer cancel()
+
+	// A subscriber that does not keep up is dropped instead of blocking the deployment
+	for i := 0; i <= subscriberBuffer; i++ {
+		bus.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventProgress})
+	}
+
+	received := 0
+	for range events {
+		received++
+	}
+	if received != subscriberBuffer {
+		t.Errorf("Expected %d events before the channel is closed, got %d", subscriberBuffer, received)
+	}
+
+	// It resumes from the last event it received
+	backlog, _, cancelResume := bus.Subscribe("1", int64(received))
+	defer cancelResume()
+	if len(backlog) != 1 {
+		t.Errorf("Expected the missed event in the backlog, got %d events", len(backlog))
+	}
+}
+
+func TestEventBus_PrunesFinishedDeployments(t *testing.T) {
+	clk := simulator.NewFakeClock(time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+	bus := NewEventBus(clk)
+
+	bus.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventStarted})
+	bus.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventCompleted})
+	bus.Publish(deployment.Event{DeploymentID: "2", Type: deployment.EventStarted})
+
+	// A client reconnecting shortly after the final event still gets the history
+	clk.Advance(eventRetention - time.Minute)
+	bus.Publish(deployment.Event{DeploymentID: "2", Type: deployment.EventProgress})
+	backlog, _, cancel := bus.Subscribe("1", 0)
+	cancel()
+	if len(backlog) != 2 {
+		t.Errorf("Expected the history of deployment 1 kept during the retention, got %v", backlog)
+	}
+
+	// The history is dropped once the retention is over, the running deployment keeps its own
+	clk.Advance(time.Minute)
+	bus.Publish(deployment.Event{DeploymentID: "2", Type: deployment.EventProgress})
+	backlog, _, cancel = bus.Subscribe("1", 0)
+	cancel()
+	if len(backlog) != 0 {
+		t.Errorf("Expected the history of deployment 1 dropped, got %v", backlog)
+	}
+	backlog, _, cancel = bus.Subscribe("2", 0)
+	cancel()
+	if len(backlog) != 3 {
+		t.Errorf("Expected the history of deployment 2 kept, got %v", backlog)
+	}
+}
@@ -1,50 +1,136 @@
 package inmemory
 
 import (
+	"container/heap"
+	"context"
 	"errors"
+	"maps"
 	"sync"
+	"time"
 
 	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
 )
 
 var (
 	ErrInstanceNotFound = errors.New("instance not found")
 )
 
+// maxTallies is the number of progress queries whose counters are kept up to date
+const maxTallies = 64
+
 // InventoryStore is an in-memory implementation of the inventory.Store interface
+// The label selectors are resolved with an inverted index of the labels and the progress counts are served by
+// tallies updated on every write, so the progress queries of a deployment do not scan the fleet
 type InventoryStore struct {
 	mu        sync.RWMutex
-	instances map[string]*inventory.Instance // key is instance name or IP
+	instances map[string]*inventory.Instance // key is instance ID, fallback to name or IP
+	byName    map[string]string              // name to instance key
+	byIP      map[string]string              // IP to instance key
+	byLabel   map[string]map[string]keySet   // label key to label value to instance keys
+
+	// tallies are the counters of the recent progress queries, the least recently used one is dropped past maxTallies
+	tallies map[tallyKey]*tally
+	tick    uint64
+}
+
+// keySet is a set of instance keys
+type keySet map[string]struct{}
+
+// tallyKey identifies a progress query by the key of its selector and its target state
+type tallyKey struct {
+	selector string
+	target   inventory.State
+}
+
+// tally counts the deployable instances matching a selector by their progress toward a target state
+// The last pings are counted by second so the unreachable instances are counted for any cutoff
+type tally struct {
+	sel    selector.Selector
+	target inventory.State
+	used   uint64
+
+	progress inventory.Progress
+	pings    map[int64]int
+}
+
+// matches checks if the instance is counted by the tally
+func (t *tally) matches(instance *inventory.Instance) bool {
+	return !instance.Cordoned && t.sel.Matches(instance.Labels)
+}
+
+// add counts the instance in the tally, a negative delta removes it
+func (t *tally) add(instance *inventory.Instance, delta int) {
+	if !t.matches(instance) {
+		return
+	}
+	t.progress.Add(instance, t.target, delta)
+	t.ping(instance, delta)
+}
+
+// ping counts the last ping of a matching instance, a negative delta removes it
+func (t *tally) ping(instance *inventory.Instance, delta int) {
+	if instance.LastPing.IsZero() {
+		return
+	}
+	second := instance.LastPing.Unix()
+	t.pings[second] += delta
+	if t.pings[second] == 0 {
+		delete(t.pings, second)
+	}
+}
+
+// unreachable counts the instances that last pinged before the second of the cutoff
+func (t *tally) unreachable(before time.Time) int {
+	if before.IsZero() {
+		return 0
+	}
+	count := 0
+	for second, n := range t.pings {
+		if second < before.Unix() {
+			count += n
+		}
+	}
+	return count
 }
 
 // NewInventoryStore creates a new in-memory inventory store
 func NewInventoryStore() *InventoryStore {
 	return &InventoryStore{
 		instances: make(map[string]*inventory.Instance),
+		byName:    make(map[string]string),
+		byIP:      make(map[string]string),
+		byLabel:   make(map[string]map[string]keySet),
+		tallies:   make(map[tallyKey]*tally),
 	}
 }
 
-// Save stores an instance in memory, using the instance name as the key
-// If an instance with the same name already exists, it will be updated
-func (s *InventoryStore) Save(instance *inventory.Instance) error {
+// Save stores an instance in memory, using the instance key
+// If an instance with the same key already exists, it will be updated
+// It fails with inventory.ErrInstanceConflict when another instance uses the same name or IP
+func (s *InventoryStore) Save(ctx context.Context, instance *inventory.Instance) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Use instance name as the key, fallback to IP if name is empty
-	key := instance.Name
-	if key == "" {
-		key = instance.IP
+	key := instance.Key()
+
+	if other, exists := s.byName[instance.Name]; exists && instance.Name != "" && other != key {
+		return inventory.ErrInstanceConflict
+	}
+	if other, exists := s.byIP[instance.IP]; exists && instance.IP != "" && other != key {
+		return inventory.ErrInstanceConflict
 	}
 
 	// Create a copy to avoid external modifications
 	instanceCopy := *instance
-	s.instances[key] = &instanceCopy
+	instanceCopy.Labels = maps.Clone(instance.Labels)
+	s.write(ctx, key, &instanceCopy)
 
 	return nil
 }
 
 // Update applies a partial update (patch) to an existing instance
-func (s *InventoryStore) Update(key string, patch inventory.InstancePatch) (*inventory.Instance, error) {
+func (s *InventoryStore) Update(ctx context.Context, key string, patch inventory.InstancePatch) (*inventory.Instance, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -53,12 +139,20 @@ func (s *InventoryStore) Update(key string, patch inventory.InstancePatch) (*inv
 		return nil, ErrInstanceNotFound
 	}
 
+	if patch.Revision != nil && *patch.Revision != instance.Revision {
+		return nil, inventory.ErrRevisionConflict
+	}
+
 	// Create a copy to modify
 	updated := *instance
 
 	// Apply patch fields if they are provided (not nil)
-	if patch.Labels != nil {
+	if patch.ReplaceLabels {
+		updated.Labels = maps.Clone(patch.Labels)
+	} else if patch.Labels != nil {
 		// For labels, we do a merge - existing labels are preserved unless overridden
+		// The labels are copied, the indexes still refer to the previous ones
+		updated.Labels = maps.Clone(updated.Labels)
 		if updated.Labels == nil {
 			updated.Labels = make(map[string]string)
 		}
@@ -79,18 +173,69 @@ func (s *InventoryStore) Update(key string, patch inventory.InstancePatch) (*inv
 		updated.CurrentState = *patch.CurrentState
 	}
 
+	if patch.Cordoned != nil {
+		updated.Cordoned = *patch.Cordoned
+	}
+	if patch.Draining != nil {
+		updated.Draining = *patch.Draining
+	}
+	if patch.CertificateSerial != nil {
+		updated.CertificateSerial = *patch.CertificateSerial
+	}
+	if patch.CredentialHash != nil {
+		updated.CredentialHash = *patch.CredentialHash
+	}
 	if patch.DesiredState != nil {
-		updated.DesiredState = *patch.DesiredState
+		setDesiredState(&updated, *patch.DesiredState)
 	}
 
 	// Update the stored instance
-	s.instances[key] = &updated
+	s.write(ctx, key, &updated)
 
 	// Return a copy of the updated instance
 	result := updated
 	return &result, nil
 }
 
+// UpdateDesiredStates sets the desired state of several instances under a single lock
+// It fails before changing anything with ErrInstanceNotFound when one of the instances does not exist,
+// or with inventory.ErrRevisionConflict when one of them is no longer at its revision in revisions
+func (s *InventoryStore) UpdateDesiredStates(ctx context.Context, states map[string]inventory.State, revisions map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range states {
+		instance, exists := s.instances[key]
+		if !exists {
+			return ErrInstanceNotFound
+		}
+		if revision, ok := revisions[key]; ok && revision != instance.Revision {
+			return inventory.ErrRevisionConflict
+		}
+	}
+
+	for key, state := range states {
+		instance := s.instances[key]
+		updated := *instance
+		setDesiredState(&updated, state)
+		s.write(ctx, key, &updated)
+	}
+
+	return nil
+}
+
+// setDesiredState moves the instance to a new desired state
+func setDesiredState(instance *inventory.Instance, state inventory.State) {
+	// Remember the last known good state so the instance can be rolled back individually
+	if instance.DesiredState != state && instance.IsKnownGood() {
+		instance.PreviousState = instance.CurrentState
+	}
+	if instance.DesiredState != state {
+		instance.DesiredRevision++
+	}
+	instance.DesiredState = state
+}
+
 // Get retrieves an instance by name or IP
 func (s *InventoryStore) Get(key string) (*inventory.Instance, bool) {
 	s.mu.RLock()
@@ -122,13 +267,13 @@ func (s *InventoryStore) GetAll() []*inventory.Instance {
 }
 
 // Delete removes an instance by name or IP
-func (s *InventoryStore) Delete(key string) bool {
+func (s *InventoryStore) Delete(ctx context.Context, key string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	_, exists := s.instances[key]
 	if exists {
-		delete(s.instances, key)
+		s.write(ctx, key, nil)
 	}
 
 	return exists
@@ -142,202 +287,390 @@ func (s *InventoryStore) Count() int {
 	return len(s.instances)
 }
 
+// GetByName finds an instance by its name
+func (s *InventoryStore) GetByName(name string) (*inventory.Instance, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.getIndexed(s.byName, name)
+}
+
 // GetByIP finds an instance by its IP address
 func (s *InventoryStore) GetByIP(ip string) (*inventory.Instance, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	for _, instance := range s.instances {
-		if instance.IP == ip {
-			instanceCopy := *instance
-			return &instanceCopy, true
-		}
+	return s.getIndexed(s.byIP, ip)
+}
+
+// getIndexed returns a copy of the instance an index points to
+func (s *InventoryStore) getIndexed(index map[string]string, value string) (*inventory.Instance, bool) {
+	if value == "" {
+		return nil, false
+	}
+
+	key, exists := index[value]
+	if !exists {
+		return nil, false
 	}
 
-	return nil, false
+	instanceCopy := *s.instances[key]
+	return &instanceCopy, true
 }
 
-// GetByLabels finds instances that match all provided labels
-func (s *InventoryStore) GetByLabels(labels map[string]string) []*inventory.Instance {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// write stores the updated version of an instance, nil to delete it, as part of the transaction of the context if any
+// It must be called with the write lock held
+func (s *InventoryStore) write(ctx context.Context, key string, updated *inventory.Instance) {
+	previous := s.instances[key]
+	if updated != nil {
+		updated.Revision = 1
+		if previous != nil {
+			updated.Revision = previous.Revision + 1
+		}
+	}
+	s.track(ctx, key, previous, updated)
+	s.replace(key, previous, updated)
+}
 
-	var matches []*inventory.Instance
+// replace stores the updated version of an instance in place of the previous one and keeps the indexes and tallies up to date
+// previous is nil for a new instance and updated is nil for a deleted one, the updated one is stored at the revision it has
+func (s *InventoryStore) replace(key string, previous, updated *inventory.Instance) {
+	if updated == nil {
+		delete(s.instances, key)
+	} else {
+		s.instances[key] = updated
+	}
 
-	for _, instance := range s.instances {
-		if s.matchesLabels(instance, labels) {
-			instanceCopy := *instance
-			matches = append(matches, &instanceCopy)
+	// Heartbeats only change the last ping, only the pings of the tallies move and only once a second
+	if previous != nil && updated != nil && !indexedChange(previous, updated) {
+		if previous.LastPing.Unix() != updated.LastPing.Unix() {
+			for _, t := range s.tallies {
+				if t.matches(updated) {
+					t.ping(previous, -1)
+					t.ping(updated, 1)
+				}
+			}
 		}
+		return
 	}
 
-	return matches
+	if previous != nil {
+		s.unindex(previous)
+		for _, t := range s.tallies {
+			t.add(previous, -1)
+		}
+	}
+	if updated != nil {
+		s.index(updated)
+		for _, t := range s.tallies {
+			t.add(updated, 1)
+		}
+	}
 }
 
-// CountByLabels returns the count of instances matching the given labels
-func (s *InventoryStore) CountByLabels(labels map[string]string) (int, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// indexedChange checks if an update changes what the indexes or the tallies depend on
+func indexedChange(previous, updated *inventory.Instance) bool {
+	return previous.Name != updated.Name || previous.IP != updated.IP ||
+		previous.Status != updated.Status || previous.Cordoned != updated.Cordoned ||
+		previous.CurrentState != updated.CurrentState || previous.DesiredState != updated.DesiredState ||
+		!maps.Equal(previous.Labels, updated.Labels)
+}
 
-	count := 0
-	for _, instance := range s.instances {
-		if s.matchesLabels(instance, labels) {
-			count++
+// index records the name, IP and labels of the instance
+func (s *InventoryStore) index(instance *inventory.Instance) {
+	key := instance.Key()
+	if instance.Name != "" {
+		s.byName[instance.Name] = key
+	}
+	if instance.IP != "" {
+		s.byIP[instance.IP] = key
+	}
+	for label, value := range instance.Labels {
+		values, ok := s.byLabel[label]
+		if !ok {
+			values = make(map[string]keySet)
+			s.byLabel[label] = values
+		}
+		keys, ok := values[value]
+		if !ok {
+			keys = make(keySet)
+			values[value] = keys
 		}
+		keys[key] = struct{}{}
 	}
+}
 
-	return count, nil
+// unindex removes the name, IP and labels of the instance
+func (s *InventoryStore) unindex(instance *inventory.Instance) {
+	key := instance.Key()
+	if s.byName[instance.Name] == key {
+		delete(s.byName, instance.Name)
+	}
+	if s.byIP[instance.IP] == key {
+		delete(s.byIP, instance.IP)
+	}
+	for label, value := range instance.Labels {
+		keys := s.byLabel[label][value]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(s.byLabel[label], value)
+		}
+		if len(s.byLabel[label]) == 0 {
+			delete(s.byLabel, label)
+		}
+	}
 }
 
-// GetNeedingUpdate returns instances that match labels and need state updates
-func (s *InventoryStore) GetNeedingUpdate(labels map[string]string, desiredState inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// eachMatching calls fn with every stored instance matching the label selector
+// The candidates come from the label index of the most selective requirement that needs a label to be set,
+// every instance is a candidate when the selector has none, like an empty selector
+func (s *InventoryStore) eachMatching(sel selector.Selector, fn func(instance *inventory.Instance)) {
+	var candidates []keySet
+	narrowed := false
+	best := len(s.instances) + 1
+	for _, requirement := range sel {
+		var sets []keySet
+		switch requirement.Operator {
+		case selector.Equals, selector.In:
+			for _, value := range requirement.Values {
+				sets = append(sets, s.byLabel[requirement.Key][value])
+			}
+		case selector.Exists:
+			for _, keys := range s.byLabel[requirement.Key] {
+				sets = append(sets, keys)
+			}
+		default:
+			continue
+		}
 
-	var matches []*inventory.Instance
-	maxResults := -1 // Default: no limit
-	if opts != nil && opts.Limit > 0 {
-		maxResults = opts.Limit
+		size := 0
+		for _, keys := range sets {
+			size += len(keys)
+		}
+		if size < best {
+			candidates, best, narrowed = sets, size, true
+		}
 	}
 
-	for _, instance := range s.instances {
-		if s.matchesLabels(instance, labels) && s.needsUpdate(instance, desiredState) {
-			instanceCopy := *instance
-			matches = append(matches, &instanceCopy)
-
-			// Check if we've reached the limit
-			if maxResults > 0 && len(matches) >= maxResults {
-				break
+	if !narrowed {
+		for _, instance := range s.instances {
+			if sel.Matches(instance.Labels) {
+				fn(instance)
 			}
 		}
+		return
 	}
 
-	return matches, nil
+	// An instance has a single value per label, the sets of a requirement are disjoint
+	for _, keys := range candidates {
+		for key := range keys {
+			if instance := s.instances[key]; sel.Matches(instance.Labels) {
+				fn(instance)
+			}
+		}
+	}
 }
 
-// CountNeedingUpdate returns the count of instances that match labels and need state updates
-func (s *InventoryStore) CountNeedingUpdate(labels map[string]string, desiredState inventory.State) (int, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// tally returns the counters of the progress query, they are counted from the label index the first time
+// It must be called with the write lock held
+func (s *InventoryStore) tally(sel selector.Selector, target inventory.State) *tally {
+	s.tick++
+	key := tallyKey{selector: sel.Key(), target: target}
+	if t, ok := s.tallies[key]; ok {
+		t.used = s.tick
+		return t
+	}
 
-	count := 0
-	for _, instance := range s.instances {
-		if s.matchesLabels(instance, labels) && s.needsUpdate(instance, desiredState) {
-			count++
+	if len(s.tallies) >= maxTallies {
+		var oldest tallyKey
+		var used uint64
+		for k, t := range s.tallies {
+			if used == 0 || t.used < used {
+				oldest, used = k, t.used
+			}
 		}
+		delete(s.tallies, oldest)
 	}
 
-	return count, nil
+	t := &tally{sel: sel, target: target, used: s.tick, pings: make(map[int64]int)}
+	s.eachMatching(sel, func(instance *inventory.Instance) {
+		t.add(instance, 1)
+	})
+	s.tallies[key] = t
+	return t
 }
 
-// CountCompleted returns the count of instances that match labels and have completed the update to desired state
-func (s *InventoryStore) CountCompleted(labels map[string]string, desiredState inventory.State) (int, error) {
+// GetByLabels finds instances that match the label selector
+func (s *InventoryStore) GetByLabels(sel selector.Selector) []*inventory.Instance {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	count := 0
-	for _, instance := range s.instances {
-		if s.matchesLabels(instance, labels) && s.isCompleted(instance, desiredState) {
-			count++
-		}
-	}
+	var matches []*inventory.Instance
+	s.eachMatching(sel, func(instance *inventory.Instance) {
+		instanceCopy := *instance
+		matches = append(matches, &instanceCopy)
+	})
+
+	return matches
+}
+
+// CountByLabels returns the count of instances matching the given label selector
+func (s *InventoryStore) CountByLabels(sel selector.Selector) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return count, nil
+	return s.tally(sel, inventory.State{}).progress.Total, nil
 }
 
-// CountFailed returns the count of instances that match labels and have failed the update to desired state
-func (s *InventoryStore) CountFailed(labels map[string]string, desiredState inventory.State) (int, error) {
+// GetNeedingUpdate returns instances that match the label selector and need state updates
+// Results are sorted by instance name so batches are selected in a stable order
+func (s *InventoryStore) GetNeedingUpdate(sel selector.Selector, desiredState inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	count := 0
-	for _, instance := range s.instances {
-		if s.matchesLabels(instance, labels) && s.isFailed(instance, desiredState) {
-			count++
+	limit := 0
+	if opts != nil {
+		limit = opts.Limit
+	}
+
+	// With a limit only the first instances in order are kept, in a heap of the limit size, instead of sorting every match
+	var selected instanceHeap
+	s.eachMatching(sel, func(instance *inventory.Instance) {
+		if instance.Cordoned || !s.needsUpdate(instance, desiredState) {
+			return
 		}
+		switch {
+		case limit <= 0 || len(selected) < limit:
+			heap.Push(&selected, instance)
+		case inventory.CompareInstances(instance, selected[0]) < 0:
+			selected[0] = instance
+			heap.Fix(&selected, 0)
+		}
+	})
+
+	// Only the selected instances are copied
+	matches := make([]*inventory.Instance, len(selected))
+	for i, instance := range selected {
+		instanceCopy := *instance
+		matches[i] = &instanceCopy
 	}
+	inventory.SortInstances(matches)
+
+	return matches, nil
+}
 
-	return count, nil
+// instanceHeap is a max-heap of instances in the order of inventory.SortInstances, its root is the last instance
+type instanceHeap []*inventory.Instance
+
+func (h instanceHeap) Len() int           { return len(h) }
+func (h instanceHeap) Less(i, j int) bool { return inventory.CompareInstances(h[i], h[j]) > 0 }
+func (h instanceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *instanceHeap) Push(x any)        { *h = append(*h, x.(*inventory.Instance)) }
+func (h *instanceHeap) Pop() any {
+	old := *h
+	instance := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return instance
 }
 
-// ResetFailedInstances resets the status of failed instances matching the labels to UNKNOWN
-func (s *InventoryStore) ResetFailedInstances(labels map[string]string) error {
+// CountNeedingUpdate returns the count of instances that match the label selector and need state updates
+func (s *InventoryStore) CountNeedingUpdate(sel selector.Selector, desiredState inventory.State) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for key, instance := range s.instances {
-		if s.matchesLabels(instance, labels) && instance.Status == inventory.FAILED {
-			// Create a copy to modify
-			updated := *instance
-			updated.Status = inventory.UNKNOWN
+	return s.tally(sel, desiredState).progress.NeedingUpdate, nil
+}
 
-			// Update the stored instance
-			s.instances[key] = &updated
-		}
-	}
+// CountCompleted returns the count of instances that match the label selector and have completed the update to desired state
+func (s *InventoryStore) CountCompleted(sel selector.Selector, desiredState inventory.State) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return nil
+	return s.tally(sel, desiredState).progress.Completed, nil
 }
 
-// CountInProgress returns the count of instances that match labels and are currently being updated
-// (desiredState == targetState but currentState != desiredState)
-func (s *InventoryStore) CountInProgress(labels map[string]string, desiredState inventory.State) (int, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// CountFailed returns the count of instances that match the label selector and have failed the update to desired state
+func (s *InventoryStore) CountFailed(sel selector.Selector, desiredState inventory.State) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	count := 0
-	for _, instance := range s.instances {
-		if s.matchesLabels(instance, labels) && s.isInProgress(instance, desiredState) {
-			count++
-		}
+	return s.tally(sel, desiredState).progress.Failed, nil
+}
+
+// CountProgress returns every progress count of the instances that match the label selector, under a single lock
+// The counts toward a single desired state come from its tally, per instance targets are counted from the label index
+func (s *InventoryStore) CountProgress(sel selector.Selector, desiredState inventory.State, opts *inventory.ProgressOptions) (inventory.Progress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if opts == nil {
+		opts = &inventory.ProgressOptions{}
 	}
+	before := opts.UnreachableBefore.Truncate(time.Second)
 
-	return count, nil
-}
+	if opts.Targets == nil {
+		t := s.tally(sel, desiredState)
+		progress := t.progress
+		progress.Unreachable = t.unreachable(before)
+		return progress, nil
+	}
 
-// isCompleted checks if an instance has completed the update to the desired state
-// This includes both successful completions and failed attempts
-func (s *InventoryStore) isCompleted(instance *inventory.Instance, desiredState inventory.State) bool {
-	// Successfully completed: current state matches desired state
-	successfullyCompleted := instance.CurrentState.CodeVersion == desiredState.CodeVersion &&
-		instance.CurrentState.ConfigurationVersion == desiredState.ConfigurationVersion &&
-		instance.Status == inventory.HEALTHY
+	var progress inventory.Progress
+	s.eachMatching(sel, func(instance *inventory.Instance) {
+		target, ok := opts.Targets[instance.Key()]
+		if !ok || instance.Cordoned {
+			return
+		}
+		progress.Add(instance, target, 1)
+		if !before.IsZero() && instance.IsUnreachable(before) {
+			progress.Unreachable++
+		}
+	})
 
-	return successfullyCompleted
+	return progress, nil
 }
 
-// isFailed checks if an instance has failed the update to the desired state
-// An instance is considered failed if it has the desired state but status is FAILED
-func (s *InventoryStore) isFailed(instance *inventory.Instance, desiredState inventory.State) bool {
-	return instance.DesiredState.CodeVersion == desiredState.CodeVersion &&
-		instance.DesiredState.ConfigurationVersion == desiredState.ConfigurationVersion &&
-		instance.Status == inventory.FAILED
-}
+// ResetFailedInstances resets the status of failed instances matching the label selector to UNKNOWN
+func (s *InventoryStore) ResetFailedInstances(ctx context.Context, sel selector.Selector) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-// isInProgress checks if an instance is currently being updated
-// An instance is in progress if: desiredState == targetState but currentState != desiredState
-func (s *InventoryStore) isInProgress(instance *inventory.Instance, desiredState inventory.State) bool {
-	// Check if the instance has been told to update to the target state
-	hasDesiredState := instance.DesiredState.CodeVersion == desiredState.CodeVersion &&
-		instance.DesiredState.ConfigurationVersion == desiredState.ConfigurationVersion
+	var failed []*inventory.Instance
+	s.eachMatching(sel, func(instance *inventory.Instance) {
+		if instance.Status == inventory.FAILED {
+			failed = append(failed, instance)
+		}
+	})
+
+	for _, instance := range failed {
+		// Create a copy to modify
+		updated := *instance
+		updated.Status = inventory.UNKNOWN
+
+		// Update the stored instance
+		s.write(ctx, instance.Key(), &updated)
+	}
+
+	return nil
+}
 
-	// Check if the instance hasn't finished updating yet
-	needsUpdate := instance.CurrentState.CodeVersion != desiredState.CodeVersion ||
-		instance.CurrentState.ConfigurationVersion != desiredState.ConfigurationVersion
+// CountInProgress returns the count of instances that match the label selector and are currently being updated
+// (desiredState == targetState but currentState != desiredState)
+func (s *InventoryStore) CountInProgress(sel selector.Selector, desiredState inventory.State) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Instance is in progress if it has the desired state but still needs to update its current state
-	return hasDesiredState && needsUpdate
+	return s.tally(sel, desiredState).progress.InProgress, nil
 }
 
 // needsUpdate checks if an instance needs an update based on desired state
 func (s *InventoryStore) needsUpdate(instance *inventory.Instance, desiredState inventory.State) bool {
-	return instance.CurrentState.CodeVersion != desiredState.CodeVersion ||
-		instance.CurrentState.ConfigurationVersion != desiredState.ConfigurationVersion
+	return instance.NeedsUpdate(desiredState)
 }
 
 // UpdateLabels provides more granular control over label updates
 // Use empty string value to remove a label
-func (s *InventoryStore) UpdateLabels(key string, labelUpdates map[string]string) (*inventory.Instance, error) {
+func (s *InventoryStore) UpdateLabels(ctx context.Context, key string, labelUpdates map[string]string) (*inventory.Instance, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -369,24 +702,9 @@ func (s *InventoryStore) UpdateLabels(key string, labelUpdates map[string]string
 		}
 	}
 
-	s.instances[key] = &updated
+	s.write(ctx, key, &updated)
 
 	// Return a copy of the updated instance
 	result := updated
 	return &result, nil
 }
-
-// matchesLabels checks if an instance has all the specified labels
-func (s *InventoryStore) matchesLabels(instance *inventory.Instance, labels map[string]string) bool {
-	if instance.Labels == nil {
-		return len(labels) == 0
-	}
-
-	for key, value := range labels {
-		if instanceValue, exists := instance.Labels[key]; !exists || instanceValue != value {
-			return false
-		}
-	}
-
-	return true
-}
@@ -0,0 +1,252 @@
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/metrics"
+	"github.com/xnok/dides/internal/selector"
+	"github.com/xnok/dides/internal/tracing"
+	"github.com/xnok/dides/internal/transaction"
+	"github.com/xnok/dides/internal/webhook"
+)
+
+// benchmarkFleet stores a fleet in the middle of a rollout from v1 to v2 of the production instances:
+// a tenth of the instances run dev, half of production completed and one batch is in progress
+func benchmarkFleet(b *testing.B, size, batchSize int) *InventoryStore {
+	b.Helper()
+
+	v1 := inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"}
+	v2 := inventory.State{CodeVersion: "v2", ConfigurationVersion: "c1"}
+
+	store := NewInventoryStore()
+	production := size - size/10
+	for i := 0; i < size; i++ {
+		instance := &inventory.Instance{
+			ID:           fmt.Sprintf("i-%06d", i),
+			Name:         fmt.Sprintf("web-%06d", i),
+			IP:           fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff),
+			Labels:       map[string]string{"env": "production", "role": "web"},
+			Status:       inventory.HEALTHY,
+			CurrentState: v1,
+			DesiredState: v1,
+		}
+		switch {
+		case i >= production:
+			instance.Labels["env"] = "dev"
+		case i < production/2:
+			instance.CurrentState, instance.DesiredState = v2, v2
+		case i < production/2+batchSize:
+			instance.DesiredState = v2
+		}
+		if err := store.Save(context.Background(), instance); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return store
+}
+
+// fullScanStore answers the deployment queries by scanning the whole fleet with label matching while holding the lock,
+// as the store did before the label index and the progress counters, it is the baseline of the benchmarks
+type fullScanStore struct {
+	*InventoryStore
+}
+
+// CountByLabels counts the matching instances
+func (s fullScanStore) CountByLabels(sel selector.Selector) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, instance := range s.instances {
+		if !instance.Cordoned && sel.Matches(instance.Labels) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// GetNeedingUpdate copies and sorts every matching instance needing an update, then keeps the first ones
+func (s fullScanStore) GetNeedingUpdate(sel selector.Selector, desiredState inventory.State, opts *inventory.GetNeedingUpdateOptions) ([]*inventory.Instance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matches []*inventory.Instance
+	for _, instance := range s.instances {
+		if !instance.Cordoned && sel.Matches(instance.Labels) && instance.NeedsUpdate(desiredState) {
+			instanceCopy := *instance
+			matches = append(matches, &instanceCopy)
+		}
+	}
+	inventory.SortInstances(matches)
+
+	if opts != nil && opts.Limit > 0 && len(matches) > opts.Limit {
+		matches = matches[:opts.Limit]
+	}
+	return matches, nil
+}
+
+// CountProgress counts the matching instances in every progress bucket
+func (s fullScanStore) CountProgress(sel selector.Selector, desiredState inventory.State, opts *inventory.ProgressOptions) (inventory.Progress, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if opts == nil {
+		opts = &inventory.ProgressOptions{}
+	}
+	before := opts.UnreachableBefore.Truncate(time.Second)
+
+	var progress inventory.Progress
+	for _, instance := range s.instances {
+		if instance.Cordoned || !sel.Matches(instance.Labels) {
+			continue
+		}
+		target := desiredState
+		if opts.Targets != nil {
+			var ok bool
+			if target, ok = opts.Targets[instance.Key()]; !ok {
+				continue
+			}
+		}
+		progress.Add(instance, target, 1)
+		if !before.IsZero() && instance.IsUnreachable(before) {
+			progress.Unreachable++
+		}
+	}
+	return progress, nil
+}
+
+// benchmarkStores are the inventories the deployments are benchmarked against
+var benchmarkStores = []struct {
+	name  string
+	store func(*InventoryStore) inventory.Store
+}{
+	{"full_scan", func(s *InventoryStore) inventory.Store { return fullScanStore{s} }},
+	{"indexed", func(s *InventoryStore) inventory.Store { return s }},
+}
+
+// benchmarkDeployments wires the deployment services over the inventory as cmd/controller does: the traced stores,
+// locker, strategy and inventory, the unit of work, and the event bus forwarding to the webhooks and the metrics
+// The queries of the deployments go to queries, the writes to the store
+// The deployment of v2 to the production instances is triggered, it starts its first batch
+func benchmarkDeployments(b *testing.B, store *InventoryStore, queries inventory.Store, batchSize int) *deployment.TriggerService {
+	b.Helper()
+
+	records := NewDeploymentStore(nil)
+	webhooks := webhook.NewDispatcher(NewWebhookStore(), nil, webhook.DefaultRetryPolicy, nil)
+	b.Cleanup(webhooks.Close)
+	events := NewEventBus(nil, webhooks, metrics.NewCollector(records, store, nil))
+
+	tracedStore := tracing.NewStore(records)
+	strategy := deployment.NewRollingDeployment(tracedStore, tracing.NewInventory(inventory.NewStateService(tracing.NewInventoryStore(queries), NewNotifier(), nil)), events)
+	service := deployment.NewTriggerService(tracedStore, tracing.NewLocker(NewInMemoryLocker()), tracing.NewStrategy(strategy), nil, events, transaction.NewManager(records, store))
+
+	err := service.TriggerDeployment(context.Background(), &deployment.DeploymentRequest{
+		CodeVersion:          "v2",
+		ConfigurationVersion: "c1",
+		Labels:               map[string]string{"env": "production"},
+		Configuration:        deployment.Configuration{BatchSize: batchSize, FailureThreshold: 10},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return service
+}
+
+// BenchmarkProgressDeployment measures a progress check of the controller while a batch is in flight, over the
+// full scans of the fleet and over the indexed store
+// batch=in_flight starts no instance, batch=started completes an instance before each check so the check starts the next one
+func BenchmarkProgressDeployment(b *testing.B) {
+	const batchSize = 1000
+	v1 := inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"}
+	v2 := inventory.State{CodeVersion: "v2", ConfigurationVersion: "c1"}
+	healthy := inventory.HEALTHY
+
+	for _, size := range []int{10_000, 100_000} {
+		for _, bs := range benchmarkStores {
+			b.Run(fmt.Sprintf("instances=%d/store=%s/batch=in_flight", size, bs.name), func(b *testing.B) {
+				ctx := context.Background()
+				store := benchmarkFleet(b, size, 0)
+				service := benchmarkDeployments(b, store, bs.store(store), batchSize)
+
+				var record *deployment.DeploymentRecord
+				b.ResetTimer()
+				for b.Loop() {
+					var err error
+					if record, err = service.ProgressDeployment(ctx); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+
+				if record.Progress.InProgressInstances != batchSize || record.Status != deployment.Running {
+					b.Fatalf("Expected a running deployment with a batch in flight, got %+v", record.Progress)
+				}
+			})
+
+			b.Run(fmt.Sprintf("instances=%d/store=%s/batch=started", size, bs.name), func(b *testing.B) {
+				ctx := context.Background()
+				store := benchmarkFleet(b, size, 0)
+				service := benchmarkDeployments(b, store, bs.store(store), batchSize)
+
+				// The first batch holds the production instances after the completed half, in name order
+				first := (size - size/10) / 2
+				inFlight := make([]string, 0, batchSize)
+				for i := first; i < first+batchSize; i++ {
+					inFlight = append(inFlight, fmt.Sprintf("i-%06d", i))
+				}
+				next := fmt.Sprintf("i-%06d", first+batchSize)
+
+				var record *deployment.DeploymentRecord
+				b.ResetTimer()
+				for b.Loop() {
+					b.StopTimer()
+					key := inFlight[0]
+					if _, err := store.Update(ctx, key, inventory.InstancePatch{CurrentState: &v2, Status: &healthy}); err != nil {
+						b.Fatal(err)
+					}
+					b.StartTimer()
+
+					var err error
+					if record, err = service.ProgressDeployment(ctx); err != nil {
+						b.Fatal(err)
+					}
+
+					// The completed instance needs an update again, the check after the next one picks it first by name
+					b.StopTimer()
+					if _, err := store.Update(ctx, key, inventory.InstancePatch{CurrentState: &v1, DesiredState: &v1}); err != nil {
+						b.Fatal(err)
+					}
+					inFlight = append(inFlight[1:], next)
+					next = key
+					b.StartTimer()
+				}
+				b.StopTimer()
+
+				if record.Progress.InProgressInstances != batchSize || record.Status != deployment.Running {
+					b.Fatalf("Expected a running deployment with a batch in flight, got %+v", record.Progress)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkInventoryStore_Heartbeat measures the update sent by an instance on every heartbeat
+func BenchmarkInventoryStore_Heartbeat(b *testing.B) {
+	store := benchmarkFleet(b, 100_000, 1000)
+	now := time.Now()
+	status := inventory.HEALTHY
+
+	b.ResetTimer()
+	i := 0
+	for b.Loop() {
+		if _, err := store.Update(context.Background(), fmt.Sprintf("i-%06d", i%100_000), inventory.InstancePatch{LastPing: &now, Status: &status}); err != nil {
+			b.Fatal(err)
+		}
+		i++
+	}
+}
@@ -1,11 +1,16 @@
 package inmemory
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"testing"
 	"time"
 
 	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+	"github.com/xnok/dides/internal/transaction"
 )
 
 func TestInventoryStore_Save(t *testing.T) {
@@ -19,7 +24,7 @@ func TestInventoryStore_Save(t *testing.T) {
 		Status:   inventory.HEALTHY,
 	}
 
-	err := store.Save(instance)
+	err := store.Save(context.Background(), instance)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -52,8 +57,8 @@ func TestInventoryStore_GetAll(t *testing.T) {
 		Name: "instance-2",
 	}
 
-	store.Save(instance1)
-	store.Save(instance2)
+	store.Save(context.Background(), instance1)
+	store.Save(context.Background(), instance2)
 
 	all := store.GetAll()
 	if len(all) != 2 {
@@ -82,18 +87,18 @@ func TestInventoryStore_GetByLabels(t *testing.T) {
 		Labels: map[string]string{"role": "web", "env": "test"},
 	}
 
-	store.Save(instance1)
-	store.Save(instance2)
-	store.Save(instance3)
+	store.Save(context.Background(), instance1)
+	store.Save(context.Background(), instance2)
+	store.Save(context.Background(), instance3)
 
 	// Test finding by single label
-	webInstances := store.GetByLabels(map[string]string{"role": "web"})
+	webInstances := store.GetByLabels(selector.FromLabels(map[string]string{"role": "web"}))
 	if len(webInstances) != 2 {
 		t.Errorf("Expected 2 web instances, got %d", len(webInstances))
 	}
 
 	// Test finding by multiple labels
-	prodWebInstances := store.GetByLabels(map[string]string{"role": "web", "env": "prod"})
+	prodWebInstances := store.GetByLabels(selector.FromLabels(map[string]string{"role": "web", "env": "prod"}))
 	if len(prodWebInstances) != 1 {
 		t.Errorf("Expected 1 prod web instance, got %d", len(prodWebInstances))
 	}
@@ -103,6 +108,47 @@ func TestInventoryStore_GetByLabels(t *testing.T) {
 	}
 }
 
+func TestInventoryStore_GetByLabels_SetBasedSelector(t *testing.T) {
+	store := NewInventoryStore()
+
+	store.Save(context.Background(), &inventory.Instance{Name: "web-a", Labels: map[string]string{"env": "prod", "zone": "a"}})
+	store.Save(context.Background(), &inventory.Instance{Name: "web-b", Labels: map[string]string{"env": "prod", "zone": "b"}})
+	store.Save(context.Background(), &inventory.Instance{Name: "web-c", Labels: map[string]string{"env": "prod", "zone": "c", "canary": "true"}})
+	store.Save(context.Background(), &inventory.Instance{Name: "web-dev", Labels: map[string]string{"env": "dev", "zone": "a"}})
+	store.Save(context.Background(), &inventory.Instance{Name: "unlabeled"})
+
+	tests := []struct {
+		selector string
+		count    int
+	}{
+		{"env=prod,zone in (a,b)", 2},
+		{"env=prod,!canary", 2},
+		{"env!=prod", 2},
+		{"zone notin (a)", 3},
+		{"canary", 1},
+		{"!zone", 1},
+	}
+
+	for _, tt := range tests {
+		sel, err := selector.Parse(tt.selector)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if matches := store.GetByLabels(sel); len(matches) != tt.count {
+			t.Errorf("Expected %d instances for %q, got %d", tt.count, tt.selector, len(matches))
+		}
+
+		count, err := store.CountByLabels(sel)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if count != tt.count {
+			t.Errorf("Expected count %d for %q, got %d", tt.count, tt.selector, count)
+		}
+	}
+}
+
 func TestInventoryStore_Delete(t *testing.T) {
 	store := NewInventoryStore()
 
@@ -111,7 +157,7 @@ func TestInventoryStore_Delete(t *testing.T) {
 		Name: "test-instance",
 	}
 
-	store.Save(instance)
+	store.Save(context.Background(), instance)
 
 	// Verify it exists
 	_, exists := store.Get("test-instance")
@@ -120,7 +166,7 @@ func TestInventoryStore_Delete(t *testing.T) {
 	}
 
 	// Delete it
-	deleted := store.Delete("test-instance")
+	deleted := store.Delete(context.Background(), "test-instance")
 	if !deleted {
 		t.Fatal("Expected deletion to return true")
 	}
@@ -144,7 +190,7 @@ func TestInventoryStore_Update(t *testing.T) {
 		Status:   inventory.UNKNOWN,
 	}
 
-	store.Save(instance)
+	store.Save(context.Background(), instance)
 
 	// Test partial update
 	newStatus := inventory.HEALTHY
@@ -156,7 +202,7 @@ func TestInventoryStore_Update(t *testing.T) {
 		Labels:   map[string]string{"env": "prod", "region": "us-west"}, // Will merge with existing
 	}
 
-	updated, err := store.Update("test-instance", patch)
+	updated, err := store.Update(context.Background(), "test-instance", patch)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -198,6 +244,54 @@ func TestInventoryStore_Update(t *testing.T) {
 	}
 }
 
+func TestInventoryStore_UpdateRecordsPreviousState(t *testing.T) {
+	store := NewInventoryStore()
+
+	v1 := inventory.State{CodeVersion: "v1.0.0", ConfigurationVersion: "config-v1"}
+	v2 := inventory.State{CodeVersion: "v2.0.0", ConfigurationVersion: "config-v2"}
+	v3 := inventory.State{CodeVersion: "v3.0.0", ConfigurationVersion: "config-v3"}
+
+	store.Save(context.Background(), &inventory.Instance{
+		Name:         "web-1",
+		Status:       inventory.HEALTHY,
+		CurrentState: v1,
+		DesiredState: v1,
+	})
+
+	// Healthy instance moving to a new version remembers where it came from
+	updated, err := store.Update(context.Background(), "web-1", inventory.InstancePatch{DesiredState: &v2})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if updated.PreviousState != v1 {
+		t.Errorf("Expected previous state %v, got %v", v1, updated.PreviousState)
+	}
+
+	// The instance fails on the new version, the failed version is not a known good state
+	failed := inventory.FAILED
+	store.Update(context.Background(), "web-1", inventory.InstancePatch{Status: &failed, CurrentState: &v2})
+
+	updated, err = store.Update(context.Background(), "web-1", inventory.InstancePatch{DesiredState: &v3})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if updated.PreviousState != v1 {
+		t.Errorf("Expected previous state to remain %v, got %v", v1, updated.PreviousState)
+	}
+
+	// Setting the same desired state again does not touch the previous state
+	healthy := inventory.HEALTHY
+	store.Update(context.Background(), "web-1", inventory.InstancePatch{Status: &healthy, CurrentState: &v3})
+
+	updated, err = store.Update(context.Background(), "web-1", inventory.InstancePatch{DesiredState: &v3})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if updated.PreviousState != v1 {
+		t.Errorf("Expected previous state to remain %v, got %v", v1, updated.PreviousState)
+	}
+}
+
 func TestInventoryStore_UpdateNonExistent(t *testing.T) {
 	store := NewInventoryStore()
 
@@ -206,7 +300,7 @@ func TestInventoryStore_UpdateNonExistent(t *testing.T) {
 		Status: &newStatus,
 	}
 
-	_, err := store.Update("non-existent", patch)
+	_, err := store.Update(context.Background(), "non-existent", patch)
 	if err != ErrInstanceNotFound {
 		t.Errorf("Expected ErrInstanceNotFound, got %v", err)
 	}
@@ -222,7 +316,7 @@ func TestInventoryStore_UpdateLabels(t *testing.T) {
 		Labels: map[string]string{"env": "test", "version": "1.0", "region": "us-east"},
 	}
 
-	store.Save(instance)
+	store.Save(context.Background(), instance)
 
 	// Update labels: change env, remove region, add new label
 	labelUpdates := map[string]string{
@@ -231,7 +325,7 @@ func TestInventoryStore_UpdateLabels(t *testing.T) {
 		"team":   "backend", // add new
 	}
 
-	updated, err := store.UpdateLabels("test-instance", labelUpdates)
+	updated, err := store.UpdateLabels(context.Background(), "test-instance", labelUpdates)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -262,6 +356,21 @@ func TestInventoryStore_UpdateLabels(t *testing.T) {
 	if _, exists := retrieved.Labels["region"]; exists {
 		t.Error("Expected region label to be removed from stored instance")
 	}
+	if retrieved.Revision != 2 {
+		t.Errorf("Expected the label update to be a new revision, got %d", retrieved.Revision)
+	}
+
+	// A label update made in a unit of work that fails is undone with it
+	manager := transaction.NewManager(store)
+	manager.Do(context.Background(), func(ctx context.Context) error {
+		if _, err := store.UpdateLabels(ctx, "test-instance", map[string]string{"env": "staging"}); err != nil {
+			return err
+		}
+		return ErrInstanceNotFound
+	})
+	if retrieved, _ := store.Get("test-instance"); retrieved.Labels["env"] != "prod" {
+		t.Errorf("Expected the label update to be rolled back, got %v", retrieved.Labels)
+	}
 }
 
 func TestInventoryStore_CountByLabels(t *testing.T) {
@@ -285,12 +394,12 @@ func TestInventoryStore_CountByLabels(t *testing.T) {
 		Labels: map[string]string{"role": "web", "env": "test"},
 	}
 
-	store.Save(instance1)
-	store.Save(instance2)
-	store.Save(instance3)
+	store.Save(context.Background(), instance1)
+	store.Save(context.Background(), instance2)
+	store.Save(context.Background(), instance3)
 
 	// Test counting by single label
-	webCount, err := store.CountByLabels(map[string]string{"role": "web"})
+	webCount, err := store.CountByLabels(selector.FromLabels(map[string]string{"role": "web"}))
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -299,7 +408,7 @@ func TestInventoryStore_CountByLabels(t *testing.T) {
 	}
 
 	// Test counting by multiple labels
-	prodWebCount, err := store.CountByLabels(map[string]string{"role": "web", "env": "prod"})
+	prodWebCount, err := store.CountByLabels(selector.FromLabels(map[string]string{"role": "web", "env": "prod"}))
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -308,7 +417,7 @@ func TestInventoryStore_CountByLabels(t *testing.T) {
 	}
 
 	// Test counting with no matches
-	noMatchCount, err := store.CountByLabels(map[string]string{"role": "cache"})
+	noMatchCount, err := store.CountByLabels(selector.FromLabels(map[string]string{"role": "cache"}))
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -351,9 +460,9 @@ func TestInventoryStore_GetNeedingUpdate(t *testing.T) {
 		},
 	}
 
-	store.Save(instance1)
-	store.Save(instance2)
-	store.Save(instance3)
+	store.Save(context.Background(), instance1)
+	store.Save(context.Background(), instance2)
+	store.Save(context.Background(), instance3)
 
 	desiredState := inventory.State{
 		CodeVersion:          "v2.0.0",
@@ -361,7 +470,7 @@ func TestInventoryStore_GetNeedingUpdate(t *testing.T) {
 	}
 
 	// Get web instances needing update
-	instances, err := store.GetNeedingUpdate(map[string]string{"role": "web"}, desiredState, nil)
+	instances, err := store.GetNeedingUpdate(selector.FromLabels(map[string]string{"role": "web"}), desiredState, nil)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -390,7 +499,7 @@ func TestInventoryStore_GetNeedingUpdateWithLimit(t *testing.T) {
 				ConfigurationVersion: "config-v1.0",
 			},
 		}
-		store.Save(instance)
+		store.Save(context.Background(), instance)
 	}
 
 	desiredState := inventory.State{
@@ -400,17 +509,19 @@ func TestInventoryStore_GetNeedingUpdateWithLimit(t *testing.T) {
 
 	// Test with limit of 2
 	opts := &inventory.GetNeedingUpdateOptions{Limit: 2}
-	instances, err := store.GetNeedingUpdate(map[string]string{"role": "web"}, desiredState, opts)
+	instances, err := store.GetNeedingUpdate(selector.FromLabels(map[string]string{"role": "web"}), desiredState, opts)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
 	if len(instances) != 2 {
 		t.Errorf("Expected 2 instances with limit, got %d", len(instances))
+	} else if instances[0].Name != "web-1" || instances[1].Name != "web-2" {
+		t.Errorf("Expected the first instances by name, got %s and %s", instances[0].Name, instances[1].Name)
 	}
 
 	// Test without limit (should return all 5)
-	instances, err = store.GetNeedingUpdate(map[string]string{"role": "web"}, desiredState, nil)
+	instances, err = store.GetNeedingUpdate(selector.FromLabels(map[string]string{"role": "web"}), desiredState, nil)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -421,7 +532,7 @@ func TestInventoryStore_GetNeedingUpdateWithLimit(t *testing.T) {
 
 	// Test with limit of 0 (should return all)
 	opts = &inventory.GetNeedingUpdateOptions{Limit: 0}
-	instances, err = store.GetNeedingUpdate(map[string]string{"role": "web"}, desiredState, opts)
+	instances, err = store.GetNeedingUpdate(selector.FromLabels(map[string]string{"role": "web"}), desiredState, opts)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -455,8 +566,8 @@ func TestInventoryStore_CountNeedingUpdate(t *testing.T) {
 		},
 	}
 
-	store.Save(instance1)
-	store.Save(instance2)
+	store.Save(context.Background(), instance1)
+	store.Save(context.Background(), instance2)
 
 	desiredState := inventory.State{
 		CodeVersion:          "v2.0.0",
@@ -464,7 +575,7 @@ func TestInventoryStore_CountNeedingUpdate(t *testing.T) {
 	}
 
 	// Count instances needing update
-	count, err := store.CountNeedingUpdate(map[string]string{"role": "web"}, desiredState)
+	count, err := store.CountNeedingUpdate(selector.FromLabels(map[string]string{"role": "web"}), desiredState)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -517,12 +628,12 @@ func TestInventoryStore_ResetFailedInstances(t *testing.T) {
 	}
 
 	// Save all instances
-	store.Save(instance1)
-	store.Save(instance2)
-	store.Save(instance3)
+	store.Save(context.Background(), instance1)
+	store.Save(context.Background(), instance2)
+	store.Save(context.Background(), instance3)
 
 	// Reset failed instances for prod env
-	err := store.ResetFailedInstances(map[string]string{"env": "prod"})
+	err := store.ResetFailedInstances(context.Background(), selector.FromLabels(map[string]string{"env": "prod"}))
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -554,3 +665,409 @@ func TestInventoryStore_ResetFailedInstances(t *testing.T) {
 		t.Errorf("Expected instance3 status to remain FAILED, got %v", updated3.Status)
 	}
 }
+
+func TestInventoryStore_CordonedExcludedFromDeployments(t *testing.T) {
+	store := NewInventoryStore()
+
+	store.Save(context.Background(), &inventory.Instance{Name: "web-1", Labels: map[string]string{"role": "web"}})
+	store.Save(context.Background(), &inventory.Instance{Name: "web-2", Labels: map[string]string{"role": "web"}})
+
+	cordoned := true
+	if _, err := store.Update(context.Background(), "web-2", inventory.InstancePatch{Cordoned: &cordoned}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	sel := selector.FromLabels(map[string]string{"role": "web"})
+	target := inventory.State{CodeVersion: "v2.0.0"}
+
+	// The cordoned instance is still tracked
+	if len(store.GetByLabels(sel)) != 2 {
+		t.Errorf("Expected 2 web instances, got %d", len(store.GetByLabels(sel)))
+	}
+
+	count, err := store.CountByLabels(sel)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 deployable instance, got %d", count)
+	}
+
+	instances, err := store.GetNeedingUpdate(sel, target, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(instances) != 1 || instances[0].Name != "web-1" {
+		t.Errorf("Expected only web-1 to need an update, got %v", instances)
+	}
+}
+
+func TestInventoryStore_SaveConflict(t *testing.T) {
+	store := NewInventoryStore()
+
+	if err := store.Save(context.Background(), &inventory.Instance{ID: "i-1", Name: "web-1", IP: "10.0.0.1"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Saving the same instance again is allowed
+	if err := store.Save(context.Background(), &inventory.Instance{ID: "i-1", Name: "web-1", IP: "10.0.0.1", Labels: map[string]string{"role": "web"}}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Another instance cannot take its name or IP
+	if err := store.Save(context.Background(), &inventory.Instance{ID: "i-2", Name: "web-1", IP: "10.0.0.2"}); err != inventory.ErrInstanceConflict {
+		t.Errorf("Expected ErrInstanceConflict for a duplicate name, got %v", err)
+	}
+	if err := store.Save(context.Background(), &inventory.Instance{ID: "i-2", Name: "web-2", IP: "10.0.0.1"}); err != inventory.ErrInstanceConflict {
+		t.Errorf("Expected ErrInstanceConflict for a duplicate IP, got %v", err)
+	}
+
+	byName, exists := store.GetByName("web-1")
+	if !exists || byName.ID != "i-1" {
+		t.Errorf("Expected web-1 to be i-1, got %v", byName)
+	}
+
+	byIP, exists := store.GetByIP("10.0.0.1")
+	if !exists || byIP.ID != "i-1" {
+		t.Errorf("Expected 10.0.0.1 to be i-1, got %v", byIP)
+	}
+
+	// The name and IP are released once the instance is deleted
+	store.Delete(context.Background(), "i-1")
+	if _, exists := store.GetByName("web-1"); exists {
+		t.Error("Expected web-1 to be released after delete")
+	}
+	if err := store.Save(context.Background(), &inventory.Instance{ID: "i-2", Name: "web-1", IP: "10.0.0.1"}); err != nil {
+		t.Errorf("Expected no error after delete, got %v", err)
+	}
+}
+
+func TestInventoryStore_IndexedCountsFollowWrites(t *testing.T) {
+	store := NewInventoryStore()
+	v1 := inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"}
+	v2 := inventory.State{CodeVersion: "v2", ConfigurationVersion: "c1"}
+
+	for i := 0; i < 20; i++ {
+		env := "production"
+		if i%4 == 0 {
+			env = "dev"
+		}
+		store.Save(context.Background(), &inventory.Instance{
+			Name:         fmt.Sprintf("web-%02d", i),
+			IP:           fmt.Sprintf("10.0.0.%d", i),
+			Labels:       map[string]string{"env": env, "zone": fmt.Sprintf("z%d", i%3)},
+			Status:       inventory.HEALTHY,
+			CurrentState: v1,
+		})
+	}
+
+	selectors := []string{"", "env=production", "env in (production,dev),zone!=z1", "zone", "!canary"}
+	check := func(step string) {
+		t.Helper()
+		for _, s := range selectors {
+			sel, _ := selector.Parse(s)
+
+			// Count the instances the way the store did before it had indexes
+			var deployable, needing, inProgress, completed, failed, matching int
+			for _, instance := range store.GetAll() {
+				if !sel.Matches(instance.Labels) {
+					continue
+				}
+				matching++
+				if instance.Cordoned {
+					continue
+				}
+				deployable++
+				if instance.NeedsUpdate(v2) {
+					needing++
+				}
+				if instance.IsInProgress(v2) {
+					inProgress++
+				}
+				if instance.IsCompleted(v2) {
+					completed++
+				}
+				if instance.IsFailed(v2) {
+					failed++
+				}
+			}
+
+			gotDeployable, _ := store.CountByLabels(sel)
+			gotNeeding, _ := store.CountNeedingUpdate(sel, v2)
+			gotInProgress, _ := store.CountInProgress(sel, v2)
+			gotCompleted, _ := store.CountCompleted(sel, v2)
+			gotFailed, _ := store.CountFailed(sel, v2)
+			got := []int{gotDeployable, gotNeeding, gotInProgress, gotCompleted, gotFailed, len(store.GetByLabels(sel))}
+			want := []int{deployable, needing, inProgress, completed, failed, matching}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("%s, selector %q: expected counts %v, got %v", step, s, want, got)
+					break
+				}
+			}
+		}
+	}
+
+	check("initial")
+
+	// Start a batch, complete and fail some instances
+	batch, _ := store.GetNeedingUpdate(selector.FromLabels(map[string]string{"env": "production"}), v2, &inventory.GetNeedingUpdateOptions{Limit: 6})
+	for _, instance := range batch {
+		store.Update(context.Background(), instance.Key(), inventory.InstancePatch{DesiredState: &v2})
+	}
+	check("batch started")
+
+	healthy, failed := inventory.HEALTHY, inventory.FAILED
+	store.Update(context.Background(), batch[0].Key(), inventory.InstancePatch{CurrentState: &v2, Status: &healthy})
+	store.Update(context.Background(), batch[1].Key(), inventory.InstancePatch{CurrentState: &v2, Status: &failed})
+	store.Update(context.Background(), batch[2].Key(), inventory.InstancePatch{Status: &failed})
+	check("batch reported")
+
+	// Labels, cordon, deletion, reset and registration change the matching instances
+	cordoned := true
+	store.Update(context.Background(), batch[3].Key(), inventory.InstancePatch{Cordoned: &cordoned})
+	store.Update(context.Background(), batch[4].Key(), inventory.InstancePatch{Labels: map[string]string{"env": "dev", "canary": "true"}})
+	store.UpdateLabels(context.Background(), batch[5].Key(), map[string]string{"zone": ""})
+	store.Delete(context.Background(), "web-01")
+	check("labels changed")
+
+	store.ResetFailedInstances(context.Background(), selector.Selector{})
+	store.Save(context.Background(), &inventory.Instance{Name: "web-20", IP: "10.0.0.20", Labels: map[string]string{"env": "production"}, DesiredState: v2, Status: inventory.FAILED})
+	check("failures reset")
+}
+
+func TestInventoryStore_CountProgress(t *testing.T) {
+	store := NewInventoryStore()
+	v1 := inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"}
+	v2 := inventory.State{CodeVersion: "v2", ConfigurationVersion: "c1"}
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	instances := []*inventory.Instance{
+		{Name: "web-1", Labels: map[string]string{"env": "prod"}, Status: inventory.HEALTHY, CurrentState: v2, DesiredState: v2, LastPing: now},
+		{Name: "web-2", Labels: map[string]string{"env": "prod"}, Status: inventory.HEALTHY, CurrentState: v1, DesiredState: v2, LastPing: now.Add(-2 * time.Minute)},
+		{Name: "web-3", Labels: map[string]string{"env": "prod"}, Status: inventory.FAILED, CurrentState: v1, DesiredState: v2, LastPing: now},
+		{Name: "web-4", Labels: map[string]string{"env": "prod"}, Status: inventory.HEALTHY, CurrentState: v1, DesiredState: v1},
+		{Name: "web-5", Labels: map[string]string{"env": "prod"}, Status: inventory.HEALTHY, CurrentState: v1, DesiredState: v1, LastPing: now.Add(-time.Hour), Cordoned: true},
+		{Name: "dev-1", Labels: map[string]string{"env": "dev"}, Status: inventory.HEALTHY, CurrentState: v1, DesiredState: v1, LastPing: now.Add(-time.Hour)},
+	}
+	for _, instance := range instances {
+		store.Save(context.Background(), instance)
+	}
+
+	sel := selector.FromLabels(map[string]string{"env": "prod"})
+	opts := &inventory.ProgressOptions{UnreachableBefore: now.Add(-time.Minute)}
+
+	// web-2 has not pinged for two minutes, web-4 never pinged and web-5 is cordoned
+	progress, err := store.CountProgress(sel, v2, opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := inventory.Progress{Total: 4, NeedingUpdate: 3, InProgress: 2, Completed: 1, Failed: 1, Unreachable: 1}
+	if progress != want {
+		t.Errorf("Expected %+v, got %+v", want, progress)
+	}
+
+	// A heartbeat makes web-2 reachable again
+	store.Update(context.Background(), "web-2", inventory.InstancePatch{LastPing: &now})
+	if progress, _ := store.CountProgress(sel, v2, opts); progress.Unreachable != 0 {
+		t.Errorf("Expected no unreachable instance after the heartbeat, got %d", progress.Unreachable)
+	}
+
+	// Without a cutoff nothing is unreachable
+	if progress, _ := store.CountProgress(sel, v2, nil); progress.Unreachable != 0 || progress.Total != 4 {
+		t.Errorf("Expected 4 instances and none unreachable without a cutoff, got %+v", progress)
+	}
+
+	// Per instance targets only count the targeted instances, each against its own state
+	opts.Targets = map[string]inventory.State{"web-1": v1, "web-4": v1, "dev-1": v1}
+	progress, _ = store.CountProgress(sel, v2, opts)
+	want = inventory.Progress{Total: 2, NeedingUpdate: 1, Completed: 1}
+	if progress != want {
+		t.Errorf("Expected %+v with targets, got %+v", want, progress)
+	}
+}
+
+func TestInventoryStore_UpdateDesiredStates(t *testing.T) {
+	store := NewInventoryStore()
+	v1 := inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"}
+	v2 := inventory.State{CodeVersion: "v2", ConfigurationVersion: "c1"}
+
+	for _, name := range []string{"web-1", "web-2"} {
+		store.Save(context.Background(), &inventory.Instance{Name: name, Status: inventory.HEALTHY, CurrentState: v1, DesiredState: v1})
+	}
+
+	// An unknown instance rejects the whole batch
+	err := store.UpdateDesiredStates(context.Background(), map[string]inventory.State{"web-1": v2, "web-3": v2}, nil)
+	if err != ErrInstanceNotFound {
+		t.Fatalf("Expected ErrInstanceNotFound, got %v", err)
+	}
+	if instance, _ := store.Get("web-1"); instance.DesiredState != v1 || instance.DesiredRevision != 0 {
+		t.Errorf("Expected web-1 untouched, got %+v", instance)
+	}
+
+	// An instance changed since it was read rejects the whole batch
+	web1, _ := store.Get("web-1")
+	web2, _ := store.Get("web-2")
+	cordoned := true
+	store.Update(context.Background(), "web-2", inventory.InstancePatch{Cordoned: &cordoned})
+	err = store.UpdateDesiredStates(context.Background(), map[string]inventory.State{"web-1": v2, "web-2": v2}, map[string]int64{"web-1": web1.Revision, "web-2": web2.Revision})
+	if err != inventory.ErrRevisionConflict {
+		t.Fatalf("Expected ErrRevisionConflict, got %v", err)
+	}
+	if instance, _ := store.Get("web-1"); instance.DesiredState != v1 {
+		t.Errorf("Expected web-1 untouched, got %+v", instance)
+	}
+	cordoned = false
+	store.Update(context.Background(), "web-2", inventory.InstancePatch{Cordoned: &cordoned})
+
+	if err := store.UpdateDesiredStates(context.Background(), map[string]inventory.State{"web-1": v2, "web-2": v2}, nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, name := range []string{"web-1", "web-2"} {
+		instance, _ := store.Get(name)
+		if instance.DesiredState != v2 || instance.DesiredRevision != 1 || instance.PreviousState != v1 {
+			t.Errorf("Expected %s moved to v2 with v1 as previous state, got %+v", name, instance)
+		}
+	}
+	if count, _ := store.CountInProgress(nil, v2); count != 2 {
+		t.Errorf("Expected 2 instances in progress, got %d", count)
+	}
+}
+
+func TestInventoryStore_UpdateRevision(t *testing.T) {
+	store := NewInventoryStore()
+	store.Save(context.Background(), &inventory.Instance{Name: "web-1", Status: inventory.HEALTHY})
+
+	read, _ := store.Get("web-1")
+	if read.Revision != 1 {
+		t.Fatalf("Expected a new instance at revision 1, got %d", read.Revision)
+	}
+
+	// An unconditional heartbeat moves the revision
+	now := time.Now()
+	if _, err := store.Update(context.Background(), "web-1", inventory.InstancePatch{LastPing: &now}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// A patch of the revision read before is rejected
+	failed := inventory.FAILED
+	if _, err := store.Update(context.Background(), "web-1", inventory.InstancePatch{Status: &failed, Revision: &read.Revision}); err != inventory.ErrRevisionConflict {
+		t.Fatalf("Expected ErrRevisionConflict, got %v", err)
+	}
+
+	fresh, _ := store.Get("web-1")
+	updated, err := store.Update(context.Background(), "web-1", inventory.InstancePatch{Status: &failed, Revision: &fresh.Revision})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if updated.Status != inventory.FAILED || updated.Revision != 3 {
+		t.Errorf("Expected a FAILED instance at revision 3, got %+v", updated)
+	}
+}
+
+// racingStore changes the instance once right before the first update it receives, like a concurrent request
+type racingStore struct {
+	*InventoryStore
+	raced bool
+}
+
+func (s *racingStore) Update(ctx context.Context, key string, patch inventory.InstancePatch) (*inventory.Instance, error) {
+	if !s.raced {
+		s.raced = true
+		s.InventoryStore.Update(context.Background(), key, inventory.InstancePatch{Labels: map[string]string{"zone": "b"}})
+	}
+	return s.InventoryStore.Update(ctx, key, patch)
+}
+
+func TestUpdateService_RetriesOnConflict(t *testing.T) {
+	store := &racingStore{InventoryStore: NewInventoryStore()}
+	store.Save(context.Background(), &inventory.Instance{Name: "web-1", Labels: map[string]string{"zone": "a"}, Status: inventory.HEALTHY})
+	service := inventory.NewUpdateService(store, nil, nil)
+
+	v2 := inventory.State{CodeVersion: "v2"}
+	instance, err := service.UpdateInstanceState(context.Background(), "web-1", inventory.StateUpdateRequest{CurrentState: &v2})
+	if err != nil {
+		t.Fatalf("Expected the update to be retried, got %v", err)
+	}
+	if instance.CurrentState != v2 || instance.Labels["zone"] != "b" {
+		t.Errorf("Expected both the concurrent change and the update, got %+v", instance)
+	}
+}
+
+func TestRegistrationService_RetriesOnConflict(t *testing.T) {
+	store := &racingStore{InventoryStore: NewInventoryStore()}
+	tokens := NewTokenStore()
+	tokens.SaveToken(&inventory.JoinToken{ID: "token", TokenHash: inventory.HashJoinToken("secret"), ExpiresAt: time.Now().Add(time.Hour), MaxUses: 2})
+	service := inventory.NewRegistrationService(store, tokens, nil, nil)
+
+	registration := inventory.RegistrationRequest{Token: "secret", Instance: inventory.Instance{Name: "web-1", Labels: map[string]string{"zone": "a"}}}
+	registered, credential, err := service.RegisterInstance(context.Background(), registration)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The labels change while the instance registers again, the registration is checked and applied again on the fresh instance
+	registration.Instance.Labels = map[string]string{"role": "web"}
+	registration.Credential = credential
+	instance, _, err := service.RegisterInstance(context.Background(), registration)
+	if err != nil {
+		t.Fatalf("Expected the registration to be retried, got %v", err)
+	}
+	if instance.ID != registered.ID || !maps.Equal(instance.Labels, registration.Instance.Labels) || instance.Revision != 3 {
+		t.Errorf("Expected the registered instance with its labels replaced at revision 3, got %+v", instance)
+	}
+	if token, _ := tokens.GetToken("token"); token.Uses != 2 {
+		t.Errorf("Expected the token used once per registration, got %d uses", token.Uses)
+	}
+}
+
+// failingStore fails to save any instance
+type failingStore struct {
+	*InventoryStore
+}
+
+func (s failingStore) Save(ctx context.Context, instance *inventory.Instance) error {
+	return errors.New("store unavailable")
+}
+
+func TestRegistrationService_GivesBackTheTokenUse(t *testing.T) {
+	tokens := NewTokenStore()
+	tokens.SaveToken(&inventory.JoinToken{ID: "token", TokenHash: inventory.HashJoinToken("secret"), ExpiresAt: time.Now().Add(time.Hour), MaxUses: 1})
+	registration := inventory.RegistrationRequest{Token: "secret", Instance: inventory.Instance{Name: "web-1"}}
+
+	// A registration that is not saved does not count against the limit of the token
+	failing := inventory.NewRegistrationService(failingStore{NewInventoryStore()}, tokens, nil, nil)
+	if _, _, err := failing.RegisterInstance(context.Background(), registration); err == nil {
+		t.Fatal("Expected the registration to fail")
+	}
+	if token, _ := tokens.GetToken("token"); token.Uses != 0 {
+		t.Errorf("Expected the use given back, got %d uses", token.Uses)
+	}
+
+	service := inventory.NewRegistrationService(NewInventoryStore(), tokens, nil, nil)
+	if _, _, err := service.RegisterInstance(context.Background(), registration); err != nil {
+		t.Fatalf("Expected the token still usable, got %v", err)
+	}
+}
+
+func TestInventoryStore_CountProgress_SelectorsWithTheSameStringForm(t *testing.T) {
+	store := NewInventoryStore()
+	v1 := inventory.State{CodeVersion: "v1"}
+	store.Save(context.Background(), &inventory.Instance{Name: "web-1", Labels: map[string]string{"env": "prod,role=web"}, CurrentState: v1, DesiredState: v1})
+	store.Save(context.Background(), &inventory.Instance{Name: "web-2", Labels: map[string]string{"env": "prod", "role": "web"}, CurrentState: v1, DesiredState: v1})
+	store.Save(context.Background(), &inventory.Instance{Name: "web-3", Labels: map[string]string{"env": "prod", "role": "web"}, CurrentState: v1, DesiredState: v1})
+
+	// Each selector is counted on its own, the counters of the first one are not reused for the second one
+	tests := []struct {
+		sel  selector.Selector
+		want int
+	}{
+		{selector.FromLabels(map[string]string{"env": "prod,role=web"}), 1},
+		{selector.FromLabels(map[string]string{"env": "prod", "role": "web"}), 2},
+	}
+	for _, tt := range tests {
+		if progress, _ := store.CountProgress(tt.sel, v1, nil); progress.Total != tt.want {
+			t.Errorf("Expected %d instances for %v, got %d", tt.want, tt.sel, progress.Total)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package inmemory
+
+import (
+	"sync"
+)
+
+// Notifier is an in-memory implementation of the inventory.Notifier interface
+type Notifier struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan struct{}]struct{} // key is the instance key
+}
+
+// NewNotifier creates a new in-memory notifier
+func NewNotifier() *Notifier {
+	return &Notifier{
+		waiters: make(map[string]map[chan struct{}]struct{}),
+	}
+}
+
+// Notify closes the channel of every waiter of the instance
+func (n *Notifier) Notify(instanceKey string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for waiter := range n.waiters[instanceKey] {
+		close(waiter)
+	}
+	delete(n.waiters, instanceKey)
+}
+
+// Wait returns a channel closed on the next notification of the instance
+func (n *Notifier) Wait(instanceKey string) (<-chan struct{}, func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	waiter := make(chan struct{})
+	if n.waiters[instanceKey] == nil {
+		n.waiters[instanceKey] = make(map[chan struct{}]struct{})
+	}
+	n.waiters[instanceKey][waiter] = struct{}{}
+
+	cancel := func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		// Already closed and removed by Notify
+		if _, ok := n.waiters[instanceKey][waiter]; !ok {
+			return
+		}
+		delete(n.waiters[instanceKey], waiter)
+		if len(n.waiters[instanceKey]) == 0 {
+			delete(n.waiters, instanceKey)
+		}
+	}
+
+	return waiter, cancel
+}
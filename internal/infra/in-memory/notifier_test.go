@@ -0,0 +1,71 @@
+package inmemory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xnok/dides/internal/inventory"
+)
+
+func TestWatchService_WatchDesiredState(t *testing.T) {
+	store := NewInventoryStore()
+	notifier := NewNotifier()
+	stateService := inventory.NewStateService(store, notifier, nil)
+	watchService := inventory.NewWatchService(store, notifier)
+
+	store.Save(context.Background(), &inventory.Instance{ID: "i-1", Name: "web-1", IP: "10.0.0.1"})
+
+	// A stale revision returns right away
+	target := inventory.State{CodeVersion: "v2.0.0"}
+	stateService.UpdateDesiredState(context.Background(), "i-1", target)
+
+	response, err := watchService.WatchDesiredState(context.Background(), "i-1", 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if response.Revision != 1 || response.DesiredState != target {
+		t.Fatalf("Expected revision 1 with %v, got %+v", target, response)
+	}
+
+	// The current revision waits for the next change
+	done := make(chan *inventory.DesiredStateResponse)
+	go func() {
+		response, _ := watchService.WatchDesiredState(context.Background(), "i-1", 1)
+		done <- response
+	}()
+
+	// Setting the same desired state is not a change
+	time.Sleep(10 * time.Millisecond)
+	stateService.UpdateDesiredState(context.Background(), "i-1", target)
+
+	select {
+	case response := <-done:
+		t.Fatalf("Expected the watch to wait, got %+v", response)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	next := inventory.State{CodeVersion: "v3.0.0"}
+	stateService.UpdateDesiredState(context.Background(), "i-1", next)
+
+	select {
+	case response := <-done:
+		if response.Revision != 2 || response.DesiredState != next {
+			t.Errorf("Expected revision 2 with %v, got %+v", next, response)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the watch to return on the desired state change")
+	}
+
+	// Without change the watch ends with the context, unchanged
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	response, err = watchService.WatchDesiredState(ctx, "i-1", 2)
+	if err != nil || response.Revision != 2 {
+		t.Errorf("Expected revision 2 unchanged, got %+v, %v", response, err)
+	}
+
+	if len(notifier.waiters) != 0 {
+		t.Errorf("Expected every waiter to be released, got %d", len(notifier.waiters))
+	}
+}
@@ -0,0 +1,134 @@
+package inmemory
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/xnok/dides/internal/inventory"
+)
+
+var (
+	ErrTokenNotUsable = errors.New("join token is expired, used up or unknown")
+)
+
+// TokenStore is an in-memory implementation of the inventory.TokenStore interface
+type TokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]*inventory.JoinToken // key is the token ID
+	hashes map[string]string               // hash of the secret to the token ID
+}
+
+// NewTokenStore creates a new in-memory join token store
+func NewTokenStore() *TokenStore {
+	return &TokenStore{
+		tokens: make(map[string]*inventory.JoinToken),
+		hashes: make(map[string]string),
+	}
+}
+
+// SaveToken stores a join token, replacing any token with the same ID
+// The secret is never kept, only its hash
+func (s *TokenStore) SaveToken(token *inventory.JoinToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if previous, exists := s.tokens[token.ID]; exists {
+		delete(s.hashes, previous.TokenHash)
+	}
+
+	tokenCopy := *token
+	tokenCopy.Token = ""
+	s.tokens[token.ID] = &tokenCopy
+	s.hashes[token.TokenHash] = token.ID
+	return nil
+}
+
+// GetToken retrieves a join token by its ID
+func (s *TokenStore) GetToken(id string) (*inventory.JoinToken, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, exists := s.tokens[id]
+	if !exists {
+		return nil, false
+	}
+
+	tokenCopy := *stored
+	return &tokenCopy, true
+}
+
+// GetTokenByHash retrieves a join token by the hash of its secret
+func (s *TokenStore) GetTokenByHash(hash string) (*inventory.JoinToken, bool) {
+	s.mu.RLock()
+	id, exists := s.hashes[hash]
+	s.mu.RUnlock()
+
+	if !exists {
+		return nil, false
+	}
+	return s.GetToken(id)
+}
+
+// GetAllTokens returns all stored join tokens
+func (s *TokenStore) GetAllTokens() []*inventory.JoinToken {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tokens := make([]*inventory.JoinToken, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokenCopy := *token
+		tokens = append(tokens, &tokenCopy)
+	}
+	return tokens
+}
+
+// DeleteToken removes a join token by its ID
+func (s *TokenStore) DeleteToken(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.tokens[id]
+	if exists {
+		delete(s.hashes, stored.TokenHash)
+		delete(s.tokens, id)
+	}
+	return exists
+}
+
+// UseToken increments the number of uses of the token with the hash if it is still usable
+// The check and the increment happen under the same lock so a token is never used more than allowed
+func (s *TokenStore) UseToken(hash string, now time.Time) (*inventory.JoinToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.tokens[s.hashes[hash]]
+	if !exists || !stored.Usable(now) {
+		return nil, ErrTokenNotUsable
+	}
+
+	updated := *stored
+	updated.Uses++
+	s.tokens[updated.ID] = &updated
+
+	result := updated
+	return &result, nil
+}
+
+// ReleaseToken decrements the number of uses of the token with the hash, a deleted token has nothing to give back
+func (s *TokenStore) ReleaseToken(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, exists := s.tokens[s.hashes[hash]]
+	if !exists {
+		return inventory.ErrJoinTokenNotFound
+	}
+
+	updated := *stored
+	if updated.Uses > 0 {
+		updated.Uses--
+	}
+	s.tokens[updated.ID] = &updated
+	return nil
+}
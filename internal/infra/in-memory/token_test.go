@@ -0,0 +1,100 @@
+package inmemory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xnok/dides/internal/inventory"
+)
+
+func TestTokenStore_UseToken(t *testing.T) {
+	store := NewTokenStore()
+	now := time.Now()
+
+	store.SaveToken(&inventory.JoinToken{ID: "limited", TokenHash: inventory.HashJoinToken("limited-secret"), ExpiresAt: now.Add(time.Hour), MaxUses: 2})
+	store.SaveToken(&inventory.JoinToken{ID: "expired", TokenHash: inventory.HashJoinToken("expired-secret"), ExpiresAt: now.Add(-time.Minute)})
+
+	// The token can be used up to its limit
+	for i := 1; i <= 2; i++ {
+		token, err := store.UseToken(inventory.HashJoinToken("limited-secret"), now)
+		if err != nil {
+			t.Fatalf("Expected no error on use %d, got %v", i, err)
+		}
+		if token.Uses != i {
+			t.Errorf("Expected %d uses, got %d", i, token.Uses)
+		}
+	}
+
+	if _, err := store.UseToken(inventory.HashJoinToken("limited-secret"), now); err != ErrTokenNotUsable {
+		t.Errorf("Expected ErrTokenNotUsable once used up, got %v", err)
+	}
+
+	if _, err := store.UseToken(inventory.HashJoinToken("expired-secret"), now); err != ErrTokenNotUsable {
+		t.Errorf("Expected ErrTokenNotUsable for an expired token, got %v", err)
+	}
+
+	if _, err := store.UseToken(inventory.HashJoinToken("unknown-secret"), now); err != ErrTokenNotUsable {
+		t.Errorf("Expected ErrTokenNotUsable for an unknown token, got %v", err)
+	}
+
+	// The token is only known by its ID and its hash
+	if _, err := store.UseToken("limited", now); err != ErrTokenNotUsable {
+		t.Errorf("Expected ErrTokenNotUsable when using the ID, got %v", err)
+	}
+}
+
+func TestTokenStore_SaveToken(t *testing.T) {
+	store := NewTokenStore()
+	store.SaveToken(&inventory.JoinToken{ID: "token", Token: "secret", TokenHash: inventory.HashJoinToken("secret"), ExpiresAt: time.Now().Add(time.Hour)})
+
+	token, exists := store.GetTokenByHash(inventory.HashJoinToken("secret"))
+	if !exists {
+		t.Fatal("Expected the token to be found by the hash of its secret")
+	}
+	if token.ID != "token" {
+		t.Errorf("Expected token ID 'token', got %s", token.ID)
+	}
+	if token.Token != "" {
+		t.Errorf("Expected the secret not to be stored, got %s", token.Token)
+	}
+}
+
+func TestTokenStore_DeleteToken(t *testing.T) {
+	store := NewTokenStore()
+	store.SaveToken(&inventory.JoinToken{ID: "token", TokenHash: inventory.HashJoinToken("secret"), ExpiresAt: time.Now().Add(time.Hour)})
+
+	if !store.DeleteToken("token") {
+		t.Error("Expected token to be deleted")
+	}
+
+	if _, exists := store.GetToken("token"); exists {
+		t.Error("Expected token to be gone after delete")
+	}
+	if _, exists := store.GetTokenByHash(inventory.HashJoinToken("secret")); exists {
+		t.Error("Expected token to be gone by its hash after delete")
+	}
+
+	if store.DeleteToken("token") {
+		t.Error("Expected deleting an unknown token to return false")
+	}
+}
+
+func TestTokenStore_ReleaseToken(t *testing.T) {
+	store := NewTokenStore()
+	now := time.Now()
+	store.SaveToken(&inventory.JoinToken{ID: "limited", TokenHash: inventory.HashJoinToken("limited-secret"), ExpiresAt: now.Add(time.Hour), MaxUses: 1})
+
+	store.UseToken(inventory.HashJoinToken("limited-secret"), now)
+	if err := store.ReleaseToken(inventory.HashJoinToken("limited-secret")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The use given back can be used again
+	if _, err := store.UseToken(inventory.HashJoinToken("limited-secret"), now); err != nil {
+		t.Errorf("Expected the token usable again, got %v", err)
+	}
+
+	if err := store.ReleaseToken(inventory.HashJoinToken("unknown-secret")); err != inventory.ErrJoinTokenNotFound {
+		t.Errorf("Expected ErrJoinTokenNotFound for an unknown token, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package inmemory
+
+import (
+	"context"
+	"maps"
+
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/transaction"
+)
+
+// txKey carries the transaction of a store in the context
+type txKey struct {
+	store any
+}
+
+// deploymentTx is the undo log of a transaction on the deployment store
+// It keeps every entry written by the transaction as it was before its first write, nil for the entries it created
+// The writes are not isolated: they are applied right away and the other readers see them before the commit
+type deploymentTx struct {
+	store    *DeploymentStore
+	original map[string]*deploymentEntry
+	done     bool
+}
+
+// Begin starts a transaction on the deployment store, only the writes made with the returned context are part of it
+func (s *DeploymentStore) Begin(ctx context.Context) (context.Context, transaction.Tx, error) {
+	tx := &deploymentTx{store: s, original: make(map[string]*deploymentEntry)}
+	return context.WithValue(ctx, txKey{s}, tx), tx, nil
+}
+
+// track copies the entry into the undo log of the transaction of the context before its first write
+// It must be called with the write lock held
+func (s *DeploymentStore) track(ctx context.Context, id string) {
+	tx, ok := ctx.Value(txKey{s}).(*deploymentTx)
+	if !ok || tx.done {
+		return
+	}
+	if _, seen := tx.original[id]; seen {
+		return
+	}
+
+	entry, exists := s.deployments[id]
+	if !exists {
+		tx.original[id] = nil
+		return
+	}
+	entryCopy := *entry
+	recordCopy := *entry.Record
+	entryCopy.Record = &recordCopy
+	tx.original[id] = &entryCopy
+}
+
+// Commit keeps the writes of the transaction
+func (tx *deploymentTx) Commit() error {
+	tx.store.mu.Lock()
+	defer tx.store.mu.Unlock()
+
+	if tx.done {
+		return transaction.ErrTransactionDone
+	}
+	tx.done = true
+	return nil
+}
+
+// Rollback restores the entries written by the transaction and removes the ones it created
+func (tx *deploymentTx) Rollback() error {
+	tx.store.mu.Lock()
+	defer tx.store.mu.Unlock()
+
+	if tx.done {
+		return transaction.ErrTransactionDone
+	}
+	tx.done = true
+
+	for id, entry := range tx.original {
+		if entry == nil {
+			delete(tx.store.deployments, id)
+		} else {
+			tx.store.deployments[id] = entry
+		}
+	}
+	return nil
+}
+
+// inventoryTx is the undo log of a transaction on the inventory store
+// It keeps every instance written with the context of the transaction as it was before the first write, nil for the instances it created,
+// and as the transaction last wrote it. The writes of the other callers, such as the agents reporting their state, are not part of it
+// The writes are not isolated: they are applied right away, so the agents and the other readers see them before the commit
+type inventoryTx struct {
+	store *InventoryStore
+	// before are the instances as they were before the first write of the transaction, after as it last wrote them
+	before map[string]*inventory.Instance
+	after  map[string]*inventory.Instance
+	// replaced are the instances the transaction last replaced, a deleted instance is restored after them
+	replaced map[string]*inventory.Instance
+	done     bool
+}
+
+// Begin starts a transaction on the inventory store, only the writes made with the returned context are part of it
+func (s *InventoryStore) Begin(ctx context.Context) (context.Context, transaction.Tx, error) {
+	tx := &inventoryTx{
+		store:    s,
+		before:   make(map[string]*inventory.Instance),
+		after:    make(map[string]*inventory.Instance),
+		replaced: make(map[string]*inventory.Instance),
+	}
+	return context.WithValue(ctx, txKey{s}, tx), tx, nil
+}
+
+// track records a write of the transaction of the context, if any, previous is nil for a new instance and updated for a deleted one
+// It must be called with the write lock held
+func (s *InventoryStore) track(ctx context.Context, key string, previous, updated *inventory.Instance) {
+	tx, ok := ctx.Value(txKey{s}).(*inventoryTx)
+	if !ok || tx.done {
+		return
+	}
+	if _, seen := tx.before[key]; !seen {
+		tx.before[key] = previous
+	}
+	tx.after[key] = updated
+	if previous != nil {
+		tx.replaced[key] = previous
+	}
+}
+
+// Commit keeps the writes of the transaction
+func (tx *inventoryTx) Commit() error {
+	tx.store.mu.Lock()
+	defer tx.store.mu.Unlock()
+
+	if tx.done {
+		return transaction.ErrTransactionDone
+	}
+	tx.done = true
+	return nil
+}
+
+// Rollback restores the instances the transaction wrote, at a new revision
+// An instance nobody else wrote since is restored as a whole. An instance written by another caller since only gets back
+// the fields the transaction changed and the other caller did not, so the reports of the agents are not lost
+// A desired state set back is a new desired revision for the agents watching it
+func (tx *inventoryTx) Rollback() error {
+	tx.store.mu.Lock()
+	defer tx.store.mu.Unlock()
+
+	if tx.done {
+		return transaction.ErrTransactionDone
+	}
+	tx.done = true
+
+	for key, before := range tx.before {
+		current, after := tx.store.instances[key], tx.after[key]
+		switch {
+		case after == nil && current == nil && before != nil:
+			// Deleted by the transaction, an update of the instance read before the delete still conflicts
+			deleted := tx.replaced[key]
+			restored := *before
+			restored.Revision = deleted.Revision + 1
+			restored.DesiredRevision = deleted.DesiredRevision
+			if restored.DesiredState != deleted.DesiredState {
+				restored.DesiredRevision++
+			}
+			tx.store.replace(key, nil, &restored)
+		case after == nil || current == nil:
+			// Deleted by the transaction and registered again, or deleted by another caller since
+		case before == nil:
+			// Created by the transaction
+			tx.store.replace(key, current, nil)
+		default:
+			restored := revert(current, before, after)
+			restored.Revision = current.Revision + 1
+			tx.store.replace(key, current, restored)
+		}
+	}
+	return nil
+}
+
+// revert returns a copy of the current instance with the fields the transaction changed from before to after set back,
+// unless another caller changed them since. It is the whole before instance when nobody else wrote it
+func revert(current, before, after *inventory.Instance) *inventory.Instance {
+	restored := *current
+	restored.Labels = maps.Clone(current.Labels)
+
+	revertField(&restored.Name, before.Name, after.Name)
+	revertField(&restored.IP, before.IP, after.IP)
+	if maps.Equal(current.Labels, after.Labels) && !maps.Equal(before.Labels, after.Labels) {
+		restored.Labels = maps.Clone(before.Labels)
+	}
+	revertField(&restored.LastPing, before.LastPing, after.LastPing)
+	revertField(&restored.Status, before.Status, after.Status)
+	revertField(&restored.CurrentState, before.CurrentState, after.CurrentState)
+	revertField(&restored.Cordoned, before.Cordoned, after.Cordoned)
+	revertField(&restored.Draining, before.Draining, after.Draining)
+	revertField(&restored.CredentialHash, before.CredentialHash, after.CredentialHash)
+	revertField(&restored.Scope, before.Scope, after.Scope)
+	revertField(&restored.CertificateSerial, before.CertificateSerial, after.CertificateSerial)
+	if current.DesiredState == after.DesiredState && before.DesiredState != after.DesiredState {
+		restored.DesiredState = before.DesiredState
+		restored.PreviousState = before.PreviousState
+		restored.DesiredRevision = current.DesiredRevision + 1
+	}
+	return &restored
+}
+
+// revertField sets the field back to its value before the transaction when the transaction changed it and nobody else did since
+func revertField[T comparable](field *T, before, after T) {
+	if *field == after && before != after {
+		*field = before
+	}
+}
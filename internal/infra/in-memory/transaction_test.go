@@ -0,0 +1,196 @@
+package inmemory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+	"github.com/xnok/dides/internal/transaction"
+)
+
+func TestTransaction_Rollback(t *testing.T) {
+	ctx := context.Background()
+	deployments := NewDeploymentStore(nil)
+	instances := NewInventoryStore()
+	manager := transaction.NewManager(deployments, instances)
+
+	v1 := inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"}
+	v2 := inventory.State{CodeVersion: "v2", ConfigurationVersion: "c1"}
+	running := &deployment.DeploymentRecord{Status: deployment.Running}
+	deployments.Save(ctx, running)
+	instances.Save(ctx, &inventory.Instance{Name: "web-1", Status: inventory.HEALTHY, CurrentState: v1, DesiredState: v1})
+	instances.Save(ctx, &inventory.Instance{Name: "web-2", Status: inventory.FAILED, CurrentState: v1, DesiredState: v1})
+	instances.Save(ctx, &inventory.Instance{Name: "web-3", Status: inventory.HEALTHY, CurrentState: v1, DesiredState: v1})
+
+	failure := errors.New("start failed")
+	var rollback *deployment.DeploymentRecord
+	err := manager.Do(ctx, func(ctx context.Context) error {
+		cancelled := *running
+		cancelled.Status = deployment.Failed
+		if err := deployments.Update(ctx, &cancelled); err != nil {
+			return err
+		}
+		if err := instances.ResetFailedInstances(ctx, selector.Selector{}); err != nil {
+			return err
+		}
+		rollback = &deployment.DeploymentRecord{Status: deployment.Running}
+		if err := deployments.Save(ctx, rollback); err != nil {
+			return err
+		}
+		if err := instances.UpdateDesiredStates(ctx, map[string]inventory.State{"web-1": v2, "web-2": v2}, nil); err != nil {
+			return err
+		}
+
+		if !instances.Delete(ctx, "web-3") {
+			return inventory.ErrInstanceNotFound
+		}
+
+		// The agent of web-1 reports and web-4 registers while the unit of work runs, outside of it
+		healthy := inventory.HEALTHY
+		_, err := instances.Update(context.Background(), "web-1", inventory.InstancePatch{Status: &healthy, CurrentState: &v2})
+		if err != nil {
+			return err
+		}
+		if err := instances.Save(context.Background(), &inventory.Instance{Name: "web-4"}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Expected the error of the unit of work, got %v", err)
+	}
+
+	// The deployment writes are undone
+	if record, _ := deployments.GetByID(ctx, running.ID); record.Status != deployment.Running {
+		t.Errorf("Expected the running deployment to be restored, got status %v", record.Status)
+	}
+	if _, err := deployments.GetByID(ctx, rollback.ID); !errors.Is(err, deployment.ErrDeploymentNotFound) {
+		t.Errorf("Expected the rollback deployment to be removed, got %v", err)
+	}
+
+	// The instance writes are undone, the report of the agent is kept
+	web1, _ := instances.Get("web-1")
+	if web1.DesiredState != v1 || web1.CurrentState != v2 || web1.DesiredRevision != 2 {
+		t.Errorf("Expected web-1 back to v1 with the agent report kept, got %+v", web1)
+	}
+	web2, _ := instances.Get("web-2")
+	if web2.DesiredState != v1 || web2.Status != inventory.FAILED {
+		t.Errorf("Expected web-2 back to v1 and FAILED, got %+v", web2)
+	}
+	if web3, ok := instances.Get("web-3"); !ok || web3.Revision != 2 {
+		t.Errorf("Expected web-3 restored at a new revision, got %+v", web3)
+	}
+	if _, ok := instances.Get("web-4"); !ok {
+		t.Errorf("Expected the registration made outside of the unit of work to be kept")
+	}
+	if count, _ := instances.CountInProgress(nil, v2); count != 0 {
+		t.Errorf("Expected no instance in progress after the rollback, got %d", count)
+	}
+
+	// A committed unit of work keeps its writes
+	err = manager.Do(ctx, func(ctx context.Context) error {
+		return instances.UpdateDesiredStates(ctx, map[string]inventory.State{"web-2": v2}, nil)
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if web2, _ := instances.Get("web-2"); web2.DesiredState != v2 {
+		t.Errorf("Expected web-2 moved to v2, got %+v", web2)
+	}
+}
+
+func TestTransaction_RollbackRestoresEveryField(t *testing.T) {
+	ctx := context.Background()
+	instances := NewInventoryStore()
+	manager := transaction.NewManager(instances)
+
+	v1 := inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"}
+	v2 := inventory.State{CodeVersion: "v2", ConfigurationVersion: "c1"}
+	instances.Save(ctx, &inventory.Instance{Name: "web-1", Labels: map[string]string{"env": "prod"}, Status: inventory.HEALTHY, CurrentState: v1, DesiredState: v1})
+	instances.Save(ctx, &inventory.Instance{Name: "web-2", Labels: map[string]string{"env": "prod"}, Status: inventory.HEALTHY, CurrentState: v1, DesiredState: v1})
+
+	failure := errors.New("unit failed")
+	err := manager.Do(ctx, func(ctx context.Context) error {
+		cordoned, failed := true, inventory.FAILED
+		for _, key := range []string{"web-1", "web-2"} {
+			_, err := instances.Update(ctx, key, inventory.InstancePatch{
+				Labels:       map[string]string{"env": "dev"},
+				Cordoned:     &cordoned,
+				CurrentState: &v2,
+				Status:       &failed,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// The writes are not isolated, the other readers see them before the commit
+		if web1, _ := instances.Get("web-1"); !web1.Cordoned || web1.Labels["env"] != "dev" {
+			t.Errorf("Expected the uncommitted write to be visible, got %+v", web1)
+		}
+
+		// The agent of web-2 reports while the unit of work runs, outside of it
+		healthy := inventory.HEALTHY
+		_, err := instances.Update(context.Background(), "web-2", inventory.InstancePatch{Status: &healthy})
+		if err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Expected the error of the unit of work, got %v", err)
+	}
+
+	// web-1 was only written by the unit of work, it is restored as a whole at a new revision
+	web1, _ := instances.Get("web-1")
+	if web1.Cordoned || web1.Labels["env"] != "prod" || web1.CurrentState != v1 || web1.Status != inventory.HEALTHY || web1.Revision != 3 {
+		t.Errorf("Expected web-1 restored at revision 3, got %+v", web1)
+	}
+
+	// web-2 keeps the report of its agent, the other fields are restored
+	web2, _ := instances.Get("web-2")
+	if web2.Cordoned || web2.Labels["env"] != "prod" || web2.CurrentState != v1 || web2.Status != inventory.HEALTHY {
+		t.Errorf("Expected web-2 restored with the agent report kept, got %+v", web2)
+	}
+	if count, _ := instances.CountByLabels(selector.FromLabels(map[string]string{"env": "dev"})); count != 0 {
+		t.Errorf("Expected the label index restored, got %d dev instances", count)
+	}
+}
+
+func TestTransaction_NotifyAfterEnd(t *testing.T) {
+	ctx := context.Background()
+	instances := NewInventoryStore()
+	notifier := NewNotifier()
+	stateService := inventory.NewStateService(instances, notifier, nil)
+	manager := transaction.NewManager(instances)
+	instances.Save(ctx, &inventory.Instance{Name: "web-1"})
+
+	waiter, cancel := notifier.Wait("web-1")
+	defer cancel()
+
+	v2 := inventory.State{CodeVersion: "v2"}
+	manager.Do(ctx, func(ctx context.Context) error {
+		if err := stateService.UpdateDesiredState(ctx, "web-1", v2); err != nil {
+			return err
+		}
+		select {
+		case <-waiter:
+			t.Errorf("Expected the agent not to be woken up before the unit of work is over")
+		default:
+		}
+		return errors.New("start failed")
+	})
+
+	// The desired state set back is a new revision the agent must read
+	select {
+	case <-waiter:
+	default:
+		t.Fatalf("Expected the agent to be woken up by the rollback")
+	}
+	if web1, _ := instances.Get("web-1"); web1.DesiredState != (inventory.State{}) || web1.DesiredRevision != 2 {
+		t.Errorf("Expected the desired state set back at revision 2, got %+v", web1)
+	}
+}
@@ -0,0 +1,127 @@
+package inmemory
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/webhook"
+)
+
+// WebhookStore is an in-memory implementation of the webhook.Store interface
+type WebhookStore struct {
+	mu            sync.RWMutex
+	subscriptions map[string]*webhook.Subscription // key is subscription ID
+	deliveries    map[string]*webhook.Delivery     // key is delivery ID
+}
+
+// NewWebhookStore creates a new in-memory webhook store
+func NewWebhookStore() *WebhookStore {
+	return &WebhookStore{
+		subscriptions: make(map[string]*webhook.Subscription),
+		deliveries:    make(map[string]*webhook.Delivery),
+	}
+}
+
+// SaveSubscription stores a subscription, replacing any subscription with the same ID
+func (s *WebhookStore) SaveSubscription(subscription *webhook.Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscriptions[subscription.ID] = copySubscription(subscription)
+	return nil
+}
+
+// GetSubscription retrieves a subscription by ID
+func (s *WebhookStore) GetSubscription(id string) (*webhook.Subscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscription, exists := s.subscriptions[id]
+	if !exists {
+		return nil, webhook.ErrSubscriptionNotFound
+	}
+	return copySubscription(subscription), nil
+}
+
+// GetAllSubscriptions returns all the subscriptions, oldest first
+func (s *WebhookStore) GetAllSubscriptions() ([]*webhook.Subscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscriptions := make([]*webhook.Subscription, 0, len(s.subscriptions))
+	for _, subscription := range s.subscriptions {
+		subscriptions = append(subscriptions, copySubscription(subscription))
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt)
+	})
+	return subscriptions, nil
+}
+
+// DeleteSubscription removes a subscription, its deliveries are kept
+func (s *WebhookStore) DeleteSubscription(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.subscriptions[id]; !exists {
+		return webhook.ErrSubscriptionNotFound
+	}
+	delete(s.subscriptions, id)
+	return nil
+}
+
+// SaveDelivery stores a delivery, replacing any delivery with the same ID
+func (s *WebhookStore) SaveDelivery(delivery *webhook.Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deliveries[delivery.ID] = copyDelivery(delivery)
+	return nil
+}
+
+// GetDelivery retrieves a delivery by ID
+func (s *WebhookStore) GetDelivery(id string) (*webhook.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	delivery, exists := s.deliveries[id]
+	if !exists {
+		return nil, webhook.ErrDeliveryNotFound
+	}
+	return copyDelivery(delivery), nil
+}
+
+// GetDeliveries returns the deliveries with the status, or all of them when empty, oldest first
+func (s *WebhookStore) GetDeliveries(status webhook.DeliveryStatus) ([]*webhook.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var deliveries []*webhook.Delivery
+	for _, delivery := range s.deliveries {
+		if status == "" || delivery.Status == status {
+			deliveries = append(deliveries, copyDelivery(delivery))
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if deliveries[i].CreatedAt.Equal(deliveries[j].CreatedAt) {
+			return deliveries[i].Event.ID < deliveries[j].Event.ID
+		}
+		return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt)
+	})
+	return deliveries, nil
+}
+
+// copySubscription returns a deep copy of the subscription
+func copySubscription(subscription *webhook.Subscription) *webhook.Subscription {
+	subscriptionCopy := *subscription
+	subscriptionCopy.Events = append([]deployment.EventType(nil), subscription.Events...)
+	return &subscriptionCopy
+}
+
+// copyDelivery returns a deep copy of the delivery
+func copyDelivery(delivery *webhook.Delivery) *webhook.Delivery {
+	deliveryCopy := *delivery
+	deliveryCopy.Event.Instances = append([]string(nil), delivery.Event.Instances...)
+	return &deliveryCopy
+}
@@ -0,0 +1,111 @@
+package inventory
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"maps"
+
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/pki"
+)
+
+var (
+	ErrInvalidCertificate       = errors.New("invalid instance certificate")
+	ErrLabelsBoundToCertificate = errors.New("labels are bound to the instance certificate, register again with a CSR to change them")
+)
+
+// CertificateAuthority signs the client certificates the instances use for mutual TLS
+type CertificateAuthority interface {
+	SignInstanceCertificate(csr *x509.CertificateRequest, instanceID string, labels map[string]string) (*x509.Certificate, error)
+}
+
+// CertificateRequest represents the request body for rotating the certificate of an instance
+type CertificateRequest struct {
+	CSR string `json:"csr"`
+}
+
+// CertificateService issues, rotates and revokes instance certificates
+// Only the last certificate issued to an instance is accepted, issuing a new one revokes the previous one
+type CertificateService struct {
+	store Store
+	ca    CertificateAuthority
+	audit AuditLog
+}
+
+// NewCertificateService creates a new certificate service backed by the certificate authority, auditLog may be nil to disable the audit
+func NewCertificateService(store Store, ca CertificateAuthority, auditLog AuditLog) *CertificateService {
+	return &CertificateService{
+		store: store,
+		ca:    ca,
+		audit: auditLog,
+	}
+}
+
+// auditedCertificate is the form of the certificate of an instance recorded in the audit log
+type auditedCertificate struct {
+	Serial string `json:"serial,omitempty"`
+}
+
+// IssueCertificate signs the PEM encoded CSR with the instance ID and labels and returns the PEM encoded certificate
+func (s *CertificateService) IssueCertificate(ctx context.Context, instanceKey string, csrPEM string) (string, error) {
+	csr, err := pki.ParseCSR(csrPEM)
+	if err != nil {
+		return "", err
+	}
+
+	instance, ok := s.store.Get(instanceKey)
+	if !ok {
+		return "", ErrInstanceNotFound
+	}
+
+	cert, err := s.ca.SignInstanceCertificate(csr, instance.Key(), instance.Labels)
+	if err != nil {
+		return "", err
+	}
+
+	serial := pki.Serial(cert)
+	if _, err := s.store.Update(ctx, instanceKey, InstancePatch{CertificateSerial: &serial}); err != nil {
+		return "", err
+	}
+
+	return pki.EncodeCertificate(cert), nil
+}
+
+// RevokeCertificate rejects the current certificate of the instance, it needs to register again to get a new one
+func (s *CertificateService) RevokeCertificate(ctx context.Context, instanceKey string) error {
+	before, ok := s.store.Get(instanceKey)
+	if !ok {
+		return ErrInstanceNotFound
+	}
+
+	revoked := ""
+	if _, err := s.store.Update(ctx, instanceKey, InstancePatch{CertificateSerial: &revoked}); err != nil {
+		return err
+	}
+
+	recordAudit(ctx, s.audit, audit.CertificateRevoke, instanceKey, &auditedCertificate{Serial: before.CertificateSerial}, &auditedCertificate{})
+	return nil
+}
+
+// Authenticate checks that a client certificate, already verified against the authority, is the current one of the instance
+// and that it is still bound to the labels of the instance
+func (s *CertificateService) Authenticate(ctx context.Context, instanceKey string, cert *x509.Certificate) error {
+	instance, ok := s.store.Get(instanceKey)
+	if !ok {
+		return ErrInstanceNotFound
+	}
+
+	if !certificateMatches(instance, cert) {
+		return ErrInvalidCertificate
+	}
+	return nil
+}
+
+// certificateMatches checks the certificate is the current one issued to the instance, with its labels
+func certificateMatches(instance *Instance, cert *x509.Certificate) bool {
+	if cert.Subject.CommonName != instance.Key() || instance.CertificateSerial == "" || pki.Serial(cert) != instance.CertificateSerial {
+		return false
+	}
+	return maps.Equal(pki.Labels(cert), instance.Labels)
+}
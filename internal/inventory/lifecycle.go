@@ -0,0 +1,137 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/clock"
+)
+
+var (
+	ErrInstanceDraining = errors.New("instance is draining")
+)
+
+// LifecycleService removes instances from the inventory and excludes them from deployments
+type LifecycleService struct {
+	store Store
+	audit AuditLog
+	clock clock.Clock
+}
+
+// NewLifecycleService creates a new lifecycle service, auditLog may be nil to disable the audit
+// The heartbeats are checked against the wall clock when clk is nil
+func NewLifecycleService(store Store, auditLog AuditLog, clk clock.Clock) *LifecycleService {
+	return &LifecycleService{
+		store: store,
+		audit: auditLog,
+		clock: clock.OrReal(clk),
+	}
+}
+
+// Deregister removes an instance from the inventory right away
+func (s *LifecycleService) Deregister(ctx context.Context, instanceKey string) error {
+	if instanceKey == "" {
+		return ErrUpdateValidation
+	}
+
+	before, ok := s.store.Get(instanceKey)
+	if !ok || !s.store.Delete(ctx, instanceKey) {
+		return ErrInstanceNotFound
+	}
+
+	recordAudit(ctx, s.audit, audit.InstanceDeregister, instanceKey, auditedInstance(before), nil)
+	return nil
+}
+
+// Cordon keeps tracking the instance but excludes it from future deployments
+func (s *LifecycleService) Cordon(ctx context.Context, instanceKey string) (*Instance, error) {
+	return s.setCordoned(ctx, instanceKey, true)
+}
+
+// Uncordon makes the instance available to deployments again
+func (s *LifecycleService) Uncordon(ctx context.Context, instanceKey string) (*Instance, error) {
+	instance, ok := s.store.Get(instanceKey)
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+
+	// A draining instance is about to be removed, it must stay cordoned
+	if instance.Draining {
+		return nil, ErrInstanceDraining
+	}
+
+	return s.setCordoned(ctx, instanceKey, false)
+}
+
+// Drain cordons the instance and removes it once it has no update in flight
+// It returns true when the instance was removed right away, because it is idle or unreachable
+func (s *LifecycleService) Drain(ctx context.Context, instanceKey string) (*Instance, bool, error) {
+	before, ok := s.store.Get(instanceKey)
+	if !ok {
+		return nil, false, ErrInstanceNotFound
+	}
+
+	draining := true
+	instance, err := s.store.Update(ctx, instanceKey, InstancePatch{Cordoned: &draining, Draining: &draining})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// An unreachable instance will never report its update is over
+	var removed bool
+	if instance.IsUnreachable(s.clock.Now().Add(-HeartbeatTTL)) {
+		removed = s.store.Delete(ctx, instanceKey)
+	} else {
+		removed = removeIfDrained(ctx, s.store, instance)
+	}
+
+	after := auditedInstance(instance)
+	if removed {
+		after = nil
+	}
+	recordAudit(ctx, s.audit, audit.InstanceDrain, instanceKey, auditedInstance(before), after)
+	return instance, removed, nil
+}
+
+// RemoveUnreachableDrained removes the draining instances that did not ping within HeartbeatTTL
+// They will never report their update is over, it returns the keys of the instances removed
+func (s *LifecycleService) RemoveUnreachableDrained(ctx context.Context) []string {
+	before := s.clock.Now().Add(-HeartbeatTTL)
+
+	var removed []string
+	for _, instance := range s.store.GetAll() {
+		if instance.Draining && instance.IsUnreachable(before) && s.store.Delete(ctx, instance.Key()) {
+			recordAudit(ctx, s.audit, audit.InstanceDeregister, instance.Key(), auditedInstance(instance), nil)
+			removed = append(removed, instance.Key())
+		}
+	}
+	return removed
+}
+
+func (s *LifecycleService) setCordoned(ctx context.Context, instanceKey string, cordoned bool) (*Instance, error) {
+	before, ok := s.store.Get(instanceKey)
+	if !ok {
+		return nil, ErrInstanceNotFound
+	}
+
+	instance, err := s.store.Update(ctx, instanceKey, InstancePatch{Cordoned: &cordoned})
+	if err != nil {
+		return nil, err
+	}
+
+	action := audit.InstanceCordon
+	if !cordoned {
+		action = audit.InstanceUncordon
+	}
+	recordAudit(ctx, s.audit, action, instanceKey, auditedInstance(before), auditedInstance(instance))
+	return instance, nil
+}
+
+// removeIfDrained removes a draining instance that has no update in flight anymore
+func removeIfDrained(ctx context.Context, store Store, instance *Instance) bool {
+	if !instance.Draining || instance.IsUpdating() {
+		return false
+	}
+	return store.Delete(ctx, instance.Key())
+}
@@ -1,6 +1,20 @@
 package inventory
 
-import "time"
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/xnok/dides/internal/selector"
+)
+
+var (
+	ErrInstanceConflict = errors.New("instance name or IP is already registered by another instance")
+	ErrRevisionConflict = errors.New("instance was changed since it was read")
+)
 
 type Status int
 
@@ -15,6 +29,8 @@ type Instance struct {
 	// ------------------------------------------------------
 	// Instance Metadata
 	// ------------------------------------------------------
+	// ID is assigned by the server at registration and never changes
+	ID string `json:"id"`
 	// IP is the address of the server
 	IP string
 	// Name is the designation or host name of the server
@@ -33,6 +49,90 @@ type Instance struct {
 
 	CurrentState State `json:"current_state"`
 	DesiredState State `json:"desired_state"`
+	// DesiredRevision is incremented by the store every time the desired state changes, agents watch it
+	DesiredRevision int64 `json:"desired_revision"`
+	// PreviousState is the last known good state, recorded when the desired state changes
+	PreviousState State `json:"previous_state"`
+	// Revision is incremented by the store on every write, a patch of an older revision fails with ErrRevisionConflict
+	Revision int64 `json:"revision"`
+
+	// ------------------------------------------------------
+	// Instance Lifecycle
+	// ------------------------------------------------------
+	// Cordoned instances are still tracked but excluded from deployments
+	Cordoned bool `json:"cordoned"`
+	// Draining instances are cordoned and removed once they have no update in flight
+	Draining bool `json:"draining"`
+
+	// ------------------------------------------------------
+	// Instance Credentials
+	// ------------------------------------------------------
+	// CredentialHash is the hash of the credential issued at registration, never exposed
+	CredentialHash string `json:"-"`
+	// Scope is the label selector of the join token used to register, label updates must stay within it
+	Scope string `json:"-"`
+	// CertificateSerial is the serial of the only client certificate accepted for the instance, empty when revoked
+	CertificateSerial string `json:"-"`
+}
+
+// Key returns the key used to identify the instance in the store
+// Registered instances are identified by their ID, Name and IP are only a fallback for instances without one
+func (i *Instance) Key() string {
+	if i.ID != "" {
+		return i.ID
+	}
+	if i.Name == "" {
+		return i.IP
+	}
+	return i.Name
+}
+
+// SortInstances orders instances by name then key, the order in which deployments select them
+func SortInstances(instances []*Instance) {
+	slices.SortFunc(instances, CompareInstances)
+}
+
+// CompareInstances compares two instances by name then key, as SortInstances orders them
+func CompareInstances(a, b *Instance) int {
+	if c := strings.Compare(a.Name, b.Name); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Key(), b.Key())
+}
+
+// IsCompleted checks if the instance runs the target state and reports HEALTHY
+func (i *Instance) IsCompleted(target State) bool {
+	return i.CurrentState == target && i.Status == HEALTHY
+}
+
+// IsFailed checks if the instance was told to move to the target state but reports FAILED
+func (i *Instance) IsFailed(target State) bool {
+	return i.DesiredState == target && i.Status == FAILED
+}
+
+// IsInProgress checks if the instance was told to move to the target state but does not run it yet
+func (i *Instance) IsInProgress(target State) bool {
+	return i.DesiredState == target && i.CurrentState != target
+}
+
+// NeedsUpdate checks if the instance does not run the target state
+func (i *Instance) NeedsUpdate(target State) bool {
+	return i.CurrentState != target
+}
+
+// IsUnreachable checks if the instance pinged before the cutoff, an instance that never pinged is not
+func (i *Instance) IsUnreachable(before time.Time) bool {
+	return !i.LastPing.IsZero() && i.LastPing.Before(before)
+}
+
+// IsUpdating checks if the instance was told to move to a state it does not run yet and has not failed
+func (i *Instance) IsUpdating() bool {
+	return !i.DesiredState.IsZero() && i.CurrentState != i.DesiredState && i.Status != FAILED
+}
+
+// IsKnownGood checks if the current state of the instance can be restored by a rollback
+func (i *Instance) IsKnownGood() bool {
+	return i.Status == HEALTHY && !i.CurrentState.IsZero()
 }
 
 // State represent the version deployed on the instance
@@ -41,10 +141,30 @@ type State struct {
 	ConfigurationVersion string
 }
 
+// IsZero reports whether no version was ever set on the state
+func (s State) IsZero() bool {
+	return s == State{}
+}
+
 // RegistrationRequest represents the request body for instance registration
 type RegistrationRequest struct {
 	Instance Instance `json:"instance"`
 	Token    string   `json:"token"`
+	// CSR is an optional PEM encoded certificate signing request for a mutual TLS client certificate
+	CSR string `json:"csr,omitempty"`
+	// Credential and Certificate prove the identity of an instance registering again, they come from the transport
+	Credential  string            `json:"-"`
+	Certificate *x509.Certificate `json:"-"`
+}
+
+// RegistrationResponse represents the response body of a successful registration
+// The credential is only returned once and must be presented on every instance update
+type RegistrationResponse struct {
+	Message    string    `json:"message"`
+	Instance   *Instance `json:"instance"`
+	Credential string    `json:"credential"`
+	// Certificate is the PEM encoded client certificate, only set when a CSR was sent
+	Certificate string `json:"certificate,omitempty"`
 }
 
 // InstancePatch represents partial updates to an instance, not all fields are updatable
@@ -54,6 +174,15 @@ type InstancePatch struct {
 	Status       *Status           `json:"status,omitempty"`
 	CurrentState *State            `json:"current_state,omitempty"`
 	DesiredState *State            `json:"desired_state,omitempty"`
+	// Lifecycle fields are managed by the controller and cannot be set by the instance
+	Cordoned          *bool   `json:"-"`
+	Draining          *bool   `json:"-"`
+	CertificateSerial *string `json:"-"`
+	// Registration fields are set when the instance registers again, ReplaceLabels replaces the labels with Labels instead of merging them
+	CredentialHash *string `json:"-"`
+	ReplaceLabels  bool    `json:"-"`
+	// Revision makes the update conditional, it is only applied to the instance at that revision
+	Revision *int64 `json:"-"`
 }
 
 // ListResponse represents the response for listing instances
@@ -67,23 +196,79 @@ type GetNeedingUpdateOptions struct {
 	Limit int // Maximum number of instances to return. 0 or negative means no limit
 }
 
+// HeartbeatTTL is how long an instance may go without a heartbeat before deployments count it unreachable
+const HeartbeatTTL = time.Minute
+
+// ProgressOptions contains options for the CountProgress query
+type ProgressOptions struct {
+	// UnreachableBefore is the cutoff of the last ping, counted to the second
+	// Instances that never pinged are not counted unreachable
+	UnreachableBefore time.Time
+	// Targets moves each instance to its own target state instead of the desired state, the others are not counted
+	Targets map[string]State
+}
+
+// Progress counts the deployable instances matching a selector by their progress toward the target state
+// An instance is counted in every bucket it belongs to, an unreachable instance can also be in progress or completed
+type Progress struct {
+	Total         int
+	NeedingUpdate int
+	InProgress    int
+	Completed     int
+	Failed        int
+	Unreachable   int
+}
+
+// Add counts the instance toward the target state, a negative delta removes it
+// Unreachable instances are left to the caller, they depend on the time of the query
+func (p *Progress) Add(instance *Instance, target State, delta int) {
+	p.Total += delta
+	if instance.NeedsUpdate(target) {
+		p.NeedingUpdate += delta
+	}
+	if instance.IsInProgress(target) {
+		p.InProgress += delta
+	}
+	if instance.IsCompleted(target) {
+		p.Completed += delta
+	}
+	if instance.IsFailed(target) {
+		p.Failed += delta
+	}
+}
+
+// Store persists the inventory
+// Cordoned instances are excluded from the Count* and GetNeedingUpdate queries used by deployments
+// The writes take the context of the unit of work they are part of, if any
 type Store interface {
 	// CRUD
-	Save(instance *Instance) error
-	Update(key string, patch InstancePatch) (*Instance, error)
+	// Save returns ErrInstanceConflict when another instance already uses the same name or IP
+	Save(ctx context.Context, instance *Instance) error
+	// Update returns ErrRevisionConflict when the patch has a revision and the instance is no longer at it
+	Update(ctx context.Context, key string, patch InstancePatch) (*Instance, error)
+	// UpdateDesiredStates sets the desired state of every instance by key, all or nothing
+	// An instance with a revision in revisions is only updated at that revision, otherwise it fails with ErrRevisionConflict
+	UpdateDesiredStates(ctx context.Context, states map[string]State, revisions map[string]int64) error
+	Get(key string) (*Instance, bool)
+	Delete(ctx context.Context, key string) bool
 	GetAll() []*Instance
-	GetByLabels(labels map[string]string) []*Instance
-	CountByLabels(labels map[string]string) (int, error)
+	GetByName(name string) (*Instance, bool)
+	GetByIP(ip string) (*Instance, bool)
+	// GetByLabels returns the instances matching the label selector
+	GetByLabels(sel selector.Selector) []*Instance
+	CountByLabels(sel selector.Selector) (int, error)
 
 	// Search for update
-	GetNeedingUpdate(labels map[string]string, desiredState State, opts *GetNeedingUpdateOptions) ([]*Instance, error)
-	CountNeedingUpdate(labels map[string]string, desiredState State) (int, error)
+	GetNeedingUpdate(sel selector.Selector, desiredState State, opts *GetNeedingUpdateOptions) ([]*Instance, error)
+	CountNeedingUpdate(sel selector.Selector, desiredState State) (int, error)
 	// CountInProgress returns the total number of instances currently being updated (desiredState == targetState but currentState != desiredState)
-	CountInProgress(labels map[string]string, desiredState State) (int, error)
+	CountInProgress(sel selector.Selector, desiredState State) (int, error)
 	// CountCompleted returns the total number of instances that have completed the update to the desired state
-	CountCompleted(labels map[string]string, desiredState State) (int, error)
+	CountCompleted(sel selector.Selector, desiredState State) (int, error)
 	// CountFailed returns the total number of instances that have failed the update to the desired state
-	CountFailed(labels map[string]string, desiredState State) (int, error)
-	// ResetFailedInstances resets the status of failed instances matching the labels to UNKNOWN
-	ResetFailedInstances(labels map[string]string) error
+	CountFailed(sel selector.Selector, desiredState State) (int, error)
+	// CountProgress returns every progress count of the instances toward the desired state, read at once
+	CountProgress(sel selector.Selector, desiredState State, opts *ProgressOptions) (Progress, error)
+	// ResetFailedInstances resets the status of failed instances matching the label selector to UNKNOWN
+	ResetFailedInstances(ctx context.Context, sel selector.Selector) error
 }
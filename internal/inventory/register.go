@@ -3,7 +3,14 @@ package inventory
 import (
 	"context"
 	"errors"
+	"log"
+	"maps"
 	"time"
+
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/clock"
+	"github.com/xnok/dides/internal/pki"
+	"github.com/xnok/dides/internal/selector"
 )
 
 var (
@@ -11,36 +18,193 @@ var (
 )
 
 type RegistrationService struct {
-	store Store
+	store  Store
+	tokens TokenStore
+	audit  AuditLog
+	clock  clock.Clock
 }
 
-func NewRegistrationService(store Store) *RegistrationService {
+// NewRegistrationService creates the registration service, auditLog may be nil to disable the audit
+// The wall clock is used when clk is nil
+func NewRegistrationService(store Store, tokens TokenStore, auditLog AuditLog, clk clock.Clock) *RegistrationService {
 	return &RegistrationService{
-		store: store,
+		store:  store,
+		tokens: tokens,
+		audit:  auditLog,
+		clock:  clock.OrReal(clk),
 	}
 }
 
 // Validate the registration request
 func (r RegistrationRequest) Validate() error {
-	// TODO: Validate registration token - we accept anthing for now to keep things simple
 	if r.Token == "" {
 		return ErrInvalidToken
 	}
+	if r.CSR != "" {
+		if _, err := pki.ParseCSR(r.CSR); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (s *RegistrationService) RegisterInstance(ctx context.Context, req RegistrationRequest) (*Instance, error) {
+// RegisterInstance verifies the join token and registers the instance
+// It returns the credential the instance must present on every subsequent update
+// Registering an instance again requires its current credential or certificate, it keeps its ID, states, history and scope,
+// only its labels are replaced and they must stay within the scope of its first registration
+// The labels of an instance with a client certificate only change with a CSR, the certificate is issued again for them
+// The registered instance is updated at the revision it was checked at, a concurrent change makes it read the instance again
+func (s *RegistrationService) RegisterInstance(ctx context.Context, req RegistrationRequest) (*Instance, string, error) {
 	if err := req.Validate(); err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	now := s.clock.Now()
+	for attempt := 1; ; attempt++ {
+		existing, instance, credential, err := s.register(ctx, req, now)
+		if errors.Is(err, ErrRevisionConflict) && attempt < maxUpdateAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		// The instance is the actor of its registration
+		ctx = audit.WithActor(ctx, "instance/"+instance.Key())
+		recordAudit(ctx, s.audit, audit.InstanceRegister, instance.Key(), auditedInstance(existing), auditedInstance(instance))
+
+		return instance, credential, nil
+	}
+}
+
+// register checks the registration against the instance already registered, if any, and saves it
+// It returns the registered instance as it was before, nil for a new one, and as it is saved
+// The use of the token is given back when the instance is not saved
+func (s *RegistrationService) register(ctx context.Context, req RegistrationRequest, now time.Time) (*Instance, *Instance, string, error) {
+	existing, err := s.findRegistered(req.Instance)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	// A name and IP are not an identity, another agent cannot take over the registered instance
+	if existing != nil && !provesIdentity(existing, req) {
+		return nil, nil, "", ErrInstanceConflict
+	}
+	if existing != nil && !inScope(existing.Scope, req.Instance.Labels) {
+		return nil, nil, "", ErrLabelsOutOfScope
+	}
+	// The client certificate would no longer authenticate the instance, a CSR gets one bound to the new labels
+	if existing != nil && existing.CertificateSerial != "" && req.CSR == "" && !maps.Equal(existing.Labels, req.Instance.Labels) {
+		return nil, nil, "", ErrLabelsBoundToCertificate
+	}
+
+	// 1. Check the scope before using the token, rejected registrations do not count against its limit
+	tokenHash := HashJoinToken(req.Token)
+	token, ok := s.tokens.GetTokenByHash(tokenHash)
+	if !ok || !token.Usable(now) {
+		return nil, nil, "", ErrInvalidToken
+	}
+	if !token.Allows(req.Instance.Labels) {
+		return nil, nil, "", ErrLabelsOutOfScope
+	}
+
+	// 2. Record the registration, the token may have been used up concurrently
+	if _, err := s.tokens.UseToken(tokenHash, now); err != nil {
+		return nil, nil, "", ErrInvalidToken
+	}
+
+	instance, credential, err := s.save(ctx, req, existing, token, now)
+	if err != nil {
+		if releaseErr := s.tokens.ReleaseToken(tokenHash); releaseErr != nil {
+			log.Printf("Failed to give back the use of join token %s: %v", token.ID, releaseErr)
+		}
+		return nil, nil, "", err
+	}
+	return existing, instance, credential, nil
+}
+
+// save issues the credential of the instance and saves it, it updates the registered instance at the revision it was checked at
+func (s *RegistrationService) save(ctx context.Context, req RegistrationRequest, existing *Instance, token *JoinToken, now time.Time) (*Instance, string, error) {
+	// 3. Issue the instance credential, only its hash is kept
+	credential, err := generateSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	credentialHash := hashCredential(credential)
+
+	// 4. Update the registered instance at the revision it was checked at
+	if existing != nil {
+		instance, err := s.store.Update(ctx, existing.Key(), InstancePatch{
+			Labels:         req.Instance.Labels,
+			ReplaceLabels:  true,
+			CredentialHash: &credentialHash,
+			LastPing:       &now,
+			Revision:       &existing.Revision,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		return instance, credential, nil
 	}
 
-	// Set the first connected timestamp
-	req.Instance.LastPing = time.Now()
+	// 5. Assign the identity of a new instance, the ID is never taken from the request
+	instance := req.Instance
+	id, err := generateSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	instance.ID = "i-" + id[:16]
+	instance.Scope = token.Selector
+	instance.CredentialHash = credentialHash
+
+	// Set the last connected timestamp
+	instance.LastPing = now
 
 	// persist the instance
-	s.store.Save(&req.Instance)
+	if err := s.store.Save(ctx, &instance); err != nil {
+		return nil, "", err
+	}
+	return &instance, credential, nil
+}
+
+// findRegistered returns the instance already registered with the same name and IP, if any
+// A name or IP used by another instance is a conflict
+func (s *RegistrationService) findRegistered(instance Instance) (*Instance, error) {
+	byName, nameTaken := s.store.GetByName(instance.Name)
+	byIP, ipTaken := s.store.GetByIP(instance.IP)
+
+	switch {
+	case !nameTaken && !ipTaken:
+		return nil, nil
+	case nameTaken && ipTaken && byName.ID == byIP.ID:
+		return byName, nil
+	case nameTaken && !ipTaken && instance.IP == "" && byName.IP == "":
+		return byName, nil
+	case ipTaken && !nameTaken && instance.Name == "" && byIP.Name == "":
+		return byIP, nil
+	}
+	return nil, ErrInstanceConflict
+}
 
-	return &req.Instance, nil
+// provesIdentity checks the registration carries the credential or the client certificate of the registered instance
+func provesIdentity(instance *Instance, req RegistrationRequest) bool {
+	if req.Certificate != nil && certificateMatches(instance, req.Certificate) {
+		return true
+	}
+	return verifyCredential(req.Credential, instance.CredentialHash)
+}
+
+// Authenticate checks the credential presented by an instance against the one issued at registration
+func (s *RegistrationService) Authenticate(ctx context.Context, instanceKey, credential string) error {
+	instance, ok := s.store.Get(instanceKey)
+	if !ok {
+		return ErrInstanceNotFound
+	}
+
+	if !verifyCredential(credential, instance.CredentialHash) {
+		return ErrInvalidCredential
+	}
+	return nil
 }
 
 // ListAllInstances returns all registered instances
@@ -48,3 +212,12 @@ func (s *RegistrationService) ListAllInstances(ctx context.Context) ([]*Instance
 	instances := s.store.GetAll()
 	return instances, nil
 }
+
+// ListInstances returns the registered instances matching the label selector
+func (s *RegistrationService) ListInstances(ctx context.Context, sel selector.Selector) ([]*Instance, error) {
+	if sel.Empty() {
+		return s.store.GetAll(), nil
+	}
+
+	return s.store.GetByLabels(sel), nil
+}
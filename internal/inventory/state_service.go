@@ -1,70 +1,102 @@
 package inventory
 
-import "context"
+import (
+	"context"
+
+	"github.com/xnok/dides/internal/clock"
+	"github.com/xnok/dides/internal/selector"
+	"github.com/xnok/dides/internal/transaction"
+)
 
 // StateService provides inventory state operations for searching and updating instance states
 type StateService struct {
-	store Store
+	store    Store
+	notifier Notifier
+	clock    clock.Clock
 }
 
-// NewStateService creates a new state service for inventory state operations
-func NewStateService(store Store) *StateService {
+// NewStateService creates a new state service for inventory state operations, notifier may be nil when no agent watches its desired state
+func NewStateService(store Store, notifier Notifier, clk clock.Clock) *StateService {
 	return &StateService{
-		store: store,
+		store:    store,
+		notifier: notifier,
+		clock:    clock.OrReal(clk),
 	}
 }
 
-// GetInstancesByLabels returns instances that match the given labels
-func (s *StateService) GetInstancesByLabels(ctx context.Context, labels map[string]string) ([]*Instance, error) {
-	if len(labels) == 0 {
-		return s.store.GetAll(), nil
+// GetInstancesByLabels returns the instances that match the given label selector and are not cordoned
+func (s *StateService) GetInstancesByLabels(ctx context.Context, sel selector.Selector) ([]*Instance, error) {
+	var instances []*Instance
+	if sel.Empty() {
+		instances = s.store.GetAll()
+	} else {
+		instances = s.store.GetByLabels(sel)
 	}
 
-	matches := s.store.GetByLabels(labels)
+	matches := make([]*Instance, 0, len(instances))
+	for _, instance := range instances {
+		if !instance.Cordoned {
+			matches = append(matches, instance)
+		}
+	}
 	return matches, nil
 }
 
-// UpdateDesiredState sets the desired state for an instance
-func (s *StateService) UpdateDesiredState(ctx context.Context, instanceKey string, state State) error {
-	patch := InstancePatch{
-		DesiredState: &state,
+// GetInstances returns the instances with the given keys, in the same order, the removed ones are left out
+func (s *StateService) GetInstances(ctx context.Context, keys []string) ([]*Instance, error) {
+	instances := make([]*Instance, 0, len(keys))
+	for _, key := range keys {
+		if instance, ok := s.store.Get(key); ok {
+			instances = append(instances, instance)
+		}
 	}
-
-	_, err := s.store.Update(instanceKey, patch)
-	return err
+	return instances, nil
 }
 
-// CountByLabels returns the count of instances matching the given labels
-func (s *StateService) CountByLabels(ctx context.Context, labels map[string]string) (int, error) {
-	return s.store.CountByLabels(labels)
+// UpdateDesiredState sets the desired state for an instance
+func (s *StateService) UpdateDesiredState(ctx context.Context, instanceKey string, state State) error {
+	return s.UpdateDesiredStates(ctx, map[string]State{instanceKey: state}, nil)
 }
 
-// GetNeedingUpdate returns instances that match labels and need state updates
-func (s *StateService) GetNeedingUpdate(ctx context.Context, labels map[string]string, desiredState State, opts *GetNeedingUpdateOptions) ([]*Instance, error) {
-	return s.store.GetNeedingUpdate(labels, desiredState, opts)
-}
+// UpdateDesiredStates sets the desired state of every instance by key, none is updated when one fails
+// An instance with a revision in revisions is only updated at that revision, otherwise it fails with ErrRevisionConflict
+func (s *StateService) UpdateDesiredStates(ctx context.Context, states map[string]State, revisions map[string]int64) error {
+	if err := s.store.UpdateDesiredStates(ctx, states, revisions); err != nil {
+		return err
+	}
 
-// CountNeedingUpdate returns the count of instances that match labels and need state updates
-func (s *StateService) CountNeedingUpdate(ctx context.Context, labels map[string]string, desiredState State) (int, error) {
-	return s.store.CountNeedingUpdate(labels, desiredState)
+	// Wake up the agents watching their desired state once the unit of work is over,
+	// a desired state set back by a rollback is a new revision for them as well
+	if s.notifier != nil {
+		transaction.AfterEnd(ctx, func() {
+			for instanceKey := range states {
+				s.notifier.Notify(instanceKey)
+			}
+		})
+	}
+	return nil
 }
 
-// CountCompleted returns the count of instances that match labels and have completed the update to desired state
-func (s *StateService) CountCompleted(ctx context.Context, labels map[string]string, desiredState State) (int, error) {
-	return s.store.CountCompleted(labels, desiredState)
+// CountByLabels returns the count of instances matching the given label selector
+func (s *StateService) CountByLabels(ctx context.Context, sel selector.Selector) (int, error) {
+	return s.store.CountByLabels(sel)
 }
 
-// CountFailed returns the count of instances that match labels and have failed the update to desired state
-func (s *StateService) CountFailed(ctx context.Context, labels map[string]string, desiredState State) (int, error) {
-	return s.store.CountFailed(labels, desiredState)
+// GetNeedingUpdate returns instances that match the label selector and need state updates
+func (s *StateService) GetNeedingUpdate(ctx context.Context, sel selector.Selector, desiredState State, opts *GetNeedingUpdateOptions) ([]*Instance, error) {
+	return s.store.GetNeedingUpdate(sel, desiredState, opts)
 }
 
-// CountInProgress returns the count of instances that match labels and are currently being updated
-func (s *StateService) CountInProgress(ctx context.Context, labels map[string]string, desiredState State) (int, error) {
-	return s.store.CountInProgress(labels, desiredState)
+// CountProgress returns every progress count of the instances that match the label selector toward the desired state
+// Instances that did not ping within HeartbeatTTL are counted unreachable, targets set the state of each instance instead
+func (s *StateService) CountProgress(ctx context.Context, sel selector.Selector, desiredState State, targets map[string]State) (Progress, error) {
+	return s.store.CountProgress(sel, desiredState, &ProgressOptions{
+		UnreachableBefore: s.clock.Now().Add(-HeartbeatTTL),
+		Targets:           targets,
+	})
 }
 
-// ResetFailedInstances resets the status of failed instances matching the labels to UNKNOWN
-func (s *StateService) ResetFailedInstances(ctx context.Context, labels map[string]string) error {
-	return s.store.ResetFailedInstances(labels)
+// ResetFailedInstances resets the status of failed instances matching the label selector to UNKNOWN
+func (s *StateService) ResetFailedInstances(ctx context.Context, sel selector.Selector) error {
+	return s.store.ResetFailedInstances(ctx, sel)
 }
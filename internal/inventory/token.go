@@ -0,0 +1,217 @@
+package inventory
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/clock"
+	"github.com/xnok/dides/internal/selector"
+)
+
+const (
+	// DefaultJoinTokenTTL is used when a join token request does not set a TTL
+	DefaultJoinTokenTTL = 24 * time.Hour
+)
+
+var (
+	ErrInvalidJoinTokenRequest = errors.New("invalid join token request")
+	ErrJoinTokenNotFound       = errors.New("join token not found")
+	ErrLabelsOutOfScope        = errors.New("labels are outside the join token scope")
+	ErrInvalidCredential       = errors.New("invalid instance credential")
+)
+
+// JoinToken allows instances to register themselves, it is created by an admin
+type JoinToken struct {
+	// ID identifies the token in the API, it is not a secret
+	ID string `json:"id"`
+	// Token is the secret instances register with, it is only returned when the token is created
+	Token string `json:"token,omitempty"`
+	// TokenHash is the hash of the secret, the only form of it kept in the store
+	TokenHash string `json:"-"`
+	// Selector restricts the labels the registered instances may carry, empty allows any label
+	Selector  string    `json:"selector,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// MaxUses is the number of registrations allowed with the token, 0 means unlimited
+	MaxUses   int       `json:"max_uses"`
+	Uses      int       `json:"uses"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Usable checks if the token is not expired and has registrations left
+func (t *JoinToken) Usable(now time.Time) bool {
+	if now.After(t.ExpiresAt) {
+		return false
+	}
+	return t.MaxUses <= 0 || t.Uses < t.MaxUses
+}
+
+// Allows checks if instances with the given labels may register with the token
+func (t *JoinToken) Allows(labels map[string]string) bool {
+	return inScope(t.Selector, labels)
+}
+
+// JoinTokenRequest represents the request body for creating a join token
+type JoinTokenRequest struct {
+	Selector string `json:"selector,omitempty"`
+	// TTL is a duration such as "1h", DefaultJoinTokenTTL is used when empty
+	TTL     string `json:"ttl,omitempty"`
+	MaxUses int    `json:"max_uses,omitempty"`
+}
+
+// Validate checks if the join token request is valid
+func (r JoinTokenRequest) Validate() error {
+	if _, err := selector.Parse(r.Selector); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJoinTokenRequest, err)
+	}
+
+	if r.TTL != "" {
+		ttl, err := time.ParseDuration(r.TTL)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("%w: ttl must be a positive duration", ErrInvalidJoinTokenRequest)
+		}
+	}
+
+	if r.MaxUses < 0 {
+		return fmt.Errorf("%w: max_uses cannot be negative", ErrInvalidJoinTokenRequest)
+	}
+	return nil
+}
+
+// TokenStore persists the join tokens by ID, the secrets are only known by their hash
+type TokenStore interface {
+	SaveToken(token *JoinToken) error
+	GetToken(id string) (*JoinToken, bool)
+	GetTokenByHash(hash string) (*JoinToken, bool)
+	GetAllTokens() []*JoinToken
+	DeleteToken(id string) bool
+	// UseToken records a registration with the token of that hash if it is still usable at the given time
+	UseToken(hash string, now time.Time) (*JoinToken, error)
+	// ReleaseToken gives back a use recorded by UseToken for a registration that was not saved
+	ReleaseToken(hash string) error
+}
+
+// TokenService lets admins manage the join tokens
+type TokenService struct {
+	tokens TokenStore
+	audit  AuditLog
+	clock  clock.Clock
+}
+
+// NewTokenService creates a new join token service, auditLog may be nil to disable the audit
+// The expirations are computed from the wall clock when clk is nil
+func NewTokenService(tokens TokenStore, auditLog AuditLog, clk clock.Clock) *TokenService {
+	return &TokenService{
+		tokens: tokens,
+		audit:  auditLog,
+		clock:  clock.OrReal(clk),
+	}
+}
+
+// CreateJoinToken issues a new join token, it is the only time its secret is returned
+func (s *TokenService) CreateJoinToken(ctx context.Context, req JoinTokenRequest) (*JoinToken, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	ttl := DefaultJoinTokenTTL
+	if req.TTL != "" {
+		ttl, _ = time.ParseDuration(req.TTL)
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+	id, err := generateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	// Store the canonical form of the selector
+	sel, _ := selector.Parse(req.Selector)
+
+	now := s.clock.Now()
+	token := &JoinToken{
+		ID:        "jt-" + id[:16],
+		TokenHash: HashJoinToken(secret),
+		Selector:  sel.String(),
+		ExpiresAt: now.Add(ttl),
+		MaxUses:   req.MaxUses,
+		CreatedAt: now,
+	}
+
+	if err := s.tokens.SaveToken(token); err != nil {
+		return nil, err
+	}
+	recordAudit(ctx, s.audit, audit.JoinTokenCreate, token.ID, nil, auditedToken(token))
+
+	token.Token = secret
+	return token, nil
+}
+
+// ListJoinTokens returns all join tokens, including the expired ones, without their secret
+func (s *TokenService) ListJoinTokens(ctx context.Context) ([]*JoinToken, error) {
+	return s.tokens.GetAllTokens(), nil
+}
+
+// RevokeJoinToken prevents any further registration with the token of that ID
+func (s *TokenService) RevokeJoinToken(ctx context.Context, id string) error {
+	token, ok := s.tokens.GetToken(id)
+	if !ok || !s.tokens.DeleteToken(id) {
+		return ErrJoinTokenNotFound
+	}
+
+	recordAudit(ctx, s.audit, audit.JoinTokenRevoke, id, auditedToken(token), nil)
+	return nil
+}
+
+// auditedToken returns the copy of the join token recorded in the audit log, never with its secret
+func auditedToken(token *JoinToken) *JoinToken {
+	tokenCopy := *token
+	tokenCopy.Token = ""
+	return &tokenCopy
+}
+
+// inScope checks if the labels match the scope selector, an invalid scope allows nothing
+func inScope(scope string, labels map[string]string) bool {
+	sel, err := selector.Parse(scope)
+	if err != nil {
+		return false
+	}
+	return sel.Matches(labels)
+}
+
+// generateSecret returns a random hex encoded secret used for join tokens and instance credentials
+func generateSecret() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashJoinToken returns the form of a join token secret kept in the store
+func HashJoinToken(secret string) string {
+	return hashCredential(secret)
+}
+
+// hashCredential returns the form of the credential kept in the store
+func hashCredential(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyCredential checks the credential against the hash kept in the store
+func verifyCredential(credential, hash string) bool {
+	if credential == "" || hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashCredential(credential)), []byte(hash)) == 1
+}
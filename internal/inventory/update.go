@@ -3,9 +3,18 @@ package inventory
 import (
 	"context"
 	"errors"
+	"log"
+	"maps"
 	"time"
+
+	"github.com/xnok/dides/internal/audit"
+	"github.com/xnok/dides/internal/clock"
+	"github.com/xnok/dides/internal/transaction"
 )
 
+// maxUpdateAttempts is how many times an instance update is tried with fresh state before the conflict is returned
+const maxUpdateAttempts = 3
+
 var (
 	ErrInstanceNotFound = errors.New("instance not found")
 	ErrUpdateValidation = errors.New("invalid update request")
@@ -28,18 +37,29 @@ func (r UpdateRequest) Validate() error {
 	return nil
 }
 
+// AuditLog records who changed which instance and how
+type AuditLog interface {
+	Record(ctx context.Context, action audit.Action, target string, before, after interface{}) error
+}
+
 type UpdateService struct {
 	store Store
+	audit AuditLog
+	clock clock.Clock
 }
 
-func NewUpdateService(store Store) *UpdateService {
+// NewUpdateService creates the instance update service, auditLog may be nil to disable the audit
+// The heartbeats are timestamped with the wall clock when clk is nil
+func NewUpdateService(store Store, auditLog AuditLog, clk clock.Clock) *UpdateService {
 	return &UpdateService{
 		store: store,
+		audit: auditLog,
+		clock: clock.OrReal(clk),
 	}
 }
 
 func (s *UpdateService) UpdateInstance(ctx context.Context, instanceKey string, req UpdateRequest) (*Instance, error) {
-	now := time.Now()
+	now := s.clock.Now()
 
 	// Validate the instance key
 	if instanceKey == "" {
@@ -53,42 +73,104 @@ func (s *UpdateService) UpdateInstance(ctx context.Context, instanceKey string,
 
 	req.Updates.LastPing = &now
 
-	// Update the instance in the store
-	instance, err := s.store.Update(instanceKey, req.Updates)
+	// The scope is checked against the instance as it is updated, a concurrent change makes it read the instance again
+	before, instance, err := s.update(ctx, instanceKey, req.Updates, func(before *Instance) error {
+		// Labels cannot leave the scope of the join token used to register
+		if req.Updates.Labels != nil && !inScope(before.Scope, mergeLabels(before.Labels, req.Updates.Labels)) {
+			return ErrLabelsOutOfScope
+		}
+		// The client certificate would no longer authenticate the instance
+		if req.Updates.Labels != nil && before.CertificateSerial != "" && !maps.Equal(before.Labels, mergeLabels(before.Labels, req.Updates.Labels)) {
+			return ErrLabelsBoundToCertificate
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	recordAudit(ctx, s.audit, audit.InstanceUpdate, instance.Key(), auditedInstance(before), auditedInstance(instance))
+
+	// A draining instance is removed as soon as its in-flight update is over
+	removeIfDrained(ctx, s.store, instance)
+
 	return instance, nil
 }
 
-// UpdateInstanceState updates the current or desired state of an instance
-func (s *UpdateService) UpdateInstanceState(ctx context.Context, instanceKey string, req StateUpdateRequest) (*Instance, error) {
-	if instanceKey == "" {
-		return nil, ErrUpdateValidation
-	}
+// update patches the instance at the revision it was read, check may reject the patch for the instance read
+// A conflicting update reads the instance again, it returns the instance before and after the patch
+func (s *UpdateService) update(ctx context.Context, instanceKey string, patch InstancePatch, check func(before *Instance) error) (*Instance, *Instance, error) {
+	for attempt := 1; ; attempt++ {
+		before, ok := s.store.Get(instanceKey)
+		if !ok {
+			return nil, nil, ErrInstanceNotFound
+		}
+		if check != nil {
+			if err := check(before); err != nil {
+				return nil, nil, err
+			}
+		}
 
-	// Get current instance
-	instances := s.store.GetAll()
-	var currentInstance *Instance
-	for _, instance := range instances {
-		key := instance.Name
-		if key == "" {
-			key = instance.IP
+		patch.Revision = &before.Revision
+		instance, err := s.store.Update(ctx, instanceKey, patch)
+		if errors.Is(err, ErrRevisionConflict) && attempt < maxUpdateAttempts {
+			continue
 		}
-		if key == instanceKey {
-			currentInstance = instance
-			break
+		if err != nil {
+			return nil, nil, err
 		}
+		return before, instance, nil
 	}
+}
 
-	if currentInstance == nil {
-		return nil, ErrInstanceNotFound
+// mergeLabels returns the labels of an instance once patched
+func mergeLabels(labels, patch map[string]string) map[string]string {
+	merged := make(map[string]string, len(labels)+len(patch))
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range patch {
+		merged[k] = v
+	}
+	return merged
+}
+
+// recordAudit adds the change to the audit log, if any, once the unit of work of the context is committed
+// The change is already made, a failure to record it is logged instead of failing the request
+func recordAudit(ctx context.Context, auditLog AuditLog, action audit.Action, target string, before, after interface{}) {
+	if auditLog == nil {
+		return
+	}
+
+	transaction.AfterCommit(ctx, func() {
+		if err := auditLog.Record(ctx, action, target, before, after); err != nil {
+			log.Printf("Failed to record audit entry %s of %s: %v", action, target, err)
+		}
+	})
+}
+
+// auditedInstance returns the copy of the instance recorded in the audit log, nil for a missing instance
+// The heartbeat timestamp and the revision are left out, they change on every update
+func auditedInstance(instance *Instance) *Instance {
+	if instance == nil {
+		return nil
+	}
+
+	instanceCopy := *instance
+	instanceCopy.LastPing = time.Time{}
+	instanceCopy.Revision = 0
+	return &instanceCopy
+}
+
+// UpdateInstanceState updates the current or desired state of an instance
+func (s *UpdateService) UpdateInstanceState(ctx context.Context, instanceKey string, req StateUpdateRequest) (*Instance, error) {
+	if instanceKey == "" {
+		return nil, ErrUpdateValidation
 	}
 
 	// Prepare patch
 	patch := InstancePatch{}
-	now := time.Now()
+	now := s.clock.Now()
 	patch.LastPing = &now
 
 	// Update current state if provided
@@ -97,20 +179,22 @@ func (s *UpdateService) UpdateInstanceState(ctx context.Context, instanceKey str
 	}
 
 	// Update the instance
-	return s.store.Update(instanceKey, patch)
+	before, instance, err := s.update(ctx, instanceKey, patch, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	recordAudit(ctx, s.audit, audit.InstanceState, instance.Key(), auditedInstance(before), auditedInstance(instance))
+
+	removeIfDrained(ctx, s.store, instance)
+	return instance, nil
 }
 
 // GetDesiredState returns the desired state for an instance
 func (s *UpdateService) GetDesiredState(ctx context.Context, instanceKey string) (*State, error) {
-	instances := s.store.GetAll()
-	for _, instance := range instances {
-		key := instance.Name
-		if key == "" {
-			key = instance.IP
-		}
-		if key == instanceKey {
-			return &instance.DesiredState, nil
-		}
+	instance, ok := s.store.Get(instanceKey)
+	if !ok {
+		return nil, ErrInstanceNotFound
 	}
-	return nil, ErrInstanceNotFound
+	return &instance.DesiredState, nil
 }
@@ -0,0 +1,65 @@
+package inventory
+
+import (
+	"context"
+)
+
+// Notifier wakes up the agents waiting for a change of their desired state
+type Notifier interface {
+	// Notify wakes up every waiter of the instance
+	Notify(instanceKey string)
+	// Wait returns a channel closed on the next notification of the instance, cancel releases it
+	Wait(instanceKey string) (<-chan struct{}, func())
+}
+
+// DesiredStateResponse represents the desired state of an instance and the revision it was set at
+type DesiredStateResponse struct {
+	DesiredState State `json:"desired_state"`
+	Revision     int64 `json:"revision"`
+}
+
+// WatchService lets agents wait for their desired state to change instead of polling it
+type WatchService struct {
+	store    Store
+	notifier Notifier
+}
+
+// NewWatchService creates a new watch service notified by the state service
+func NewWatchService(store Store, notifier Notifier) *WatchService {
+	return &WatchService{
+		store:    store,
+		notifier: notifier,
+	}
+}
+
+// WatchDesiredState returns as soon as the desired state revision of the instance differs from the given one
+// When the context is done first, it returns the unchanged desired state and revision
+func (s *WatchService) WatchDesiredState(ctx context.Context, instanceKey string, revision int64) (*DesiredStateResponse, error) {
+	// Wait before reading the instance so a change in between is not missed
+	changed, cancel := s.notifier.Wait(instanceKey)
+	defer func() { cancel() }()
+
+	for {
+		instance, ok := s.store.Get(instanceKey)
+		if !ok {
+			return nil, ErrInstanceNotFound
+		}
+
+		response := &DesiredStateResponse{
+			DesiredState: instance.DesiredState,
+			Revision:     instance.DesiredRevision,
+		}
+		if instance.DesiredRevision != revision {
+			return response, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return response, nil
+		case <-changed:
+			// Notified, wait again in case the desired state was set to the same value
+			cancel()
+			changed, cancel = s.notifier.Wait(instanceKey)
+		}
+	}
+}
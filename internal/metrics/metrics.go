@@ -0,0 +1,297 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/xnok/dides/internal/clock"
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+)
+
+const namespace = "dides"
+
+// heartbeatAgeBuckets spread from a healthy heartbeat interval to instances gone for an hour
+var heartbeatAgeBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// DeploymentStore is the part of the deployment store read at scrape time
+type DeploymentStore interface {
+	GetByStatus(ctx context.Context, status deployment.DeploymentStatus) ([]*deployment.DeploymentRecord, error)
+}
+
+// InstanceStore is the part of the inventory store read at scrape time
+type InstanceStore interface {
+	GetAll() []*inventory.Instance
+}
+
+// Collector exposes the controller metrics in the Prometheus text exposition format
+// The deployments and instances are read from the stores at scrape time, the lifecycle counters and the
+// batch durations are derived from the deployment events, it implements deployment.Publisher
+type Collector struct {
+	deployments DeploymentStore
+	instances   InstanceStore
+	registry    *prometheus.Registry
+	clock       clock.Clock
+
+	deploymentsStarted  prometheus.Counter
+	deploymentsFinished *prometheus.CounterVec
+	autoRollbacks       prometheus.Counter
+	batchDuration       prometheus.Histogram
+	httpDuration        *prometheus.HistogramVec
+
+	deploymentsDesc  *prometheus.Desc
+	progressDesc     *prometheus.Desc
+	instancesDesc    *prometheus.Desc
+	versionsDesc     *prometheus.Desc
+	heartbeatAgeDesc *prometheus.Desc
+
+	// batches are the batches of each deployment whose instances have not all reached an outcome yet
+	mu      sync.Mutex
+	batches map[string][]*batch
+}
+
+// batch is a set of instances whose desired state was updated together
+type batch struct {
+	started time.Time
+	pending map[string]struct{}
+}
+
+// NewCollector creates the collector and registers it with the Go runtime and process metrics
+// The heartbeat ages are measured with the wall clock when clk is nil
+func NewCollector(deployments DeploymentStore, instances InstanceStore, clk clock.Clock) *Collector {
+	c := &Collector{
+		deployments: deployments,
+		instances:   instances,
+		registry:    prometheus.NewRegistry(),
+		clock:       clock.OrReal(clk),
+		batches:     make(map[string][]*batch),
+
+		deploymentsStarted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deployments_started_total",
+			Help:      "Deployments started, including the rollback deployments.",
+		}),
+		deploymentsFinished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deployments_finished_total",
+			Help:      "Deployments finished by final status.",
+		}, []string{"status"}),
+		autoRollbacks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "deployment_auto_rollbacks_total",
+			Help:      "Rollbacks started because a deployment exceeded its failure threshold.",
+		}),
+		batchDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "deployment_batch_duration_seconds",
+			Help:      "Time from a batch start until every instance of the batch completed or failed.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of the HTTP handlers by route pattern, long-polls and event streams included.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "code"}),
+
+		deploymentsDesc: prometheus.NewDesc(namespace+"_deployments",
+			"Deployments by status.", []string{"status"}, nil),
+		progressDesc: prometheus.NewDesc(namespace+"_deployment_progress_instances",
+			"Progress of the running deployments in instances.", []string{"deployment_id", "state"}, nil),
+		instancesDesc: prometheus.NewDesc(namespace+"_instances",
+			"Instances by health status.", []string{"status"}, nil),
+		versionsDesc: prometheus.NewDesc(namespace+"_instances_by_version",
+			"Instances by current code and configuration version.", []string{"code_version", "configuration_version"}, nil),
+		heartbeatAgeDesc: prometheus.NewDesc(namespace+"_instance_heartbeat_age_seconds",
+			"Time since the last heartbeat of the instances.", nil, nil),
+	}
+
+	c.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		c.deploymentsStarted,
+		c.deploymentsFinished,
+		c.autoRollbacks,
+		c.batchDuration,
+		c.httpDuration,
+		c,
+	)
+	return c
+}
+
+// Handler serves the registered metrics
+func (c *Collector) Handler() http.Handler {
+	return promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware observes the latency of the handlers, labelled with the chi route pattern to bound the cardinality
+func (c *Collector) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		c.httpDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// Publish updates the lifecycle counters and the batch durations with a deployment event
+func (c *Collector) Publish(event deployment.Event) {
+	switch event.Type {
+	case deployment.EventStarted:
+		c.deploymentsStarted.Inc()
+	case deployment.EventRollback:
+		c.autoRollbacks.Inc()
+	case deployment.EventCompleted, deployment.EventFailed:
+		c.deploymentsFinished.WithLabelValues(deploymentStatus(event.Status)).Inc()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch event.Type {
+	case deployment.EventBatchStarted:
+		pending := make(map[string]struct{}, len(event.Instances))
+		for _, key := range event.Instances {
+			pending[key] = struct{}{}
+		}
+		c.batches[event.DeploymentID] = append(c.batches[event.DeploymentID], &batch{started: event.Time, pending: pending})
+	case deployment.EventInstanceCompleted, deployment.EventInstanceFailed:
+		var running []*batch
+		for _, b := range c.batches[event.DeploymentID] {
+			for _, key := range event.Instances {
+				delete(b.pending, key)
+			}
+			if len(b.pending) == 0 {
+				c.batchDuration.Observe(event.Time.Sub(b.started).Seconds())
+				continue
+			}
+			running = append(running, b)
+		}
+		c.batches[event.DeploymentID] = running
+	case deployment.EventCompleted, deployment.EventFailed:
+		// The instances left in a batch of a finished deployment never reach an outcome
+		delete(c.batches, event.DeploymentID)
+	}
+}
+
+// Describe sends the descriptors of the metrics read from the stores
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.deploymentsDesc
+	ch <- c.progressDesc
+	ch <- c.instancesDesc
+	ch <- c.versionsDesc
+	ch <- c.heartbeatAgeDesc
+}
+
+// Collect reads the deployments and the instances from the stores
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.collectDeployments(ch)
+	c.collectInstances(ch)
+}
+
+func (c *Collector) collectDeployments(ch chan<- prometheus.Metric) {
+	for _, status := range []deployment.DeploymentStatus{deployment.Running, deployment.Completed, deployment.Failed} {
+		records, err := c.deployments.GetByStatus(context.Background(), status)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.deploymentsDesc, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.deploymentsDesc, prometheus.GaugeValue, float64(len(records)), deploymentStatus(status))
+
+		if status != deployment.Running {
+			continue
+		}
+		for _, record := range records {
+			progress := record.Progress
+			for state, value := range map[string]int{
+				"total":       progress.TotalMatchingInstances,
+				"in_progress": progress.InProgressInstances,
+				"completed":   progress.CompletedInstances,
+				"failed":      progress.FailedInstances,
+				"unreachable": progress.UnreachableInstances,
+			} {
+				ch <- prometheus.MustNewConstMetric(c.progressDesc, prometheus.GaugeValue, float64(value), record.ID, state)
+			}
+		}
+	}
+}
+
+func (c *Collector) collectInstances(ch chan<- prometheus.Metric) {
+	type version struct{ code, configuration string }
+
+	statuses := map[inventory.Status]int{inventory.UNKNOWN: 0, inventory.HEALTHY: 0, inventory.FAILED: 0}
+	versions := make(map[version]int)
+	buckets := make(map[float64]uint64, len(heartbeatAgeBuckets))
+	var count uint64
+	var sum float64
+
+	now := c.clock.Now()
+	for _, instance := range c.instances.GetAll() {
+		statuses[instance.Status]++
+		versions[version{instance.CurrentState.CodeVersion, instance.CurrentState.ConfigurationVersion}]++
+
+		// Instances that never sent a heartbeat have no age
+		if instance.LastPing.IsZero() {
+			continue
+		}
+		age := now.Sub(instance.LastPing).Seconds()
+		count++
+		sum += age
+		for _, bound := range heartbeatAgeBuckets {
+			if age <= bound {
+				buckets[bound]++
+			}
+		}
+	}
+
+	for status, value := range statuses {
+		ch <- prometheus.MustNewConstMetric(c.instancesDesc, prometheus.GaugeValue, float64(value), instanceStatus(status))
+	}
+	for v, value := range versions {
+		ch <- prometheus.MustNewConstMetric(c.versionsDesc, prometheus.GaugeValue, float64(value), v.code, v.configuration)
+	}
+	ch <- prometheus.MustNewConstHistogram(c.heartbeatAgeDesc, count, sum, buckets)
+}
+
+// deploymentStatus returns the label value of a deployment status
+func deploymentStatus(status deployment.DeploymentStatus) string {
+	switch status {
+	case deployment.Running:
+		return "running"
+	case deployment.Completed:
+		return "completed"
+	case deployment.Failed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// instanceStatus returns the label value of an instance health status
+func instanceStatus(status inventory.Status) string {
+	switch status {
+	case inventory.HEALTHY:
+		return "healthy"
+	case inventory.FAILED:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,135 @@
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/xnok/dides/internal/deployment"
+	inmemory "github.com/xnok/dides/internal/infra/in-memory"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/metrics"
+)
+
+// scrape returns the text exposition of the collector metrics
+func scrape(t *testing.T, collector *metrics.Collector) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	collector.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", recorder.Code)
+	}
+	body, _ := io.ReadAll(recorder.Body)
+	return string(body)
+}
+
+func assertMetrics(t *testing.T, exposition string, expected ...string) {
+	t.Helper()
+	for _, line := range expected {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("Expected the metric %q in:\n%s", line, exposition)
+		}
+	}
+}
+
+func TestCollector_Collect(t *testing.T) {
+	deploymentStore := inmemory.NewDeploymentStore(nil)
+	inventoryStore := inmemory.NewInventoryStore()
+	collector := metrics.NewCollector(deploymentStore, inventoryStore, nil)
+
+	deploymentStore.Save(context.Background(), &deployment.DeploymentRecord{
+		ID:       "1",
+		Status:   deployment.Running,
+		Progress: deployment.DeploymentProgress{TotalMatchingInstances: 3, InProgressInstances: 2},
+	})
+	deploymentStore.Save(context.Background(), &deployment.DeploymentRecord{ID: "0", Status: deployment.Completed})
+
+	inventoryStore.Save(context.Background(), &inventory.Instance{
+		ID:           "i-1",
+		Name:         "web-1",
+		Status:       inventory.HEALTHY,
+		LastPing:     time.Now().Add(-10 * time.Second),
+		CurrentState: inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"},
+	})
+	inventoryStore.Save(context.Background(), &inventory.Instance{
+		ID:           "i-2",
+		Name:         "web-2",
+		Status:       inventory.FAILED,
+		LastPing:     time.Now().Add(-10 * time.Minute),
+		CurrentState: inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"},
+	})
+	inventoryStore.Save(context.Background(), &inventory.Instance{ID: "i-3", Name: "web-3"})
+
+	assertMetrics(t, scrape(t, collector),
+		`dides_deployments{status="running"} 1`,
+		`dides_deployments{status="completed"} 1`,
+		`dides_deployments{status="failed"} 0`,
+		`dides_deployment_progress_instances{deployment_id="1",state="total"} 3`,
+		`dides_deployment_progress_instances{deployment_id="1",state="in_progress"} 2`,
+		`dides_instances{status="healthy"} 1`,
+		`dides_instances{status="failed"} 1`,
+		`dides_instances{status="unknown"} 1`,
+		`dides_instances_by_version{code_version="v1",configuration_version="c1"} 2`,
+		`dides_instances_by_version{code_version="",configuration_version=""} 1`,
+		`dides_instance_heartbeat_age_seconds_bucket{le="15"} 1`,
+		`dides_instance_heartbeat_age_seconds_bucket{le="600"} 1`,
+		`dides_instance_heartbeat_age_seconds_bucket{le="1800"} 2`,
+		`dides_instance_heartbeat_age_seconds_count 2`,
+	)
+}
+
+func TestCollector_Publish(t *testing.T) {
+	collector := metrics.NewCollector(inmemory.NewDeploymentStore(nil), inmemory.NewInventoryStore(), nil)
+
+	start := time.Now()
+	collector.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventStarted, Time: start})
+	collector.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventBatchStarted, Time: start, Instances: []string{"i-1", "i-2"}})
+	collector.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventInstanceCompleted, Time: start.Add(time.Second), Instances: []string{"i-1"}})
+	collector.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventInstanceFailed, Time: start.Add(3 * time.Second), Instances: []string{"i-2"}})
+
+	// The second batch never finishes, the deployment is rolled back
+	collector.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventBatchStarted, Time: start, Instances: []string{"i-3"}})
+	collector.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventRollback, Time: start, RollbackID: "2"})
+	collector.Publish(deployment.Event{DeploymentID: "1", Type: deployment.EventFailed, Time: start, Status: deployment.Failed})
+	collector.Publish(deployment.Event{DeploymentID: "2", Type: deployment.EventStarted, Time: start})
+
+	assertMetrics(t, scrape(t, collector),
+		`dides_deployments_started_total 2`,
+		`dides_deployments_finished_total{status="failed"} 1`,
+		`dides_deployment_auto_rollbacks_total 1`,
+		`dides_deployment_batch_duration_seconds_sum 3`,
+		`dides_deployment_batch_duration_seconds_count 1`,
+	)
+}
+
+func TestCollector_Middleware(t *testing.T) {
+	collector := metrics.NewCollector(inmemory.NewDeploymentStore(nil), inmemory.NewInventoryStore(), nil)
+
+	// The metrics are registered before the recoverer, as in cmd/controller, so a panic is measured as a 500
+	r := chi.NewRouter()
+	r.Use(collector.Middleware)
+	r.Use(middleware.Recoverer)
+	r.Get("/deploy/{deploymentID}/events", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	r.Post("/deploy/progress", func(w http.ResponseWriter, r *http.Request) {
+		panic("progress failed")
+	})
+
+	for _, id := range []string{"1", "2"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/deploy/"+id+"/events", nil))
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/deploy/progress", nil))
+
+	// The route pattern keeps one series for every deployment ID
+	assertMetrics(t, scrape(t, collector),
+		`dides_http_request_duration_seconds_count{code="404",method="GET",route="/deploy/{deploymentID}/events"} 2`,
+		`dides_http_request_duration_seconds_count{code="500",method="POST",route="/deploy/progress"} 1`,
+	)
+}
@@ -0,0 +1,221 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xnok/dides/internal/clock"
+)
+
+const (
+	// CAValidity is the lifetime of the generated certificate authority
+	CAValidity = 365 * 24 * time.Hour
+	// CertificateValidity is the lifetime of the certificates signed by the authority
+	CertificateValidity = 30 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidCSR = errors.New("invalid certificate signing request")
+)
+
+// CA is a small certificate authority signing the client certificates of the instances
+// and the server certificate of the controller
+type CA struct {
+	cert  *x509.Certificate
+	key   *ecdsa.PrivateKey
+	clock clock.Clock
+}
+
+// NewCA generates a self-signed certificate authority, the certificates are valid from the time of clk, the wall clock when nil
+func NewCA(commonName string, clk clock.Clock) (*CA, error) {
+	clk = clock.OrReal(clk)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := clk.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CA{cert: cert, key: key, clock: clk}, nil
+}
+
+// CertificatePEM returns the PEM encoded certificate of the authority, clients need it to trust the controller
+func (ca *CA) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+}
+
+// Pool returns a pool containing the authority, used to verify the certificates it signed
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// SignInstanceCertificate signs a client certificate bound to the instance ID and labels
+// The ID is the common name and each label is an organizational unit in the key=value form
+func (ca *CA) SignInstanceCertificate(csr *x509.CertificateRequest, instanceID string, labels map[string]string) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+	}
+
+	units := make([]string, 0, len(labels))
+	for key, value := range labels {
+		units = append(units, key+"="+value)
+	}
+	sort.Strings(units)
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: instanceID, OrganizationalUnit: units},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	return ca.sign(template, csr.PublicKey)
+}
+
+// ServerCertificate issues the TLS certificate of the controller for the given host names and IPs
+func (ca *CA) ServerCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "dides-controller"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	cert, err := ca.sign(template, &key.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw, ca.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, nil
+}
+
+// sign completes the template with a serial and validity period and signs it with the authority key
+func (ca *CA) sign(template *x509.Certificate, publicKey any) (*x509.Certificate, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := ca.clock.Now()
+	template.SerialNumber = serial
+	template.NotBefore = now.Add(-time.Minute)
+	template.NotAfter = now.Add(CertificateValidity)
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, publicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// ParseCSR decodes a PEM encoded certificate signing request and checks its signature
+func ParseCSR(csrPEM string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, ErrInvalidCSR
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCSR, err)
+	}
+	return csr, nil
+}
+
+// NewCSR generates a private key and a PEM encoded certificate signing request, as an agent would
+func NewCSR(commonName string) (*ecdsa.PrivateKey, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// EncodeCertificate returns the PEM form of a certificate
+func EncodeCertificate(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+// Labels returns the labels a certificate signed by SignInstanceCertificate is bound to
+func Labels(cert *x509.Certificate) map[string]string {
+	labels := make(map[string]string, len(cert.Subject.OrganizationalUnit))
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if key, value, found := strings.Cut(unit, "="); found {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// Serial returns the serial number of a certificate in the form kept by the inventory
+func Serial(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
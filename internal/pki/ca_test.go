@@ -0,0 +1,70 @@
+package pki
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+func TestCA_SignInstanceCertificate(t *testing.T) {
+	ca, err := NewCA("test-ca", nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, csrPEM, err := NewCSR("web-1")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	csr, err := ParseCSR(csrPEM)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	cert, err := ca.SignInstanceCertificate(csr, "i-123", map[string]string{"role": "web", "env": "prod"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The certificate is bound to the instance ID, not the name requested by the agent
+	if cert.Subject.CommonName != "i-123" {
+		t.Errorf("Expected common name i-123, got %s", cert.Subject.CommonName)
+	}
+
+	labels := Labels(cert)
+	if len(labels) != 2 || labels["env"] != "prod" || labels["role"] != "web" {
+		t.Errorf("Expected labels env=prod,role=web, got %v", labels)
+	}
+
+	// The certificate is a client certificate trusted by the authority
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     ca.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		t.Errorf("Expected certificate to be verified by the authority, got %v", err)
+	}
+
+	// Another authority does not trust it
+	other, _ := NewCA("other-ca", nil)
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     other.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err == nil {
+		t.Error("Expected certificate not to be verified by another authority")
+	}
+}
+
+func TestParseCSR_Invalid(t *testing.T) {
+	for _, csrPEM := range []string{
+		"",
+		"not a pem",
+		"-----BEGIN CERTIFICATE REQUEST-----\nAAAA\n-----END CERTIFICATE REQUEST-----\n",
+	} {
+		if _, err := ParseCSR(csrPEM); !errors.Is(err, ErrInvalidCSR) {
+			t.Errorf("Expected ErrInvalidCSR for %q, got %v", csrPEM, err)
+		}
+	}
+}
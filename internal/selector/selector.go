@@ -0,0 +1,403 @@
+package selector
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidSelector = errors.New("invalid label selector")
+
+	setRequirementRegex = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+)
+
+// Operator is the relation a requirement checks between a label and its values
+type Operator string
+
+const (
+	Equals       Operator = "="
+	NotEquals    Operator = "!="
+	In           Operator = "in"
+	NotIn        Operator = "notin"
+	Exists       Operator = "exists"
+	DoesNotExist Operator = "!"
+)
+
+// Requirement is a single condition on a label
+type Requirement struct {
+	Key      string
+	Operator Operator
+	// Values is a single value for Equals/NotEquals, a set for In/NotIn and empty for Exists/DoesNotExist
+	Values []string
+}
+
+// Selector matches the label sets satisfying all of its requirements
+// An empty selector matches everything
+type Selector []Requirement
+
+// FromLabels creates a selector requiring every label to be equal to the given value
+// The labels are not validated, the selector of labels Parse would reject has no string form, Build rejects them
+func FromLabels(labels map[string]string) Selector {
+	selector := make(Selector, 0, len(labels))
+	for key, value := range labels {
+		selector = append(selector, Requirement{Key: key, Operator: Equals, Values: []string{value}})
+	}
+	selector.sort()
+	return selector
+}
+
+// Parse creates a selector from its string form, e.g. "env=prod,zone in (a,b),!canary"
+func Parse(s string) (Selector, error) {
+	selector := Selector{}
+	for _, term := range splitTerms(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		requirement, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, requirement)
+	}
+	selector.sort()
+	return selector, nil
+}
+
+// Build creates a selector from equality labels and an optional string form
+// The labels are validated as in the string form, so the selector can be parsed back from its string form
+func Build(labels map[string]string, s string) (Selector, error) {
+	parsed, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range labels {
+		if _, err := newRequirement(key, Equals, []string{value}, key+"="+value); err != nil {
+			return nil, err
+		}
+	}
+
+	selector := append(FromLabels(labels), parsed...)
+	selector.sort()
+	return selector, nil
+}
+
+// Empty reports whether the selector has no requirement and matches everything
+func (s Selector) Empty() bool {
+	return len(s) == 0
+}
+
+// Matches checks if the labels satisfy all requirements of the selector
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		if !requirement.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches checks if the labels satisfy the requirement
+// As with Kubernetes selectors, != and notin also match when the label is missing
+func (r Requirement) Matches(labels map[string]string) bool {
+	value, exists := labels[r.Key]
+	switch r.Operator {
+	case Equals, In:
+		return exists && contains(r.Values, value)
+	case NotEquals, NotIn:
+		return !exists || !contains(r.Values, value)
+	case Exists:
+		return exists
+	case DoesNotExist:
+		return !exists
+	}
+	return false
+}
+
+// String returns the string form of the selector, it can be parsed back with Parse
+func (s Selector) String() string {
+	terms := make([]string, 0, len(s))
+	for _, requirement := range s {
+		terms = append(terms, requirement.String())
+	}
+	return strings.Join(terms, ",")
+}
+
+// Key returns a form of the selector identifying it, two selectors have the same key only when they have the same requirements
+// Unlike String, it is unambiguous for the selectors of any labels created with FromLabels
+func (s Selector) Key() string {
+	var b strings.Builder
+	for _, requirement := range s {
+		b.WriteString(strconv.Quote(requirement.Key))
+		b.WriteString(string(requirement.Operator))
+		for _, value := range requirement.Values {
+			b.WriteString(strconv.Quote(value))
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// String returns the string form of the requirement
+func (r Requirement) String() string {
+	switch r.Operator {
+	case Equals, NotEquals:
+		return r.Key + string(r.Operator) + strings.Join(r.Values, "")
+	case In, NotIn:
+		return fmt.Sprintf("%s %s (%s)", r.Key, r.Operator, strings.Join(r.Values, ","))
+	case Exists:
+		return r.Key
+	case DoesNotExist:
+		return "!" + r.Key
+	}
+	return ""
+}
+
+// Overlaps checks if at least one label set can be matched by both selectors
+// Two deployments with overlapping selectors may target the same instances
+func (s Selector) Overlaps(other Selector) bool {
+	return append(append(Selector{}, s...), other...).satisfiable()
+}
+
+// Implies checks if every label set matched by the selector is also matched by the other selector
+// A deployment whose selector implies another one only targets instances of the other deployment
+func (s Selector) Implies(other Selector) bool {
+	domains := s.domains()
+	for _, d := range domains {
+		if !d.satisfiable() {
+			// Nothing is matched, the implication holds for every selector
+			return true
+		}
+	}
+
+	for _, requirement := range other {
+		d, ok := domains[requirement.Key]
+		if !ok {
+			d = newDomain()
+		}
+		if !d.implies(requirement) {
+			return false
+		}
+	}
+	return true
+}
+
+// satisfiable checks if at least one label set matches the selector
+func (s Selector) satisfiable() bool {
+	for _, d := range s.domains() {
+		if !d.satisfiable() {
+			return false
+		}
+	}
+	return true
+}
+
+// domains returns the values each label key may take to satisfy the selector
+func (s Selector) domains() map[string]*domain {
+	domains := make(map[string]*domain)
+	for _, requirement := range s {
+		d, ok := domains[requirement.Key]
+		if !ok {
+			d = newDomain()
+			domains[requirement.Key] = d
+		}
+		d.restrict(requirement)
+	}
+	return domains
+}
+
+func (s Selector) sort() {
+	sort.SliceStable(s, func(i, j int) bool {
+		if s[i].Key != s[j].Key {
+			return s[i].Key < s[j].Key
+		}
+		return s[i].Operator < s[j].Operator
+	})
+}
+
+// domain describes the values a label may take
+type domain struct {
+	// absent is true when the label may be missing
+	absent bool
+	// present is true when the label may be set
+	present bool
+	// allowed restricts the values when not nil
+	allowed map[string]bool
+	// excluded values are never allowed
+	excluded map[string]bool
+}
+
+func newDomain() *domain {
+	return &domain{
+		absent:   true,
+		present:  true,
+		excluded: make(map[string]bool),
+	}
+}
+
+// restrict narrows the domain to the values satisfying the requirement
+func (d *domain) restrict(r Requirement) {
+	switch r.Operator {
+	case Equals, In:
+		d.absent = false
+		allowed := make(map[string]bool)
+		for _, value := range r.Values {
+			if d.allowed == nil || d.allowed[value] {
+				allowed[value] = true
+			}
+		}
+		d.allowed = allowed
+	case NotEquals, NotIn:
+		for _, value := range r.Values {
+			d.excluded[value] = true
+		}
+	case Exists:
+		d.absent = false
+	case DoesNotExist:
+		d.present = false
+	}
+
+	// The label cannot be set when every allowed value is excluded
+	if d.allowed != nil && len(d.values()) == 0 {
+		d.present = false
+	}
+}
+
+// values returns the allowed values that are not excluded, only meaningful when allowed is not nil
+func (d *domain) values() []string {
+	var values []string
+	for value := range d.allowed {
+		if !d.excluded[value] {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (d *domain) satisfiable() bool {
+	return d.absent || d.present
+}
+
+// implies checks if every value of the domain satisfies the requirement
+func (d *domain) implies(r Requirement) bool {
+	switch r.Operator {
+	case Equals, In:
+		if d.absent || d.allowed == nil {
+			return false
+		}
+		for _, value := range d.values() {
+			if !contains(r.Values, value) {
+				return false
+			}
+		}
+		return true
+	case NotEquals, NotIn:
+		if !d.present {
+			return true
+		}
+		if d.allowed != nil {
+			for _, value := range d.values() {
+				if contains(r.Values, value) {
+					return false
+				}
+			}
+			return true
+		}
+		for _, value := range r.Values {
+			if !d.excluded[value] {
+				return false
+			}
+		}
+		return true
+	case Exists:
+		return !d.absent
+	case DoesNotExist:
+		return !d.present
+	}
+	return false
+}
+
+// parseRequirement parses a single term of the selector string form
+func parseRequirement(term string) (Requirement, error) {
+	if match := setRequirementRegex.FindStringSubmatch(term); match != nil {
+		values := []string{}
+		for _, value := range strings.Split(match[3], ",") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				return Requirement{}, fmt.Errorf("%w: empty value in %q", ErrInvalidSelector, term)
+			}
+			values = append(values, value)
+		}
+		return newRequirement(match[1], Operator(match[2]), values, term)
+	}
+
+	if strings.HasPrefix(term, "!") && !strings.Contains(term, "=") {
+		return newRequirement(strings.TrimSpace(term[1:]), DoesNotExist, nil, term)
+	}
+
+	for _, op := range []string{"!=", "==", "="} {
+		if key, value, found := strings.Cut(term, op); found {
+			operator := Equals
+			if op == "!=" {
+				operator = NotEquals
+			}
+			return newRequirement(strings.TrimSpace(key), operator, []string{strings.TrimSpace(value)}, term)
+		}
+	}
+
+	return newRequirement(term, Exists, nil, term)
+}
+
+// newRequirement validates the key and values of a requirement
+func newRequirement(key string, operator Operator, values []string, term string) (Requirement, error) {
+	if key == "" || strings.ContainsAny(key, " \t,()!=") {
+		return Requirement{}, fmt.Errorf("%w: invalid key in %q", ErrInvalidSelector, term)
+	}
+
+	for _, value := range values {
+		if strings.ContainsAny(value, " \t,()!=") {
+			return Requirement{}, fmt.Errorf("%w: invalid value in %q", ErrInvalidSelector, term)
+		}
+	}
+
+	if (operator == Equals || operator == NotEquals) && values[0] == "" {
+		return Requirement{}, fmt.Errorf("%w: missing value in %q", ErrInvalidSelector, term)
+	}
+
+	return Requirement{Key: key, Operator: operator, Values: values}, nil
+}
+
+// splitTerms splits the selector string form on the commas that are not inside parentheses
+func splitTerms(s string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, s[start:])
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
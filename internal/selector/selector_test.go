@@ -0,0 +1,206 @@
+package selector
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	selector, err := Parse("env=prod,zone in (a, b),!canary,tier!=db,region notin (eu),team")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if len(selector) != 6 {
+		t.Fatalf("Expected 6 requirements, got %d", len(selector))
+	}
+
+	// Requirements are sorted by key
+	expected := "!canary,env=prod,region notin (eu),team,tier!=db,zone in (a,b)"
+	if selector.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, selector.String())
+	}
+
+	// The string form can be parsed back
+	reparsed, err := Parse(selector.String())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if reparsed.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, reparsed.String())
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, s := range []string{
+		"env=",
+		"zone in (a,b",
+		"zone in (a,,b)",
+		"=prod",
+		"my key=prod",
+	} {
+		if _, err := Parse(s); !errors.Is(err, ErrInvalidSelector) {
+			t.Errorf("Expected ErrInvalidSelector for %q, got %v", s, err)
+		}
+	}
+}
+
+func TestSelector_Matches(t *testing.T) {
+	labels := map[string]string{"env": "prod", "zone": "a", "role": "web"}
+
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"env=prod", true},
+		{"env==prod", true},
+		{"env=dev", false},
+		{"env!=dev", true},
+		{"zone in (a,b)", true},
+		{"zone in (b,c)", false},
+		{"zone notin (b,c)", true},
+		{"zone notin (a)", false},
+		{"role", true},
+		{"canary", false},
+		{"!canary", true},
+		{"!role", false},
+		// != and notin also match a missing label
+		{"canary!=true", true},
+		{"canary notin (true)", true},
+		{"env=prod,zone in (a,b),!canary", true},
+		{"env=prod,zone in (a,b),role!=web", false},
+	}
+
+	for _, tt := range tests {
+		selector, err := Parse(tt.selector)
+		if err != nil {
+			t.Fatalf("Expected no error for %q, got %v", tt.selector, err)
+		}
+		if selector.Matches(labels) != tt.matches {
+			t.Errorf("Expected %q matching %v to be %v", tt.selector, labels, tt.matches)
+		}
+	}
+}
+
+func TestFromLabels(t *testing.T) {
+	selector := FromLabels(map[string]string{"role": "web", "env": "prod"})
+
+	if selector.String() != "env=prod,role=web" {
+		t.Errorf("Expected env=prod,role=web, got %s", selector.String())
+	}
+
+	if !selector.Matches(map[string]string{"env": "prod", "role": "web", "zone": "a"}) {
+		t.Error("Expected selector to match a superset of its labels")
+	}
+
+	if selector.Matches(map[string]string{"env": "prod"}) {
+		t.Error("Expected selector not to match a subset of its labels")
+	}
+
+	if !FromLabels(nil).Empty() {
+		t.Error("Expected selector from no labels to be empty")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	selector, err := Build(map[string]string{"env": "prod"}, "zone in (a,b)")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if selector.String() != "env=prod,zone in (a,b)" {
+		t.Errorf("Expected env=prod,zone in (a,b), got %s", selector.String())
+	}
+}
+
+func TestBuild_Invalid(t *testing.T) {
+	for _, labels := range []map[string]string{
+		{"env": ""},
+		{"env": "prod east"},
+		{"env": "prod,role=web"},
+		{"my key": "prod"},
+	} {
+		if _, err := Build(labels, ""); !errors.Is(err, ErrInvalidSelector) {
+			t.Errorf("Expected ErrInvalidSelector for %v, got %v", labels, err)
+		}
+	}
+}
+
+func TestSelector_Key(t *testing.T) {
+	// Both selectors have the same string form, not the same key
+	a := FromLabels(map[string]string{"env": "prod,role=web"})
+	b := FromLabels(map[string]string{"env": "prod", "role": "web"})
+	if a.String() != b.String() {
+		t.Fatalf("Expected the same string form, got %s and %s", a.String(), b.String())
+	}
+	if a.Key() == b.Key() {
+		t.Errorf("Expected different keys, got %s", a.Key())
+	}
+
+	parsed, _ := Parse("role=web,env=prod")
+	if parsed.Key() != b.Key() {
+		t.Errorf("Expected the same key for the same requirements, got %s and %s", parsed.Key(), b.Key())
+	}
+}
+
+func TestSelector_Overlaps(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		overlaps bool
+	}{
+		{"", "env=prod", true},
+		{"env=prod", "env=prod,role=web", true},
+		{"env=prod", "env=dev", false},
+		{"env=prod", "role=web", true},
+		{"zone in (a,b)", "zone in (b,c)", true},
+		{"zone in (a,b)", "zone in (c,d)", false},
+		{"zone in (a,b)", "zone notin (a,b)", false},
+		{"zone in (a,b)", "zone!=a", true},
+		{"canary", "!canary", false},
+		{"!canary", "canary!=true", true},
+		{"env=prod", "!env", false},
+	}
+
+	for _, tt := range tests {
+		a, _ := Parse(tt.a)
+		b, _ := Parse(tt.b)
+		if a.Overlaps(b) != tt.overlaps {
+			t.Errorf("Expected %q overlaps %q to be %v", tt.a, tt.b, tt.overlaps)
+		}
+		if b.Overlaps(a) != tt.overlaps {
+			t.Errorf("Expected %q overlaps %q to be %v", tt.b, tt.a, tt.overlaps)
+		}
+	}
+}
+
+func TestSelector_Implies(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		implies bool
+	}{
+		{"env=prod", "", true},
+		{"", "env=prod", false},
+		{"env=prod,role=web", "env=prod", true},
+		{"env=prod", "env=prod,role=web", false},
+		{"zone=a", "zone in (a,b)", true},
+		{"zone in (a,b)", "zone=a", false},
+		{"zone in (a,b),zone!=b", "zone=a", true},
+		{"zone=a", "zone notin (b,c)", true},
+		{"zone notin (b,c)", "zone!=b", true},
+		{"zone!=b", "zone notin (b,c)", false},
+		{"env=prod", "env", true},
+		{"!canary", "canary!=true", true},
+		{"canary!=true", "!canary", false},
+		// A selector matching nothing implies every selector
+		{"env=prod,env=dev", "role=web", true},
+	}
+
+	for _, tt := range tests {
+		a, _ := Parse(tt.a)
+		b, _ := Parse(tt.b)
+		if a.Implies(b) != tt.implies {
+			t.Errorf("Expected %q implies %q to be %v", tt.a, tt.b, tt.implies)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// stateAttributes returns the selector and the desired state of an inventory query
+func stateAttributes(sel selector.Selector, state inventory.State) trace.SpanStartOption {
+	return trace.WithAttributes(
+		deployment.AttributeLabels.String(sel.String()),
+		deployment.AttributeCodeVersion.String(state.CodeVersion),
+		deployment.AttributeConfigVersion.String(state.ConfigurationVersion),
+	)
+}
+
+// Store traces every method of a deployment store
+type Store struct {
+	next deployment.Store
+}
+
+// NewStore decorates the deployment store with spans
+func NewStore(next deployment.Store) *Store {
+	return &Store{next: next}
+}
+
+func (s *Store) Save(ctx context.Context, record *deployment.DeploymentRecord) (err error) {
+	ctx, span := start(ctx, "DeploymentStore.Save", trace.WithAttributes(deployment.RequestAttributes(&record.Request)...))
+	defer func() { deployment.EndSpan(span, err) }()
+
+	err = s.next.Save(ctx, record)
+	// The ID is assigned by the store
+	span.SetAttributes(deployment.RecordAttributes(record)...)
+	return err
+}
+
+func (s *Store) GetByStatus(ctx context.Context, status deployment.DeploymentStatus) (_ []*deployment.DeploymentRecord, err error) {
+	ctx, span := start(ctx, "DeploymentStore.GetByStatus", trace.WithAttributes(deployment.AttributeDeploymentStatus.Int(int(status))))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.GetByStatus(ctx, status)
+}
+
+func (s *Store) Update(ctx context.Context, record *deployment.DeploymentRecord) (err error) {
+	ctx, span := start(ctx, "DeploymentStore.Update", trace.WithAttributes(deployment.RecordAttributes(record)...))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.Update(ctx, record)
+}
+
+func (s *Store) GetByID(ctx context.Context, id string) (_ *deployment.DeploymentRecord, err error) {
+	ctx, span := start(ctx, "DeploymentStore.GetByID", trace.WithAttributes(deployment.AttributeDeploymentID.String(id)))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.GetByID(ctx, id)
+}
+
+func (s *Store) GetByLabelsAndStatus(ctx context.Context, sel selector.Selector, status deployment.DeploymentStatus) (_ []*deployment.DeploymentRecord, err error) {
+	ctx, span := start(ctx, "DeploymentStore.GetByLabelsAndStatus", trace.WithAttributes(
+		deployment.AttributeLabels.String(sel.String()),
+		deployment.AttributeDeploymentStatus.Int(int(status)),
+	))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.GetByLabelsAndStatus(ctx, sel, status)
+}
+
+func (s *Store) GetOverlappingByStatus(ctx context.Context, sel selector.Selector, status deployment.DeploymentStatus) (_ []*deployment.DeploymentRecord, err error) {
+	ctx, span := start(ctx, "DeploymentStore.GetOverlappingByStatus", trace.WithAttributes(
+		deployment.AttributeLabels.String(sel.String()),
+		deployment.AttributeDeploymentStatus.Int(int(status)),
+	))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.GetOverlappingByStatus(ctx, sel, status)
+}
+
+// Locker traces the lock acquisitions and releases, the Lock span measures the wait for the lock
+type Locker struct {
+	next deployment.Locker
+}
+
+// NewLocker decorates the locker with spans
+func NewLocker(next deployment.Locker) *Locker {
+	return &Locker{next: next}
+}
+
+func (l *Locker) Lock(ctx context.Context, key string) (err error) {
+	ctx, span := start(ctx, "Locker.Lock", trace.WithAttributes(attribute.String("dides.lock.key", key)))
+	defer func() { deployment.EndSpan(span, err) }()
+	return l.next.Lock(ctx, key)
+}
+
+func (l *Locker) Unlock(ctx context.Context, key string) (err error) {
+	ctx, span := start(ctx, "Locker.Unlock", trace.WithAttributes(attribute.String("dides.lock.key", key)))
+	defer func() { deployment.EndSpan(span, err) }()
+	return l.next.Unlock(ctx, key)
+}
+
+// Strategy traces every call to a deployment strategy
+type Strategy struct {
+	next deployment.DeploymentStrategy
+}
+
+// NewStrategy decorates the deployment strategy with spans
+func NewStrategy(next deployment.DeploymentStrategy) *Strategy {
+	return &Strategy{next: next}
+}
+
+func (s *Strategy) StartDeployment(ctx context.Context, record *deployment.DeploymentRecord) (err error) {
+	ctx, span := start(ctx, "DeploymentStrategy.StartDeployment", trace.WithAttributes(deployment.RecordAttributes(record)...))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.StartDeployment(ctx, record)
+}
+
+func (s *Strategy) ProgressDeployment(ctx context.Context, record *deployment.DeploymentRecord) (_ *deployment.DeploymentRecord, err error) {
+	ctx, span := start(ctx, "DeploymentStrategy.ProgressDeployment", trace.WithAttributes(deployment.RecordAttributes(record)...))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.ProgressDeployment(ctx, record)
+}
+
+func (s *Strategy) PlanDeployment(ctx context.Context, req *deployment.DeploymentRequest) (_ *deployment.DeploymentPlan, err error) {
+	ctx, span := start(ctx, "DeploymentStrategy.PlanDeployment", trace.WithAttributes(deployment.RequestAttributes(req)...))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.PlanDeployment(ctx, req)
+}
+
+func (s *Strategy) ResetFailedInstances(ctx context.Context, sel selector.Selector) (err error) {
+	ctx, span := start(ctx, "DeploymentStrategy.ResetFailedInstances", trace.WithAttributes(deployment.AttributeLabels.String(sel.String())))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.ResetFailedInstances(ctx, sel)
+}
+
+func (s *Strategy) ResolvePreviousStates(ctx context.Context, sel selector.Selector, from inventory.State) (_ map[string]inventory.State, err error) {
+	ctx, span := start(ctx, "DeploymentStrategy.ResolvePreviousStates", stateAttributes(sel, from))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.ResolvePreviousStates(ctx, sel, from)
+}
+
+// Inventory traces the inventory queries and updates made by the deployment strategies
+type Inventory struct {
+	next deployment.InventoryService
+}
+
+// NewInventory decorates the inventory service used by the strategies with spans
+func NewInventory(next deployment.InventoryService) *Inventory {
+	return &Inventory{next: next}
+}
+
+func (i *Inventory) GetInstancesByLabels(ctx context.Context, sel selector.Selector) (_ []*inventory.Instance, err error) {
+	ctx, span := start(ctx, "InventoryService.GetInstancesByLabels", trace.WithAttributes(deployment.AttributeLabels.String(sel.String())))
+	defer func() { deployment.EndSpan(span, err) }()
+	return i.next.GetInstancesByLabels(ctx, sel)
+}
+
+func (i *Inventory) GetInstances(ctx context.Context, keys []string) (_ []*inventory.Instance, err error) {
+	ctx, span := start(ctx, "InventoryService.GetInstances", trace.WithAttributes(attribute.Int("dides.instance.count", len(keys))))
+	defer func() { deployment.EndSpan(span, err) }()
+	return i.next.GetInstances(ctx, keys)
+}
+
+func (i *Inventory) UpdateDesiredStates(ctx context.Context, states map[string]inventory.State, revisions map[string]int64) (err error) {
+	ctx, span := start(ctx, "InventoryService.UpdateDesiredStates", trace.WithAttributes(attribute.Int("dides.instance.count", len(states))))
+	defer func() { deployment.EndSpan(span, err) }()
+	return i.next.UpdateDesiredStates(ctx, states, revisions)
+}
+
+func (i *Inventory) CountByLabels(ctx context.Context, sel selector.Selector) (_ int, err error) {
+	ctx, span := start(ctx, "InventoryService.CountByLabels", trace.WithAttributes(deployment.AttributeLabels.String(sel.String())))
+	defer func() { deployment.EndSpan(span, err) }()
+	return i.next.CountByLabels(ctx, sel)
+}
+
+func (i *Inventory) GetNeedingUpdate(ctx context.Context, sel selector.Selector, desiredState inventory.State, opts *inventory.GetNeedingUpdateOptions) (_ []*inventory.Instance, err error) {
+	ctx, span := start(ctx, "InventoryService.GetNeedingUpdate", stateAttributes(sel, desiredState))
+	defer func() { deployment.EndSpan(span, err) }()
+	return i.next.GetNeedingUpdate(ctx, sel, desiredState, opts)
+}
+
+func (i *Inventory) CountProgress(ctx context.Context, sel selector.Selector, desiredState inventory.State, targets map[string]inventory.State) (_ inventory.Progress, err error) {
+	ctx, span := start(ctx, "InventoryService.CountProgress", stateAttributes(sel, desiredState))
+	defer func() { deployment.EndSpan(span, err) }()
+	return i.next.CountProgress(ctx, sel, desiredState, targets)
+}
+
+func (i *Inventory) ResetFailedInstances(ctx context.Context, sel selector.Selector) (err error) {
+	ctx, span := start(ctx, "InventoryService.ResetFailedInstances", trace.WithAttributes(deployment.AttributeLabels.String(sel.String())))
+	defer func() { deployment.EndSpan(span, err) }()
+	return i.next.ResetFailedInstances(ctx, sel)
+}
@@ -0,0 +1,132 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attributeInstanceKey is the key of the instance read or written by the inventory store
+const attributeInstanceKey = attribute.Key("dides.instance.key")
+
+// InventoryStore traces every method of an inventory store
+// The writes are children of the span in their context, the queries take no context and start a trace of their own
+type InventoryStore struct {
+	next inventory.Store
+}
+
+// NewInventoryStore decorates the inventory store with spans
+func NewInventoryStore(next inventory.Store) *InventoryStore {
+	return &InventoryStore{next: next}
+}
+
+// selectorAttributes returns the label selector of an inventory query
+func selectorAttributes(sel selector.Selector) trace.SpanStartOption {
+	return trace.WithAttributes(deployment.AttributeLabels.String(sel.String()))
+}
+
+func (s *InventoryStore) Save(ctx context.Context, instance *inventory.Instance) (err error) {
+	ctx, span := start(ctx, "InventoryStore.Save", trace.WithAttributes(attributeInstanceKey.String(instance.Key())))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.Save(ctx, instance)
+}
+
+func (s *InventoryStore) Update(ctx context.Context, key string, patch inventory.InstancePatch) (_ *inventory.Instance, err error) {
+	ctx, span := start(ctx, "InventoryStore.Update", trace.WithAttributes(attributeInstanceKey.String(key)))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.Update(ctx, key, patch)
+}
+
+func (s *InventoryStore) UpdateDesiredStates(ctx context.Context, states map[string]inventory.State, revisions map[string]int64) (err error) {
+	ctx, span := start(ctx, "InventoryStore.UpdateDesiredStates", trace.WithAttributes(attribute.Int("dides.instance.count", len(states))))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.UpdateDesiredStates(ctx, states, revisions)
+}
+
+func (s *InventoryStore) Get(key string) (*inventory.Instance, bool) {
+	_, span := start(context.Background(), "InventoryStore.Get", trace.WithAttributes(attributeInstanceKey.String(key)))
+	defer span.End()
+	return s.next.Get(key)
+}
+
+func (s *InventoryStore) Delete(ctx context.Context, key string) bool {
+	ctx, span := start(ctx, "InventoryStore.Delete", trace.WithAttributes(attributeInstanceKey.String(key)))
+	defer span.End()
+	return s.next.Delete(ctx, key)
+}
+
+func (s *InventoryStore) GetAll() []*inventory.Instance {
+	_, span := start(context.Background(), "InventoryStore.GetAll")
+	defer span.End()
+	return s.next.GetAll()
+}
+
+func (s *InventoryStore) GetByName(name string) (*inventory.Instance, bool) {
+	_, span := start(context.Background(), "InventoryStore.GetByName", trace.WithAttributes(attribute.String("dides.instance.name", name)))
+	defer span.End()
+	return s.next.GetByName(name)
+}
+
+func (s *InventoryStore) GetByIP(ip string) (*inventory.Instance, bool) {
+	_, span := start(context.Background(), "InventoryStore.GetByIP", trace.WithAttributes(attribute.String("dides.instance.ip", ip)))
+	defer span.End()
+	return s.next.GetByIP(ip)
+}
+
+func (s *InventoryStore) GetByLabels(sel selector.Selector) []*inventory.Instance {
+	_, span := start(context.Background(), "InventoryStore.GetByLabels", selectorAttributes(sel))
+	defer span.End()
+	return s.next.GetByLabels(sel)
+}
+
+func (s *InventoryStore) CountByLabels(sel selector.Selector) (_ int, err error) {
+	_, span := start(context.Background(), "InventoryStore.CountByLabels", selectorAttributes(sel))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.CountByLabels(sel)
+}
+
+func (s *InventoryStore) GetNeedingUpdate(sel selector.Selector, desiredState inventory.State, opts *inventory.GetNeedingUpdateOptions) (_ []*inventory.Instance, err error) {
+	_, span := start(context.Background(), "InventoryStore.GetNeedingUpdate", stateAttributes(sel, desiredState))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.GetNeedingUpdate(sel, desiredState, opts)
+}
+
+func (s *InventoryStore) CountNeedingUpdate(sel selector.Selector, desiredState inventory.State) (_ int, err error) {
+	_, span := start(context.Background(), "InventoryStore.CountNeedingUpdate", stateAttributes(sel, desiredState))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.CountNeedingUpdate(sel, desiredState)
+}
+
+func (s *InventoryStore) CountInProgress(sel selector.Selector, desiredState inventory.State) (_ int, err error) {
+	_, span := start(context.Background(), "InventoryStore.CountInProgress", stateAttributes(sel, desiredState))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.CountInProgress(sel, desiredState)
+}
+
+func (s *InventoryStore) CountCompleted(sel selector.Selector, desiredState inventory.State) (_ int, err error) {
+	_, span := start(context.Background(), "InventoryStore.CountCompleted", stateAttributes(sel, desiredState))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.CountCompleted(sel, desiredState)
+}
+
+func (s *InventoryStore) CountFailed(sel selector.Selector, desiredState inventory.State) (_ int, err error) {
+	_, span := start(context.Background(), "InventoryStore.CountFailed", stateAttributes(sel, desiredState))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.CountFailed(sel, desiredState)
+}
+
+func (s *InventoryStore) CountProgress(sel selector.Selector, desiredState inventory.State, opts *inventory.ProgressOptions) (_ inventory.Progress, err error) {
+	_, span := start(context.Background(), "InventoryStore.CountProgress", stateAttributes(sel, desiredState))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.CountProgress(sel, desiredState, opts)
+}
+
+func (s *InventoryStore) ResetFailedInstances(ctx context.Context, sel selector.Selector) (err error) {
+	ctx, span := start(ctx, "InventoryStore.ResetFailedInstances", selectorAttributes(sel))
+	defer func() { deployment.EndSpan(span, err) }()
+	return s.next.ResetFailedInstances(ctx, sel)
+}
@@ -0,0 +1,186 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/xnok/dides/internal/deployment"
+	inmemory "github.com/xnok/dides/internal/infra/in-memory"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recorder receives the spans of every test, the global tracers keep the first registered provider
+var recorder = tracetest.NewSpanRecorder()
+
+func init() {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// spansOf returns the ended spans of the trace by name
+func spansOf(traceID trace.TraceID) map[string]sdktrace.ReadOnlySpan {
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+	return spans
+}
+
+func attributeOf(span sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracing_TriggerDeployment(t *testing.T) {
+	inventoryStore := inmemory.NewInventoryStore()
+	inventoryStore.Save(context.Background(), &inventory.Instance{ID: "i-1", Name: "web-1", Labels: map[string]string{"env": "prod"}})
+	inventoryStore.Save(context.Background(), &inventory.Instance{ID: "i-2", Name: "web-2", Labels: map[string]string{"env": "prod"}})
+
+	store := tracing.NewStore(inmemory.NewDeploymentStore(nil))
+	strategy := deployment.NewRollingDeployment(store, tracing.NewInventory(inventory.NewStateService(inventoryStore, nil, nil)), nil)
+	service := deployment.NewTriggerService(store, tracing.NewLocker(inmemory.NewInMemoryLocker()), tracing.NewStrategy(strategy), nil, nil, nil)
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	err := service.TriggerDeployment(ctx, &deployment.DeploymentRequest{
+		CodeVersion:          "v2",
+		ConfigurationVersion: "c2",
+		Labels:               map[string]string{"env": "prod"},
+		Configuration:        deployment.Configuration{BatchSize: 1, FailureThreshold: 1},
+	})
+	root.End()
+	if err != nil {
+		t.Fatalf("Failed to trigger the deployment: %v", err)
+	}
+
+	spans := spansOf(root.SpanContext().TraceID())
+	trigger, ok := spans["TriggerService.TriggerDeployment"]
+	if !ok {
+		t.Fatalf("Expected a TriggerService span, got %v", spans)
+	}
+	if trigger.Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Errorf("Expected the TriggerService span to be a child of the caller span")
+	}
+	if value, _ := attributeOf(trigger, deployment.AttributeLabels); value.AsString() != "env=prod" {
+		t.Errorf("Expected the labels attribute env=prod, got %q", value.AsString())
+	}
+	if value, _ := attributeOf(trigger, deployment.AttributeDeploymentID); value.AsString() == "" {
+		t.Errorf("Expected the deployment ID attribute once the deployment is saved")
+	}
+
+	// The lock, store, strategy and inventory calls are children of the trigger span
+	for _, name := range []string{
+		"Locker.Lock",
+		"Locker.Unlock",
+		"DeploymentStore.GetByStatus",
+		"DeploymentStore.Save",
+		"DeploymentStrategy.StartDeployment",
+	} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != trigger.SpanContext().SpanID() {
+			t.Errorf("Expected the %s span to be a child of the trigger span", name)
+		}
+	}
+
+	start := spans["DeploymentStrategy.StartDeployment"]
+	for _, name := range []string{"InventoryService.GetNeedingUpdate", "InventoryService.UpdateDesiredStates", "DeploymentStore.Update"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != start.SpanContext().SpanID() {
+			t.Errorf("Expected the %s span to be a child of the strategy span", name)
+		}
+	}
+}
+
+func TestTracing_InventoryStore(t *testing.T) {
+	store := tracing.NewInventoryStore(inmemory.NewInventoryStore())
+	service := inventory.NewUpdateService(store, nil, nil)
+	store.Save(context.Background(), &inventory.Instance{ID: "i-1", Name: "web-1"})
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	healthy := inventory.HEALTHY
+	_, err := service.UpdateInstance(ctx, "i-1", inventory.UpdateRequest{Updates: inventory.InstancePatch{Status: &healthy}})
+	root.End()
+	if err != nil {
+		t.Fatalf("Failed to update the instance: %v", err)
+	}
+
+	// The write is a child of the caller span, with the key of the instance
+	update, ok := spansOf(root.SpanContext().TraceID())["InventoryStore.Update"]
+	if !ok {
+		t.Fatalf("Expected an InventoryStore.Update span, got %v", spansOf(root.SpanContext().TraceID()))
+	}
+	if update.Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Errorf("Expected the InventoryStore.Update span to be a child of the caller span")
+	}
+	if value, _ := attributeOf(update, "dides.instance.key"); value.AsString() != "i-1" {
+		t.Errorf("Expected the instance key attribute i-1, got %q", value.AsString())
+	}
+
+	// The read takes no context, it is traced on its own
+	found := false
+	for _, span := range recorder.Ended() {
+		if span.Name() == "InventoryStore.Get" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected an InventoryStore.Get span")
+	}
+}
+
+func TestTracing_Middleware(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(tracing.Middleware)
+	r.Get("/deploy/{deploymentID}/events", func(w http.ResponseWriter, r *http.Request) {
+		if !trace.SpanContextFromContext(r.Context()).IsValid() {
+			t.Errorf("Expected the handler context to carry the request span")
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	// The request continues the trace of the caller
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	req := httptest.NewRequest(http.MethodGet, "/deploy/1/events", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	span, ok := spansOf(traceID)["GET /deploy/{deploymentID}/events"]
+	if !ok {
+		t.Fatalf("Expected a span named after the route, got %v", spansOf(traceID))
+	}
+	if span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("Expected a server span, got %v", span.SpanKind())
+	}
+	if value, _ := attributeOf(span, "http.response.status_code"); value.AsInt64() != http.StatusNotFound {
+		t.Errorf("Expected the status code attribute 404, got %v", value.AsInt64())
+	}
+}
+
+func TestSetup_UnknownExporter(t *testing.T) {
+	if _, err := tracing.Setup(context.Background(), "zipkin", "dides", nil); err == nil {
+		t.Errorf("Expected an error for an unknown exporter")
+	}
+}
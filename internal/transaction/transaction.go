@@ -0,0 +1,154 @@
+// Package transaction runs units of work spanning several stores
+package transaction
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrTransactionDone = errors.New("transaction already committed or rolled back")
+)
+
+// Participant is a store that can take part in a transaction
+// In-memory stores apply the writes right away and keep an undo log to roll them back, other callers see them before the commit,
+// SQL stores would begin a database transaction and isolate them
+type Participant interface {
+	// Begin starts the part of the store in a transaction, the returned context carries it to the store methods
+	Begin(ctx context.Context) (context.Context, Tx, error)
+}
+
+// Tx is the part of a participant in a transaction
+type Tx interface {
+	Commit() error
+	Rollback() error
+}
+
+// Manager runs units of work across its participants, one at a time
+type Manager struct {
+	mu           sync.Mutex
+	participants []Participant
+}
+
+// unitKey carries the running unit of work in the context
+type unitKey struct{}
+
+// unit is a running unit of work and the side effects waiting for its outcome
+type unit struct {
+	manager *Manager
+
+	mu        sync.Mutex
+	committed []func()
+	ended     []func()
+}
+
+// NewManager creates a transaction manager for the participants
+func NewManager(participants ...Participant) *Manager {
+	return &Manager{participants: participants}
+}
+
+// AfterCommit runs fn once the unit of work of the context is committed, right away when the context has none
+// Irreversible side effects, such as publishing an event, wait for the writes they report to be kept
+func AfterCommit(ctx context.Context, fn func()) {
+	u, ok := ctx.Value(unitKey{}).(*unit)
+	if !ok {
+		fn()
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.committed = append(u.committed, fn)
+}
+
+// AfterEnd runs fn once the unit of work of the context is committed or rolled back, right away when the context has none
+func AfterEnd(ctx context.Context, fn func()) {
+	u, ok := ctx.Value(unitKey{}).(*unit)
+	if !ok {
+		fn()
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ended = append(u.ended, fn)
+}
+
+// end runs the side effects waiting for the outcome of the unit of work, in the order they were added
+func (u *unit) end(committed bool) {
+	u.mu.Lock()
+	effects := u.ended
+	if committed {
+		effects = append(u.committed, u.ended...)
+	}
+	u.committed, u.ended = nil, nil
+	u.mu.Unlock()
+
+	for _, fn := range effects {
+		fn()
+	}
+}
+
+// Do runs fn in a transaction of every participant: the writes are committed when fn returns nil and rolled back otherwise
+// A Do called with the context of a running unit of work joins it instead of starting another one
+// The side effects added with AfterCommit and AfterEnd run once the participants are committed or rolled back
+func (m *Manager) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	if u, ok := ctx.Value(unitKey{}).(*unit); ok && u.manager == m {
+		return fn(ctx)
+	}
+
+	u := &unit{manager: m}
+	committed := false
+	defer func() { u.end(committed) }()
+
+	err := m.run(context.WithValue(ctx, unitKey{}, u), fn)
+	committed = err == nil
+	return err
+}
+
+// run begins a transaction on every participant, runs fn and ends them
+// The participants commit in order, when one fails the ones after it are rolled back
+func (m *Manager) run(ctx context.Context, fn func(ctx context.Context) error) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	txs := make([]Tx, 0, len(m.participants))
+	for _, participant := range m.participants {
+		var tx Tx
+		ctx, tx, err = participant.Begin(ctx)
+		if err != nil {
+			return errors.Join(err, rollback(txs))
+		}
+		txs = append(txs, tx)
+	}
+
+	// A panic undoes the writes before it goes on
+	defer func() {
+		if r := recover(); r != nil {
+			rollback(txs)
+			panic(r)
+		}
+	}()
+
+	if err := fn(ctx); err != nil {
+		return errors.Join(err, rollback(txs))
+	}
+
+	for i, tx := range txs {
+		if err := tx.Commit(); err != nil {
+			return errors.Join(fmt.Errorf("failed to commit transaction: %w", err), rollback(txs[i+1:]))
+		}
+	}
+	return nil
+}
+
+// rollback rolls back the transactions in reverse order
+func rollback(txs []Tx) error {
+	var errs []error
+	for i := len(txs) - 1; i >= 0; i-- {
+		if err := txs[i].Rollback(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to roll back transaction: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,135 @@
+package transaction
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// participant records the outcome of its transactions
+type participant struct {
+	name   string
+	log    *[]string
+	begins int
+}
+
+type tx struct {
+	p *participant
+}
+
+func (p *participant) Begin(ctx context.Context) (context.Context, Tx, error) {
+	p.begins++
+	return ctx, tx{p}, nil
+}
+
+func (t tx) Commit() error {
+	*t.p.log = append(*t.p.log, t.p.name+" commit")
+	return nil
+}
+
+func (t tx) Rollback() error {
+	*t.p.log = append(*t.p.log, t.p.name+" rollback")
+	return nil
+}
+
+func TestManager_Do(t *testing.T) {
+	var log []string
+	deployments := &participant{name: "deployments", log: &log}
+	instances := &participant{name: "instances", log: &log}
+	manager := NewManager(deployments, instances)
+	ctx := context.Background()
+
+	// Every participant commits in order
+	if err := manager.Do(ctx, func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if want := []string{"deployments commit", "instances commit"}; !equal(log, want) {
+		t.Errorf("Expected %v, got %v", want, log)
+	}
+
+	// A failing unit of work rolls back in reverse order and returns its error
+	log = nil
+	failure := errors.New("start failed")
+	if err := manager.Do(ctx, func(ctx context.Context) error { return failure }); !errors.Is(err, failure) {
+		t.Fatalf("Expected the error of the unit of work, got %v", err)
+	}
+	if want := []string{"instances rollback", "deployments rollback"}; !equal(log, want) {
+		t.Errorf("Expected %v, got %v", want, log)
+	}
+
+	// A nested unit of work joins the running one
+	log = nil
+	err := manager.Do(ctx, func(ctx context.Context) error {
+		return manager.Do(ctx, func(ctx context.Context) error { return nil })
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if deployments.begins != 3 || len(log) != 2 {
+		t.Errorf("Expected the nested unit of work to join, got %d transactions and %v", deployments.begins, log)
+	}
+}
+
+func TestManager_DoPanic(t *testing.T) {
+	var log []string
+	manager := NewManager(&participant{name: "deployments", log: &log})
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected the panic to go on")
+		}
+		if want := []string{"deployments rollback"}; !equal(log, want) {
+			t.Errorf("Expected %v, got %v", want, log)
+		}
+	}()
+	manager.Do(context.Background(), func(ctx context.Context) error { panic("boom") })
+}
+
+func TestManager_SideEffects(t *testing.T) {
+	var log []string
+	manager := NewManager(&participant{name: "deployments", log: &log})
+	ctx := context.Background()
+
+	// Without a unit of work the side effects run right away
+	AfterCommit(ctx, func() { log = append(log, "published") })
+	if want := []string{"published"}; !equal(log, want) {
+		t.Errorf("Expected %v, got %v", want, log)
+	}
+
+	// The side effects of a committed unit of work run after the commit, the nested ones included
+	log = nil
+	manager.Do(ctx, func(ctx context.Context) error {
+		AfterCommit(ctx, func() { log = append(log, "published") })
+		AfterEnd(ctx, func() { log = append(log, "notified") })
+		return manager.Do(ctx, func(ctx context.Context) error {
+			AfterCommit(ctx, func() { log = append(log, "audited") })
+			return nil
+		})
+	})
+	if want := []string{"deployments commit", "published", "audited", "notified"}; !equal(log, want) {
+		t.Errorf("Expected %v, got %v", want, log)
+	}
+
+	// Only the side effects waiting for the end run after a rollback
+	log = nil
+	manager.Do(ctx, func(ctx context.Context) error {
+		AfterCommit(ctx, func() { log = append(log, "published") })
+		AfterEnd(ctx, func() { log = append(log, "notified") })
+		return errors.New("start failed")
+	})
+	if want := []string{"deployments rollback", "notified"}; !equal(log, want) {
+		t.Errorf("Expected %v, got %v", want, log)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,303 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xnok/dides/internal/auth"
+	"github.com/xnok/dides/internal/clock"
+	"github.com/xnok/dides/internal/deployment"
+)
+
+var (
+	ErrDeliveryPending = errors.New("webhook delivery is still being attempted")
+)
+
+// RetryPolicy bounds the attempts of a delivery, the wait between attempts doubles from InitialBackoff up to MaxBackoff
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy gives up on a delivery after about 2 minutes
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    6,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     time.Minute,
+}
+
+// Backoff returns the wait after the given failed attempt, starting at 1
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	return backoff
+}
+
+// Dispatcher delivers the published deployment events to the matching subscriptions, it implements deployment.Publisher
+// Each delivery is attempted in the background so publishing never waits on a receiver
+type Dispatcher struct {
+	store  Store
+	client *http.Client
+	policy RetryPolicy
+	clock  clock.Clock
+
+	// mu serializes the redeliveries with the status checks
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher creates a dispatcher, a nil client uses a client with a 10 seconds timeout
+// The deliveries are timestamped, signed and retried with the wall clock when clk is nil
+func NewDispatcher(store Store, client *http.Client, policy RetryPolicy, clk clock.Clock) *Dispatcher {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		store:  store,
+		client: client,
+		policy: policy,
+		clock:  clock.OrReal(clk),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Publish records a pending delivery of the event for each matching subscription and starts delivering it
+func (d *Dispatcher) Publish(event deployment.Event) {
+	subscriptions, err := d.store.GetAllSubscriptions()
+	if err != nil {
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		if !subscription.Matches(event) {
+			continue
+		}
+
+		id, err := generateID("d-")
+		if err != nil {
+			continue
+		}
+		now := d.clock.Now()
+		delivery := &Delivery{
+			ID:             id,
+			SubscriptionID: subscription.ID,
+			Event:          event,
+			Status:         Pending,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		if err := d.store.SaveDelivery(delivery); err != nil {
+			continue
+		}
+		d.start(delivery)
+	}
+}
+
+// Close stops retrying the pending deliveries and waits for the attempts in flight
+func (d *Dispatcher) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// CreateSubscription validates the request and saves the subscription, it requires the admin role
+// The returned subscription is the only one carrying the secret
+func (d *Dispatcher) CreateSubscription(ctx context.Context, req *SubscriptionRequest) (*Subscription, error) {
+	if err := auth.RequireRole(ctx, auth.Admin); err != nil {
+		return nil, err
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+
+	id, err := generateID("wh-")
+	if err != nil {
+		return nil, err
+	}
+	secret := req.Secret
+	if secret == "" {
+		if secret, err = generateSecret(); err != nil {
+			return nil, err
+		}
+	}
+
+	subscription := &Subscription{
+		ID:        id,
+		URL:       req.URL,
+		Secret:    secret,
+		Events:    req.Events,
+		CreatedAt: d.clock.Now(),
+	}
+	if err := d.store.SaveSubscription(subscription); err != nil {
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// ListSubscriptions returns the subscriptions without their secret, it requires the admin role
+func (d *Dispatcher) ListSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	if err := auth.RequireRole(ctx, auth.Admin); err != nil {
+		return nil, err
+	}
+
+	subscriptions, err := d.store.GetAllSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+	for _, subscription := range subscriptions {
+		subscription.Secret = ""
+	}
+	return subscriptions, nil
+}
+
+// DeleteSubscription removes the subscription, its pending deliveries fail on their next attempt
+func (d *Dispatcher) DeleteSubscription(ctx context.Context, id string) error {
+	if err := auth.RequireRole(ctx, auth.Admin); err != nil {
+		return err
+	}
+	return d.store.DeleteSubscription(id)
+}
+
+// ListDeliveries returns the deliveries with the status, Failed lists the dead letters, it requires the admin role
+func (d *Dispatcher) ListDeliveries(ctx context.Context, status DeliveryStatus) ([]*Delivery, error) {
+	if err := auth.RequireRole(ctx, auth.Admin); err != nil {
+		return nil, err
+	}
+	return d.store.GetDeliveries(status)
+}
+
+// Redeliver attempts a failed or delivered delivery again with a fresh retry budget, it requires the admin role
+func (d *Dispatcher) Redeliver(ctx context.Context, id string) (*Delivery, error) {
+	if err := auth.RequireRole(ctx, auth.Admin); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delivery, err := d.store.GetDelivery(id)
+	if err != nil {
+		return nil, err
+	}
+	if delivery.Status == Pending {
+		return nil, ErrDeliveryPending
+	}
+	if _, err := d.store.GetSubscription(delivery.SubscriptionID); err != nil {
+		return nil, err
+	}
+
+	delivery.Status = Pending
+	delivery.Attempts = 0
+	delivery.LastError = ""
+	delivery.DeliveredAt = time.Time{}
+	delivery.UpdatedAt = d.clock.Now()
+	if err := d.store.SaveDelivery(delivery); err != nil {
+		return nil, err
+	}
+
+	d.start(delivery)
+	return delivery, nil
+}
+
+// start attempts a copy of the delivery in the background
+func (d *Dispatcher) start(delivery *Delivery) {
+	attempted := *delivery
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.deliver(&attempted)
+	}()
+}
+
+// deliver attempts the delivery until it is acknowledged or the retry budget is exhausted
+// Deliveries interrupted by Close stay pending
+func (d *Dispatcher) deliver(delivery *Delivery) {
+	for {
+		err := d.attempt(delivery)
+		if d.ctx.Err() != nil {
+			return
+		}
+
+		delivery.Attempts++
+		delivery.UpdatedAt = d.clock.Now()
+		if err == nil {
+			delivery.Status = Delivered
+			delivery.LastError = ""
+			delivery.DeliveredAt = delivery.UpdatedAt
+		} else {
+			delivery.LastError = err.Error()
+			if delivery.Attempts >= d.policy.MaxAttempts || errors.Is(err, ErrSubscriptionNotFound) {
+				delivery.Status = Failed
+			}
+		}
+
+		d.mu.Lock()
+		d.store.SaveDelivery(delivery)
+		d.mu.Unlock()
+
+		if delivery.Status != Pending {
+			return
+		}
+
+		select {
+		case <-d.clock.After(d.policy.Backoff(delivery.Attempts)):
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+// attempt posts the signed event to the subscription URL, any status other than 2xx is an error
+func (d *Dispatcher) attempt(delivery *Delivery) error {
+	subscription, err := d.store.GetSubscription(delivery.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	now := d.clock.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(delivery.Event.Type))
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(SignatureHeader, Sign(subscription.Secret, now, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xnok/dides/internal/auth"
+	"github.com/xnok/dides/internal/deployment"
+	inmemory "github.com/xnok/dides/internal/infra/in-memory"
+	"github.com/xnok/dides/internal/webhook"
+	"github.com/xnok/dides/pkg/simulator"
+)
+
+var testPolicy = webhook.RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     5 * time.Millisecond,
+}
+
+// receiver records the verified events it receives, it answers with the statuses in order then 200
+type receiver struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	statuses []int
+	events   []deployment.Event
+	attempts int
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	unix, err := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+	if err != nil || !webhook.Verify(rc.secret, time.Unix(unix, 0), body, r.Header.Get(webhook.SignatureHeader)) {
+		rc.t.Errorf("Invalid signature %q", r.Header.Get(webhook.SignatureHeader))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.attempts++
+	if len(rc.statuses) > 0 {
+		status := rc.statuses[0]
+		rc.statuses = rc.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+
+	var event deployment.Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		rc.t.Errorf("Failed to decode event: %v", err)
+	}
+	if r.Header.Get(webhook.EventHeader) != string(event.Type) {
+		rc.t.Errorf("Expected event header %q, got %q", event.Type, r.Header.Get(webhook.EventHeader))
+	}
+	rc.events = append(rc.events, event)
+}
+
+func (rc *receiver) received() ([]deployment.Event, int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]deployment.Event(nil), rc.events...), rc.attempts
+}
+
+// waitForDeliveries waits until the store holds count deliveries with the status
+func waitForDeliveries(t *testing.T, store webhook.Store, status webhook.DeliveryStatus, count int) []*webhook.Delivery {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		deliveries, _ := store.GetDeliveries(status)
+		if len(deliveries) == count {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d %s deliveries, got %d", count, status, len(deliveries))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcher_Publish_SignedAndFiltered(t *testing.T) {
+	rc := &receiver{t: t, secret: "s3cret"}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	store := inmemory.NewWebhookStore()
+	dispatcher := webhook.NewDispatcher(store, nil, testPolicy, nil)
+	defer dispatcher.Close()
+
+	_, err := dispatcher.CreateSubscription(context.Background(), &webhook.SubscriptionRequest{
+		URL:    server.URL,
+		Secret: "s3cret",
+		Events: []deployment.EventType{deployment.EventStarted, deployment.EventCompleted},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+
+	dispatcher.Publish(deployment.Event{ID: 1, DeploymentID: "1", Type: deployment.EventStarted})
+	dispatcher.Publish(deployment.Event{ID: 2, DeploymentID: "1", Type: deployment.EventProgress})
+	dispatcher.Publish(deployment.Event{ID: 3, DeploymentID: "1", Type: deployment.EventCompleted})
+
+	waitForDeliveries(t, store, webhook.Delivered, 2)
+	events, _ := rc.received()
+	if len(events) != 2 {
+		t.Fatalf("Expected the 2 matching events, got %d", len(events))
+	}
+	for _, event := range events {
+		if event.Type == deployment.EventProgress {
+			t.Errorf("Expected the progress event to be filtered out")
+		}
+	}
+}
+
+func TestDispatcher_Publish_RetriesThenDeadLetters(t *testing.T) {
+	rc := &receiver{t: t, secret: "s3cret", statuses: []int{
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+	}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	store := inmemory.NewWebhookStore()
+	dispatcher := webhook.NewDispatcher(store, nil, testPolicy, nil)
+	defer dispatcher.Close()
+
+	if _, err := dispatcher.CreateSubscription(context.Background(), &webhook.SubscriptionRequest{URL: server.URL, Secret: "s3cret"}); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+
+	// 1. The delivery fails on every attempt and is recorded as a dead letter
+	dispatcher.Publish(deployment.Event{ID: 1, DeploymentID: "1", Type: deployment.EventFailed})
+	deadLetters := waitForDeliveries(t, store, webhook.Failed, 1)
+	if deadLetters[0].Attempts != testPolicy.MaxAttempts {
+		t.Errorf("Expected %d attempts, got %d", testPolicy.MaxAttempts, deadLetters[0].Attempts)
+	}
+	if deadLetters[0].LastError == "" {
+		t.Errorf("Expected the last error to be recorded")
+	}
+
+	// 2. Once the receiver recovers the dead letter can be redelivered
+	redelivered, err := dispatcher.Redeliver(context.Background(), deadLetters[0].ID)
+	if err != nil {
+		t.Fatalf("Failed to redeliver: %v", err)
+	}
+	if redelivered.Status != webhook.Pending {
+		t.Errorf("Expected the redelivery to be pending, got %s", redelivered.Status)
+	}
+
+	delivered := waitForDeliveries(t, store, webhook.Delivered, 1)
+	if delivered[0].ID != deadLetters[0].ID || delivered[0].Attempts != 1 {
+		t.Errorf("Expected the dead letter to be delivered on the first attempt, got %+v", delivered[0])
+	}
+	events, attempts := rc.received()
+	if len(events) != 1 || attempts != 4 {
+		t.Errorf("Expected 1 event after 4 attempts, got %d after %d", len(events), attempts)
+	}
+
+	// 3. Unknown deliveries cannot be redelivered
+	if _, err := dispatcher.Redeliver(context.Background(), "unknown"); !errors.Is(err, webhook.ErrDeliveryNotFound) {
+		t.Errorf("Expected ErrDeliveryNotFound, got %v", err)
+	}
+}
+
+func TestDispatcher_Publish_RetriesOnTheClock(t *testing.T) {
+	rc := &receiver{t: t, secret: "s3cret", statuses: []int{http.StatusInternalServerError}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	// The backoff is an hour of the fake clock, the retry only happens once it is advanced
+	clk := simulator.NewFakeClock(time.Now())
+	store := inmemory.NewWebhookStore()
+	dispatcher := webhook.NewDispatcher(store, nil, webhook.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour, MaxBackoff: time.Hour}, clk)
+	defer dispatcher.Close()
+
+	if _, err := dispatcher.CreateSubscription(context.Background(), &webhook.SubscriptionRequest{URL: server.URL, Secret: "s3cret"}); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	dispatcher.Publish(deployment.Event{ID: 1, DeploymentID: "1", Type: deployment.EventStarted})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !clk.AdvanceToNext() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the delivery to wait for the backoff on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	delivered := waitForDeliveries(t, store, webhook.Delivered, 1)
+	if delivered[0].Attempts != 2 {
+		t.Errorf("Expected the delivery to succeed on the second attempt, got %d attempts", delivered[0].Attempts)
+	}
+}
+
+func TestDispatcher_CreateSubscription(t *testing.T) {
+	dispatcher := webhook.NewDispatcher(inmemory.NewWebhookStore(), nil, testPolicy, nil)
+	defer dispatcher.Close()
+
+	invalid := []*webhook.SubscriptionRequest{
+		{URL: "not a url"},
+		{URL: "ftp://example.com/hook"},
+		{URL: "https://example.com/hook", Events: []deployment.EventType{"unknown"}},
+	}
+	for _, req := range invalid {
+		if _, err := dispatcher.CreateSubscription(context.Background(), req); !errors.Is(err, webhook.ErrInvalidSubscription) {
+			t.Errorf("Expected ErrInvalidSubscription for %+v, got %v", req, err)
+		}
+	}
+
+	// The secret is generated when missing and only returned on creation
+	subscription, err := dispatcher.CreateSubscription(context.Background(), &webhook.SubscriptionRequest{URL: "https://example.com/hook"})
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	if subscription.Secret == "" {
+		t.Errorf("Expected a generated secret")
+	}
+	subscriptions, _ := dispatcher.ListSubscriptions(context.Background())
+	if len(subscriptions) != 1 || subscriptions[0].Secret != "" {
+		t.Errorf("Expected the listed subscription without its secret, got %+v", subscriptions)
+	}
+
+	// Managing the subscriptions requires the admin role
+	deployer := auth.WithPrincipal(context.Background(), &auth.Principal{Name: "ci", Role: auth.Deployer})
+	if _, err := dispatcher.ListSubscriptions(deployer); !errors.Is(err, auth.ErrForbidden) {
+		t.Errorf("Expected ErrForbidden, got %v", err)
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := webhook.RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, backoff := range expected {
+		if got := policy.Backoff(i + 1); got != backoff {
+			t.Errorf("Expected backoff %v after attempt %d, got %v", backoff, i+1, got)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/xnok/dides/internal/deployment"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the timestamp and the body, see Sign
+	SignatureHeader = "X-Dides-Signature"
+	// TimestampHeader carries the Unix time the delivery attempt was signed at
+	TimestampHeader = "X-Dides-Timestamp"
+	// EventHeader carries the type of the delivered event
+	EventHeader = "X-Dides-Event"
+	// DeliveryHeader carries the delivery ID, it is the same across the attempts of a delivery
+	DeliveryHeader = "X-Dides-Delivery"
+)
+
+var (
+	ErrInvalidSubscription  = errors.New("invalid webhook subscription")
+	ErrSubscriptionNotFound = errors.New("webhook subscription not found")
+	ErrDeliveryNotFound     = errors.New("webhook delivery not found")
+)
+
+// Subscription sends the deployment events matching its filter to an URL
+type Subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret signs the payloads, it is only returned when the subscription is created
+	Secret string `json:"secret,omitempty"`
+	// Events filters the event types sent to the URL, empty sends every event
+	Events    []deployment.EventType `json:"events,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// Matches checks if the event passes the subscription filter
+func (s *Subscription) Matches(event deployment.Event) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, eventType := range s.Events {
+		if eventType == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// SubscriptionRequest represents the request body for creating a subscription
+type SubscriptionRequest struct {
+	URL string `json:"url"`
+	// Secret is generated when empty
+	Secret string                 `json:"secret,omitempty"`
+	Events []deployment.EventType `json:"events,omitempty"`
+}
+
+// eventTypes are the event types a subscription can filter on
+var eventTypes = map[deployment.EventType]bool{
+	deployment.EventStarted:           true,
+	deployment.EventProgress:          true,
+	deployment.EventBatchStarted:      true,
+	deployment.EventInstanceCompleted: true,
+	deployment.EventInstanceFailed:    true,
+	deployment.EventRollback:          true,
+	deployment.EventCompleted:         true,
+	deployment.EventFailed:            true,
+}
+
+// Validate checks the URL is an absolute HTTP(S) URL and the event types exist
+func (r *SubscriptionRequest) Validate() error {
+	target, err := url.Parse(r.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https URL", ErrInvalidSubscription)
+	}
+	for _, eventType := range r.Events {
+		if !eventTypes[eventType] {
+			return fmt.Errorf("%w: unknown event type %q", ErrInvalidSubscription, eventType)
+		}
+	}
+	return nil
+}
+
+// DeliveryStatus is the outcome of a delivery
+type DeliveryStatus string
+
+const (
+	// Pending deliveries are being attempted
+	Pending DeliveryStatus = "pending"
+	// Delivered deliveries were acknowledged with a 2xx response
+	Delivered DeliveryStatus = "delivered"
+	// Failed deliveries exhausted their attempts, they form the dead-letter record and can be redelivered
+	Failed DeliveryStatus = "failed"
+)
+
+// Delivery is an event sent to a subscription
+type Delivery struct {
+	ID             string           `json:"id"`
+	SubscriptionID string           `json:"subscription_id"`
+	Event          deployment.Event `json:"event"`
+	Status         DeliveryStatus   `json:"status"`
+	Attempts       int              `json:"attempts"`
+	// LastError is the transport error or the unexpected status of the last attempt
+	LastError   string    `json:"last_error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	DeliveredAt time.Time `json:"delivered_at"`
+}
+
+// DeliveriesResponse represents the response of a delivery listing
+type DeliveriesResponse struct {
+	Deliveries []*Delivery `json:"deliveries"`
+	Count      int         `json:"count"`
+}
+
+// SubscriptionsResponse represents the response of a subscription listing
+type SubscriptionsResponse struct {
+	Subscriptions []*Subscription `json:"subscriptions"`
+	Count         int             `json:"count"`
+}
+
+// Store persists the subscriptions and their deliveries
+type Store interface {
+	SaveSubscription(subscription *Subscription) error
+	GetSubscription(id string) (*Subscription, error)
+	GetAllSubscriptions() ([]*Subscription, error)
+	DeleteSubscription(id string) error
+	SaveDelivery(delivery *Delivery) error
+	GetDelivery(id string) (*Delivery, error)
+	// GetDeliveries returns the deliveries with the status, or all of them when empty, oldest first
+	GetDeliveries(status DeliveryStatus) ([]*Delivery, error)
+}
+
+// Sign returns the signature of a payload sent at the timestamp: "sha256=" followed by the hex HMAC-SHA256
+// of the Unix timestamp, a dot and the body. Receivers recompute it with the subscription secret and
+// reject old timestamps to prevent replays.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a payload in constant time
+func Verify(secret string, timestamp time.Time, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// generateID returns a random ID with the prefix
+func generateID(prefix string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// generateSecret returns a random signing secret
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
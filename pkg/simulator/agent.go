@@ -0,0 +1,488 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xnok/dides/internal/clock"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+)
+
+// Defaults of the agent options
+const (
+	DefaultHeartbeatInterval = 10 * time.Second
+	DefaultApplyDelay        = 2 * time.Second
+	DefaultWatchTimeout      = 30 * time.Second
+)
+
+// AgentOptions configures how the simulated agents talk to the controller
+type AgentOptions struct {
+	// ControllerURL is the base URL of the controller REST API
+	ControllerURL string
+	// Token is the join token used to register
+	Token string
+	// HeartbeatInterval is the time between two status reports
+	HeartbeatInterval time.Duration
+	// ApplyDelay is how long the agent takes to move to a new desired state
+	ApplyDelay time.Duration
+	// WatchTimeout is how long a desired state watch waits before it is renewed
+	WatchTimeout time.Duration
+	// Seed drives the random failures of the agent
+	Seed int64
+	// Clock schedules the apply delays, the wall clock when nil
+	// The heartbeats and watches always use the wall clock, they talk to the controller
+	Clock Clock
+	// Client sends the requests, http.DefaultClient when nil
+	Client *http.Client
+	// Logger receives the agent activity, log.Default() when nil
+	Logger *log.Logger
+}
+
+// withDefaults fills the unset options
+func (o AgentOptions) withDefaults() AgentOptions {
+	if o.HeartbeatInterval <= 0 {
+		o.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if o.ApplyDelay < 0 {
+		o.ApplyDelay = 0
+	}
+	if o.WatchTimeout <= 0 {
+		o.WatchTimeout = DefaultWatchTimeout
+	}
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+	if o.Clock == nil {
+		o.Clock = clock.Real{}
+	}
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+	return o
+}
+
+// Agent simulates the agent running on an instance: it registers, heartbeats,
+// watches its desired state and applies it after a delay, unless one of its failures triggers
+type Agent struct {
+	config  InstanceConfig
+	options AgentOptions
+	// rand draws the random failures, only the watch loop uses it
+	rand *rand.Rand
+	// reportMu orders the reports, a heartbeat cannot overwrite the status of a later apply
+	reportMu sync.Mutex
+
+	mu         sync.Mutex
+	id         string
+	credential string
+	revision   int64
+	current    inventory.State
+	status     inventory.Status
+	// flapping agents alternate their status at every heartbeat
+	flapping bool
+	// crash stops the heartbeat and the watch of the agent
+	crash   context.CancelFunc
+	crashed bool
+}
+
+// NewAgent creates the agent of an instance of the simulator config, the failures of the instance are injected
+func NewAgent(config InstanceConfig, options AgentOptions) *Agent {
+	return &Agent{
+		config:  config,
+		options: options.withDefaults(),
+		rand:    newRand(options.Seed, config.Name),
+		status:  inventory.HEALTHY,
+	}
+}
+
+// Name returns the name of the simulated instance
+func (a *Agent) Name() string {
+	return a.config.Name
+}
+
+// ID returns the ID assigned to the instance at registration, empty until then
+func (a *Agent) ID() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.id
+}
+
+// CurrentState returns the state the simulated instance runs
+func (a *Agent) CurrentState() inventory.State {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.current
+}
+
+// Crashed reports whether a Crash failure stopped the agent
+func (a *Agent) Crashed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.crashed
+}
+
+// Run registers the instance then heartbeats and applies its desired state until the context is cancelled or the agent crashes
+func (a *Agent) Run(ctx context.Context) error {
+	if err := a.Register(ctx); err != nil {
+		return err
+	}
+
+	ctx, crash := context.WithCancel(ctx)
+	defer crash()
+	a.mu.Lock()
+	a.crash = crash
+	a.mu.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.heartbeat(ctx)
+	}()
+	a.watch(ctx)
+	wg.Wait()
+
+	return nil
+}
+
+// Register registers the instance with the join token
+// A re-registered instance resumes from the state the controller knows
+func (a *Agent) Register(ctx context.Context) error {
+	body, err := a.config.ToJSON(a.options.Token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration request: %w", err)
+	}
+
+	var response inventory.RegistrationResponse
+	if err := a.do(ctx, http.MethodPost, "/inventory/instances/register", body, http.StatusCreated, &response); err != nil {
+		return fmt.Errorf("failed to register %s: %w", a.config.Name, err)
+	}
+
+	a.mu.Lock()
+	a.id = response.Instance.ID
+	a.credential = response.Credential
+	a.current = response.Instance.CurrentState
+	a.mu.Unlock()
+
+	a.options.Logger.Printf("[%s] registered as %s", a.config.Name, response.Instance.ID)
+	return a.report(ctx, true, nil)
+}
+
+// heartbeat pings the controller at every interval
+// Only a flapping instance reports its status, the other status changes are reported when they happen
+// so a heartbeat never overwrites the reset of a failed instance done by the controller
+func (a *Agent) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(a.options.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			flapping := a.flapping
+			if flapping {
+				a.status = flip(a.status)
+			}
+			a.mu.Unlock()
+			if err := a.report(ctx, flapping, nil); err != nil && ctx.Err() == nil {
+				a.options.Logger.Printf("[%s] heartbeat failed: %v", a.config.Name, err)
+			}
+		}
+	}
+}
+
+// watch long-polls the desired state and applies every new revision
+func (a *Agent) watch(ctx context.Context) {
+	for ctx.Err() == nil {
+		response, err := a.watchDesiredState(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			a.options.Logger.Printf("[%s] watch failed: %v", a.config.Name, err)
+			sleep(ctx, a.options.HeartbeatInterval)
+			continue
+		}
+		if response == nil {
+			continue
+		}
+
+		a.mu.Lock()
+		a.revision = response.Revision
+		upToDate := response.DesiredState.IsZero() || response.DesiredState == a.current
+		a.mu.Unlock()
+		if upToDate {
+			continue
+		}
+
+		a.apply(ctx, response.DesiredState)
+	}
+}
+
+// Inject adds a failure to the agent, it triggers on the desired states applied from now on
+func (a *Agent) Inject(failure Failure) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.config.Failures = append(a.config.Failures, failure)
+}
+
+// failures returns the failures injected in the agent
+func (a *Agent) failures() []Failure {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Failure(nil), a.config.Failures...)
+}
+
+// apply moves the instance to the desired state once the apply delay is over
+// The first failure of the agent that triggers on the desired state decides how the apply ends
+func (a *Agent) apply(ctx context.Context, desired inventory.State) {
+	delay, failure := a.options.ApplyDelay, a.failureFor(desired)
+	for _, f := range a.failures() {
+		if f.Mode == SlowApply && f.matches(desired.CodeVersion) {
+			delay = f.Delay
+		}
+	}
+
+	a.options.Logger.Printf("[%s] applying %s/%s", a.config.Name, desired.CodeVersion, desired.ConfigurationVersion)
+
+	// A failed instance is reset while it applies, like the controller does before a rollback
+	a.mu.Lock()
+	a.flapping = false
+	reset := a.status == inventory.FAILED
+	if reset {
+		a.status = inventory.UNKNOWN
+	}
+	a.mu.Unlock()
+	if reset {
+		if err := a.report(ctx, true, nil); err != nil && ctx.Err() == nil {
+			a.options.Logger.Printf("[%s] failed to report the reset: %v", a.config.Name, err)
+		}
+	}
+
+	switch failure {
+	case Crash:
+		a.mu.Lock()
+		a.crashed = true
+		a.crash()
+		a.mu.Unlock()
+		a.options.Logger.Printf("[%s] crashed", a.config.Name)
+		return
+	case Hang:
+		a.options.Logger.Printf("[%s] hanging", a.config.Name)
+		<-ctx.Done()
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-a.options.Clock.After(delay):
+	}
+
+	a.mu.Lock()
+	a.current = desired
+	a.status = inventory.HEALTHY
+	a.flapping = failure == Flap
+	if failure == FailApply {
+		a.status = inventory.FAILED
+	}
+	status := a.status
+	a.mu.Unlock()
+
+	if err := a.report(ctx, true, &desired); err != nil && ctx.Err() == nil {
+		a.options.Logger.Printf("[%s] failed to report %s/%s: %v", a.config.Name, desired.CodeVersion, desired.ConfigurationVersion, err)
+		return
+	}
+	if status == inventory.FAILED {
+		a.options.Logger.Printf("[%s] failed to apply %s/%s", a.config.Name, desired.CodeVersion, desired.ConfigurationVersion)
+		return
+	}
+	a.options.Logger.Printf("[%s] running %s/%s", a.config.Name, desired.CodeVersion, desired.ConfigurationVersion)
+}
+
+// failureFor returns the mode of the first failure that triggers on the desired state, empty when the apply succeeds
+// A random draw is made for every matching failure with a probability, in order, so a seed always draws the same failures
+func (a *Agent) failureFor(desired inventory.State) FailureMode {
+	var triggered FailureMode
+	for _, f := range a.failures() {
+		if f.Mode == SlowApply || !f.matches(desired.CodeVersion) {
+			continue
+		}
+		if f.Probability > 0 && a.rand.Float64() >= f.Probability {
+			continue
+		}
+		if triggered == "" {
+			triggered = f.Mode
+		}
+	}
+	return triggered
+}
+
+// flip alternates a flapping status
+func flip(status inventory.Status) inventory.Status {
+	if status == inventory.HEALTHY {
+		return inventory.FAILED
+	}
+	return inventory.HEALTHY
+}
+
+// report pings the controller with the status of the instance when withStatus is set, and its current state when it changed
+func (a *Agent) report(ctx context.Context, withStatus bool, current *inventory.State) error {
+	a.reportMu.Lock()
+	defer a.reportMu.Unlock()
+
+	a.mu.Lock()
+	id, status := a.id, a.status
+	a.mu.Unlock()
+
+	patch := inventory.InstancePatch{CurrentState: current}
+	if withStatus {
+		patch.Status = &status
+	}
+	body, err := json.Marshal(inventory.UpdateRequest{Updates: patch})
+	if err != nil {
+		return err
+	}
+	return a.do(ctx, http.MethodPatch, "/inventory/instances/"+id, body, http.StatusOK, nil)
+}
+
+// watchDesiredState waits for the desired state to move past the known revision, nil when the watch timed out
+func (a *Agent) watchDesiredState(ctx context.Context) (*inventory.DesiredStateResponse, error) {
+	a.mu.Lock()
+	path := fmt.Sprintf("/inventory/instances/%s/desired-state?revision=%d&timeout=%s", a.id, a.revision, a.options.WatchTimeout)
+	a.mu.Unlock()
+
+	var response inventory.DesiredStateResponse
+	err := a.do(ctx, http.MethodGet, path, nil, http.StatusOK, &response)
+	if err == errNotModified {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// errNotModified is returned by do when the controller answers 304
+var errNotModified = errors.New("not modified")
+
+// do sends a request authenticated with the instance credential and decodes the response into target
+func (a *Agent) do(ctx context.Context, method, path string, body []byte, expectedStatus int, target interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.options.ControllerURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	a.mu.Lock()
+	if a.credential != "" {
+		req.Header.Set("Authorization", "Bearer "+a.credential)
+	}
+	a.mu.Unlock()
+
+	resp, err := a.options.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return errNotModified
+	}
+	if resp.StatusCode != expectedStatus {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	if target == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// sleep waits for the duration, it returns false when the context is cancelled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Fleet runs one agent per instance of the simulator config
+type Fleet struct {
+	Agents []*Agent
+}
+
+// NewFleet creates the agents of every instance of the config
+// Each agent gets the failures of its instance and of the labels it matches, drawn from the seed of the config
+func NewFleet(config *Config, options AgentOptions) *Fleet {
+	options.Seed = config.Seed
+
+	fleet := &Fleet{}
+	for _, instance := range config.Instances {
+		instance.Failures = config.FailuresOf(instance)
+		fleet.Agents = append(fleet.Agents, NewAgent(instance, options))
+	}
+	return fleet
+}
+
+// Inject adds the failure to the agents of the instances matching the label selector
+func (f *Fleet) Inject(sel selector.Selector, failure Failure) int {
+	var injected int
+	for _, agent := range f.Agents {
+		if sel.Matches(agent.config.Labels) {
+			agent.Inject(failure)
+			injected++
+		}
+	}
+	return injected
+}
+
+// Agent returns the agent of the instance with the given name
+func (f *Fleet) Agent(name string) (*Agent, bool) {
+	for _, agent := range f.Agents {
+		if agent.Name() == name {
+			return agent, true
+		}
+	}
+	return nil, false
+}
+
+// Run runs every agent in its own goroutine until the context is cancelled
+// A registration failure is logged as it happens, the other agents keep running and the failures are returned at the end
+func (f *Fleet) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(f.Agents))
+	for i, agent := range f.Agents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := agent.Run(ctx); err != nil {
+				agent.options.Logger.Printf("[%s] %v", agent.Name(), err)
+				errs[i] = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,96 @@
+package simulator
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xnok/dides/internal/clock"
+)
+
+// Clock tells the time and schedules the apply delays of the agents
+type Clock = clock.Clock
+
+// FakeClock is a clock that only moves when it is advanced
+// Shared by the controller and the agents, it lets a scenario simulate hours of rollout in milliseconds
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+// waiter is a pending After call
+type waiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewFakeClock creates a fake clock set at start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the time of the clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel receiving the time once the clock is advanced by d, right away when d is not positive
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{deadline: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d and fires the waiters whose deadline is past
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advanceTo(c.now.Add(d))
+}
+
+// AdvanceToNext moves the clock to the earliest pending deadline and fires its waiters
+// It returns false when nothing waits on the clock
+func (c *FakeClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.waiters) == 0 {
+		return false
+	}
+	next := c.waiters[0].deadline
+	for _, w := range c.waiters[1:] {
+		if w.deadline.Before(next) {
+			next = w.deadline
+		}
+	}
+	c.advanceTo(next)
+	return true
+}
+
+// advanceTo sets the clock and fires the due waiters in deadline order, the clock never goes back
+func (c *FakeClock) advanceTo(t time.Time) {
+	if t.After(c.now) {
+		c.now = t
+	}
+
+	sort.SliceStable(c.waiters, func(i, j int) bool { return c.waiters[i].deadline.Before(c.waiters[j].deadline) })
+	var pending []waiter
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
@@ -0,0 +1,40 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewFakeClock(start)
+
+	if fired := clk.After(0); len(fired) != 1 {
+		t.Errorf("Expected a zero delay to elapse right away")
+	}
+
+	hour, twoHours := clk.After(time.Hour), clk.After(2*time.Hour)
+	clk.Advance(30 * time.Minute)
+	if len(hour) != 0 || len(twoHours) != 0 {
+		t.Fatalf("Expected no delay to elapse after 30 minutes")
+	}
+
+	// The clock jumps to the next deadline and only fires its waiters
+	if !clk.AdvanceToNext() {
+		t.Fatalf("Expected pending delays")
+	}
+	if now := clk.Now(); !now.Equal(start.Add(time.Hour)) {
+		t.Errorf("Expected the clock at %s, got %s", start.Add(time.Hour), now)
+	}
+	if len(hour) != 1 || len(twoHours) != 0 {
+		t.Errorf("Expected only the one hour delay to elapse")
+	}
+
+	clk.Advance(2 * time.Hour)
+	if at := <-twoHours; !at.Equal(start.Add(3 * time.Hour)) {
+		t.Errorf("Expected the delay to receive the time of the clock, got %s", at)
+	}
+	if clk.AdvanceToNext() {
+		t.Errorf("Expected no pending delay left")
+	}
+}
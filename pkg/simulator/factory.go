@@ -53,6 +53,37 @@ func (cb *ConfigBuilder) AddInstancesWithPattern(baseIP string, namePrefix strin
 	return cb
 }
 
+// AddTemplate adds the instances generated by the template, it panics on an invalid template
+func (cb *ConfigBuilder) AddTemplate(template InstanceTemplate) *ConfigBuilder {
+	if err := template.Validate(); err != nil {
+		panic(err)
+	}
+	cb.config.Instances = append(cb.config.Instances, template.Instances()...)
+	return cb
+}
+
+// WithSeed sets the seed the random failures are drawn from
+func (cb *ConfigBuilder) WithSeed(seed int64) *ConfigBuilder {
+	cb.config.Seed = seed
+	return cb
+}
+
+// AddFailure injects a failure in the instances with the given name
+func (cb *ConfigBuilder) AddFailure(name string, failure Failure) *ConfigBuilder {
+	for i := range cb.config.Instances {
+		if cb.config.Instances[i].Name == name {
+			cb.config.Instances[i].Failures = append(cb.config.Instances[i].Failures, failure)
+		}
+	}
+	return cb
+}
+
+// AddLabelFailure injects a failure in every instance matching the label selector
+func (cb *ConfigBuilder) AddLabelFailure(labelSelector string, failure Failure) *ConfigBuilder {
+	cb.config.Failures = append(cb.config.Failures, LabelFailure{Selector: labelSelector, Failure: failure})
+	return cb
+}
+
 // Build returns the built configuration
 func (cb *ConfigBuilder) Build() *Config {
 	return cb.config
@@ -0,0 +1,116 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/xnok/dides/internal/selector"
+)
+
+var (
+	ErrInvalidFailure = errors.New("invalid failure")
+)
+
+// FailureMode is the misbehaviour injected in a simulated agent
+type FailureMode string
+
+const (
+	// FailApply reports FAILED once the desired state is applied
+	FailApply FailureMode = "fail_apply"
+	// Hang never finishes applying the desired state, the agent keeps heartbeating
+	Hang FailureMode = "hang"
+	// Crash stops the agent when it starts applying, it neither heartbeats nor watches anymore
+	Crash FailureMode = "crash"
+	// Flap applies the desired state then alternates between HEALTHY and FAILED at every heartbeat
+	Flap FailureMode = "flap"
+	// SlowApply applies the desired state after Delay instead of the apply delay of the agent
+	SlowApply FailureMode = "slow_apply"
+)
+
+// Failure injects a misbehaviour when the agent applies a desired state
+type Failure struct {
+	Mode FailureMode `yaml:"mode"`
+	// Version restricts the failure to the desired states with this code version, every apply when empty
+	Version string `yaml:"version,omitempty"`
+	// Probability is the chance the failure triggers on a matching apply, it always triggers when 0
+	Probability float64 `yaml:"probability,omitempty"`
+	// Delay is the apply duration of SlowApply
+	Delay time.Duration `yaml:"delay,omitempty"`
+}
+
+// Validate checks the mode and the parameters of the failure
+func (f Failure) Validate() error {
+	switch f.Mode {
+	case FailApply, Hang, Crash, Flap:
+	case SlowApply:
+		if f.Delay <= 0 {
+			return fmt.Errorf("%w: %s requires a positive delay", ErrInvalidFailure, f.Mode)
+		}
+	default:
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidFailure, f.Mode)
+	}
+	if f.Probability < 0 || f.Probability > 1 {
+		return fmt.Errorf("%w: probability %v is not between 0 and 1", ErrInvalidFailure, f.Probability)
+	}
+	return nil
+}
+
+// matches checks if the failure applies to the code version
+func (f Failure) matches(codeVersion string) bool {
+	return f.Version == "" || f.Version == codeVersion
+}
+
+// LabelFailure injects a failure in every instance matching the label selector
+type LabelFailure struct {
+	Selector string `yaml:"selector"`
+	Failure  `yaml:",inline"`
+}
+
+// Validate checks the selector and the failure
+func (f LabelFailure) Validate() error {
+	if _, err := selector.Parse(f.Selector); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidFailure, err)
+	}
+	return f.Failure.Validate()
+}
+
+// Validate checks the failures of the config
+func (c *Config) Validate() error {
+	for _, failure := range c.Failures {
+		if err := failure.Validate(); err != nil {
+			return fmt.Errorf("failure on %q: %w", failure.Selector, err)
+		}
+	}
+	for _, instance := range c.Instances {
+		for _, failure := range instance.Failures {
+			if err := failure.Validate(); err != nil {
+				return fmt.Errorf("failure of %s: %w", instance.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// FailuresOf returns the failures of the instance followed by the label failures matching it
+func (c *Config) FailuresOf(instance InstanceConfig) []Failure {
+	failures := append([]Failure(nil), instance.Failures...)
+	for _, failure := range c.Failures {
+		sel, err := selector.Parse(failure.Selector)
+		if err != nil || !sel.Matches(instance.Labels) {
+			continue
+		}
+		failures = append(failures, failure.Failure)
+	}
+	return failures
+}
+
+// newRand returns the random source of an instance
+// Each instance draws from its own source derived from the seed and its name, so the draws do not depend on the scheduling of the agents
+func newRand(seed int64, name string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
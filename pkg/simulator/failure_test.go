@@ -0,0 +1,125 @@
+package simulator
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/xnok/dides/internal/inventory"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{
+			name: "valid failures",
+			config: NewConfigBuilder().
+				AddInstance("10.0.0.1", "web-1", map[string]string{"env": "production"}).
+				AddFailure("web-1", Failure{Mode: FailApply, Version: "v2", Probability: 0.5}).
+				AddLabelFailure("env=production", Failure{Mode: SlowApply, Delay: time.Second}).
+				Build(),
+		},
+		{
+			name: "unknown mode",
+			config: NewConfigBuilder().
+				AddInstance("10.0.0.1", "web-1", nil).
+				AddFailure("web-1", Failure{Mode: "explode"}).
+				Build(),
+			wantErr: true,
+		},
+		{
+			name: "probability above 1",
+			config: NewConfigBuilder().
+				AddLabelFailure("env=production", Failure{Mode: Crash, Probability: 1.5}).
+				Build(),
+			wantErr: true,
+		},
+		{
+			name: "slow apply without delay",
+			config: NewConfigBuilder().
+				AddLabelFailure("env=production", Failure{Mode: SlowApply}).
+				Build(),
+			wantErr: true,
+		},
+		{
+			name: "invalid selector",
+			config: NewConfigBuilder().
+				AddLabelFailure("env in production", Failure{Mode: Hang}).
+				Build(),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.wantErr && !errors.Is(err, ErrInvalidFailure) {
+				t.Errorf("Expected ErrInvalidFailure, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConfig_FailuresOf(t *testing.T) {
+	config := NewConfigBuilder().
+		AddInstance("10.0.0.1", "web-1", map[string]string{"env": "production"}).
+		AddInstance("10.0.0.2", "web-2", map[string]string{"env": "dev"}).
+		AddFailure("web-1", Failure{Mode: Hang}).
+		AddLabelFailure("env=production", Failure{Mode: Flap}).
+		Build()
+
+	failures := config.FailuresOf(config.Instances[0])
+	if len(failures) != 2 || failures[0].Mode != Hang || failures[1].Mode != Flap {
+		t.Errorf("Expected the instance failure then the label failure, got %+v", failures)
+	}
+	if failures := config.FailuresOf(config.Instances[1]); len(failures) != 0 {
+		t.Errorf("Expected no failure outside the selector, got %+v", failures)
+	}
+}
+
+func TestAgent_FailureFor(t *testing.T) {
+	v2 := inventory.State{CodeVersion: "v2", ConfigurationVersion: "c1"}
+	v1 := inventory.State{CodeVersion: "v1", ConfigurationVersion: "c1"}
+
+	// Failures only trigger on their version
+	agent := NewAgent(InstanceConfig{Name: "web-1", Failures: []Failure{{Mode: FailApply, Version: "v2"}}}, AgentOptions{})
+	if mode := agent.failureFor(v2); mode != FailApply {
+		t.Errorf("Expected %s on v2, got %q", FailApply, mode)
+	}
+	if mode := agent.failureFor(v1); mode != "" {
+		t.Errorf("Expected no failure on v1, got %q", mode)
+	}
+
+	// The same seed draws the same failures
+	draws := func(seed int64) []FailureMode {
+		agent := NewAgent(InstanceConfig{Name: "web-1", Failures: []Failure{{Mode: FailApply, Probability: 0.5}}}, AgentOptions{Seed: seed})
+		var modes []FailureMode
+		for range 32 {
+			modes = append(modes, agent.failureFor(v2))
+		}
+		return modes
+	}
+	first, replay, other := draws(42), draws(42), draws(7)
+	var triggered int
+	for i := range first {
+		if first[i] != replay[i] {
+			t.Fatalf("Expected the draw %d to replay with the same seed", i)
+		}
+		if first[i] == FailApply {
+			triggered++
+		}
+	}
+	if triggered == 0 || triggered == len(first) {
+		t.Errorf("Expected a probability of 0.5 to trigger some of the time, triggered %d/%d", triggered, len(first))
+	}
+	if slices.Equal(first, other) {
+		t.Errorf("Expected another seed to draw other failures")
+	}
+}
@@ -11,7 +11,13 @@ import (
 
 // Config represents the structure of simulator.config.yaml
 type Config struct {
+	// Seed drives the random failures, a scenario replays the same way with the same seed
+	Seed      int64            `yaml:"seed"`
 	Instances []InstanceConfig `yaml:"instances"`
+	// Templates generate instances, they are added to the listed ones when the config is loaded
+	Templates []InstanceTemplate `yaml:"templates,omitempty"`
+	// Failures are injected in every instance matching their selector
+	Failures []LabelFailure `yaml:"failures,omitempty"`
 }
 
 // InstanceConfig represents an instance configuration from YAML
@@ -19,6 +25,8 @@ type InstanceConfig struct {
 	IP     string            `yaml:"ip"`
 	Name   string            `yaml:"name"`
 	Labels map[string]string `yaml:"labels"`
+	// Failures are injected in this instance only
+	Failures []Failure `yaml:"failures,omitempty"`
 }
 
 // LoadConfigFromFile loads simulator configuration from a YAML file
@@ -33,6 +41,13 @@ func LoadConfigFromFile(filePath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	if err := config.expandTemplates(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file: %w", err)
+	}
+
 	return &config, nil
 }
 
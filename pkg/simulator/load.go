@@ -0,0 +1,616 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+)
+
+// Defaults of the load test
+const (
+	DefaultLoadWorkers  = 64
+	DefaultLoadDuration = time.Minute
+	DefaultLoadTimeout  = 30 * time.Minute
+)
+
+// requestDurationMetric is the histogram of the controller handler latencies, labelled by method, route pattern and status code
+const requestDurationMetric = "dides_http_request_duration_seconds"
+
+// Routes of the endpoints driven by the load test, as labelled in the controller histogram
+const (
+	registrationRoute = "POST /inventory/instances/register"
+	patchRoute        = "PATCH /inventory/instances/{instanceID}"
+	progressRoute     = "POST /deploy/progress"
+)
+
+// LoadOptions configures a load test
+type LoadOptions struct {
+	// ControllerURL is the base URL of the controller REST API
+	ControllerURL string
+	// Token is the join token used to register the fleet
+	Token string
+	// APIKey authenticates the deployment, the progress and the metrics calls
+	APIKey string
+	// Workers is the number of concurrent connections, the fleet is split between them
+	Workers int
+	// HeartbeatInterval is the time between two heartbeats of an instance
+	HeartbeatInterval time.Duration
+	// ProgressInterval is the time between two progress calls during the rollout
+	ProgressInterval time.Duration
+	// Duration is how long the fleet heartbeats before the deployment is triggered, or in total without a deployment
+	Duration time.Duration
+	// Deployment is rolled out once the fleet heartbeated for Duration, only the heartbeats are measured when nil
+	Deployment *deployment.DeploymentRequest
+	// Timeout is the longest the rollout may take
+	Timeout time.Duration
+	// Client sends the requests, a client keeping a connection per worker when nil
+	Client *http.Client
+	// Logger receives the load test activity, log.Default() when nil
+	Logger *log.Logger
+}
+
+// withDefaults fills the unset options
+func (o LoadOptions) withDefaults() LoadOptions {
+	if o.Workers <= 0 {
+		o.Workers = DefaultLoadWorkers
+	}
+	if o.HeartbeatInterval <= 0 {
+		o.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if o.ProgressInterval <= 0 {
+		o.ProgressInterval = time.Second
+	}
+	if o.Duration <= 0 {
+		o.Duration = DefaultLoadDuration
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultLoadTimeout
+	}
+	if o.Client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = o.Workers
+		o.Client = &http.Client{Transport: transport}
+	}
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+	return o
+}
+
+// LoadReport is the machine-readable outcome of a load test
+type LoadReport struct {
+	Instances  int `json:"instances"`
+	Registered int `json:"registered"`
+	Workers    int `json:"workers"`
+	// TargetHeartbeatRate is the heartbeats per second the fleet should send, HeartbeatRate is the rate the controller sustained
+	TargetHeartbeatRate float64 `json:"target_heartbeat_rate"`
+	HeartbeatRate       float64 `json:"heartbeat_rate"`
+	// Client holds the round trips observed by the simulator, they include the network and the queueing in the client
+	Client EndpointLatencies `json:"client"`
+	// Controller holds the time spent in the controller handlers, read from its request duration histogram
+	// It is left out when the metrics cannot be read
+	Controller *EndpointLatencies `json:"controller,omitempty"`
+	Rollout    *RolloutReport     `json:"rollout,omitempty"`
+}
+
+// EndpointLatencies are the latencies of the endpoints driven by the load test
+type EndpointLatencies struct {
+	Registration       LatencyReport `json:"registration"`
+	PatchInstance      LatencyReport `json:"patch_instance"`
+	ProgressDeployment LatencyReport `json:"progress_deployment"`
+}
+
+// LatencyReport summarizes the latencies of an endpoint, in milliseconds
+// The controller latencies are estimated from the histogram buckets, the max being the upper bound of the highest bucket used
+type LatencyReport struct {
+	Count  int     `json:"count"`
+	Errors int     `json:"errors"`
+	Mean   float64 `json:"mean_ms"`
+	P50    float64 `json:"p50_ms"`
+	P90    float64 `json:"p90_ms"`
+	P99    float64 `json:"p99_ms"`
+	Max    float64 `json:"max_ms"`
+}
+
+// RolloutReport is the end-to-end outcome of the deployment, from the trigger to its final status
+type RolloutReport struct {
+	Status   string                        `json:"status"`
+	Duration float64                       `json:"duration_seconds"`
+	Progress deployment.DeploymentProgress `json:"progress"`
+}
+
+// latencies collects the latencies of the calls to an endpoint
+type latencies struct {
+	samples []time.Duration
+	errors  int
+}
+
+// add records a call, the failed calls are only counted
+func (l *latencies) add(d time.Duration, err error) {
+	if err != nil {
+		l.errors++
+		return
+	}
+	l.samples = append(l.samples, d)
+}
+
+// merge adds the calls recorded by another collector
+func (l *latencies) merge(other *latencies) {
+	l.samples = append(l.samples, other.samples...)
+	l.errors += other.errors
+}
+
+// report summarizes the latencies with nearest-rank percentiles
+func (l *latencies) report() LatencyReport {
+	report := LatencyReport{Count: len(l.samples), Errors: l.errors}
+	if len(l.samples) == 0 {
+		return report
+	}
+
+	sorted := slices.Clone(l.samples)
+	slices.Sort(sorted)
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	percentile := func(p float64) float64 {
+		rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+		return milliseconds(sorted[max(rank, 0)])
+	}
+
+	report.Mean = milliseconds(total / time.Duration(len(sorted)))
+	report.P50 = percentile(0.50)
+	report.P90 = percentile(0.90)
+	report.P99 = percentile(0.99)
+	report.Max = milliseconds(sorted[len(sorted)-1])
+	return report
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// loadInstance is an instance of the load test, only its worker touches it once registered
+type loadInstance struct {
+	config     InstanceConfig
+	id         string
+	credential string
+	current    inventory.State
+	desired    inventory.State
+}
+
+// heartbeatResponse is the part of the heartbeat response the load test acts upon
+type heartbeatResponse struct {
+	DesiredState inventory.State `json:"desired_state"`
+}
+
+// LoadTest drives a large fleet against a controller without the per-agent goroutines and watches of the Fleet
+// The instances learn their desired state from the heartbeat responses and report it applied on the next heartbeat
+type LoadTest struct {
+	options   LoadOptions
+	instances []*loadInstance
+}
+
+// NewLoadTest creates a load test of the instances of the config, their failures are not injected
+func NewLoadTest(config *Config, options LoadOptions) *LoadTest {
+	instances := make([]*loadInstance, 0, len(config.Instances))
+	for _, instance := range config.Instances {
+		instances = append(instances, &loadInstance{config: instance})
+	}
+	return &LoadTest{
+		options:   options.withDefaults(),
+		instances: instances,
+	}
+}
+
+// Run registers the fleet, heartbeats for the configured duration, rolls out the deployment if any and reports the latencies
+// It returns the report gathered so far with the error when the rollout does not finish
+func (l *LoadTest) Run(ctx context.Context) (*LoadReport, error) {
+	report := &LoadReport{
+		Instances:           len(l.instances),
+		Workers:             l.options.Workers,
+		TargetHeartbeatRate: float64(len(l.instances)) / l.options.HeartbeatInterval.Seconds(),
+	}
+
+	// The controller histograms are read before and after the test, only the difference is reported
+	before, err := l.scrapeDurations(ctx)
+	if err != nil {
+		l.options.Logger.Printf("Only the client latencies are reported, failed to read the controller metrics: %v", err)
+	}
+
+	// 1. Register the fleet, the instances that failed are left out of the heartbeats
+	l.options.Logger.Printf("Registering %d instances with %d workers", len(l.instances), l.options.Workers)
+	registration, registered := l.register(ctx)
+	report.Client.Registration = registration.report()
+	report.Registered = len(registered)
+	if ctx.Err() != nil {
+		return report, ctx.Err()
+	}
+
+	// 2. Heartbeat until the rollout is over
+	heartbeatCtx, stop := context.WithCancel(ctx)
+	heartbeats := make(chan *latencies, l.options.Workers)
+	started := time.Now()
+	var wg sync.WaitGroup
+	for _, chunk := range split(registered, l.options.Workers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			heartbeats <- l.heartbeat(heartbeatCtx, chunk)
+		}()
+	}
+
+	l.options.Logger.Printf("Heartbeating %d instances every %s", len(registered), l.options.HeartbeatInterval)
+	sleep(ctx, l.options.Duration)
+
+	// 3. Roll out the deployment
+	var progress latencies
+	if l.options.Deployment != nil && ctx.Err() == nil {
+		report.Rollout, err = l.rollout(ctx, &progress)
+	}
+
+	stop()
+	wg.Wait()
+	close(heartbeats)
+	elapsed := time.Since(started)
+
+	var patches latencies
+	for worker := range heartbeats {
+		patches.merge(worker)
+	}
+	report.Client.PatchInstance = patches.report()
+	report.HeartbeatRate = float64(len(patches.samples)) / elapsed.Seconds()
+	report.Client.ProgressDeployment = progress.report()
+
+	if before != nil && ctx.Err() == nil {
+		after, scrapeErr := l.scrapeDurations(ctx)
+		if scrapeErr != nil {
+			l.options.Logger.Printf("Only the client latencies are reported, failed to read the controller metrics: %v", scrapeErr)
+		} else {
+			report.Controller = &EndpointLatencies{
+				Registration:       after[registrationRoute].since(before[registrationRoute]).report(),
+				PatchInstance:      after[patchRoute].since(before[patchRoute]).report(),
+				ProgressDeployment: after[progressRoute].since(before[progressRoute]).report(),
+			}
+		}
+	}
+	return report, errors.Join(err, ctx.Err())
+}
+
+// register registers the instances with the workers, it returns the registered ones
+func (l *LoadTest) register(ctx context.Context) (*latencies, []*loadInstance) {
+	queue := make(chan *loadInstance)
+	results := make(chan *latencies, l.options.Workers)
+	var mu sync.Mutex
+	var registered []*loadInstance
+
+	for range l.options.Workers {
+		go func() {
+			var worker latencies
+			for instance := range queue {
+				start := time.Now()
+				err := l.registerInstance(ctx, instance)
+				worker.add(time.Since(start), err)
+				if err == nil {
+					mu.Lock()
+					registered = append(registered, instance)
+					mu.Unlock()
+				}
+			}
+			results <- &worker
+		}()
+	}
+
+	for _, instance := range l.instances {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- instance
+	}
+	close(queue)
+
+	var all latencies
+	for range l.options.Workers {
+		all.merge(<-results)
+	}
+	return &all, registered
+}
+
+// registerInstance registers a single instance and keeps its identity
+func (l *LoadTest) registerInstance(ctx context.Context, instance *loadInstance) error {
+	body, err := instance.config.ToJSON(l.options.Token)
+	if err != nil {
+		return err
+	}
+	var response inventory.RegistrationResponse
+	if err := l.do(ctx, http.MethodPost, "/inventory/instances/register", "", body, http.StatusCreated, &response); err != nil {
+		return err
+	}
+	instance.id, instance.credential = response.Instance.ID, response.Credential
+	instance.current = response.Instance.CurrentState
+	return nil
+}
+
+// heartbeat sends the heartbeats of the instances of a worker, evenly spread over the heartbeat interval
+// A worker that cannot keep up sends them as fast as the controller answers
+func (l *LoadTest) heartbeat(ctx context.Context, instances []*loadInstance) *latencies {
+	var worker latencies
+	if len(instances) == 0 {
+		return &worker
+	}
+
+	ticker := time.NewTicker(max(l.options.HeartbeatInterval/time.Duration(len(instances)), time.Microsecond))
+	defer ticker.Stop()
+	for {
+		for _, instance := range instances {
+			select {
+			case <-ctx.Done():
+				return &worker
+			case <-ticker.C:
+			}
+			start := time.Now()
+			err := l.heartbeatInstance(ctx, instance)
+			if ctx.Err() != nil {
+				return &worker
+			}
+			worker.add(time.Since(start), err)
+		}
+	}
+}
+
+// heartbeatInstance pings the controller, reporting the desired state learnt on the previous heartbeat as applied
+func (l *LoadTest) heartbeatInstance(ctx context.Context, instance *loadInstance) error {
+	var patch inventory.InstancePatch
+	if instance.desired != (inventory.State{}) && instance.desired != instance.current {
+		status, applied := inventory.HEALTHY, instance.desired
+		patch.Status, patch.CurrentState = &status, &applied
+	}
+
+	body, err := json.Marshal(inventory.UpdateRequest{Updates: patch})
+	if err != nil {
+		return err
+	}
+	var response heartbeatResponse
+	if err := l.do(ctx, http.MethodPatch, "/inventory/instances/"+instance.id, instance.credential, body, http.StatusOK, &response); err != nil {
+		return err
+	}
+	if patch.CurrentState != nil {
+		instance.current = *patch.CurrentState
+	}
+	instance.desired = response.DesiredState
+	return nil
+}
+
+// rollout triggers the deployment and progresses it until it completes or fails, timing every progress call
+func (l *LoadTest) rollout(ctx context.Context, progress *latencies) (*RolloutReport, error) {
+	body, err := json.Marshal(l.options.Deployment)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.do(ctx, http.MethodPost, "/deploy/", "", body, http.StatusCreated, nil); err != nil {
+		return nil, fmt.Errorf("failed to trigger the deployment: %w", err)
+	}
+	l.options.Logger.Printf("Deployment of %s/%s triggered", l.options.Deployment.CodeVersion, l.options.Deployment.ConfigurationVersion)
+
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, l.options.Timeout)
+	defer cancel()
+
+	report := &RolloutReport{}
+	for {
+		var response deployment.DeploymentProgressResponse
+		start := time.Now()
+		err := l.do(ctx, http.MethodPost, "/deploy/progress", "", nil, http.StatusOK, &response)
+		if ctx.Err() == nil {
+			progress.add(time.Since(start), err)
+		}
+		if err == nil {
+			report.Status, report.Progress = statusName(response.Status), response.Progress
+			report.Duration = time.Since(started).Seconds()
+			if response.Status == deployment.Completed || response.Status == deployment.Failed {
+				l.options.Logger.Printf("Deployment %s after %.1fs: %+v", report.Status, report.Duration, report.Progress)
+				return report, nil
+			}
+		}
+		if !sleep(ctx, l.options.ProgressInterval) {
+			return report, fmt.Errorf("%w: the rollout did not finish within %s", ErrExpectationFailed, l.options.Timeout)
+		}
+	}
+}
+
+// scrapeDurations reads the request duration histograms of the controller, by method and route
+func (l *LoadTest) scrapeDurations(ctx context.Context) (map[string]*histogram, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.options.ControllerURL+"/metrics", nil)
+	if err != nil {
+		return nil, err
+	}
+	if l.options.APIKey != "" {
+		req.Header.Set("X-API-Key", l.options.APIKey)
+	}
+
+	resp, err := l.options.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /metrics answered %d", resp.StatusCode)
+	}
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	histograms := make(map[string]*histogram)
+	family, ok := families[requestDurationMetric]
+	if !ok {
+		return histograms, nil
+	}
+	for _, metric := range family.GetMetric() {
+		labels := make(map[string]string)
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+
+		key := labels["method"] + " " + labels["route"]
+		h, ok := histograms[key]
+		if !ok {
+			h = &histogram{buckets: make(map[float64]uint64)}
+			histograms[key] = h
+		}
+		h.add(metric.GetHistogram(), strings.HasPrefix(labels["code"], "2"))
+	}
+	return histograms, nil
+}
+
+// histogram is the controller latency histogram of an endpoint, all status codes together
+// The buckets only count the successful requests, like the client latencies
+type histogram struct {
+	buckets map[float64]uint64
+	count   uint64
+	errors  uint64
+	sum     float64
+}
+
+// add merges the histogram of a status code
+func (h *histogram) add(m *dto.Histogram, success bool) {
+	if !success {
+		h.errors += m.GetSampleCount()
+		return
+	}
+	h.count += m.GetSampleCount()
+	h.sum += m.GetSampleSum()
+	for _, bucket := range m.GetBucket() {
+		h.buckets[bucket.GetUpperBound()] += bucket.GetCumulativeCount()
+	}
+}
+
+// since returns the observations made after the previous histogram, either may be nil
+func (h *histogram) since(previous *histogram) *histogram {
+	if h == nil {
+		return &histogram{}
+	}
+	if previous == nil {
+		return h
+	}
+
+	diff := &histogram{
+		buckets: make(map[float64]uint64, len(h.buckets)),
+		count:   h.count - previous.count,
+		errors:  h.errors - previous.errors,
+		sum:     h.sum - previous.sum,
+	}
+	for bound, count := range h.buckets {
+		diff.buckets[bound] = count - previous.buckets[bound]
+	}
+	return diff
+}
+
+// report summarizes the histogram, the percentiles are interpolated within the buckets as Prometheus histogram_quantile does
+func (h *histogram) report() LatencyReport {
+	report := LatencyReport{Count: int(h.count), Errors: int(h.errors)}
+	if h.count == 0 {
+		return report
+	}
+
+	bounds := make([]float64, 0, len(h.buckets))
+	for bound := range h.buckets {
+		if !math.IsInf(bound, 1) {
+			bounds = append(bounds, bound)
+		}
+	}
+	sort.Float64s(bounds)
+
+	quantile := func(q float64) float64 {
+		rank := q * float64(h.count)
+		lower, below := 0.0, uint64(0)
+		for _, bound := range bounds {
+			count := h.buckets[bound]
+			if float64(count) >= rank && count > below {
+				seconds := lower + (bound-lower)*(rank-float64(below))/float64(count-below)
+				return seconds * 1000
+			}
+			lower, below = bound, count
+		}
+		// The observations above the highest bucket are reported at its bound
+		return lower * 1000
+	}
+
+	report.Mean = h.sum / float64(h.count) * 1000
+	report.P50 = quantile(0.50)
+	report.P90 = quantile(0.90)
+	report.P99 = quantile(0.99)
+	report.Max = quantile(1)
+	return report
+}
+
+// do sends a request with the instance credential, or the operator API key without one, and decodes the response into target
+func (l *LoadTest) do(ctx context.Context, method, path, credential string, body []byte, expectedStatus int, target interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, l.options.ControllerURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if credential != "" {
+		req.Header.Set("Authorization", "Bearer "+credential)
+	} else if l.options.APIKey != "" {
+		req.Header.Set("X-API-Key", l.options.APIKey)
+	}
+
+	resp, err := l.options.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s answered %d: %s", method, path, resp.StatusCode, bytes.TrimSpace(message))
+	}
+	if target != nil {
+		if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+			return err
+		}
+	}
+	// The connection is only reused once the body is read to the end
+	_, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
+
+// split divides the instances into at most n chunks of even sizes
+func split(instances []*loadInstance, n int) [][]*loadInstance {
+	chunks := make([][]*loadInstance, 0, n)
+	size := (len(instances) + n - 1) / n
+	for size > 0 && len(instances) > 0 {
+		end := min(size, len(instances))
+		chunks = append(chunks, instances[:end])
+		instances = instances[end:]
+	}
+	return chunks
+}
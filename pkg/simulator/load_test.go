@@ -0,0 +1,84 @@
+package simulator
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestInstanceTemplate_Instances(t *testing.T) {
+	template := InstanceTemplate{Name: "web", IP: "10.0.0.254", Count: 300, Labels: map[string]string{"env": "production"}}
+	if err := template.Validate(); err != nil {
+		t.Fatalf("Expected a valid template, got %v", err)
+	}
+
+	instances := template.Instances()
+	if len(instances) != 300 {
+		t.Fatalf("Expected 300 instances, got %d", len(instances))
+	}
+	first, third, last := instances[0], instances[2], instances[299]
+	if first.Name != "web-1" || first.IP != "10.0.0.254" || third.IP != "10.0.1.0" || last.Name != "web-300" || last.IP != "10.0.2.41" {
+		t.Errorf("Expected consecutive names and IPs, got %s %s, %s %s, %s %s", first.Name, first.IP, third.Name, third.IP, last.Name, last.IP)
+	}
+
+	// The instances do not share their labels
+	first.Labels["env"] = "dev"
+	if last.Labels["env"] != "production" {
+		t.Errorf("Expected the labels to be copied per instance")
+	}
+
+	for _, invalid := range []InstanceTemplate{
+		{IP: "10.0.0.1", Count: 1},
+		{Name: "web", IP: "10.0.0.1"},
+		{Name: "web", IP: "10.0.0", Count: 1},
+		{Name: "web", IP: "255.255.255.255", Count: 2},
+	} {
+		if err := invalid.Validate(); !errors.Is(err, ErrInvalidTemplate) {
+			t.Errorf("Expected ErrInvalidTemplate for %+v, got %v", invalid, err)
+		}
+	}
+}
+
+func TestLatencies_Report(t *testing.T) {
+	var l latencies
+	for i := 100; i >= 1; i-- {
+		l.add(time.Duration(i)*time.Millisecond, nil)
+	}
+	l.add(time.Second, errors.New("timeout"))
+
+	report := l.report()
+	want := LatencyReport{Count: 100, Errors: 1, Mean: 50.5, P50: 50, P90: 90, P99: 99, Max: 100}
+	if report != want {
+		t.Errorf("Expected %+v, got %+v", want, report)
+	}
+	if empty := (&latencies{}).report(); empty != (LatencyReport{}) {
+		t.Errorf("Expected an empty report without calls, got %+v", empty)
+	}
+}
+
+func TestHistogram_Report(t *testing.T) {
+	before := &histogram{buckets: map[float64]uint64{0.01: 10, 0.1: 10, math.Inf(1): 10}, count: 10, errors: 1, sum: 0.05}
+	after := &histogram{buckets: map[float64]uint64{0.01: 10, 0.1: 110, math.Inf(1): 110}, count: 110, errors: 2, sum: 5.05}
+
+	// Only the 100 calls between 10ms and 100ms made since the first scrape are reported
+	report := after.since(before).report()
+	want := LatencyReport{Count: 100, Errors: 1, Mean: 50, P50: 55, P90: 91, P99: 99.1, Max: 100}
+	for _, pair := range [][2]float64{
+		{report.Mean, want.Mean}, {report.P50, want.P50}, {report.P90, want.P90}, {report.P99, want.P99}, {report.Max, want.Max},
+	} {
+		if math.Abs(pair[0]-pair[1]) > 1e-6 {
+			t.Errorf("Expected %+v, got %+v", want, report)
+			break
+		}
+	}
+	if report.Count != want.Count || report.Errors != want.Errors {
+		t.Errorf("Expected %+v, got %+v", want, report)
+	}
+
+	// The routes the controller never served have no histogram
+	var missing *histogram
+	if empty := missing.since(nil).report(); empty != (LatencyReport{}) {
+		t.Errorf("Expected an empty report without calls, got %+v", empty)
+	}
+}
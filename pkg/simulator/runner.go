@@ -0,0 +1,325 @@
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+)
+
+var (
+	ErrExpectationFailed = errors.New("expectation failed")
+)
+
+// Defaults of the scenario runner
+const (
+	DefaultStepTimeout      = 10 * time.Second
+	DefaultProgressInterval = 20 * time.Millisecond
+)
+
+// Runner runs scenarios against a controller
+type Runner struct {
+	// ControllerURL is the base URL of the controller REST API
+	ControllerURL string
+	// Token is the join token used by the agents to register
+	Token string
+	// APIKey authenticates the deployments and the progress calls, the operator API must be open without it
+	APIKey string
+	// Agent configures the agents, its controller URL and token are the ones of the runner
+	Agent AgentOptions
+	// ProgressInterval is the time between two progress calls of a progress step
+	ProgressInterval time.Duration
+	// Clock is the fake clock shared with the controller, the wall clock is used when nil
+	// The agents wait their apply delays on it and the progress steps advance it to the next pending delay
+	Clock *FakeClock
+	// Client sends the operator requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+// scenarioRun holds the state of a scenario while it runs
+type scenarioRun struct {
+	runner *Runner
+	fleet  *Fleet
+	stop   context.CancelFunc
+	done   chan error
+
+	// last is the last progressed deployment, rolledBack tells if it was rolled back automatically
+	last       *deployment.DeploymentProgressResponse
+	rolledBack bool
+}
+
+// Run runs every step of the scenario in order and stops at the first failing one
+// The agents are stopped before it returns
+func (r *Runner) Run(ctx context.Context, scenario *Scenario) error {
+	options := r.Agent
+	options.ControllerURL, options.Token = r.ControllerURL, r.Token
+	if r.Clock != nil {
+		options.Clock = r.Clock
+	}
+	if options.Logger == nil {
+		options.Logger = log.New(io.Discard, "", 0)
+	}
+
+	run := &scenarioRun{runner: r, fleet: NewFleet(&scenario.Config, options)}
+	defer run.close()
+
+	for i, step := range scenario.Steps {
+		if err := run.step(ctx, step); err != nil {
+			return fmt.Errorf("%s: step %d (%s): %w", scenario.Name, i+1, step.Name(), err)
+		}
+	}
+	return nil
+}
+
+// step runs a single step
+func (run *scenarioRun) step(ctx context.Context, step Step) error {
+	switch {
+	case step.Register != nil:
+		return run.register(ctx, step.Register)
+	case step.Deploy != nil:
+		return run.deploy(ctx, step.Deploy)
+	case step.Progress != nil:
+		return run.progress(ctx, step.Progress)
+	case step.Inject != nil:
+		return run.inject(step.Inject)
+	case step.Advance != nil:
+		return run.advance(step.Advance)
+	case step.Expect != nil:
+		return run.expect(ctx, step.Expect)
+	}
+	return ErrInvalidScenario
+}
+
+// register starts the agents and waits for every instance to report HEALTHY
+func (run *scenarioRun) register(ctx context.Context, step *RegisterStep) error {
+	if run.stop != nil {
+		return fmt.Errorf("%w: the fleet is already registered", ErrInvalidScenario)
+	}
+
+	fleetCtx, stop := context.WithCancel(context.Background())
+	run.stop, run.done = stop, make(chan error, 1)
+	go func() { run.done <- run.fleet.Run(fleetCtx) }()
+
+	return run.runner.poll(ctx, step.Timeout, func() (bool, error) {
+		instances, err := run.runner.instances(ctx)
+		if err != nil {
+			return false, err
+		}
+		for _, agent := range run.fleet.Agents {
+			instance, ok := instances[agent.Name()]
+			if !ok || instance.Status != inventory.HEALTHY {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// deploy triggers the deployment of the step
+func (run *scenarioRun) deploy(ctx context.Context, step *DeployStep) error {
+	expectedStatus := step.ExpectStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusCreated
+	}
+	return run.runner.do(ctx, http.MethodPost, "/deploy/", step.Request(), expectedStatus, nil)
+}
+
+// progress progresses the running deployment until it completes or fails
+// A failed deployment was rolled back automatically when a deployment is running once it failed
+// With a fake clock, the clock jumps to the next apply delay to elapse between two progress calls
+func (run *scenarioRun) progress(ctx context.Context, step *ProgressStep) error {
+	err := run.runner.poll(ctx, step.Timeout, func() (bool, error) {
+		var response deployment.DeploymentProgressResponse
+		if err := run.runner.do(ctx, http.MethodPost, "/deploy/progress", nil, http.StatusOK, &response); err != nil {
+			return false, err
+		}
+		run.last = &response
+		if response.Status == deployment.Completed || response.Status == deployment.Failed {
+			return true, nil
+		}
+		if run.runner.Clock != nil {
+			run.runner.Clock.AdvanceToNext()
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	run.rolledBack = false
+	if run.last.Status == deployment.Failed {
+		var running deployment.DeploymentStatusResponse
+		if err := run.runner.do(ctx, http.MethodGet, "/deploy/status", nil, http.StatusOK, &running); err != nil {
+			return err
+		}
+		run.rolledBack = running.Count > 0
+	}
+	return nil
+}
+
+// inject adds the failures to the agents of the matching instances
+func (run *scenarioRun) inject(failures []InjectedFailure) error {
+	for _, failure := range failures {
+		if failure.Instance != "" {
+			agent, ok := run.fleet.Agent(failure.Instance)
+			if !ok {
+				return fmt.Errorf("%w: unknown instance %q", ErrInvalidScenario, failure.Instance)
+			}
+			agent.Inject(failure.Failure)
+			continue
+		}
+
+		sel, err := failure.selector()
+		if err != nil {
+			return err
+		}
+		if run.fleet.Inject(sel, failure.Failure) == 0 {
+			return fmt.Errorf("%w: no instance matches %q", ErrInvalidScenario, failure.Selector)
+		}
+	}
+	return nil
+}
+
+// advance moves the fake clock forward
+func (run *scenarioRun) advance(step *AdvanceStep) error {
+	if run.runner.Clock == nil {
+		return fmt.Errorf("%w: advance needs a fake clock", ErrInvalidScenario)
+	}
+	run.runner.Clock.Advance(step.Duration)
+	return nil
+}
+
+// expect checks the outcome of the last progress step and the current state of the instances
+func (run *scenarioRun) expect(ctx context.Context, expectation *Expectation) error {
+	var errs []error
+	if expectation.Status != "" || expectation.Rollback != nil || expectation.Progress != nil {
+		if run.last == nil {
+			return fmt.Errorf("%w: no deployment was progressed", ErrExpectationFailed)
+		}
+	}
+
+	if expectation.Status != "" && deploymentStatuses[expectation.Status] != run.last.Status {
+		errs = append(errs, fmt.Errorf("%w: deployment is %s, expected %s", ErrExpectationFailed, statusName(run.last.Status), expectation.Status))
+	}
+	if expectation.Rollback != nil && *expectation.Rollback != run.rolledBack {
+		errs = append(errs, fmt.Errorf("%w: rollback is %t, expected %t", ErrExpectationFailed, run.rolledBack, *expectation.Rollback))
+	}
+	if expectation.Progress != nil && expectation.Progress.progress(run.last.Progress) != run.last.Progress {
+		errs = append(errs, fmt.Errorf("%w: progress is %+v, expected %+v", ErrExpectationFailed, run.last.Progress, expectation.Progress.progress(run.last.Progress)))
+	}
+
+	if len(expectation.Versions) > 0 {
+		instances, err := run.runner.instances(ctx)
+		if err != nil {
+			return err
+		}
+		for name, versions := range expectation.Versions {
+			want, _ := parseVersions(versions)
+			instance, ok := instances[name]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%w: instance %s is not registered", ErrExpectationFailed, name))
+				continue
+			}
+			if instance.CurrentState != want {
+				errs = append(errs, fmt.Errorf("%w: instance %s runs %s/%s, expected %s", ErrExpectationFailed,
+					name, instance.CurrentState.CodeVersion, instance.CurrentState.ConfigurationVersion, versions))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// close stops the agents and waits for them
+func (run *scenarioRun) close() {
+	if run.stop == nil {
+		return
+	}
+	run.stop()
+	<-run.done
+}
+
+// instances returns the instances of the controller by name
+func (r *Runner) instances(ctx context.Context) (map[string]*inventory.Instance, error) {
+	var response inventory.ListResponse
+	if err := r.do(ctx, http.MethodGet, "/inventory/instances", nil, http.StatusOK, &response); err != nil {
+		return nil, err
+	}
+	instances := make(map[string]*inventory.Instance, len(response.Instances))
+	for _, instance := range response.Instances {
+		instances[instance.Name] = instance
+	}
+	return instances, nil
+}
+
+// poll calls done at every progress interval until it reports true, fails or the timeout expires
+func (r *Runner) poll(ctx context.Context, timeout time.Duration, done func() (bool, error)) error {
+	if timeout <= 0 {
+		timeout = DefaultStepTimeout
+	}
+	interval := r.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		ok, err := done()
+		if err != nil || ok {
+			return err
+		}
+		if !sleep(ctx, interval) {
+			return fmt.Errorf("%w: timed out after %s", ErrExpectationFailed, timeout)
+		}
+	}
+}
+
+// do sends an operator request and decodes the response into target
+func (r *Runner) do(ctx context.Context, method, path string, body interface{}, expectedStatus int, target interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.ControllerURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.APIKey != "" {
+		req.Header.Set("X-API-Key", r.APIKey)
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != expectedStatus {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%w: %s %s answered %d, expected %d: %s", ErrExpectationFailed, method, path, resp.StatusCode, expectedStatus, bytes.TrimSpace(message))
+	}
+	if target == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
@@ -0,0 +1,261 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/xnok/dides/internal/deployment"
+	"github.com/xnok/dides/internal/inventory"
+	"github.com/xnok/dides/internal/selector"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrInvalidScenario = errors.New("invalid scenario")
+)
+
+// deploymentStatuses are the deployment statuses by the name used in the scenarios
+var deploymentStatuses = map[string]deployment.DeploymentStatus{
+	"running":   deployment.Running,
+	"completed": deployment.Completed,
+	"failed":    deployment.Failed,
+}
+
+// statusName returns the scenario name of a deployment status
+func statusName(status deployment.DeploymentStatus) string {
+	for name, s := range deploymentStatuses {
+		if s == status {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown(%d)", status)
+}
+
+// Scenario is a simulator config with a script run against a controller
+type Scenario struct {
+	Name   string `yaml:"name"`
+	Config `yaml:",inline"`
+	Steps  []Step `yaml:"steps"`
+}
+
+// Step is one action of a scenario, exactly one of its fields is set
+type Step struct {
+	// Register starts an agent per instance and waits for the fleet to report HEALTHY
+	Register *RegisterStep `yaml:"register,omitempty"`
+	// Deploy triggers a deployment
+	Deploy *DeployStep `yaml:"deploy,omitempty"`
+	// Progress progresses the running deployment until it completes or fails
+	Progress *ProgressStep `yaml:"progress,omitempty"`
+	// Inject adds failures to the running agents
+	Inject []InjectedFailure `yaml:"inject,omitempty"`
+	// Advance moves the fake clock of the runner forward
+	Advance *AdvanceStep `yaml:"advance,omitempty"`
+	// Expect checks the outcome of the previous steps
+	Expect *Expectation `yaml:"expect,omitempty"`
+}
+
+// RegisterStep waits at most Timeout for the fleet to register
+type RegisterStep struct {
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// DeployStep triggers a deployment, the controller must answer with ExpectStatus (201 Created by default)
+type DeployStep struct {
+	CodeVersion          string            `yaml:"code_version"`
+	ConfigurationVersion string            `yaml:"configuration_version"`
+	Labels               map[string]string `yaml:"labels,omitempty"`
+	Selector             string            `yaml:"selector,omitempty"`
+	Configuration        struct {
+		BatchSize        int                     `yaml:"batch_size"`
+		FailureThreshold int                     `yaml:"failure_threshold"`
+		RollbackMode     deployment.RollbackMode `yaml:"rollback_mode,omitempty"`
+	} `yaml:"configuration"`
+	ExpectStatus int `yaml:"expect_status,omitempty"`
+}
+
+// Request returns the deployment request of the step
+func (s *DeployStep) Request() deployment.DeploymentRequest {
+	return deployment.DeploymentRequest{
+		CodeVersion:          s.CodeVersion,
+		ConfigurationVersion: s.ConfigurationVersion,
+		Labels:               s.Labels,
+		Selector:             s.Selector,
+		Configuration: deployment.Configuration{
+			BatchSize:        s.Configuration.BatchSize,
+			FailureThreshold: s.Configuration.FailureThreshold,
+			RollbackMode:     s.Configuration.RollbackMode,
+		},
+	}
+}
+
+// AdvanceStep moves the fake clock forward by Duration, the agents whose apply delay elapsed apply their desired state
+type AdvanceStep struct {
+	Duration time.Duration `yaml:"duration"`
+}
+
+// ProgressStep waits at most Timeout for the running deployment to complete or fail
+type ProgressStep struct {
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// InjectedFailure is a failure added to an instance, or to the instances matching a selector, during a scenario
+type InjectedFailure struct {
+	Instance string `yaml:"instance,omitempty"`
+	Selector string `yaml:"selector,omitempty"`
+	Failure  `yaml:",inline"`
+}
+
+// selector returns the selector of the instances receiving the failure
+func (f InjectedFailure) selector() (selector.Selector, error) {
+	if f.Instance != "" {
+		return selector.Selector{}, nil
+	}
+	return selector.Parse(f.Selector)
+}
+
+// Expectation is the expected outcome of the last progress step and the versions run by the instances
+type Expectation struct {
+	// Status is the final status of the last progressed deployment: running, completed or failed
+	Status string `yaml:"status,omitempty"`
+	// Rollback tells whether the last progressed deployment failed and was rolled back automatically
+	Rollback *bool `yaml:"rollback,omitempty"`
+	// Progress are the counters of the last progressed deployment
+	Progress *ExpectedProgress `yaml:"progress,omitempty"`
+	// Versions are the "code_version/configuration_version" current states by instance name, empty when nothing was applied
+	Versions map[string]string `yaml:"versions,omitempty"`
+}
+
+// ExpectedProgress are the expected counters of a deployment
+type ExpectedProgress struct {
+	Total      int `yaml:"total"`
+	InProgress int `yaml:"in_progress"`
+	Completed  int `yaml:"completed"`
+	Failed     int `yaml:"failed"`
+	// Unreachable is only checked when set, a fake clock moving faster than the heartbeats makes instances unreachable
+	Unreachable *int `yaml:"unreachable,omitempty"`
+}
+
+// progress returns the deployment counters, the unreachable instances are taken from actual when not expected
+func (p ExpectedProgress) progress(actual deployment.DeploymentProgress) deployment.DeploymentProgress {
+	unreachable := actual.UnreachableInstances
+	if p.Unreachable != nil {
+		unreachable = *p.Unreachable
+	}
+	return deployment.DeploymentProgress{
+		TotalMatchingInstances: p.Total,
+		InProgressInstances:    p.InProgress,
+		CompletedInstances:     p.Completed,
+		FailedInstances:        p.Failed,
+		UnreachableInstances:   unreachable,
+	}
+}
+
+// parseVersions parses a "code_version/configuration_version" state, the empty string is the zero state
+func parseVersions(versions string) (inventory.State, error) {
+	if versions == "" {
+		return inventory.State{}, nil
+	}
+	code, config, ok := strings.Cut(versions, "/")
+	if !ok || code == "" || config == "" {
+		return inventory.State{}, fmt.Errorf("%w: versions %q are not code_version/configuration_version", ErrInvalidScenario, versions)
+	}
+	return inventory.State{CodeVersion: code, ConfigurationVersion: config}, nil
+}
+
+// LoadScenarioFromFile loads and validates a scenario from a YAML file
+func LoadScenarioFromFile(filePath string) (*Scenario, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario file: %w", err)
+	}
+
+	var scenario Scenario
+	if err := yaml.UnmarshalStrict(data, &scenario); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario file: %w", err)
+	}
+
+	if err := scenario.expandTemplates(); err != nil {
+		return nil, fmt.Errorf("invalid scenario file: %w", err)
+	}
+	if err := scenario.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario file: %w", err)
+	}
+
+	return &scenario, nil
+}
+
+// Validate checks the config and every step of the scenario
+func (s *Scenario) Validate() error {
+	if err := s.Config.Validate(); err != nil {
+		return err
+	}
+	for i, step := range s.Steps {
+		if err := step.Validate(); err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Name returns the action of the step
+func (s Step) Name() string {
+	switch {
+	case s.Register != nil:
+		return "register"
+	case s.Deploy != nil:
+		return "deploy"
+	case s.Progress != nil:
+		return "progress"
+	case s.Inject != nil:
+		return "inject"
+	case s.Advance != nil:
+		return "advance"
+	case s.Expect != nil:
+		return "expect"
+	}
+	return ""
+}
+
+// Validate checks the step has exactly one valid action
+func (s Step) Validate() error {
+	var actions int
+	for _, set := range []bool{s.Register != nil, s.Deploy != nil, s.Progress != nil, s.Inject != nil, s.Advance != nil, s.Expect != nil} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("%w: a step must have exactly one of register, deploy, progress, inject, advance or expect", ErrInvalidScenario)
+	}
+
+	if s.Advance != nil && s.Advance.Duration <= 0 {
+		return fmt.Errorf("%w: advance needs a positive duration", ErrInvalidScenario)
+	}
+
+	for _, failure := range s.Inject {
+		if (failure.Instance == "") == (failure.Selector == "") {
+			return fmt.Errorf("%w: an injected failure needs either an instance or a selector", ErrInvalidScenario)
+		}
+		if _, err := failure.selector(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidScenario, err)
+		}
+		if err := failure.Failure.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if s.Expect != nil {
+		if _, ok := deploymentStatuses[s.Expect.Status]; s.Expect.Status != "" && !ok {
+			return fmt.Errorf("%w: unknown deployment status %q", ErrInvalidScenario, s.Expect.Status)
+		}
+		for _, versions := range s.Expect.Versions {
+			if _, err := parseVersions(versions); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package simulator
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadScenarioFromFile(t *testing.T) {
+	files, err := filepath.Glob("../../testdata/scenarios/*.yaml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("Expected scenario files, got %v (%v)", files, err)
+	}
+	for _, file := range files {
+		scenario, err := LoadScenarioFromFile(file)
+		if err != nil {
+			t.Errorf("Expected %s to load, got %v", file, err)
+			continue
+		}
+		if scenario.Name == "" || len(scenario.Instances) == 0 || len(scenario.Steps) == 0 {
+			t.Errorf("Expected %s to have a name, instances and steps", file)
+		}
+	}
+}
+
+func TestStep_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    Step
+		wantErr bool
+	}{
+		{
+			name: "progress",
+			step: Step{Progress: &ProgressStep{}},
+		},
+		{
+			name: "injected failure",
+			step: Step{Inject: []InjectedFailure{{Selector: "env=production", Failure: Failure{Mode: FailApply}}}},
+		},
+		{
+			name:    "no action",
+			step:    Step{},
+			wantErr: true,
+		},
+		{
+			name:    "two actions",
+			step:    Step{Register: &RegisterStep{}, Progress: &ProgressStep{}},
+			wantErr: true,
+		},
+		{
+			name:    "injected failure with instance and selector",
+			step:    Step{Inject: []InjectedFailure{{Instance: "web-1", Selector: "env=production", Failure: Failure{Mode: Hang}}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown status",
+			step:    Step{Expect: &Expectation{Status: "rolled-back"}},
+			wantErr: true,
+		},
+		{
+			name:    "versions without configuration",
+			step:    Step{Expect: &Expectation{Versions: map[string]string{"web-1": "v2.0.0"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.step.Validate()
+			if tt.wantErr && !errors.Is(err, ErrInvalidScenario) {
+				t.Errorf("Expected ErrInvalidScenario, got %v", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+)
+
+var (
+	ErrInvalidTemplate = errors.New("invalid instance template")
+)
+
+// InstanceTemplate generates Count instances named "<name>-<n>", with consecutive IPs from IP, sharing the same labels
+// It is how a config describes a fleet too large to list, such as the load test fleets
+type InstanceTemplate struct {
+	Name   string            `yaml:"name"`
+	IP     string            `yaml:"ip"`
+	Count  int               `yaml:"count"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Validate checks the template generates valid instances
+func (t InstanceTemplate) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("%w: a template needs a name", ErrInvalidTemplate)
+	}
+	if t.Count <= 0 {
+		return fmt.Errorf("%w: template %s needs a positive count", ErrInvalidTemplate, t.Name)
+	}
+	first, err := netip.ParseAddr(t.IP)
+	if err != nil {
+		return fmt.Errorf("%w: template %s: %v", ErrInvalidTemplate, t.Name, err)
+	}
+
+	// The last address must not wrap around the address space
+	last := first
+	for range t.Count - 1 {
+		if last = last.Next(); !last.IsValid() {
+			return fmt.Errorf("%w: template %s overflows the address space from %s", ErrInvalidTemplate, t.Name, t.IP)
+		}
+	}
+	return nil
+}
+
+// Instances returns the instances generated by a valid template
+func (t InstanceTemplate) Instances() []InstanceConfig {
+	instances := make([]InstanceConfig, 0, t.Count)
+	ip := netip.MustParseAddr(t.IP)
+	for i := 1; i <= t.Count; i++ {
+		labels := maps.Clone(t.Labels)
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		instances = append(instances, InstanceConfig{
+			IP:     ip.String(),
+			Name:   fmt.Sprintf("%s-%d", t.Name, i),
+			Labels: labels,
+		})
+		ip = ip.Next()
+	}
+	return instances
+}
+
+// expandTemplates validates the templates of the config and appends their instances to the listed ones
+func (c *Config) expandTemplates() error {
+	for _, template := range c.Templates {
+		if err := template.Validate(); err != nil {
+			return err
+		}
+		c.Instances = append(c.Instances, template.Instances()...)
+	}
+	c.Templates = nil
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/xnok/dides/internal/deployment"
 	"github.com/xnok/dides/internal/inventory"
@@ -17,17 +18,23 @@ import (
 type TestUtilities struct {
 	Server *httptest.Server
 	Config *Config
+
+	// IDs and credentials issued to the registered instances, by instance name
+	ids         map[string]string
+	credentials map[string]string
 }
 
 // NewTestUtilities creates a new TestUtilities instance
 func NewTestUtilities(server *httptest.Server, config *Config) *TestUtilities {
 	return &TestUtilities{
-		Server: server,
-		Config: config,
+		Server:      server,
+		Config:      config,
+		ids:         make(map[string]string),
+		credentials: make(map[string]string),
 	}
 }
 
-// RegisterInstance registers a single instance with the test server
+// RegisterInstance registers a single instance with the test server, with its credential when it was registered before
 func (tu *TestUtilities) RegisterInstance(t *testing.T, instanceConfig InstanceConfig, token string) *http.Response {
 	t.Helper()
 
@@ -36,18 +43,48 @@ func (tu *TestUtilities) RegisterInstance(t *testing.T, instanceConfig InstanceC
 		t.Fatalf("Failed to marshal request: %v", err)
 	}
 
-	resp, err := http.Post(
-		tu.Server.URL+"/inventory/instances/register",
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
+	req, err := http.NewRequest(http.MethodPost, tu.Server.URL+"/inventory/instances/register", bytes.NewBuffer(jsonData))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// An instance registered before proves its identity with its credential
+	if credential := tu.credentials[instanceConfig.Name]; credential != "" {
+		req.Header.Set("Authorization", "Bearer "+credential)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatalf("Failed to make request: %v", err)
 	}
 
+	if resp.StatusCode == http.StatusCreated {
+		// Keep the credential and restore the body so the caller can still read the response
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+
+		var response inventory.RegistrationResponse
+		if err := json.Unmarshal(body, &response); err == nil && response.Instance != nil {
+			tu.ids[instanceConfig.Name] = response.Instance.ID
+			tu.credentials[instanceConfig.Name] = response.Credential
+		}
+	}
+
 	return resp
 }
 
+// InstanceID returns the ID assigned to the instance at registration
+func (tu *TestUtilities) InstanceID(instanceName string) string {
+	return tu.ids[instanceName]
+}
+
+// Credential returns the credential issued to the instance at registration
+func (tu *TestUtilities) Credential(instanceName string) string {
+	return tu.credentials[instanceName]
+}
+
 // RegisterAllInstances registers all instances from the config
 func (tu *TestUtilities) RegisterAllInstances(t *testing.T, token string) []string {
 	t.Helper()
@@ -110,13 +147,14 @@ func (tu *TestUtilities) UpdateInstance(t *testing.T, instanceName string, updat
 
 	req, err := http.NewRequest(
 		"PATCH",
-		tu.Server.URL+"/inventory/instances/"+instanceName,
+		tu.Server.URL+"/inventory/instances/"+tu.ids[instanceName],
 		bytes.NewBuffer(jsonData),
 	)
 	if err != nil {
 		t.Fatalf("Failed to create request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+tu.credentials[instanceName])
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -127,6 +165,41 @@ func (tu *TestUtilities) UpdateInstance(t *testing.T, instanceName string, updat
 	return resp
 }
 
+// WatchDesiredState long-polls the desired state of an instance until it differs from the revision or the timeout expires
+// It reports failures with t.Errorf so it can run in its own goroutine, the response is nil when not modified
+func (tu *TestUtilities) WatchDesiredState(t *testing.T, instanceName string, revision int64, timeout time.Duration) (*inventory.DesiredStateResponse, *http.Response) {
+	t.Helper()
+
+	req, err := http.NewRequest(
+		"GET",
+		fmt.Sprintf("%s/inventory/instances/%s/desired-state?revision=%d&timeout=%s", tu.Server.URL, tu.ids[instanceName], revision, timeout),
+		nil,
+	)
+	if err != nil {
+		t.Errorf("Failed to create request: %v", err)
+		return nil, nil
+	}
+	req.Header.Set("Authorization", "Bearer "+tu.credentials[instanceName])
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("Failed to watch desired state: %v", err)
+		return nil, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp
+	}
+
+	var response inventory.DesiredStateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		t.Errorf("Failed to decode desired state: %v", err)
+		return nil, resp
+	}
+	return &response, resp
+}
+
 // GetAllInstances retrieves all instances from the inventory
 func (tu *TestUtilities) GetAllInstances(t *testing.T) []*inventory.Instance {
 	t.Helper()
@@ -172,6 +245,18 @@ func (tu *TestUtilities) TriggerDeployment(t *testing.T, deploymentRequest deplo
 	return resp
 }
 
+// PlanDeployment previews a deployment request and returns decoded response
+func (tu *TestUtilities) PlanDeployment(t *testing.T, deploymentRequest deployment.DeploymentRequest) (*deployment.DeploymentPlan, *http.Response) {
+	t.Helper()
+
+	resp := tu.MakeHTTPRequest(t, http.MethodPost, "/deploy/plan", deploymentRequest)
+
+	var plan deployment.DeploymentPlan
+	tu.DecodeResponse(t, resp, &plan)
+
+	return &plan, resp
+}
+
 // ProgressDeployment progresses the current running deployment and returns decoded response
 func (tu *TestUtilities) ProgressDeployment(t *testing.T) (*deployment.DeploymentProgressResponse, *http.Response) {
 	t.Helper()